@@ -6,11 +6,17 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mergermarket/cdflow2/docker"
 	"github.com/mergermarket/cdflow2/docker/official"
+	"github.com/mergermarket/cdflow2/docker/retry"
 	"github.com/mergermarket/cdflow2/manifest"
+	"github.com/mergermarket/cdflow2/redact"
+	"github.com/rs/xid"
 )
 
 // Failure represents a non-zero exit status without the need for further output.
@@ -30,28 +36,79 @@ type GlobalArgs struct {
 	NoPullRelease   bool
 	NoPullTerraform bool
 	Quiet           bool
+	HostUser        bool
+	NoHostUser      bool
+	ImageArchive    string
+	UpdateLock      bool
+	Retries         int
+	RetryMaxDelay   time.Duration
 }
 
 // GlobalState contains common to all commands.
 type GlobalState struct {
-	GlobalArgs   *GlobalArgs
-	Component    string
-	Commit       string
-	CodeDir      string
-	Manifest     *manifest.Manifest
-	InputStream  io.Reader
-	OutputStream io.Writer
-	ErrorStream  io.Writer
-	DockerClient docker.Iface
+	GlobalArgs    *GlobalArgs
+	RunID         string
+	Component     string
+	Commit        string
+	CodeDir       string
+	Manifest      *manifest.Manifest
+	InputStream   io.Reader
+	OutputStream  io.Writer
+	ErrorStream   io.Writer
+	DockerClient  docker.Iface
+	ContainerUser string
+	RetryPolicy   retry.Policy
+	// Secrets are masked in OutputStream and ErrorStream (e.g. values the config container marks as sensitive).
+	Secrets *redact.Secrets
 }
 
-// GetGlobalState collects info common to every command.
-func GetGlobalState(globalArgs *GlobalArgs) (*GlobalState, error) {
+// GetDockerState collects the info needed by commands that manage docker resources without a project (e.g. gc),
+// so doesn't need a cdflow.yaml or git.
+func GetDockerState(globalArgs *GlobalArgs) (*GlobalState, error) {
 	var state GlobalState
 
 	state.GlobalArgs = globalArgs
+	state.RunID = xid.New().String()
+
+	state.InputStream = os.Stdin
+	state.Secrets = redact.NewSecrets()
+	state.OutputStream = redact.NewWriter(os.Stdout, state.Secrets)
+	state.ErrorStream = redact.NewWriter(os.Stderr, state.Secrets)
+
+	dockerClient, err := official.NewClient()
+	if err != nil {
+		return nil, fmt.Errorf("error creating docker client: %w", err)
+	}
+	if globalArgs.ImageArchive != "" {
+		dockerClient.SetImageArchive(globalArgs.ImageArchive)
+	}
+	state.RetryPolicy = retry.Policy{
+		Retries:      globalArgs.Retries,
+		InitialDelay: retry.DefaultInitialDelay,
+		MaxDelay:     globalArgs.RetryMaxDelay,
+		Log:          state.ErrorStream,
+	}
+	state.DockerClient = retry.New(dockerClient, state.RetryPolicy)
 
-	var err error
+	return &state, nil
+}
+
+// Flush writes any output held back by redaction (because it could have been the start of a secret) - called
+// before exiting.
+func (state *GlobalState) Flush() {
+	for _, stream := range []io.Writer{state.OutputStream, state.ErrorStream} {
+		if flusher, ok := stream.(interface{ Flush() error }); ok {
+			flusher.Flush()
+		}
+	}
+}
+
+// GetGlobalState collects info common to every command.
+func GetGlobalState(globalArgs *GlobalArgs) (*GlobalState, error) {
+	state, err := GetDockerState(globalArgs)
+	if err != nil {
+		return nil, err
+	}
 
 	state.CodeDir, err = os.Getwd()
 	if err != nil {
@@ -84,17 +141,42 @@ func GetGlobalState(globalArgs *GlobalArgs) (*GlobalState, error) {
 		state.Commit = globalArgs.Commit
 	}
 
-	state.InputStream = os.Stdin
-	state.OutputStream = os.Stdout
-	state.ErrorStream = os.Stderr
+	state.DockerClient.SetLabels(ResourceLabels(state))
 
-	dockerClient, err := official.NewClient()
-	if err != nil {
-		return nil, fmt.Errorf("error creating docker client: %w", err)
+	state.ContainerUser = ContainerUser(globalArgs, runtime.GOOS, os.Getuid(), os.Getgid())
+
+	return state, nil
+}
+
+// ContainerUser returns the user ("uid:gid") to run the terraform and build containers as, so that files they write
+// to directories mounted from the host aren't owned by root. This is on by default on Linux (Docker Desktop on other
+// platforms maps ownership itself), and can be switched with --host-user/--no-host-user. An empty string means run
+// as the image's user.
+func ContainerUser(globalArgs *GlobalArgs, goos string, uid, gid int) string {
+	enabled := goos == "linux"
+	if globalArgs.HostUser {
+		enabled = true
+	} else if globalArgs.NoHostUser {
+		enabled = false
+	}
+	// uid is -1 on windows, and there's nothing to gain if we're already root
+	if !enabled || uid <= 0 {
+		return ""
 	}
-	state.DockerClient = dockerClient
+	return fmt.Sprintf("%d:%d", uid, gid)
+}
 
-	return &state, nil
+// ResourceLabels returns the labels added to the containers and volumes created by this run of cdflow2, used by
+// the gc command to find those left behind by runs that have crashed.
+func ResourceLabels(state *GlobalState) map[string]string {
+	host, _ := os.Hostname()
+	return map[string]string{
+		docker.LabelRunID:     state.RunID,
+		docker.LabelComponent: state.Component,
+		docker.LabelCommand:   state.GlobalArgs.Command,
+		docker.LabelPID:       strconv.Itoa(os.Getpid()),
+		docker.LabelHost:      host,
+	}
 }
 
 func handleArg(arg string, globalArgs *GlobalArgs, take func() (string, error)) (bool, error) {
@@ -121,6 +203,15 @@ func handleSimpleFlag(arg string, globalArgs *GlobalArgs) bool {
 	} else if arg == "--quiet" || arg == "-q" {
 		globalArgs.Quiet = true
 		return true
+	} else if arg == "--host-user" {
+		globalArgs.HostUser = true
+		return true
+	} else if arg == "--no-host-user" {
+		globalArgs.NoHostUser = true
+		return true
+	} else if arg == "--update-lock" {
+		globalArgs.UpdateLock = true
+		return true
 	}
 	return false
 }
@@ -142,6 +233,34 @@ func handleFlag(arg string, globalArgs *GlobalArgs, take func() (string, error))
 		globalArgs.Commit = value
 	} else if strings.HasPrefix(arg, "--commit=") {
 		globalArgs.Commit = strings.TrimPrefix(arg, "--commit=")
+	} else if arg == "--image-archive" {
+		value, err := take()
+		if err != nil {
+			return false, err
+		}
+		globalArgs.ImageArchive = value
+	} else if strings.HasPrefix(arg, "--image-archive=") {
+		globalArgs.ImageArchive = strings.TrimPrefix(arg, "--image-archive=")
+	} else if arg == "--retries" || strings.HasPrefix(arg, "--retries=") {
+		value, err := flagValue(arg, "--retries", take)
+		if err != nil {
+			return false, err
+		}
+		retries, err := strconv.Atoi(value)
+		if err != nil || retries < 0 {
+			return false, fmt.Errorf("invalid value for --retries (must be a whole number): %q", value)
+		}
+		globalArgs.Retries = retries
+	} else if arg == "--retry-max-delay" || strings.HasPrefix(arg, "--retry-max-delay=") {
+		value, err := flagValue(arg, "--retry-max-delay", take)
+		if err != nil {
+			return false, err
+		}
+		delay, err := time.ParseDuration(value)
+		if err != nil || delay < 0 {
+			return false, fmt.Errorf("invalid value for --retry-max-delay (must be a duration, e.g. 30s): %q", value)
+		}
+		globalArgs.RetryMaxDelay = delay
 	} else if arg == "--help" || arg == "-h" {
 		globalArgs.Command = "help"
 		return true, nil
@@ -154,9 +273,20 @@ func handleFlag(arg string, globalArgs *GlobalArgs, take func() (string, error))
 	return false, nil
 }
 
+// flagValue returns the value of a flag passed either as "--flag=value" or "--flag value".
+func flagValue(arg, flag string, take func() (string, error)) (string, error) {
+	if strings.HasPrefix(arg, flag+"=") {
+		return strings.TrimPrefix(arg, flag+"="), nil
+	}
+	return take()
+}
+
 // ParseArgs takes arguments and splits them into global and remaining args.
 func ParseArgs(args []string) (*GlobalArgs, []string, error) {
-	var globalArgs GlobalArgs
+	globalArgs := GlobalArgs{
+		Retries:       retry.DefaultRetries,
+		RetryMaxDelay: retry.DefaultMaxDelay,
+	}
 	remainingArgs := []string{}
 	i := 0
 	take := func() (string, error) {
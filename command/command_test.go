@@ -4,8 +4,10 @@ import (
 	"log"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/docker/retry"
 )
 
 func TestParseArgs(t *testing.T) {
@@ -180,3 +182,56 @@ func TestGetComponentFromGit(t *testing.T) {
 		log.Fatalln("expected cdflow2 component from git, got:", component)
 	}
 }
+
+func TestContainerUser(t *testing.T) {
+	for _, testCase := range []struct {
+		args     []string
+		goos     string
+		uid      int
+		expected string
+	}{
+		{[]string{"deploy"}, "linux", 1000, "1000:1001"},
+		{[]string{"deploy"}, "darwin", 1000, ""},
+		{[]string{"--host-user", "deploy"}, "darwin", 1000, "1000:1001"},
+		{[]string{"--no-host-user", "deploy"}, "linux", 1000, ""},
+		{[]string{"deploy"}, "linux", 0, ""},
+		{[]string{"--host-user", "deploy"}, "windows", -1, ""},
+	} {
+		globalArgs, _, err := command.ParseArgs(testCase.args)
+		if err != nil {
+			t.Fatal("unexpected error from parseArgs:", err)
+		}
+		if user := command.ContainerUser(globalArgs, testCase.goos, testCase.uid, 1001); user != testCase.expected {
+			t.Fatalf("expected user '%v' for %v on %v (uid %v), got '%v'", testCase.expected, testCase.args, testCase.goos, testCase.uid, user)
+		}
+	}
+}
+
+func TestParseArgsRetries(t *testing.T) {
+	globalArgs, _, err := command.ParseArgs([]string{"--retries", "5", "--retry-max-delay=1m", "deploy"})
+	if err != nil {
+		t.Fatal("unexpected error from parseArgs:", err)
+	}
+	if globalArgs.Retries != 5 {
+		t.Fatal("expected 5 retries, got:", globalArgs.Retries)
+	}
+	if globalArgs.RetryMaxDelay != time.Minute {
+		t.Fatal("expected max delay of a minute, got:", globalArgs.RetryMaxDelay)
+	}
+}
+
+func TestParseArgsRetriesDefault(t *testing.T) {
+	globalArgs, _, err := command.ParseArgs([]string{"deploy"})
+	if err != nil {
+		t.Fatal("unexpected error from parseArgs:", err)
+	}
+	if globalArgs.Retries != retry.DefaultRetries || globalArgs.RetryMaxDelay != retry.DefaultMaxDelay {
+		t.Fatal("expected default retry options, got:", globalArgs.Retries, globalArgs.RetryMaxDelay)
+	}
+}
+
+func TestParseArgsInvalidRetries(t *testing.T) {
+	if _, _, err := command.ParseArgs([]string{"--retries", "lots", "deploy"}); err == nil {
+		t.Fatal("expected error for invalid --retries")
+	}
+}
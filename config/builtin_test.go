@@ -0,0 +1,183 @@
+package config_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/manifest"
+)
+
+func createBuiltinState(t *testing.T, dockerClient *fake.Client) *command.GlobalState {
+	codeDir, err := ioutil.TempDir("", "cdflow2-builtin-local-test")
+	if err != nil {
+		t.Fatal("error creating temp dir:", err)
+	}
+	dockerClient.AddLocalImage("terraform-image")
+	return &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  &bytes.Buffer{},
+		CodeDir:      codeDir,
+		Manifest: &manifest.Manifest{
+			Version:   2,
+			Config:    manifest.ImageWithParams{Image: config.BuiltinLocalImage},
+			Terraform: manifest.Terraform{Image: "terraform-image"},
+		},
+		GlobalArgs: &command.GlobalArgs{},
+	}
+}
+
+func TestBuiltinLocalReleaseAndPrepareTerraform(t *testing.T) {
+	// Given
+	ctx := context.Background()
+	dockerClient := fake.NewClient()
+	state := createBuiltinState(t, dockerClient)
+	defer os.RemoveAll(state.CodeDir)
+	buildVolume, err := dockerClient.CreateVolume(ctx, "")
+	if err != nil {
+		t.Fatal("error creating volume:", err)
+	}
+	if err := dockerClient.WriteVolumeFile(buildVolume, "app/app.zip", []byte("app")); err != nil {
+		t.Fatal("error writing to volume:", err)
+	}
+
+	// When
+	releaseContainer, err := config.NewContainer(ctx, state, config.BuiltinLocalImage, buildVolume)
+	if err != nil {
+		t.Fatal("error creating config container:", err)
+	}
+	configureResponse, err := releaseContainer.ConfigureRelease(
+		ctx, "1", "test-component", "abc123", nil, nil, map[string]*config.ReleaseRequirements{"app": {}},
+	)
+	if err != nil {
+		t.Fatal("error configuring release:", err)
+	}
+	if err := releaseContainer.WriteReleaseMetadata(ctx, map[string]map[string]string{"release": {"version": "1"}}); err != nil {
+		t.Fatal("error writing release metadata:", err)
+	}
+	if _, err := releaseContainer.UploadRelease(ctx, "saved-terraform-image"); err != nil {
+		t.Fatal("error uploading release:", err)
+	}
+	if err := releaseContainer.Done(); err != nil {
+		t.Fatal("error stopping config container:", err)
+	}
+
+	deployVolume, err := dockerClient.CreateVolume(ctx, "")
+	if err != nil {
+		t.Fatal("error creating volume:", err)
+	}
+	deployContainer, err := config.NewContainer(ctx, state, config.BuiltinLocalImage, deployVolume)
+	if err != nil {
+		t.Fatal("error creating config container:", err)
+	}
+	defer deployContainer.Done()
+	stateShouldExist := false
+	response, err := deployContainer.PrepareTerraform(ctx, "1", "test-component", "abc123", "live", &stateShouldExist, nil, nil)
+	if err != nil {
+		t.Fatal("error preparing terraform:", err)
+	}
+
+	// Then
+	if configureResponse.Env["app"] == nil {
+		t.Fatal("expected env for build, got:", configureResponse.Env)
+	}
+	if _, err := os.Stat(filepath.Join(state.CodeDir, ".cdflow2-local/releases/test-component/1.tar")); err != nil {
+		t.Fatal("expected release archive:", err)
+	}
+	files, err := dockerClient.ReadVolume(deployVolume)
+	if err != nil {
+		t.Fatal("error reading volume:", err)
+	}
+	if string(files["app/app.zip"]) != "app" || len(files["release-metadata.json"]) == 0 {
+		t.Fatal("expected release in volume, got:", files)
+	}
+	if response.TerraformImage != "saved-terraform-image" || response.TerraformBackendType != "local" {
+		t.Fatalf("unexpected response: %+v", response)
+	}
+	if response.TerraformBackendConfigParameters["workspace_dir"].Value != "/code/.cdflow2-local/state/test-component" {
+		t.Fatal("unexpected workspace_dir:", response.TerraformBackendConfigParameters["workspace_dir"].Value)
+	}
+}
+
+func TestBuiltinLocalStateShouldExist(t *testing.T) {
+	// Given
+	ctx := context.Background()
+	dockerClient := fake.NewClient()
+	state := createBuiltinState(t, dockerClient)
+	defer os.RemoveAll(state.CodeDir)
+	configContainer, err := config.NewContainer(ctx, state, config.BuiltinLocalImage, "")
+	if err != nil {
+		t.Fatal("error creating config container:", err)
+	}
+	defer configContainer.Done()
+	stateShouldExist := true
+
+	// When
+	_, missingErr := configContainer.PrepareTerraform(ctx, "", "test-component", "abc123", "live", &stateShouldExist, nil, nil)
+	stateFile := filepath.Join(state.CodeDir, ".cdflow2-local/state/test-component/live/terraform.tfstate")
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0755); err != nil {
+		t.Fatal("error creating state dir:", err)
+	}
+	if err := ioutil.WriteFile(stateFile, []byte("{}"), 0644); err != nil {
+		t.Fatal("error writing state:", err)
+	}
+	_, existsErr := configContainer.PrepareTerraform(ctx, "", "test-component", "abc123", "live", &stateShouldExist, nil, nil)
+	_, invalidErr := configContainer.PrepareTerraform(ctx, "", "test-component", "abc123", "live", nil, map[string]interface{}{"dir": "../elsewhere"}, nil)
+
+	// Then
+	var responseError *config.ResponseError
+	if !errors.As(missingErr, &responseError) || responseError.Code != config.ErrorCodeNotFound {
+		t.Fatal("expected not_found error, got:", missingErr)
+	}
+	if existsErr != nil {
+		t.Fatal("unexpected error:", existsErr)
+	}
+	if !errors.As(invalidErr, &responseError) || responseError.Code != config.ErrorCodeInvalidConfig {
+		t.Fatal("expected invalid_config error, got:", invalidErr)
+	}
+}
+
+func TestBuiltinLocalInvalidNames(t *testing.T) {
+	// Given
+	ctx := context.Background()
+	dockerClient := fake.NewClient()
+	state := createBuiltinState(t, dockerClient)
+	defer os.RemoveAll(state.CodeDir)
+	configContainer, err := config.NewContainer(ctx, state, config.BuiltinLocalImage, "")
+	if err != nil {
+		t.Fatal("error creating config container:", err)
+	}
+	defer configContainer.Done()
+
+	for _, testCase := range []struct{ component, version, envName string }{
+		{"test-component", "../../../elsewhere", "live"},
+		{"test-component", `1\2`, "live"},
+		{"test-component", "1/2", "live"},
+		{"..", "", "live"},
+		{"test-component", "", "../live"},
+	} {
+		// When
+		_, configureErr := configContainer.ConfigureRelease(ctx, testCase.version, testCase.component, "abc123", nil, nil, nil)
+		_, prepareErr := configContainer.PrepareTerraform(ctx, testCase.version, testCase.component, "abc123", testCase.envName, nil, nil, nil)
+
+		// Then
+		var responseError *config.ResponseError
+		if testCase.version != "" && (!errors.As(configureErr, &responseError) || responseError.Code != config.ErrorCodeInvalidConfig) {
+			t.Fatalf("expected invalid_config error configuring release for %+v, got: %v", testCase, configureErr)
+		}
+		if !errors.As(prepareErr, &responseError) || responseError.Code != config.ErrorCodeInvalidConfig {
+			t.Fatalf("expected invalid_config error preparing terraform for %+v, got: %v", testCase, prepareErr)
+		}
+	}
+	if matches, _ := filepath.Glob(filepath.Join(filepath.Dir(state.CodeDir), "elsewhere*")); len(matches) != 0 {
+		t.Fatal("expected nothing to be written outside the project, got:", matches)
+	}
+}
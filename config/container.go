@@ -3,14 +3,20 @@ package config
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"time"
 
 	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config/local"
 	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/docker/retry"
+	"github.com/mergermarket/cdflow2/manifest"
+	"github.com/mergermarket/cdflow2/redact"
 	"github.com/mergermarket/cdflow2/util"
 )
 
@@ -21,13 +27,33 @@ type Container struct {
 	done         chan error
 	finished     bool
 	errorStream  io.Writer
+	session      *session
+	image        string
+	capabilities *Capabilities
+	retryPolicy  retry.Policy
+	secrets      *redact.Secrets
+	// builtin handles requests in process for builtin config images, rather than a container.
+	builtin *local.Handler
 }
 
+// BuiltinLocalImage is the config image for the builtin config backend that stores releases and terraform state in
+// the project (see the local package).
+const BuiltinLocalImage = "builtin:local"
+
 // NewContainer creates and returns a new config container.
-func NewContainer(state *command.GlobalState, image, releaseVolume string) (*Container, error) {
+func NewContainer(ctx context.Context, state *command.GlobalState, image, releaseVolume string) (*Container, error) {
 	dockerClient := state.DockerClient
 
-	cacheVolume, err := util.GetCacheVolume(dockerClient)
+	if manifest.IsBuiltinImage(image) {
+		return newBuiltinContainer(ctx, state, image, releaseVolume)
+	}
+
+	cacheVolume, err := util.GetCacheVolume(ctx, dockerClient)
+	if err != nil {
+		return nil, err
+	}
+
+	useSession, err := supportsSession(ctx, dockerClient, image)
 	if err != nil {
 		return nil, err
 	}
@@ -41,6 +67,9 @@ func NewContainer(state *command.GlobalState, image, releaseVolume string) (*Con
 		dockerClient: dockerClient,
 		done:         done,
 		errorStream:  state.ErrorStream,
+		image:        image,
+		retryPolicy:  state.RetryPolicy,
+		secrets:      state.Secrets,
 	}
 
 	go func() {
@@ -51,6 +80,9 @@ func NewContainer(state *command.GlobalState, image, releaseVolume string) (*Con
 			ErrorStream:  state.ErrorStream,
 			Started:      started,
 		}
+		if state.Manifest != nil {
+			options.Limits = state.Manifest.Config.Limits.ContainerLimits()
+		}
 		if releaseVolume == "" { // setup doesn't need a volume
 			options.WorkingDir = "/"
 		} else {
@@ -60,7 +92,8 @@ func NewContainer(state *command.GlobalState, image, releaseVolume string) (*Con
 				cacheVolume + ":/cache",
 			}
 		}
-		err := dockerClient.Run(&options)
+		// not tied to ctx since the lifecycle of the container is managed by Done (which must run on cancellation)
+		err := dockerClient.Run(context.Background(), &options)
 		container.finished = true
 		done <- err
 	}()
@@ -68,35 +101,126 @@ func NewContainer(state *command.GlobalState, image, releaseVolume string) (*Con
 	select {
 	case id := <-started:
 		container.id = id
+		if useSession {
+			container.session = startSession(dockerClient, id, state.ErrorStream)
+		}
+		capabilities, err := container.hello(ctx)
+		if err != nil {
+			if doneErr := container.Done(); doneErr != nil {
+				err = fmt.Errorf("%w, also %v", err, doneErr)
+			}
+			return nil, err
+		}
+		container.capabilities = capabilities
 		return container, nil
 	case err := <-done:
 		return nil, err
 	}
 }
 
-func (configContainer *Container) request(request interface{}, response interface{}) error {
+// newBuiltinContainer returns a config "container" for a builtin config image, which handles requests in process. If
+// there's a release volume a container is created (but not started) with it mounted at /release, so that files can be
+// copied to and from it.
+func newBuiltinContainer(ctx context.Context, state *command.GlobalState, image, releaseVolume string) (_ *Container, returnedError error) {
+	if image != BuiltinLocalImage {
+		return nil, fmt.Errorf("unknown builtin config image %s (supported: %s)", image, BuiltinLocalImage)
+	}
+	container := &Container{
+		dockerClient: state.DockerClient,
+		errorStream:  state.ErrorStream,
+		image:        image,
+		retryPolicy:  state.RetryPolicy,
+		secrets:      state.Secrets,
+	}
+	if releaseVolume != "" {
+		// the terraform image is needed to run terraform anyway, so it's used rather than requiring another image
+		terraformImage := state.Manifest.Terraform.Image
+		if err := state.DockerClient.EnsureImage(ctx, terraformImage, state.ErrorStream); err != nil {
+			return nil, fmt.Errorf("error pulling terraform image %v: %w", terraformImage, err)
+		}
+		id, err := state.DockerClient.CreateContainer(ctx, &docker.CreateContainerOptions{
+			Image: terraformImage,
+			Binds: []string{releaseVolume + ":/release"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		container.id = id
+		defer func() {
+			if returnedError == nil {
+				return
+			}
+			if err := container.Done(); err != nil {
+				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+			}
+		}()
+	}
+	container.builtin = local.New(state.DockerClient, container.id, state.CodeDir, state.ErrorStream)
+	capabilities, err := container.hello(ctx)
+	if err != nil {
+		return nil, err
+	}
+	container.capabilities = capabilities
+	return container, nil
+}
+
+// request sends a request to the config container and decodes the response. Requests that fail with a structured
+// error the config container says is retryable are retried according to the retry policy.
+func (configContainer *Container) request(ctx context.Context, request interface{}, response interface{}) error {
 	var rawRequest bytes.Buffer
 	if err := json.NewEncoder(&rawRequest).Encode(request); err != nil {
 		return err
 	}
+	var action struct{ Action string }
+	if err := json.Unmarshal(rawRequest.Bytes(), &action); err != nil {
+		return err
+	}
+	return retry.Do(ctx, &configContainer.retryPolicy, "config container "+action.Action, isRetryableResponseError, func() error {
+		rawResponse, err := configContainer.send(ctx, request, rawRequest.Bytes())
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(rawResponse, response); err != nil {
+			return fmt.Errorf("error decoding response: %w", err)
+		}
+		return checkResponseError(action.Action, rawResponse)
+	})
+}
+
+// Send sends a request to the config container and returns the raw response without checking it or retrying - for
+// testing config images (see the conformance package).
+func (configContainer *Container) Send(ctx context.Context, request interface{}) ([]byte, error) {
+	rawRequest, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	return configContainer.send(ctx, request, rawRequest)
+}
+
+// send sends a request to the config container and returns the raw response - via the session if the image supports
+// it, otherwise by exec'ing `/app forward`.
+func (configContainer *Container) send(ctx context.Context, request interface{}, rawRequest []byte) ([]byte, error) {
+	if configContainer.builtin != nil {
+		return configContainer.builtin.Handle(ctx, rawRequest)
+	}
+	if configContainer.session != nil {
+		return configContainer.session.send(ctx, request)
+	}
 	var errors bytes.Buffer
 	var rawResponse bytes.Buffer
-	if err := configContainer.dockerClient.Exec(&docker.ExecOptions{
+	if err := configContainer.dockerClient.Exec(ctx, &docker.ExecOptions{
 		ID:           configContainer.id,
 		Cmd:          []string{"/app", "forward"},
-		InputStream:  &rawRequest,
+		InputStream:  bytes.NewReader(rawRequest),
 		OutputStream: &rawResponse,
 		ErrorStream:  &errors,
 	}); err != nil {
-		return err
+		return nil, err
 	}
 	if len(rawResponse.Bytes()) == 0 {
-		return fmt.Errorf("no response returned")
+		return nil, fmt.Errorf("no response returned")
 	}
-	if err := json.NewDecoder(&rawResponse).Decode(response); err != nil {
-		return fmt.Errorf("error decoding response: %w", err)
-	}
-	return nil
+	return rawResponse.Bytes(), nil
 }
 
 // ReleaseRequirements contains a list of needs.
@@ -119,14 +243,18 @@ type setupConfigResponse struct {
 
 // Setup requests the container does setup.
 func (configContainer *Container) Setup(
+	ctx context.Context,
 	config map[string]interface{},
 	env map[string]string,
 	component, commit string,
 	releaseRequirements map[string]*ReleaseRequirements,
 ) error {
+	if err := configContainer.requireAction(ActionSetup); err != nil {
+		return err
+	}
 	var response setupConfigResponse
-	if err := configContainer.request(&setupConfigRequest{
-		Action:              "setup",
+	if err := configContainer.request(ctx, &setupConfigRequest{
+		Action:              ActionSetup,
 		Config:              config,
 		Env:                 env,
 		Component:           component,
@@ -155,19 +283,27 @@ type configureReleaseConfigRequest struct {
 type ConfigureReleaseConfigResponse struct {
 	Env                map[string]map[string]string
 	AdditionalMetadata map[string]string
-	Success            bool
+	// SensitiveEnv are the names of variables in Env whose values are masked in output.
+	SensitiveEnv []string
+	// SensitiveValues are other values to mask in output.
+	SensitiveValues []string
+	Success         bool
 }
 
 // ConfigureRelease requests the container configures the release and returns the response.
 func (configContainer *Container) ConfigureRelease(
+	ctx context.Context,
 	version, component, commit string,
 	config map[string]interface{},
 	env map[string]string,
 	releaseRequirements map[string]*ReleaseRequirements,
 ) (*ConfigureReleaseConfigResponse, error) {
+	if err := configContainer.requireAction(ActionConfigureRelease); err != nil {
+		return nil, err
+	}
 	var response ConfigureReleaseConfigResponse
-	if err := configContainer.request(&configureReleaseConfigRequest{
-		Action:              "configure_release",
+	if err := configContainer.request(ctx, &configureReleaseConfigRequest{
+		Action:              ActionConfigureRelease,
 		Version:             version,
 		Component:           component,
 		Commit:              commit,
@@ -180,24 +316,37 @@ func (configContainer *Container) ConfigureRelease(
 	if !response.Success {
 		return nil, command.Failure(1)
 	}
+	for _, buildEnv := range response.Env {
+		configContainer.addSensitiveEnv(buildEnv, response.SensitiveEnv)
+	}
+	configContainer.secrets.Add(response.SensitiveValues...)
 	return &response, nil
 }
 
+// addSensitiveEnv masks the values of the named variables in env in output.
+func (configContainer *Container) addSensitiveEnv(env map[string]string, names []string) {
+	for _, name := range names {
+		if value, ok := env[name]; ok {
+			configContainer.secrets.Add(value)
+		}
+	}
+}
+
 // WriteReleaseMetadata copies the release metadata file into the release volume via the config container.
-func (configContainer *Container) WriteReleaseMetadata(releaseMetadata map[string]map[string]string) error {
+func (configContainer *Container) WriteReleaseMetadata(ctx context.Context, releaseMetadata map[string]map[string]string) error {
 	encoded, err := json.Marshal(releaseMetadata)
 	if err != nil {
 		return err
 	}
 
-	if err := configContainer.CopyFileToRelease("release-metadata.json", encoded); err != nil {
+	if err := configContainer.CopyFileToRelease(ctx, "release-metadata.json", encoded); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (configContainer *Container) CopyFileToRelease(filename string, content []byte) error {
+func (configContainer *Container) CopyFileToRelease(ctx context.Context, filename string, content []byte) error {
 
 	buffer := new(bytes.Buffer)
 	tarWriter := tar.NewWriter(buffer)
@@ -218,12 +367,26 @@ func (configContainer *Container) CopyFileToRelease(filename string, content []b
 		return err
 	}
 
-	if err := configContainer.dockerClient.CopyToContainer(configContainer.id, "/", buffer); err != nil {
+	if err := configContainer.dockerClient.CopyToContainer(ctx, configContainer.id, "/", buffer); err != nil {
 		return err
 	}
 	return nil
 }
 
+// ReadReleaseFile reads a file from the release volume via the config container.
+func (configContainer *Container) ReadReleaseFile(ctx context.Context, filename string) ([]byte, error) {
+	reader, err := configContainer.dockerClient.CopyFromContainer(ctx, configContainer.id, "/release/"+filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	tarReader := tar.NewReader(reader)
+	if _, err := tarReader.Next(); err != nil {
+		return nil, fmt.Errorf("error reading %s from release: %w", filename, err)
+	}
+	return ioutil.ReadAll(tarReader)
+}
+
 type uploadReleaseRequest struct {
 	Action         string
 	TerraformImage string
@@ -236,10 +399,13 @@ type UploadReleaseResponse struct {
 }
 
 // UploadRelease requests that the config container uploads the release and returns the response.
-func (configContainer *Container) UploadRelease(terraformImage string) (*UploadReleaseResponse, error) {
+func (configContainer *Container) UploadRelease(ctx context.Context, terraformImage string) (*UploadReleaseResponse, error) {
+	if err := configContainer.requireAction(ActionUploadRelease); err != nil {
+		return nil, err
+	}
 	var response UploadReleaseResponse
-	if err := configContainer.request(&uploadReleaseRequest{
-		Action:         "upload_release",
+	if err := configContainer.request(ctx, &uploadReleaseRequest{
+		Action:         ActionUploadRelease,
 		TerraformImage: terraformImage,
 	}, &response); err != nil {
 		return nil, err
@@ -274,20 +440,40 @@ type PrepareTerraformResponse struct {
 	TerraformBackendType             string
 	TerraformBackendConfig           map[string]string
 	TerraformBackendConfigParameters map[string]*TerrafromBackendConfigParameter
-	Success                          bool
+	// SensitiveEnv are the names of variables in Env whose values are masked in output.
+	SensitiveEnv []string
+	// SensitiveValues are other values to mask in output.
+	SensitiveValues []string
+	// CredentialFiles are written to CredentialsDir in the terraform container, keyed by filename.
+	CredentialFiles map[string]string
+	// CredentialsExpire is when the credentials in Env and CredentialFiles expire, if they do - they're refreshed
+	// before then with refresh_credentials (if the config image supports it).
+	CredentialsExpire time.Time
+	Success           bool
 }
 
 // PrepareTerraform requests that the config container prepares for running terraform and returns the response.
 func (configContainer *Container) PrepareTerraform(
+	ctx context.Context,
 	version, component, commit, envName string,
 	stateShouldExist *bool,
 	config map[string]interface{},
 	env map[string]string,
 ) (*PrepareTerraformResponse, error) {
+	if err := configContainer.requireAction(ActionPrepareTerraform); err != nil {
+		return nil, err
+	}
+	if stateShouldExist != nil && !configContainer.capabilities.Features[FeatureStateShouldExist] {
+		if !*stateShouldExist {
+			return nil, fmt.Errorf("config image %s does not support checking the terraform state doesn't exist yet (the %s feature) - it may need upgrading", configContainer.image, FeatureStateShouldExist)
+		}
+		// the check that the state exists is the default, so just don't ask for it
+		stateShouldExist = nil
+	}
 
 	var response PrepareTerraformResponse
-	if err := configContainer.request(&prepareTerraformRequest{
-		Action:           "prepare_terraform",
+	if err := configContainer.request(ctx, &prepareTerraformRequest{
+		Action:           ActionPrepareTerraform,
 		Config:           config,
 		Env:              env,
 		EnvName:          envName,
@@ -301,23 +487,40 @@ func (configContainer *Container) PrepareTerraform(
 	if !response.Success {
 		return nil, errors.New("config container failed to prepare for running terraform")
 	}
+	configContainer.addSensitiveEnv(response.Env, response.SensitiveEnv)
+	configContainer.secrets.Add(response.SensitiveValues...)
+	for _, parameter := range response.TerraformBackendConfigParameters {
+		// a display value means the value is sensitive
+		if parameter.DisplayValue != "" {
+			configContainer.secrets.Add(parameter.Value)
+		}
+	}
 	return &response, nil
 }
 
 // SetupTerraform creates the config container and prepares terraform in one.
-func SetupTerraform(state *command.GlobalState, stateShouldExist *bool, envName, version string, env map[string]string) (_ *PrepareTerraformResponse, returnedBuildVolume string, terraformImage string, returnedError error) {
+func SetupTerraform(ctx context.Context, state *command.GlobalState, stateShouldExist *bool, envName, version string, env map[string]string) (_ *PrepareTerraformResponse, returnedBuildVolume string, terraformImage string, returnedError error) {
 	dockerClient := state.DockerClient
 
-	if err := Pull(state); err != nil {
+	if err := Pull(ctx, state); err != nil {
 		return nil, "", "", err
 	}
 
-	buildVolume, err := dockerClient.CreateVolume("")
+	buildVolume, err := dockerClient.CreateVolume(ctx, "")
 	if err != nil {
 		return nil, "", "", err
 	}
+	defer func() {
+		// on success the caller takes ownership of the volume
+		if returnedError == nil {
+			return
+		}
+		if err := dockerClient.RemoveVolume(context.Background(), buildVolume); err != nil {
+			returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+		}
+	}()
 
-	configContainer, err := NewContainer(state, state.Manifest.Config.Image, buildVolume)
+	configContainer, err := NewContainer(ctx, state, state.Manifest.Config.Image, buildVolume)
 	if err != nil {
 		return nil, "", "", err
 	}
@@ -332,7 +535,7 @@ func SetupTerraform(state *command.GlobalState, stateShouldExist *bool, envName,
 		}
 	}()
 
-	prepareTerraformResponse, err := configContainer.PrepareTerraform(version, state.Component, state.Commit, envName, stateShouldExist, state.Manifest.Config.Params, env)
+	prepareTerraformResponse, err := configContainer.PrepareTerraform(ctx, version, state.Component, state.Commit, envName, stateShouldExist, state.Manifest.Config.Params, env)
 	if err != nil {
 		return nil, "", "", err
 	}
@@ -342,30 +545,39 @@ func SetupTerraform(state *command.GlobalState, stateShouldExist *bool, envName,
 		imageName = state.Manifest.Terraform.Image
 	}
 	if !state.GlobalArgs.NoPullTerraform {
-		if err := dockerClient.EnsureImage(imageName, state.ErrorStream); err != nil {
+		if err := dockerClient.EnsureImage(ctx, imageName, state.ErrorStream); err != nil {
 			return nil, "", "", fmt.Errorf("error pulling terraform image %v: %w", imageName, err)
 		}
 	}
 	return prepareTerraformResponse, buildVolume, imageName, nil
 }
 
-// Done stops and removes the config container.
+// Done stops and removes the config container - it doesn't take a context since it must run even after cancellation.
 func (configContainer *Container) Done() error {
+	if configContainer.builtin != nil {
+		if configContainer.id == "" {
+			return nil
+		}
+		return configContainer.dockerClient.RemoveContainer(context.Background(), configContainer.id)
+	}
+	if configContainer.session != nil {
+		configContainer.session.close()
+	}
 	if !configContainer.finished {
-		if err := configContainer.dockerClient.Stop(configContainer.id, 2*time.Second); err != nil {
+		if err := configContainer.dockerClient.Stop(context.Background(), configContainer.id, 2*time.Second); err != nil {
 			return err
 		}
 	}
 	return <-configContainer.done
 }
 
-// Pull pulls the config image.
-func Pull(state *command.GlobalState) error {
-	if state.GlobalArgs.NoPullConfig {
+// Pull pulls the config image (builtin config images aren't pulled).
+func Pull(ctx context.Context, state *command.GlobalState) error {
+	if state.GlobalArgs.NoPullConfig || manifest.IsBuiltinImage(state.Manifest.Config.Image) {
 		return nil
 	}
 	fmt.Fprintf(state.ErrorStream, "\nPulling config image %v...\n\n", state.Manifest.Config.Image)
-	if err := state.DockerClient.PullImage(state.Manifest.Config.Image, state.ErrorStream); err != nil {
+	if err := state.DockerClient.PullImage(ctx, state.Manifest.Config.Image, state.ErrorStream); err != nil {
 		return fmt.Errorf("error pulling config image: %w", err)
 	}
 	return nil
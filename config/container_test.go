@@ -2,6 +2,7 @@ package config_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"reflect"
 	"testing"
@@ -33,7 +34,7 @@ func TestConfigRelease(t *testing.T) {
 
 	// When
 	func() {
-		configContainer, err := config.NewContainer(state, test.GetConfig("TEST_CONFIG_IMAGE"), releaseVolume)
+		configContainer, err := config.NewContainer(context.Background(), state, test.GetConfig("TEST_CONFIG_IMAGE"), releaseVolume)
 		if err != nil {
 			t.Fatal("error creating config container:", err)
 		}
@@ -44,6 +45,7 @@ func TestConfigRelease(t *testing.T) {
 		}()
 
 		configureReleaseResponse, err = configContainer.ConfigureRelease(
+			context.Background(),
 			"test-version",
 			"test-component",
 			"test-commit",
@@ -63,13 +65,13 @@ func TestConfigRelease(t *testing.T) {
 			t.Fatal("error in configureRelease:", err, errorBuffer.String())
 		}
 
-		configContainer.WriteReleaseMetadata(map[string]map[string]string{
+		configContainer.WriteReleaseMetadata(context.Background(), map[string]map[string]string{
 			"release": {
 				"metadata-key": "metadata-value",
 			},
 		})
 
-		uploadReleaseResponse, err = configContainer.UploadRelease("terraform:image")
+		uploadReleaseResponse, err = configContainer.UploadRelease(context.Background(), "terraform:image")
 		if err != nil {
 			t.Fatal("error in uploadRelease:", err)
 		}
@@ -149,7 +151,7 @@ func TestConfigDeploy(t *testing.T) {
 
 	// When
 	func() {
-		configContainer, err := config.NewContainer(state, test.GetConfig("TEST_CONFIG_IMAGE"), releaseVolume)
+		configContainer, err := config.NewContainer(context.Background(), state, test.GetConfig("TEST_CONFIG_IMAGE"), releaseVolume)
 		if err != nil {
 			t.Fatal("error creating config container:", err)
 		}
@@ -160,6 +162,7 @@ func TestConfigDeploy(t *testing.T) {
 		}()
 
 		prepareTerraformResponse, err = configContainer.PrepareTerraform(
+			context.Background(),
 			"test-version",
 			"test-component",
 			"test-commit",
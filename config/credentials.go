@@ -0,0 +1,68 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// CredentialsDir is where the CredentialFiles from prepare_terraform and refresh_credentials are written in the
+// terraform container - so config images can point tools at them in Env (e.g. AWS_CONFIG_FILE). It's in the
+// container's own filesystem rather than the /build volume, since other containers (e.g. config) mount that.
+const CredentialsDir = "/tmp/cdflow2-credentials"
+
+type refreshCredentialsRequest struct {
+	Action    string
+	Version   string
+	Component string
+	Commit    string
+	Config    map[string]interface{}
+	Env       map[string]string
+	EnvName   string
+}
+
+// RefreshCredentialsResponse contains the response to the refresh credentials request.
+type RefreshCredentialsResponse struct {
+	// Env replaces the Env from prepare_terraform for terraform commands run from now on.
+	Env map[string]string
+	// CredentialFiles are written to CredentialsDir, replacing those written before.
+	CredentialFiles map[string]string
+	// CredentialsExpire is when the new credentials expire (zero if they don't, so needn't be refreshed again).
+	CredentialsExpire time.Time
+	// SensitiveEnv are the names of variables in Env whose values are masked in output.
+	SensitiveEnv []string
+	// SensitiveValues are other values to mask in output.
+	SensitiveValues []string
+	Success         bool
+}
+
+// RefreshCredentials requests fresh credentials for running terraform, to replace those from prepare_terraform
+// before they expire.
+func (configContainer *Container) RefreshCredentials(
+	ctx context.Context,
+	version, component, commit, envName string,
+	config map[string]interface{},
+	env map[string]string,
+) (*RefreshCredentialsResponse, error) {
+	if err := configContainer.requireAction(ActionRefreshCredentials); err != nil {
+		return nil, err
+	}
+	var response RefreshCredentialsResponse
+	if err := configContainer.request(ctx, &refreshCredentialsRequest{
+		Action:    ActionRefreshCredentials,
+		Version:   version,
+		Component: component,
+		Commit:    commit,
+		Config:    config,
+		Env:       env,
+		EnvName:   envName,
+	}, &response); err != nil {
+		return nil, err
+	}
+	if !response.Success {
+		return nil, errors.New("config container failed to refresh credentials")
+	}
+	configContainer.addSensitiveEnv(response.Env, response.SensitiveEnv)
+	configContainer.secrets.Add(response.SensitiveValues...)
+	return &response, nil
+}
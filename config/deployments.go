@@ -0,0 +1,115 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// PlanChanges are the resource changes counted in a terraform plan.
+type PlanChanges struct {
+	Add     int
+	Change  int
+	Destroy int
+}
+
+// Deployment records a version being deployed to an environment.
+type Deployment struct {
+	EnvName  string
+	Version  string
+	Commit   string
+	User     string
+	Started  time.Time
+	Finished time.Time
+	// Changes is nil if the plan's summary couldn't be found in its output.
+	Changes *PlanChanges
+	// Rollback is set if this deployment was a rollback.
+	Rollback bool `json:",omitempty"`
+	// RollbackFrom is the version that was rolled back from, if this deployment was a rollback and it was known.
+	RollbackFrom string `json:",omitempty"`
+}
+
+type recordDeploymentRequest struct {
+	Action     string
+	Component  string
+	Config     map[string]interface{}
+	Env        map[string]string
+	Deployment *Deployment
+}
+
+type recordDeploymentResponse struct {
+	Success bool
+}
+
+// RecordDeployment requests that the config container records a successful deployment.
+func (configContainer *Container) RecordDeployment(
+	ctx context.Context,
+	component string,
+	config map[string]interface{},
+	env map[string]string,
+	deployment *Deployment,
+) error {
+	if err := configContainer.requireAction(ActionRecordDeployment); err != nil {
+		return err
+	}
+	var response recordDeploymentResponse
+	if err := configContainer.request(ctx, &recordDeploymentRequest{
+		Action:     ActionRecordDeployment,
+		Component:  component,
+		Config:     config,
+		Env:        env,
+		Deployment: deployment,
+	}, &response); err != nil {
+		return err
+	}
+	if !response.Success {
+		return errors.New("config container failed to record deployment")
+	}
+	return nil
+}
+
+type getDeploymentsRequest struct {
+	Action    string
+	Component string
+	Config    map[string]interface{}
+	Env       map[string]string
+	EnvNames  []string `json:",omitempty"`
+	Limit     int      `json:",omitempty"`
+}
+
+// GetDeploymentsResponse contains the response to the get deployments request - the latest deployments to each
+// environment, newest first.
+type GetDeploymentsResponse struct {
+	Deployments []*Deployment
+	Success     bool
+}
+
+// GetDeployments requests the latest deployments to each of envNames (or every environment the component has been
+// deployed to if empty) from the config container - up to limit per environment (just the latest if zero).
+func (configContainer *Container) GetDeployments(
+	ctx context.Context,
+	component string,
+	config map[string]interface{},
+	env map[string]string,
+	envNames []string,
+	limit int,
+) (*GetDeploymentsResponse, error) {
+	if err := configContainer.requireAction(ActionGetDeployments); err != nil {
+		return nil, err
+	}
+	var response GetDeploymentsResponse
+	if err := configContainer.request(ctx, &getDeploymentsRequest{
+		Action:    ActionGetDeployments,
+		Component: component,
+		Config:    config,
+		Env:       env,
+		EnvNames:  envNames,
+		Limit:     limit,
+	}, &response); err != nil {
+		return nil, err
+	}
+	if !response.Success {
+		return nil, errors.New("config container failed to get deployments")
+	}
+	return &response, nil
+}
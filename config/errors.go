@@ -0,0 +1,86 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Error codes a config container can return in a structured error, and the exit status cdflow2 exits with for each.
+const (
+	ErrorCodeInvalidConfig = "invalid_config"
+	ErrorCodeNotFound      = "not_found"
+	ErrorCodeUnauthorized  = "unauthorized"
+	ErrorCodeConflict      = "conflict"
+	ErrorCodeUnavailable   = "unavailable"
+)
+
+var exitCodes = map[string]int{
+	ErrorCodeInvalidConfig: 3,
+	ErrorCodeNotFound:      4,
+	ErrorCodeUnauthorized:  5,
+	ErrorCodeConflict:      6,
+	ErrorCodeUnavailable:   7,
+}
+
+// ResponseError is a structured error returned by a config container in the Error field of a response with Success
+// set to false.
+type ResponseError struct {
+	// Code identifies the kind of error (e.g. "unauthorized") - see the ErrorCode constants.
+	Code string
+	// Message describes what went wrong.
+	Message string
+	// Remediation optionally suggests what the user could do to fix the problem.
+	Remediation string
+	// Retryable is true if the request might succeed if made again (e.g. a credential service hiccup).
+	Retryable bool
+	// Action is the action of the request that failed (filled in by cdflow2).
+	Action string `json:"-"`
+}
+
+func (responseError *ResponseError) Error() string {
+	code := responseError.Code
+	if code == "" {
+		code = "error"
+	}
+	message := fmt.Sprintf("config container %s failed (%s): %s", responseError.Action, code, responseError.Message)
+	if responseError.Remediation != "" {
+		message += "\nhint: " + responseError.Remediation
+	}
+	return message
+}
+
+// ExitCode returns the exit status for the error code, so scripts can tell kinds of failure apart (1 for codes that
+// aren't known).
+func (responseError *ResponseError) ExitCode() int {
+	if exitCode, ok := exitCodes[responseError.Code]; ok {
+		return exitCode
+	}
+	return 1
+}
+
+// responseStatus is the part of every response that says whether it succeeded.
+type responseStatus struct {
+	Success bool
+	Error   *ResponseError
+}
+
+// checkResponseError returns the structured error from a response if it failed with one. Failed responses without
+// one (from config images that don't send them) are left for the caller to handle.
+func checkResponseError(action string, rawResponse []byte) error {
+	var status responseStatus
+	if err := json.Unmarshal(rawResponse, &status); err != nil {
+		return fmt.Errorf("error decoding response: %w", err)
+	}
+	if status.Success || status.Error == nil {
+		return nil
+	}
+	status.Error.Action = action
+	return status.Error
+}
+
+// isRetryableResponseError returns true if the config container said the request could be retried.
+func isRetryableResponseError(err error) bool {
+	var responseError *ResponseError
+	return errors.As(err, &responseError) && responseError.Retryable
+}
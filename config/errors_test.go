@@ -0,0 +1,134 @@
+package config_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/docker/retry"
+)
+
+// handleFailingConfigureRelease simulates a legacy config image whose configure_release requests fail with errors
+// until they run out, returning the number of configure_release requests made.
+func handleFailingConfigureRelease(dockerClient *fake.Client, failures ...*config.ResponseError) *int {
+	var requests int
+	dockerClient.AddLocalImage("config-image")
+	dockerClient.HandleRun("config-image", fake.WaitForStop(0))
+	dockerClient.HandleExec("config-image", func(process *fake.Process) int {
+		var request struct{ Action string }
+		if err := json.NewDecoder(process.InputStream).Decode(&request); err != nil {
+			fmt.Fprintln(process.ErrorStream, "error decoding request:", err)
+			return 1
+		}
+		if request.Action != config.ActionConfigureRelease {
+			json.NewEncoder(process.OutputStream).Encode(map[string]interface{}{"Success": false})
+			return 0
+		}
+		requests++
+		if requests <= len(failures) {
+			json.NewEncoder(process.OutputStream).Encode(map[string]interface{}{
+				"Success": false,
+				"Error":   failures[requests-1],
+			})
+			return 0
+		}
+		json.NewEncoder(process.OutputStream).Encode(map[string]interface{}{"Success": true})
+		return 0
+	})
+	return &requests
+}
+
+func configureRelease(t *testing.T, dockerClient *fake.Client) (*bytes.Buffer, error) {
+	var errorBuffer bytes.Buffer
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  &errorBuffer,
+		RetryPolicy: retry.Policy{
+			Retries:      2,
+			InitialDelay: time.Millisecond,
+			MaxDelay:     time.Millisecond,
+			Log:          &errorBuffer,
+		},
+	}
+	configContainer, err := config.NewContainer(context.Background(), state, "config-image", "")
+	if err != nil {
+		t.Fatal("error creating config container:", err)
+	}
+	defer func() {
+		if err := configContainer.Done(); err != nil {
+			t.Fatal("error stopping config container:", err)
+		}
+	}()
+	_, err = configContainer.ConfigureRelease(context.Background(), "1", "component", "commit", nil, nil, nil)
+	return &errorBuffer, err
+}
+
+func TestRetryableResponseError(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	requests := handleFailingConfigureRelease(dockerClient, &config.ResponseError{
+		Code:      config.ErrorCodeUnavailable,
+		Message:   "credential service unavailable",
+		Retryable: true,
+	})
+
+	// When
+	errorBuffer, err := configureRelease(t, dockerClient)
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if *requests != 2 {
+		t.Fatal("expected request to be retried once, got requests:", *requests)
+	}
+	if !strings.Contains(errorBuffer.String(), "credential service unavailable") {
+		t.Fatal("expected retry to be logged, got:", errorBuffer.String())
+	}
+}
+
+func TestResponseError(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	requests := handleFailingConfigureRelease(dockerClient, &config.ResponseError{
+		Code:        config.ErrorCodeUnauthorized,
+		Message:     "access denied to release bucket",
+		Remediation: "check the deploy role can read the release bucket",
+	})
+
+	// When
+	_, err := configureRelease(t, dockerClient)
+
+	// Then
+	var responseError *config.ResponseError
+	if !errors.As(err, &responseError) {
+		t.Fatal("expected structured error, got:", err)
+	}
+	if *requests != 1 {
+		t.Fatal("expected request not to be retried, got requests:", *requests)
+	}
+	if responseError.ExitCode() != 5 {
+		t.Fatal("unexpected exit code:", responseError.ExitCode())
+	}
+	expected := "config container configure_release failed (unauthorized): access denied to release bucket\n" +
+		"hint: check the deploy role can read the release bucket"
+	if err.Error() != expected {
+		t.Fatalf("unexpected error message: %q", err.Error())
+	}
+}
+
+func TestResponseErrorUnknownCode(t *testing.T) {
+	responseError := &config.ResponseError{Code: "something_new", Message: "message"}
+	if responseError.ExitCode() != 1 {
+		t.Fatal("expected exit code 1 for unknown code, got:", responseError.ExitCode())
+	}
+}
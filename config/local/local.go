@@ -0,0 +1,380 @@
+// Package local implements the config container protocol in process, storing releases and terraform state in a
+// directory within the project rather than in a cloud account - for trying cdflow2 out, or testing infrastructure
+// changes offline. It's used when the config image is "builtin:local".
+package local
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/util"
+)
+
+// DefaultDir is where releases and terraform state are stored, relative to the project, unless the dir config param
+// is set.
+const DefaultDir = ".cdflow2-local"
+
+// protocolVersion is the version of the config container protocol implemented (see config.ProtocolVersion).
+const protocolVersion = 2
+
+// Handler handles config container requests for a single command, so it remembers the release being built between
+// the configure_release and upload_release requests, as a config container would.
+type Handler struct {
+	dockerClient docker.Iface
+	// containerID is a container with the release volume mounted at /release, or "" if there's no release volume.
+	containerID string
+	codeDir     string
+	errorStream io.Writer
+	release     *releaseMetadata
+	dir         string
+}
+
+// New returns a handler that stores releases and terraform state under codeDir, transferring releases to and from the
+// release volume mounted in the container with ID containerID.
+func New(dockerClient docker.Iface, containerID, codeDir string, errorStream io.Writer) *Handler {
+	return &Handler{
+		dockerClient: dockerClient,
+		containerID:  containerID,
+		codeDir:      codeDir,
+		errorStream:  errorStream,
+	}
+}
+
+type request struct {
+	Action              string
+	Version             string
+	Component           string
+	Commit              string
+	EnvName             string
+	Config              map[string]interface{}
+	ReleaseRequirements map[string]json.RawMessage
+	TerraformImage      string
+	StateShouldExist    *bool
+}
+
+// releaseMetadata is saved alongside each release archive.
+type releaseMetadata struct {
+	Version        string
+	Component      string
+	Commit         string
+	Created        time.Time
+	TerraformImage string
+}
+
+// failure is a structured error returned to cdflow2 in a failed response (see config.ResponseError).
+type failure struct {
+	Code        string
+	Message     string
+	Remediation string `json:",omitempty"`
+}
+
+func (failure *failure) Error() string {
+	return failure.Message
+}
+
+// Handle handles a JSON encoded request and returns the JSON encoded response.
+func (handler *Handler) Handle(ctx context.Context, rawRequest []byte) ([]byte, error) {
+	var request request
+	if err := json.Unmarshal(rawRequest, &request); err != nil {
+		return nil, fmt.Errorf("error decoding request: %w", err)
+	}
+	response, err := handler.handle(ctx, &request)
+	var failed *failure
+	if errors.As(err, &failed) {
+		return json.Marshal(map[string]interface{}{"Success": false, "Error": failed})
+	} else if err != nil {
+		return nil, fmt.Errorf("builtin:local %s: %w", request.Action, err)
+	}
+	return json.Marshal(response)
+}
+
+func (handler *Handler) handle(ctx context.Context, request *request) (interface{}, error) {
+	switch request.Action {
+	case "hello":
+		return map[string]interface{}{
+			"ProtocolVersion": protocolVersion,
+			"Actions":         []string{"hello", "setup", "configure_release", "upload_release", "prepare_terraform"},
+			"Features":        []string{"state_should_exist", "terraform_backend_config_parameters"},
+			"Success":         true,
+		}, nil
+	case "setup":
+		return handler.setup(request)
+	case "configure_release":
+		return handler.configureRelease(request)
+	case "upload_release":
+		return handler.uploadRelease(ctx, request)
+	case "prepare_terraform":
+		return handler.prepareTerraform(ctx, request)
+	}
+	return nil, &failure{Code: "invalid_config", Message: "unsupported action " + request.Action}
+}
+
+// getDir returns the directory to store releases and state in, relative to the project, from the dir config param.
+func getDir(config map[string]interface{}) (string, error) {
+	value, ok := config["dir"]
+	if !ok {
+		return DefaultDir, nil
+	}
+	dir, ok := value.(string)
+	if !ok || dir == "" {
+		return "", &failure{Code: "invalid_config", Message: fmt.Sprintf("config param dir must be a path, got %v", value)}
+	}
+	dir = path.Clean(dir)
+	// terraform reads the state via the project, which is mounted at /code in the terraform container
+	if path.IsAbs(dir) || dir == "." || dir == ".." || strings.HasPrefix(dir, "../") {
+		return "", &failure{
+			Code:        "invalid_config",
+			Message:     fmt.Sprintf("config param dir must be a directory within the project, got %q", value),
+			Remediation: "use a relative path such as " + DefaultDir,
+		}
+	}
+	return dir, nil
+}
+
+// checkName checks a name from the request (e.g. the version) can be used in a path, without escaping the directory
+// it's joined to.
+func checkName(description, name string) error {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.Contains(name, "..") {
+		return &failure{
+			Code:    "invalid_config",
+			Message: fmt.Sprintf("%s must not be empty or contain '/', '\\' or '..', got %q", description, name),
+		}
+	}
+	return nil
+}
+
+func (handler *Handler) releaseFilename(dir, component, version, extension string) (string, error) {
+	if err := checkName("component", component); err != nil {
+		return "", err
+	}
+	if err := checkName("version", version); err != nil {
+		return "", err
+	}
+	return filepath.Join(handler.codeDir, filepath.FromSlash(dir), "releases", component, version+extension), nil
+}
+
+func (handler *Handler) setup(request *request) (interface{}, error) {
+	dir, err := getDir(request.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkName("component", request.Component); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(handler.codeDir, filepath.FromSlash(dir), "releases", request.Component), 0755); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(
+		handler.errorStream, "\n%s\n",
+		util.FormatInfo(fmt.Sprintf("releases and terraform state will be stored in %s - you may want to add it to .gitignore", dir)),
+	)
+	return map[string]interface{}{"Success": true}, nil
+}
+
+func (handler *Handler) configureRelease(request *request) (interface{}, error) {
+	dir, err := getDir(request.Config)
+	if err != nil {
+		return nil, err
+	}
+	filename, err := handler.releaseFilename(dir, request.Component, request.Version, ".json")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(filename); err == nil {
+		return nil, &failure{
+			Code:        "conflict",
+			Message:     fmt.Sprintf("release %s of %s already exists in %s", request.Version, request.Component, dir),
+			Remediation: "use a different version",
+		}
+	}
+	handler.dir = dir
+	handler.release = &releaseMetadata{Version: request.Version, Component: request.Component, Commit: request.Commit}
+	// no config to give the builds, but each needs an entry for cdflow2 to add the built in variables to
+	env := make(map[string]map[string]string)
+	for buildID := range request.ReleaseRequirements {
+		env[buildID] = make(map[string]string)
+	}
+	return map[string]interface{}{"Env": env, "Success": true}, nil
+}
+
+func (handler *Handler) uploadRelease(ctx context.Context, request *request) (interface{}, error) {
+	if handler.release == nil || handler.containerID == "" {
+		return nil, errors.New("release not configured")
+	}
+	release := *handler.release
+	release.Created = time.Now().UTC()
+	release.TerraformImage = request.TerraformImage
+
+	archiveFilename, err := handler.releaseFilename(handler.dir, release.Component, release.Version, ".tar")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(archiveFilename), 0755); err != nil {
+		return nil, err
+	}
+	reader, err := handler.dockerClient.CopyFromContainer(ctx, handler.containerID, "/release")
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	if err := writeFile(archiveFilename, reader); err != nil {
+		return nil, err
+	}
+
+	// written last, since it's what marks the release as existing
+	encoded, err := json.MarshalIndent(&release, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	metadataFilename, err := handler.releaseFilename(handler.dir, release.Component, release.Version, ".json")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFile(metadataFilename, strings.NewReader(string(encoded))); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"Message": fmt.Sprintf("Release %s of %s saved in %s.", release.Version, release.Component, handler.dir),
+		"Success": true,
+	}, nil
+}
+
+// writeFile writes a file via a temporary file, so it's never left partially written.
+func writeFile(filename string, reader io.Reader) (returnedError error) {
+	file, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if returnedError != nil {
+			os.Remove(file.Name())
+		}
+	}()
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), filename)
+}
+
+func (handler *Handler) prepareTerraform(ctx context.Context, request *request) (interface{}, error) {
+	dir, err := getDir(request.Config)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkName("component", request.Component); err != nil {
+		return nil, err
+	}
+	if err := checkName("environment name", request.EnvName); err != nil {
+		return nil, err
+	}
+
+	var terraformImage string
+	if request.Version != "" {
+		release, err := handler.fetchRelease(ctx, dir, request.Component, request.Version)
+		if err != nil {
+			return nil, err
+		}
+		terraformImage = release.TerraformImage
+	}
+
+	// each environment has its own workspace, which the local backend keeps in a directory under workspace_dir
+	stateDir := path.Join(dir, "state", request.Component)
+	if err := os.MkdirAll(filepath.Join(handler.codeDir, filepath.FromSlash(stateDir)), 0755); err != nil {
+		return nil, err
+	}
+	if err := handler.checkState(path.Join(stateDir, request.EnvName, "terraform.tfstate"), request); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"TerraformImage":       terraformImage,
+		"Env":                  map[string]string{},
+		"TerraformBackendType": "local",
+		"TerraformBackendConfigParameters": map[string]interface{}{
+			"path":          map[string]string{"Value": path.Join("/code", stateDir, "terraform.tfstate")},
+			"workspace_dir": map[string]string{"Value": path.Join("/code", stateDir)},
+		},
+		"Success": true,
+	}, nil
+}
+
+// fetchRelease copies a release from its archive into the release volume and returns its metadata.
+func (handler *Handler) fetchRelease(ctx context.Context, dir, component, version string) (*releaseMetadata, error) {
+	metadataFilename, err := handler.releaseFilename(dir, component, version, ".json")
+	if err != nil {
+		return nil, err
+	}
+	if handler.containerID == "" {
+		return nil, errors.New("no release volume")
+	}
+	data, err := ioutil.ReadFile(metadataFilename)
+	if os.IsNotExist(err) {
+		return nil, &failure{
+			Code:        "not_found",
+			Message:     fmt.Sprintf("release %s of %s not found in %s", version, component, dir),
+			Remediation: "create it with: cdflow2 release " + version,
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	var release releaseMetadata
+	if err := json.Unmarshal(data, &release); err != nil {
+		return nil, fmt.Errorf("error decoding release metadata: %w", err)
+	}
+
+	archiveFilename, err := handler.releaseFilename(dir, component, version, ".tar")
+	if err != nil {
+		return nil, err
+	}
+	archive, err := os.Open(archiveFilename)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	// the archive contains the release directory itself
+	if err := handler.dockerClient.CopyToContainer(ctx, handler.containerID, "/", archive); err != nil {
+		return nil, fmt.Errorf("error copying release to volume: %w", err)
+	}
+	return &release, nil
+}
+
+// checkState checks the terraform state for the environment does or doesn't exist as requested.
+func (handler *Handler) checkState(statePath string, request *request) error {
+	if request.StateShouldExist == nil {
+		return nil
+	}
+	_, err := os.Stat(filepath.Join(handler.codeDir, filepath.FromSlash(statePath)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	exists := err == nil
+	if *request.StateShouldExist && !exists {
+		return &failure{
+			Code:        "not_found",
+			Message:     fmt.Sprintf("no terraform state for %s in %s (expected %s)", request.Component, request.EnvName, statePath),
+			Remediation: "pass --new-state if this is the first deployment to " + request.EnvName,
+		}
+	}
+	if !*request.StateShouldExist && exists {
+		return &failure{
+			Code:        "conflict",
+			Message:     fmt.Sprintf("terraform state for %s in %s already exists (%s)", request.Component, request.EnvName, statePath),
+			Remediation: "remove --new-state, since " + request.EnvName + " has been deployed to before",
+		}
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// EnvLock is a lock on an environment, preventing concurrent deploys and destroys.
+type EnvLock struct {
+	EnvName  string
+	ID       string
+	Holder   string
+	Reason   string
+	Acquired time.Time
+	Expires  time.Time
+}
+
+// EnvLockedError is returned when an environment is locked by someone else.
+type EnvLockedError struct {
+	Lock *EnvLock
+}
+
+func (lockedError *EnvLockedError) Error() string {
+	lock := lockedError.Lock
+	message := fmt.Sprintf("environment %s is locked by %s", lock.EnvName, lock.Holder)
+	if lock.Reason != "" {
+		message += fmt.Sprintf(" (%s)", lock.Reason)
+	}
+	if !lock.Acquired.IsZero() {
+		message += " since " + lock.Acquired.UTC().Format(time.RFC3339)
+	}
+	if !lock.Expires.IsZero() {
+		message += ", expiring " + lock.Expires.UTC().Format(time.RFC3339)
+	}
+	return message + fmt.Sprintf(` - wait for it to be released, or run "cdflow2 unlock --force --reason REASON %s"`, lock.EnvName)
+}
+
+// ExitCode returns the exit status for a conflict, as for a ResponseError with the conflict code.
+func (lockedError *EnvLockedError) ExitCode() int {
+	return exitCodes[ErrorCodeConflict]
+}
+
+type acquireLockRequest struct {
+	Action     string
+	Component  string
+	Config     map[string]interface{}
+	Env        map[string]string
+	EnvName    string
+	ID         string `json:",omitempty"`
+	Holder     string
+	Reason     string
+	TTLSeconds int
+}
+
+type acquireLockResponse struct {
+	// Acquired is false if the lock is held by someone else.
+	Acquired bool
+	// Lock is the lock acquired, or the lock that is held if not acquired.
+	Lock    *EnvLock
+	Success bool
+}
+
+// AcquireLock requests that the config container locks an environment for ttl, returning an EnvLockedError if it is
+// already locked.
+func (configContainer *Container) AcquireLock(
+	ctx context.Context,
+	component string,
+	config map[string]interface{},
+	env map[string]string,
+	envName, holder, reason string,
+	ttl time.Duration,
+) (*EnvLock, error) {
+	return configContainer.acquireLock(ctx, component, config, env, envName, "", holder, reason, ttl)
+}
+
+// RenewLock requests that the config container extends the lock with the ID (held by this command) to expire ttl
+// from now. It returns an EnvLockedError if the environment is locked by someone else (or the config container
+// doesn't support renewing locks), and a lock with a different ID if the lock had expired and was acquired afresh.
+func (configContainer *Container) RenewLock(
+	ctx context.Context,
+	component string,
+	config map[string]interface{},
+	env map[string]string,
+	envName, id, holder, reason string,
+	ttl time.Duration,
+) (*EnvLock, error) {
+	return configContainer.acquireLock(ctx, component, config, env, envName, id, holder, reason, ttl)
+}
+
+func (configContainer *Container) acquireLock(
+	ctx context.Context,
+	component string,
+	config map[string]interface{},
+	env map[string]string,
+	envName, id, holder, reason string,
+	ttl time.Duration,
+) (*EnvLock, error) {
+	if err := configContainer.requireAction(ActionAcquireLock); err != nil {
+		return nil, err
+	}
+	var response acquireLockResponse
+	if err := configContainer.request(ctx, &acquireLockRequest{
+		Action:     ActionAcquireLock,
+		Component:  component,
+		Config:     config,
+		Env:        env,
+		EnvName:    envName,
+		ID:         id,
+		Holder:     holder,
+		Reason:     reason,
+		TTLSeconds: int(ttl.Seconds()),
+	}, &response); err != nil {
+		return nil, err
+	}
+	if !response.Success {
+		return nil, errors.New("config container failed to acquire lock")
+	}
+	if response.Lock == nil {
+		response.Lock = &EnvLock{EnvName: envName}
+	}
+	if response.Lock.EnvName == "" {
+		response.Lock.EnvName = envName
+	}
+	if !response.Acquired {
+		return nil, &EnvLockedError{Lock: response.Lock}
+	}
+	return response.Lock, nil
+}
+
+type releaseLockRequest struct {
+	Action    string
+	Component string
+	Config    map[string]interface{}
+	Env       map[string]string
+	EnvName   string
+	ID        string `json:",omitempty"`
+	Holder    string
+	Force     bool
+	Reason    string `json:",omitempty"`
+}
+
+type releaseLockResponse struct {
+	// Released is false if there was no lock to release.
+	Released bool
+	// Lock is the lock that was released.
+	Lock    *EnvLock
+	Success bool
+}
+
+// ReleaseLock requests that the config container releases the lock on an environment - the lock with the ID if set,
+// otherwise the lock held by holder. With force the lock is released whoever holds it, with the reason recorded for
+// audit. The released lock is returned (nil if there wasn't one).
+func (configContainer *Container) ReleaseLock(
+	ctx context.Context,
+	component string,
+	config map[string]interface{},
+	env map[string]string,
+	envName, id, holder string,
+	force bool,
+	reason string,
+) (*EnvLock, error) {
+	if err := configContainer.requireAction(ActionReleaseLock); err != nil {
+		return nil, err
+	}
+	var response releaseLockResponse
+	if err := configContainer.request(ctx, &releaseLockRequest{
+		Action:    ActionReleaseLock,
+		Component: component,
+		Config:    config,
+		Env:       env,
+		EnvName:   envName,
+		ID:        id,
+		Holder:    holder,
+		Force:     force,
+		Reason:    reason,
+	}, &response); err != nil {
+		return nil, err
+	}
+	if !response.Success {
+		return nil, errors.New("config container failed to release lock")
+	}
+	if !response.Released {
+		return nil, nil
+	}
+	if response.Lock == nil {
+		response.Lock = &EnvLock{EnvName: envName, ID: id}
+	}
+	return response.Lock, nil
+}
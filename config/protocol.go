@@ -0,0 +1,135 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ProtocolVersion is the version of the config container protocol spoken by this version of cdflow2, sent in the
+// hello request.
+const ProtocolVersion = 2
+
+// MinimumProtocolVersion is the oldest config container protocol version this version of cdflow2 accepts in a hello
+// response. Hello was added in version 2, so images that answer it must speak at least that - images that don't
+// understand it are treated as legacy instead.
+const MinimumProtocolVersion = 2
+
+// legacyProtocolVersion is the protocol version assumed for config images that don't understand the hello action.
+const legacyProtocolVersion = 1
+
+// Actions understood by config containers.
+const (
+	ActionHello              = "hello"
+	ActionSetup              = "setup"
+	ActionConfigureRelease   = "configure_release"
+	ActionUploadRelease      = "upload_release"
+	ActionPrepareTerraform   = "prepare_terraform"
+	ActionListReleases       = "list_releases"
+	ActionRecordDeployment   = "record_deployment"
+	ActionGetDeployments     = "get_deployments"
+	ActionAcquireLock        = "acquire_lock"
+	ActionReleaseLock        = "release_lock"
+	ActionRefreshCredentials = "refresh_credentials"
+)
+
+// Optional features a config container can support within an action.
+const (
+	// FeatureStateShouldExist means the StateShouldExist field of the prepare_terraform request is checked.
+	FeatureStateShouldExist = "state_should_exist"
+	// FeatureBackendConfigParameters means the prepare_terraform response can include TerraformBackendConfigParameters.
+	FeatureBackendConfigParameters = "terraform_backend_config_parameters"
+)
+
+// legacyActions and legacyFeatures are what config images that don't understand the hello action are assumed to
+// support - i.e. what cdflow2 relied on before the hello action was added.
+var legacyActions = []string{ActionSetup, ActionConfigureRelease, ActionUploadRelease, ActionPrepareTerraform}
+var legacyFeatures = []string{FeatureStateShouldExist, FeatureBackendConfigParameters}
+
+// Capabilities describes the protocol version, actions and features supported by a config image.
+type Capabilities struct {
+	ProtocolVersion int
+	Actions         map[string]bool
+	Features        map[string]bool
+	// Legacy is true if the config image didn't understand the hello action, so its capabilities are assumed.
+	Legacy bool
+}
+
+func newCapabilities(protocolVersion int, actions, features []string, legacy bool) *Capabilities {
+	result := &Capabilities{
+		ProtocolVersion: protocolVersion,
+		Actions:         make(map[string]bool),
+		Features:        make(map[string]bool),
+		Legacy:          legacy,
+	}
+	for _, action := range actions {
+		result.Actions[action] = true
+	}
+	for _, feature := range features {
+		result.Features[feature] = true
+	}
+	return result
+}
+
+type helloRequest struct {
+	Action          string
+	ProtocolVersion int
+}
+
+type helloResponse struct {
+	ProtocolVersion int
+	Actions         []string
+	Features        []string
+	Success         bool
+}
+
+// hello tells the config container the protocol version cdflow2 speaks and finds out what it supports. Images that
+// answer that they don't understand the hello action (a failed response without a structured error, since those were
+// added after hello) are assumed to support the actions and features that existed before it. Any other error is
+// returned rather than guessing.
+func (configContainer *Container) hello(ctx context.Context) (*Capabilities, error) {
+	var response helloResponse
+	if err := configContainer.request(ctx, &helloRequest{
+		Action:          ActionHello,
+		ProtocolVersion: ProtocolVersion,
+	}, &response); err != nil {
+		return nil, fmt.Errorf("error sending hello to config image %s: %w", configContainer.image, err)
+	}
+	if !response.Success {
+		return newCapabilities(legacyProtocolVersion, legacyActions, legacyFeatures, true), nil
+	}
+	if response.ProtocolVersion < MinimumProtocolVersion {
+		return nil, fmt.Errorf(
+			"config image %s speaks config container protocol version %d, but this version of cdflow2 requires at least version %d - upgrade the config image",
+			configContainer.image, response.ProtocolVersion, MinimumProtocolVersion,
+		)
+	}
+	return newCapabilities(response.ProtocolVersion, response.Actions, response.Features, false), nil
+}
+
+// Capabilities returns what the config image supports, as discovered when the container was started.
+func (configContainer *Container) Capabilities() *Capabilities {
+	return configContainer.capabilities
+}
+
+// Supports returns true if the config image supports an action.
+func (configContainer *Container) Supports(action string) bool {
+	return configContainer.capabilities.Actions[action]
+}
+
+// requireAction returns an error naming the action and what the image does support if it doesn't support the action.
+func (configContainer *Container) requireAction(action string) error {
+	if configContainer.Supports(action) {
+		return nil
+	}
+	var supported []string
+	for supportedAction := range configContainer.capabilities.Actions {
+		supported = append(supported, supportedAction)
+	}
+	sort.Strings(supported)
+	return fmt.Errorf(
+		"config image %s does not support the %s action (protocol version %d, supported actions: %s) - it may need upgrading",
+		configContainer.image, action, configContainer.capabilities.ProtocolVersion, strings.Join(supported, ", "),
+	)
+}
@@ -0,0 +1,125 @@
+package config_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/test"
+)
+
+func newConfigContainer(t *testing.T, hello interface{}) (*config.Container, *fake.Client, error) {
+	dockerClient := fake.NewClient()
+	test.HandleFakeConfig(dockerClient, "config-image", func(request map[string]interface{}) interface{} {
+		if request["Action"] == config.ActionHello {
+			if request["ProtocolVersion"] != float64(config.ProtocolVersion) {
+				t.Fatal("expected protocol version in hello request, got:", request["ProtocolVersion"])
+			}
+			return hello
+		}
+		return map[string]interface{}{"Success": true}
+	})
+	dockerClient.PullImage(context.Background(), "config-image", nil)
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  &bytes.Buffer{},
+	}
+	configContainer, err := config.NewContainer(context.Background(), state, "config-image", "release-volume")
+	return configContainer, dockerClient, err
+}
+
+func TestHello(t *testing.T) {
+	// Given
+	configContainer, _, err := newConfigContainer(t, map[string]interface{}{
+		"ProtocolVersion": 2,
+		"Actions":         []string{"hello", "prepare_terraform"},
+		"Features":        []string{},
+		"Success":         true,
+	})
+	if err != nil {
+		t.Fatal("error creating config container:", err)
+	}
+	defer configContainer.Done()
+
+	// When
+	capabilities := configContainer.Capabilities()
+	_, uploadErr := configContainer.UploadRelease(context.Background(), "terraform-image")
+	_, newStateErr := configContainer.PrepareTerraform(context.Background(), "1", "component", "commit", "env", new(bool), nil, nil)
+
+	// Then
+	if capabilities.Legacy || capabilities.ProtocolVersion != 2 || !configContainer.Supports(config.ActionPrepareTerraform) {
+		t.Fatal("unexpected capabilities:", capabilities)
+	}
+	if uploadErr == nil || !strings.Contains(uploadErr.Error(), "does not support the upload_release action") {
+		t.Fatal("expected unsupported action error, got:", uploadErr)
+	}
+	if newStateErr == nil || !strings.Contains(newStateErr.Error(), config.FeatureStateShouldExist) {
+		t.Fatal("expected unsupported feature error, got:", newStateErr)
+	}
+}
+
+func TestHelloLegacy(t *testing.T) {
+	// Given an image that doesn't understand hello
+	configContainer, _, err := newConfigContainer(t, map[string]interface{}{"Success": false})
+	if err != nil {
+		t.Fatal("error creating config container:", err)
+	}
+	defer configContainer.Done()
+
+	// When
+	capabilities := configContainer.Capabilities()
+
+	// Then
+	if !capabilities.Legacy || capabilities.ProtocolVersion != 1 {
+		t.Fatal("expected legacy capabilities, got:", capabilities)
+	}
+	for _, action := range []string{config.ActionSetup, config.ActionConfigureRelease, config.ActionUploadRelease, config.ActionPrepareTerraform} {
+		if !configContainer.Supports(action) {
+			t.Fatal("expected legacy image to support", action)
+		}
+	}
+}
+
+func TestHelloTooOld(t *testing.T) {
+	// When
+	_, dockerClient, err := newConfigContainer(t, map[string]interface{}{
+		"ProtocolVersion": 1,
+		"Success":         true,
+	})
+
+	// Then
+	if err == nil || !strings.Contains(err.Error(), "upgrade the config image") {
+		t.Fatal("expected protocol version error, got:", err)
+	}
+	if containers := dockerClient.Containers(); len(containers) != 0 {
+		t.Fatal("expected config container to be removed, got:", containers)
+	}
+}
+
+func TestHelloErrors(t *testing.T) {
+	for name, hello := range map[string]interface{}{
+		"structured error": map[string]interface{}{
+			"Success": false,
+			"Error":   map[string]interface{}{"Code": "unauthorized", "Message": "no credentials"},
+		},
+		"missing protocol version": map[string]interface{}{"Success": true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// When
+			_, dockerClient, err := newConfigContainer(t, hello)
+
+			// Then
+			if err == nil {
+				t.Fatal("expected error rather than falling back to legacy capabilities")
+			}
+			if containers := dockerClient.Containers(); len(containers) != 0 {
+				t.Fatal("expected config container to be removed, got:", containers)
+			}
+		})
+	}
+}
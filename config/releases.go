@@ -0,0 +1,83 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ReleaseFilter restricts and pages the releases returned by ListReleases.
+type ReleaseFilter struct {
+	// Since only includes releases created at or after this time (if not zero).
+	Since time.Time
+	// Commit only includes releases built from this commit (if set).
+	Commit string
+	// Prefix only includes releases whose version starts with this (if set).
+	Prefix string
+	// Limit is the maximum number of releases to return in a page (the config container's default if zero).
+	Limit int
+	// PageToken continues from a previous page (the NextPageToken from its response).
+	PageToken string
+}
+
+type listReleasesRequest struct {
+	Action    string
+	Component string
+	Config    map[string]interface{}
+	Env       map[string]string
+	Since     string `json:",omitempty"`
+	Commit    string `json:",omitempty"`
+	Prefix    string `json:",omitempty"`
+	Limit     int    `json:",omitempty"`
+	PageToken string `json:",omitempty"`
+}
+
+// Release describes a release returned by ListReleases.
+type Release struct {
+	Version            string
+	Commit             string
+	Created            time.Time
+	TerraformImage     string
+	AdditionalMetadata map[string]string
+}
+
+// ListReleasesResponse contains the response to the list releases request - newest release first.
+type ListReleasesResponse struct {
+	Releases      []*Release
+	NextPageToken string
+	Success       bool
+}
+
+// ListReleases requests a page of the component's releases from the config container.
+func (configContainer *Container) ListReleases(
+	ctx context.Context,
+	component string,
+	config map[string]interface{},
+	env map[string]string,
+	filter *ReleaseFilter,
+) (*ListReleasesResponse, error) {
+	if err := configContainer.requireAction(ActionListReleases); err != nil {
+		return nil, err
+	}
+	request := listReleasesRequest{
+		Action:    ActionListReleases,
+		Component: component,
+		Config:    config,
+		Env:       env,
+		Commit:    filter.Commit,
+		Prefix:    filter.Prefix,
+		Limit:     filter.Limit,
+		PageToken: filter.PageToken,
+	}
+	if !filter.Since.IsZero() {
+		request.Since = filter.Since.UTC().Format(time.RFC3339)
+	}
+	var response ListReleasesResponse
+	if err := configContainer.request(ctx, &request, &response); err != nil {
+		return nil, err
+	}
+	if !response.Success {
+		return nil, errors.New("config container failed to list releases")
+	}
+	return &response, nil
+}
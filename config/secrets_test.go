@@ -0,0 +1,64 @@
+package config_test
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/redact"
+	"github.com/mergermarket/cdflow2/test"
+)
+
+func TestPrepareTerraformSensitiveValues(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	test.HandleFakeConfig(dockerClient, "config-image", func(request map[string]interface{}) interface{} {
+		if request["Action"] == config.ActionHello {
+			// answer hello as a config image that predates it does
+			return map[string]interface{}{"Success": false}
+		}
+		return map[string]interface{}{
+			"TerraformImage": "terraform-image",
+			"Env": map[string]string{
+				"AWS_SECRET_ACCESS_KEY": "secret-access-key",
+				"AWS_REGION":            "eu-west-1",
+			},
+			"SensitiveEnv":    []string{"AWS_SECRET_ACCESS_KEY"},
+			"SensitiveValues": []string{"other-secret"},
+			"TerraformBackendConfigParameters": map[string]interface{}{
+				"bucket": map[string]string{"Value": "state-bucket"},
+				"token":  map[string]string{"Value": "backend-token", "DisplayValue": "token"},
+			},
+			"Success": true,
+		}
+	})
+	dockerClient.AddLocalImage("config-image")
+	secrets := redact.NewSecrets()
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  &bytes.Buffer{},
+		Secrets:      secrets,
+	}
+	configContainer, err := config.NewContainer(context.Background(), state, "config-image", "")
+	if err != nil {
+		t.Fatal("error creating config container:", err)
+	}
+	defer configContainer.Done()
+
+	// When
+	if _, err := configContainer.PrepareTerraform(context.Background(), "1", "component", "commit", "live", nil, nil, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// Then
+	var output bytes.Buffer
+	writer := redact.NewWriter(&output, secrets)
+	writer.Write([]byte("secret-access-key eu-west-1 other-secret state-bucket backend-token\n"))
+	if output.String() != "[redacted] eu-west-1 [redacted] state-bucket [redacted]\n" {
+		t.Fatalf("unexpected output: %q", output.String())
+	}
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mergermarket/cdflow2/docker"
+)
+
+// SessionLabel is the image label a config image sets (to "true") to advertise that `/app session` is supported - a
+// single long running exec that exchanges newline delimited JSON requests and responses (see sessionRequest and
+// sessionResponse), rather than an exec of `/app forward` per request.
+const SessionLabel = "cdflow2.config.session"
+
+// sessionRequest is a line written to the session's stdin.
+type sessionRequest struct {
+	ID      string
+	Request interface{}
+}
+
+// sessionResponse is a line read from the session's stdout, with the ID of the request it is in response to.
+type sessionResponse struct {
+	ID       string
+	Response json.RawMessage
+}
+
+// session is a long running exec in the config container that requests are sent to.
+type session struct {
+	input      *io.PipeWriter
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	nextID     int
+	pending    map[string]chan json.RawMessage
+	err        error
+	done       chan struct{}
+}
+
+// supportsSession returns true if the config image advertises support for session mode.
+func supportsSession(ctx context.Context, dockerClient docker.Iface, image string) (bool, error) {
+	labels, err := dockerClient.GetImageLabels(ctx, image)
+	if err != nil {
+		return false, fmt.Errorf("error inspecting config image: %w", err)
+	}
+	return labels[SessionLabel] == "true", nil
+}
+
+// startSession execs `/app session` in the config container and starts reading responses from it.
+func startSession(dockerClient docker.Iface, id string, errorStream io.Writer) *session {
+	inputReader, inputWriter := io.Pipe()
+	outputReader, outputWriter := io.Pipe()
+	session := &session{
+		input:   inputWriter,
+		pending: make(map[string]chan json.RawMessage),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		// not tied to a request's context since the session lasts as long as the container - it ends when stdin
+		// is closed by close
+		err := dockerClient.Exec(context.Background(), &docker.ExecOptions{
+			ID:           id,
+			Cmd:          []string{"/app", "session"},
+			InputStream:  inputReader,
+			OutputStream: outputWriter,
+			ErrorStream:  errorStream,
+		})
+		if err == nil {
+			err = io.EOF
+		}
+		outputWriter.CloseWithError(err)
+		inputReader.CloseWithError(err)
+	}()
+	go session.readResponses(outputReader)
+	return session
+}
+
+// readResponses reads responses until the session ends, passing each to the request waiting for it.
+func (session *session) readResponses(output io.Reader) {
+	scanner := bufio.NewScanner(output)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var err error
+	for scanner.Scan() {
+		var response sessionResponse
+		if err = json.Unmarshal(scanner.Bytes(), &response); err != nil {
+			err = fmt.Errorf("error decoding response from config container session: %w", err)
+			break
+		}
+		session.mutex.Lock()
+		responseChannel, ok := session.pending[response.ID]
+		delete(session.pending, response.ID)
+		session.mutex.Unlock()
+		if ok {
+			responseChannel <- response.Response
+		}
+	}
+	if err == nil {
+		err = scanner.Err()
+	}
+	if err == nil || err == io.EOF {
+		err = fmt.Errorf("config container session ended")
+	} else {
+		err = fmt.Errorf("config container session ended: %w", err)
+	}
+	session.mutex.Lock()
+	session.err = err
+	session.mutex.Unlock()
+	close(session.done)
+}
+
+// send sends a request and waits for the response with the same ID.
+func (session *session) send(ctx context.Context, request interface{}) (json.RawMessage, error) {
+	responseChannel := make(chan json.RawMessage, 1)
+
+	session.mutex.Lock()
+	if session.err != nil {
+		session.mutex.Unlock()
+		return nil, session.err
+	}
+	session.nextID++
+	id := strconv.Itoa(session.nextID)
+	session.pending[id] = responseChannel
+	session.mutex.Unlock()
+
+	// a separate lock for writing keeps lines from concurrent requests from interleaving, without blocking responses
+	session.writeMutex.Lock()
+	err := json.NewEncoder(session.input).Encode(&sessionRequest{ID: id, Request: request})
+	session.writeMutex.Unlock()
+	if err != nil {
+		session.forget(id)
+		return nil, fmt.Errorf("error sending request to config container session: %w", err)
+	}
+
+	select {
+	case rawResponse := <-responseChannel:
+		return rawResponse, nil
+	case <-session.done:
+		session.forget(id)
+		return nil, session.err
+	case <-ctx.Done():
+		session.forget(id)
+		return nil, ctx.Err()
+	}
+}
+
+func (session *session) forget(id string) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	delete(session.pending, id)
+}
+
+// close ends the session by closing its stdin, giving it a moment to finish before the container is stopped.
+func (session *session) close() {
+	session.input.Close()
+	select {
+	case <-session.done:
+	case <-time.After(2 * time.Second):
+	}
+}
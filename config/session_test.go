@@ -0,0 +1,121 @@
+package config_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/docker/fake"
+)
+
+// handleConfigExecs simulates a config image that supports both `/app forward` and `/app session`, recording the
+// commands exec'd.
+func handleConfigExecs(dockerClient *fake.Client, image string, execs *[]string, mutex *sync.Mutex) {
+	dockerClient.AddLocalImage(image)
+	dockerClient.HandleRun(image, fake.WaitForStop(0))
+	dockerClient.HandleExec(image, func(process *fake.Process) int {
+		mutex.Lock()
+		*execs = append(*execs, process.Cmd[1])
+		mutex.Unlock()
+		respond := func(request map[string]interface{}) interface{} {
+			if request["Action"] == config.ActionHello {
+				// answer hello as a config image that predates it does
+				return map[string]interface{}{"Success": false}
+			}
+			return map[string]interface{}{
+				"Env":     map[string]map[string]string{"release": {"ACTION": request["Action"].(string)}},
+				"Success": true,
+			}
+		}
+		if process.Cmd[1] == "forward" {
+			var request map[string]interface{}
+			if err := json.NewDecoder(process.InputStream).Decode(&request); err != nil {
+				fmt.Fprintln(process.ErrorStream, "error decoding request:", err)
+				return 1
+			}
+			json.NewEncoder(process.OutputStream).Encode(respond(request))
+			return 0
+		}
+		scanner := bufio.NewScanner(process.InputStream)
+		for scanner.Scan() {
+			var line struct {
+				ID      string
+				Request map[string]interface{}
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+				fmt.Fprintln(process.ErrorStream, "error decoding request:", err)
+				return 1
+			}
+			json.NewEncoder(process.OutputStream).Encode(map[string]interface{}{
+				"ID":       line.ID,
+				"Response": respond(line.Request),
+			})
+		}
+		return 0
+	})
+}
+
+func configureReleaseTwice(t *testing.T, dockerClient *fake.Client) {
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  &bytes.Buffer{},
+	}
+	configContainer, err := config.NewContainer(context.Background(), state, "config-image", "")
+	if err != nil {
+		t.Fatal("error creating config container:", err)
+	}
+	for i := 0; i < 2; i++ {
+		response, err := configContainer.ConfigureRelease(context.Background(), "1", "component", "commit", nil, nil, nil)
+		if err != nil {
+			t.Fatal("error configuring release:", err)
+		}
+		if !reflect.DeepEqual(response.Env, map[string]map[string]string{"release": {"ACTION": "configure_release"}}) {
+			t.Fatal("unexpected response:", response.Env)
+		}
+	}
+	if err := configContainer.Done(); err != nil {
+		t.Fatal("error stopping config container:", err)
+	}
+}
+
+func TestSession(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	var execs []string
+	var mutex sync.Mutex
+	handleConfigExecs(dockerClient, "config-image", &execs, &mutex)
+	dockerClient.SetImageLabels("config-image", map[string]string{config.SessionLabel: "true"})
+
+	// When
+	configureReleaseTwice(t, dockerClient)
+
+	// Then
+	if !reflect.DeepEqual(execs, []string{"session"}) {
+		t.Fatal("expected a single session exec, got:", execs)
+	}
+}
+
+func TestSessionFallback(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	var execs []string
+	var mutex sync.Mutex
+	handleConfigExecs(dockerClient, "config-image", &execs, &mutex)
+
+	// When
+	configureReleaseTwice(t, dockerClient)
+
+	// Then
+	// including the hello request
+	if !reflect.DeepEqual(execs, []string{"forward", "forward", "forward"}) {
+		t.Fatal("expected an exec per request, got:", execs)
+	}
+}
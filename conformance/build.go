@@ -0,0 +1,325 @@
+package conformance
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/util"
+)
+
+// buildRun is the outcome of running a build image once.
+type buildRun struct {
+	err error
+	// metadata is the content of /release-metadata.json, or nil if the build didn't write it.
+	metadata []byte
+	// buildMetadata is the content of /build/release-metadata.json, checked for when the build didn't write metadata
+	// where it should.
+	buildMetadata []byte
+	// releaseFiles is true if the build wrote to /release.
+	releaseFiles bool
+}
+
+// CheckBuild checks a build (release) image, adding the results to the report. The build is run against a scratch
+// copy of the code directory (empty unless --code is passed) and a throwaway build volume.
+func CheckBuild(ctx context.Context, state *command.GlobalState, args *CommandArgs, report *Report) (returnedError error) {
+	if !state.GlobalArgs.NoPullRelease {
+		fmt.Fprintf(state.ErrorStream, "\nPulling build image %v...\n\n", args.Image)
+		if err := state.DockerClient.PullImage(ctx, args.Image, state.ErrorStream); err != nil {
+			return fmt.Errorf("error pulling build image: %w", err)
+		}
+	}
+
+	report.Check("requirements", func() error {
+		return checkRequirements(ctx, state, args.Image)
+	})
+
+	codeDir, err := ioutil.TempDir("", "cdflow2-conformance")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(codeDir); err != nil {
+			if returnedError != nil {
+				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+			} else {
+				returnedError = err
+			}
+		}
+	}()
+	if args.CodeDir != "" {
+		if err := copyDir(args.CodeDir, codeDir); err != nil {
+			return fmt.Errorf("error copying %s to scratch code directory: %w", args.CodeDir, err)
+		}
+	}
+	before, err := snapshot(codeDir)
+	if err != nil {
+		return err
+	}
+
+	params := args.Params
+	if params == nil {
+		params = make(map[string]interface{})
+	}
+	manifestParams, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	run, err := runBuild(ctx, state, args.Image, codeDir, string(manifestParams))
+	if err != nil {
+		return err
+	}
+	built := report.Check("build", func() error {
+		return run.err
+	})
+	report.Check("release metadata", func() error {
+		if !built {
+			return skip("build failed")
+		}
+		return checkMetadata(run)
+	})
+	report.Check("no params", func() error {
+		if !built {
+			return skip("build failed")
+		}
+		// cdflow2 sends null when the build has no params in cdflow.yaml
+		run, err := runBuild(ctx, state, args.Image, codeDir, "null")
+		if err != nil {
+			return err
+		}
+		if run.err != nil {
+			return fmt.Errorf("build with MANIFEST_PARAMS=null (sent when there are no params) failed: %w", run.err)
+		}
+		return checkMetadata(run)
+	})
+	report.Check("code directory unchanged", func() error {
+		after, err := snapshot(codeDir)
+		if err != nil {
+			return err
+		}
+		if changes := compareSnapshots(before, after); len(changes) != 0 {
+			return fmt.Errorf("the build changed %s - /code is read only in a release (save files to /build)", strings.Join(changes, ", "))
+		}
+		return nil
+	})
+	report.Check("no files in /release", func() error {
+		if run.releaseFiles {
+			return errors.New("the build wrote to /release, which isn't saved (save files to /build)")
+		}
+		return nil
+	})
+	return nil
+}
+
+// checkRequirements checks the requirements command writes a single JSON object with a Needs list of strings.
+func checkRequirements(ctx context.Context, state *command.GlobalState, image string) error {
+	var output bytes.Buffer
+	if err := state.DockerClient.Run(ctx, &docker.RunOptions{
+		Image:        image,
+		OutputStream: &output,
+		ErrorStream:  state.ErrorStream,
+		NamePrefix:   "cdflow2-release-requirements",
+		Cmd:          []string{"requirements"},
+	}); err != nil {
+		return fmt.Errorf("error running requirements: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(output.Bytes()))
+	var requirements struct {
+		Needs *[]string
+	}
+	if err := decoder.Decode(&requirements); err != nil {
+		return fmt.Errorf("expected a JSON object with Needs (e.g. {\"Needs\": []}) on stdout, got %q: %v", output.String(), err)
+	}
+	if requirements.Needs == nil {
+		return fmt.Errorf("expected Needs in requirements (e.g. {\"Needs\": []}), got %q", output.String())
+	}
+	if decoder.More() {
+		return fmt.Errorf("expected only the requirements JSON on stdout, got %q", output.String())
+	}
+	return nil
+}
+
+// runBuild runs the build as a release would, except that the code directory is writable so changes can be detected.
+func runBuild(ctx context.Context, state *command.GlobalState, image, codeDir, manifestParams string) (_ *buildRun, returnedError error) {
+	dockerClient := state.DockerClient
+	buildVolume, err := dockerClient.CreateVolume(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dockerClient.RemoveVolume(context.Background(), buildVolume); err != nil {
+			if returnedError != nil {
+				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+			} else {
+				returnedError = err
+			}
+		}
+	}()
+
+	var result buildRun
+	result.err = dockerClient.Run(ctx, &docker.RunOptions{
+		Image:        image,
+		OutputStream: state.OutputStream,
+		ErrorStream:  state.ErrorStream,
+		WorkingDir:   "/code",
+		Env: []string{
+			"BUILD_ID=" + conformanceBuildID,
+			"COMMIT=conformance",
+			"COMPONENT=" + state.Component,
+			"MANIFEST_PARAMS=" + manifestParams,
+			"VERSION=" + util.RandomName("conformance"),
+			"CDFLOW2_CODE_DIR=" + codeDir,
+		},
+		Binds: []string{
+			codeDir + ":/code",
+			buildVolume + ":/build",
+		},
+		NamePrefix: "cdflow2-release",
+		BeforeRemove: func(id string) error {
+			result.metadata, _ = readContainerFile(ctx, dockerClient, id, "/release-metadata.json")
+			if result.metadata == nil {
+				result.buildMetadata, _ = readContainerFile(ctx, dockerClient, id, "/build/release-metadata.json")
+			}
+			reader, err := dockerClient.CopyFromContainer(ctx, id, "/release")
+			if err == nil {
+				reader.Close()
+				result.releaseFiles = true
+			}
+			return nil
+		},
+	})
+	if errors.Is(result.err, context.Canceled) {
+		return nil, result.err
+	}
+	return &result, nil
+}
+
+func readContainerFile(ctx context.Context, dockerClient docker.Iface, id, filename string) ([]byte, error) {
+	reader, err := dockerClient.CopyFromContainer(ctx, id, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	tarReader := tar.NewReader(reader)
+	if _, err := tarReader.Next(); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(tarReader)
+}
+
+// checkMetadata checks the build wrote /release-metadata.json as a JSON object with string values.
+func checkMetadata(run *buildRun) error {
+	if run.metadata == nil {
+		if run.buildMetadata != nil {
+			return errors.New("release-metadata.json was written to /build rather than / (i.e. /release-metadata.json)")
+		}
+		return errors.New("no /release-metadata.json written")
+	}
+	var metadata map[string]interface{}
+	if err := json.Unmarshal(run.metadata, &metadata); err != nil || metadata == nil {
+		return fmt.Errorf("/release-metadata.json must be a JSON object, got %q", string(run.metadata))
+	}
+	var invalid []string
+	for key, value := range metadata {
+		if _, ok := value.(string); !ok {
+			invalid = append(invalid, key)
+		}
+	}
+	if len(invalid) != 0 {
+		sort.Strings(invalid)
+		return fmt.Errorf("/release-metadata.json must map keys to strings (it's passed to terraform as a map(string)), but these aren't strings: %s", strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// copyDir copies the files in source to target.
+func copyDir(source, target string) error {
+	return filepath.Walk(source, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(source, name)
+		if err != nil {
+			return err
+		}
+		destination := filepath.Join(target, relative)
+		if info.IsDir() {
+			return os.MkdirAll(destination, info.Mode()|0700)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		input, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer input.Close()
+		output, err := os.OpenFile(destination, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(output, input); err != nil {
+			output.Close()
+			return err
+		}
+		return output.Close()
+	})
+}
+
+// snapshot returns a hash of each file in dir (and an empty string for each directory), keyed by relative path.
+func snapshot(dir string) (map[string]string, error) {
+	result := make(map[string]string)
+	err := filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(dir, name)
+		if err != nil || relative == "." {
+			return err
+		}
+		if info.IsDir() {
+			result[relative] = ""
+			return nil
+		}
+		content, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(content)
+		result[relative] = hex.EncodeToString(hash[:])
+		return nil
+	})
+	return result, err
+}
+
+// compareSnapshots describes the files added, changed or removed between two snapshots.
+func compareSnapshots(before, after map[string]string) []string {
+	var result []string
+	for name, hash := range after {
+		if previous, ok := before[name]; !ok {
+			result = append(result, "added "+name)
+		} else if previous != hash {
+			result = append(result, "changed "+name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			result = append(result, "removed "+name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
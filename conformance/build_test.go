@@ -0,0 +1,87 @@
+package conformance_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/conformance"
+	"github.com/mergermarket/cdflow2/docker/fake"
+)
+
+func TestConformanceBuild(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	dockerClient.AddImage("build-image")
+	dockerClient.HandleRun("build-image", func(process *fake.Process) int {
+		if len(process.Cmd) == 1 && process.Cmd[0] == "requirements" {
+			fmt.Fprintln(process.OutputStream, `{"Needs": []}`)
+			return 0
+		}
+		process.Container.WriteFile("/build/app.zip", []byte("app"))
+		process.Container.WriteFile("/release-metadata.json", []byte(`{"version": "`+process.Env["VERSION"]+`"}`))
+		return 0
+	})
+	var output bytes.Buffer
+	args, err := conformance.ParseArgs([]string{"build", "build-image", "--param", "a=b"})
+	if err != nil {
+		t.Fatal("unexpected error parsing args:", err)
+	}
+
+	// When
+	err = conformance.RunCommand(context.Background(), createState(dockerClient, &output), args, map[string]string{})
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err, output.String())
+	}
+	if !strings.Contains(output.String(), "6 passed, 0 failed, 0 skipped\n") {
+		t.Fatal("unexpected report:", output.String())
+	}
+}
+
+func TestConformanceBuildFailures(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	dockerClient.AddImage("build-image")
+	dockerClient.HandleRun("build-image", func(process *fake.Process) int {
+		if len(process.Cmd) == 1 && process.Cmd[0] == "requirements" {
+			fmt.Fprintln(process.OutputStream, `["docker"]`)
+			return 0
+		}
+		if process.Env["MANIFEST_PARAMS"] == "null" {
+			return 1
+		}
+		process.Container.WriteFile("/code/output.txt", []byte("oops"))
+		process.Container.WriteFile("/release/app.zip", []byte("app"))
+		process.Container.WriteFile("/release-metadata.json", []byte(`{"version": "1", "count": 2}`))
+		return 0
+	})
+	var output bytes.Buffer
+
+	// When
+	err := conformance.RunCommand(context.Background(), createState(dockerClient, &output), &conformance.CommandArgs{
+		Kind:  "build",
+		Image: "build-image",
+	}, map[string]string{})
+
+	// Then
+	if err != command.Failure(1) {
+		t.Fatal("expected failure, got:", err)
+	}
+	for _, expected := range []string{
+		"FAIL  requirements - expected a JSON object with Needs",
+		"PASS  build\n",
+		"FAIL  release metadata - /release-metadata.json must map keys to strings (it's passed to terraform as a map(string)), but these aren't strings: count\n",
+		"FAIL  no params - build with MANIFEST_PARAMS=null",
+		"FAIL  code directory unchanged - the build changed added output.txt",
+		"FAIL  no files in /release",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Fatalf("expected %q in report, got:\n%s", expected, output.String())
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package conformance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/manifest"
+)
+
+// DefaultEnvName is the environment name sent in requests that need one, unless --env is passed.
+const DefaultEnvName = "conformance"
+
+// DefaultComponent is the component name sent in requests, unless the --component global option is passed.
+const DefaultComponent = "cdflow2-conformance"
+
+// DefaultTerraformImage is the terraform image recorded in the release uploaded by the config checks - it isn't
+// pulled or run.
+const DefaultTerraformImage = "hashicorp/terraform:latest"
+
+// CommandArgs contains specific arguments to the conformance command.
+type CommandArgs struct {
+	// Kind is the kind of image being tested - "config" or "build".
+	Kind           string
+	Image          string
+	Params         map[string]interface{}
+	EnvName        string
+	TerraformImage string
+	// CodeDir is copied to the scratch code directory builds are run against.
+	CodeDir string
+}
+
+// ParseArgs parses command line arguments to the conformance subcommand.
+func ParseArgs(args []string) (*CommandArgs, error) {
+	if len(args) < 2 {
+		return nil, errors.New("expected conformance config IMAGE or conformance build IMAGE")
+	}
+	// options that only apply to one kind of image
+	options := map[string]string{"--env": "config", "--terraform-image": "config", "--code": "build"}
+	if args[0] != "config" && args[0] != "build" {
+		return nil, fmt.Errorf("unknown kind of image %q (expected config or build)", args[0])
+	}
+	result := CommandArgs{
+		Kind:           args[0],
+		Image:          args[1],
+		Params:         make(map[string]interface{}),
+		EnvName:        DefaultEnvName,
+		TerraformImage: DefaultTerraformImage,
+	}
+	for i := 2; i < len(args); i++ {
+		arg := args[i]
+		name, value, hasValue := arg, "", false
+		if index := strings.Index(arg, "="); index != -1 && strings.HasPrefix(arg, "--") {
+			name, value, hasValue = arg[:index], arg[index+1:], true
+		}
+		if kind, ok := options[name]; name != "--param" && (!ok || kind != result.Kind) {
+			return nil, fmt.Errorf("Unknown conformance %s option: %s", result.Kind, arg)
+		}
+		if !hasValue {
+			i++
+			if i >= len(args) {
+				return nil, errors.New("missing value for " + name)
+			}
+			value = args[i]
+		}
+		switch name {
+		case "--param":
+			parts := strings.SplitN(value, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return nil, fmt.Errorf("invalid --param %q (expected KEY=VALUE)", value)
+			}
+			result.Params[parts[0]] = parts[1]
+		case "--env":
+			result.EnvName = value
+		case "--terraform-image":
+			result.TerraformImage = value
+		case "--code":
+			result.CodeDir = value
+		}
+	}
+	if manifest.IsBuiltinImage(result.Image) {
+		return nil, fmt.Errorf("%s is built into cdflow2 rather than a docker image, so can't be tested", result.Image)
+	}
+	return &result, nil
+}
+
+// RunCommand runs the conformance command, checking an image follows the protocol cdflow2 uses to talk to it and
+// printing a report - it fails if any check fails.
+func RunCommand(ctx context.Context, state *command.GlobalState, args *CommandArgs, env map[string]string) error {
+	if state.Component == "" {
+		state.Component = DefaultComponent
+	}
+	report := &Report{Image: args.Image}
+	if args.Kind == "build" {
+		if err := CheckBuild(ctx, state, args, report); err != nil {
+			return err
+		}
+	} else if err := CheckConfig(ctx, state, args, env, report); err != nil {
+		return err
+	}
+	if err := report.Write(state.OutputStream); err != nil {
+		return err
+	}
+	if report.Failed() {
+		return command.Failure(1)
+	}
+	return nil
+}
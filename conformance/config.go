@@ -0,0 +1,344 @@
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/util"
+)
+
+// conformanceBuildID is the build the release is configured for.
+const conformanceBuildID = "release"
+
+// configChecker drives a config image through the protocol, remembering what earlier checks established for later
+// ones - e.g. the version of the release uploaded.
+type configChecker struct {
+	state           *command.GlobalState
+	args            *CommandArgs
+	env             map[string]string
+	report          *Report
+	version         string
+	commit          string
+	releaseMetadata []byte
+	uploaded        bool
+}
+
+// responseStatus is the part of every response checked for all actions.
+type responseStatus struct {
+	Success *bool
+	Error   *config.ResponseError
+}
+
+// checkStatus checks a response is a JSON object with a Success field (and a well formed Error if it has one), and
+// returns whether it succeeded.
+func checkStatus(rawResponse []byte) (bool, error) {
+	var status responseStatus
+	if err := json.Unmarshal(rawResponse, &status); err != nil {
+		return false, fmt.Errorf("invalid response %q: %w", string(rawResponse), err)
+	}
+	if status.Success == nil {
+		return false, fmt.Errorf("response has no Success field: %s", rawResponse)
+	}
+	if status.Error != nil && (status.Error.Code == "" || status.Error.Message == "") {
+		return false, fmt.Errorf("Error in response must have a Code and Message: %s", rawResponse)
+	}
+	return *status.Success, nil
+}
+
+// send sends a request and checks the response succeeded, decoding it into response.
+func send(ctx context.Context, configContainer *config.Container, request map[string]interface{}, response interface{}) error {
+	rawResponse, err := configContainer.Send(ctx, request)
+	if err != nil {
+		return fmt.Errorf("no response: %w", err)
+	}
+	success, err := checkStatus(rawResponse)
+	if err != nil {
+		return err
+	}
+	if !success {
+		return fmt.Errorf("%s failed: %s", request["Action"], rawResponse)
+	}
+	if err := json.Unmarshal(rawResponse, response); err != nil {
+		return fmt.Errorf("unexpected response to %s: %w", request["Action"], err)
+	}
+	return nil
+}
+
+// expectFailure sends a request that should fail, checking the structured error has the expected code if there is one
+// (and code is set).
+func expectFailure(ctx context.Context, configContainer *config.Container, request map[string]interface{}, code string) error {
+	rawResponse, err := configContainer.Send(ctx, request)
+	if err != nil {
+		return fmt.Errorf("no response (expected a response with Success set to false): %w", err)
+	}
+	success, err := checkStatus(rawResponse)
+	if err != nil {
+		return err
+	}
+	if success {
+		return fmt.Errorf("expected %s to fail, got: %s", request["Action"], rawResponse)
+	}
+	var status responseStatus
+	json.Unmarshal(rawResponse, &status)
+	if code != "" && status.Error != nil && status.Error.Code != code {
+		return fmt.Errorf("expected error code %s, got %s", code, status.Error.Code)
+	}
+	return nil
+}
+
+// CheckConfig checks a config image, adding the results to the report. A release with a random version is configured
+// and uploaded using the image's params and credentials, so should be run against a test account.
+func CheckConfig(ctx context.Context, state *command.GlobalState, args *CommandArgs, env map[string]string, report *Report) error {
+	if !state.GlobalArgs.NoPullConfig {
+		fmt.Fprintf(state.ErrorStream, "\nPulling config image %v...\n\n", args.Image)
+		if err := state.DockerClient.PullImage(ctx, args.Image, state.ErrorStream); err != nil {
+			return fmt.Errorf("error pulling config image: %w", err)
+		}
+	}
+	checker := &configChecker{
+		state:   state,
+		args:    args,
+		env:     env,
+		report:  report,
+		version: util.RandomName("conformance"),
+		commit:  state.Commit,
+	}
+	if checker.commit == "" {
+		checker.commit = "conformance"
+	}
+	for _, phase := range []func(context.Context) error{checker.checkHello, checker.checkRelease, checker.checkPrepareTerraform} {
+		if err := phase(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withContainer starts a config container, with a throwaway release volume if withVolume is set, and calls use with it.
+func (checker *configChecker) withContainer(ctx context.Context, withVolume bool, use func(*config.Container)) (returnedError error) {
+	dockerClient := checker.state.DockerClient
+	var volume string
+	if withVolume {
+		var err error
+		volume, err = dockerClient.CreateVolume(ctx, "")
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := dockerClient.RemoveVolume(context.Background(), volume); err != nil {
+				if returnedError != nil {
+					returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+				} else {
+					returnedError = err
+				}
+			}
+		}()
+	}
+	configContainer, err := config.NewContainer(ctx, checker.state, checker.args.Image, volume)
+	if err != nil {
+		return fmt.Errorf("error starting config container: %w", err)
+	}
+	use(configContainer)
+	if err := configContainer.Done(); err != nil {
+		return fmt.Errorf("config container exited with an error: %w", err)
+	}
+	return nil
+}
+
+func (checker *configChecker) checkHello(ctx context.Context) error {
+	return checker.withContainer(ctx, false, func(configContainer *config.Container) {
+		legacy := configContainer.Capabilities().Legacy
+		checker.report.Check("hello", func() error {
+			rawResponse, err := configContainer.Send(ctx, map[string]interface{}{
+				"Action":          config.ActionHello,
+				"ProtocolVersion": config.ProtocolVersion,
+			})
+			if err != nil || legacy {
+				return skip("the image doesn't understand hello, so is assumed to speak protocol version 1")
+			}
+			var response struct {
+				ProtocolVersion int
+				Actions         []string
+				Features        []string
+			}
+			if _, err := checkStatus(rawResponse); err != nil {
+				return err
+			}
+			if err := json.Unmarshal(rawResponse, &response); err != nil {
+				return fmt.Errorf("unexpected response to hello: %w", err)
+			}
+			if response.ProtocolVersion < config.MinimumProtocolVersion {
+				return fmt.Errorf("ProtocolVersion %d is older than the minimum supported (%d)", response.ProtocolVersion, config.MinimumProtocolVersion)
+			}
+			var missing []string
+			for _, action := range []string{config.ActionHello, config.ActionConfigureRelease, config.ActionUploadRelease, config.ActionPrepareTerraform} {
+				if !configContainer.Supports(action) {
+					missing = append(missing, action)
+				}
+			}
+			if len(missing) != 0 {
+				return fmt.Errorf("Actions doesn't include %s, which cdflow2 needs to release and deploy", strings.Join(missing, ", "))
+			}
+			return nil
+		})
+		checker.report.Check("unknown action", func() error {
+			if legacy {
+				return skip("only required of images that understand hello")
+			}
+			// so that newer versions of cdflow2 can find out what isn't supported
+			return expectFailure(ctx, configContainer, map[string]interface{}{"Action": "cdflow2_conformance_unknown_action"}, "")
+		})
+	})
+}
+
+// checkRelease configures and uploads a release in the same container, since config containers are expected to keep
+// what they need from configure_release in memory for upload_release.
+func (checker *configChecker) checkRelease(ctx context.Context) error {
+	return checker.withContainer(ctx, true, func(configContainer *config.Container) {
+		configured := checker.report.Check(config.ActionConfigureRelease, func() error {
+			var response struct {
+				Env                map[string]map[string]string
+				AdditionalMetadata map[string]string
+			}
+			if err := send(ctx, configContainer, map[string]interface{}{
+				"Action":              config.ActionConfigureRelease,
+				"Version":             checker.version,
+				"Component":           checker.state.Component,
+				"Commit":              checker.commit,
+				"Config":              checker.args.Params,
+				"Env":                 checker.env,
+				"ReleaseRequirements": map[string]*config.ReleaseRequirements{conformanceBuildID: {Needs: []string{}}},
+			}, &response); err != nil {
+				return err
+			}
+			if response.Env[conformanceBuildID] == nil {
+				return fmt.Errorf("Env must have an entry for each build in ReleaseRequirements (%s), since cdflow2 adds to it", conformanceBuildID)
+			}
+			return nil
+		})
+		checker.uploaded = checker.report.Check(config.ActionUploadRelease, func() error {
+			if !configured {
+				return skip("%s failed", config.ActionConfigureRelease)
+			}
+			releaseMetadata := map[string]map[string]string{
+				"release": {"version": checker.version, "commit": checker.commit, "component": checker.state.Component},
+			}
+			encoded, err := json.Marshal(releaseMetadata)
+			if err != nil {
+				return err
+			}
+			checker.releaseMetadata = encoded
+			if err := configContainer.WriteReleaseMetadata(ctx, releaseMetadata); err != nil {
+				return fmt.Errorf("error writing release metadata to /release: %w", err)
+			}
+			var response struct {
+				Message string
+			}
+			return send(ctx, configContainer, map[string]interface{}{
+				"Action":         config.ActionUploadRelease,
+				"TerraformImage": checker.args.TerraformImage,
+			}, &response)
+		})
+	})
+}
+
+func (checker *configChecker) prepareTerraformRequest(version, envName string) map[string]interface{} {
+	return map[string]interface{}{
+		"Action":    config.ActionPrepareTerraform,
+		"Version":   version,
+		"Component": checker.state.Component,
+		"Commit":    checker.commit,
+		"Config":    checker.args.Params,
+		"Env":       checker.env,
+		"EnvName":   envName,
+	}
+}
+
+// checkPrepareTerraform checks the uploaded release is downloaded to /release, and how missing releases and state
+// are handled - each in a fresh container.
+func (checker *configChecker) checkPrepareTerraform(ctx context.Context) error {
+	if err := checker.withContainer(ctx, true, func(configContainer *config.Container) {
+		checker.report.Check(config.ActionPrepareTerraform, func() error {
+			if !checker.uploaded {
+				return skip("%s failed", config.ActionUploadRelease)
+			}
+			var response struct {
+				TerraformImage                   string
+				Env                              map[string]string
+				TerraformBackendType             string
+				TerraformBackendConfig           map[string]string
+				TerraformBackendConfigParameters map[string]*config.TerrafromBackendConfigParameter
+			}
+			if err := send(ctx, configContainer, checker.prepareTerraformRequest(checker.version, checker.args.EnvName), &response); err != nil {
+				return err
+			}
+			if response.TerraformImage != checker.args.TerraformImage {
+				return fmt.Errorf("expected TerraformImage %s (as uploaded), got %q", checker.args.TerraformImage, response.TerraformImage)
+			}
+			if response.TerraformBackendType == "" {
+				return errors.New("no TerraformBackendType")
+			}
+			releaseMetadata, err := configContainer.ReadReleaseFile(ctx, "release-metadata.json")
+			if err != nil || !bytes.Equal(releaseMetadata, checker.releaseMetadata) {
+				return fmt.Errorf("expected the release to be downloaded to /release (release-metadata.json not found or different)")
+			}
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+	if err := checker.withContainer(ctx, true, func(configContainer *config.Container) {
+		checker.report.Check(config.ActionPrepareTerraform+" (missing release)", func() error {
+			return expectFailure(ctx, configContainer, checker.prepareTerraformRequest(checker.version+"-missing", checker.args.EnvName), config.ErrorCodeNotFound)
+		})
+	}); err != nil {
+		return err
+	}
+	if err := checker.withContainer(ctx, true, func(configContainer *config.Container) {
+		checker.report.Check(config.FeatureStateShouldExist, func() error {
+			if !configContainer.Capabilities().Features[config.FeatureStateShouldExist] {
+				return skip("feature not supported")
+			}
+			if !checker.uploaded {
+				return skip("%s failed", config.ActionUploadRelease)
+			}
+			request := checker.prepareTerraformRequest(checker.version, util.RandomName("conformance"))
+			request["StateShouldExist"] = true
+			return expectFailure(ctx, configContainer, request, config.ErrorCodeNotFound)
+		})
+	}); err != nil {
+		return err
+	}
+	return checker.withContainer(ctx, false, func(configContainer *config.Container) {
+		checker.report.Check(config.ActionListReleases, func() error {
+			if !configContainer.Supports(config.ActionListReleases) {
+				return skip("action not supported")
+			}
+			if !checker.uploaded {
+				return skip("%s failed", config.ActionUploadRelease)
+			}
+			var response config.ListReleasesResponse
+			if err := send(ctx, configContainer, map[string]interface{}{
+				"Action":    config.ActionListReleases,
+				"Component": checker.state.Component,
+				"Config":    checker.args.Params,
+				"Env":       checker.env,
+				"Prefix":    checker.version,
+			}, &response); err != nil {
+				return err
+			}
+			for _, release := range response.Releases {
+				if release.Version == checker.version {
+					return nil
+				}
+			}
+			return fmt.Errorf("the uploaded release %s wasn't listed", checker.version)
+		})
+	})
+}
@@ -0,0 +1,154 @@
+package conformance_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/conformance"
+	"github.com/mergermarket/cdflow2/docker/fake"
+)
+
+// handleFakeConfig simulates a config image that stores releases in memory, with breakConfigureRelease omitting the
+// build's Env from the configure_release response.
+func handleFakeConfig(dockerClient *fake.Client, breakConfigureRelease bool) {
+	var mutex sync.Mutex
+	releases := make(map[string]map[string][]byte)
+	configured := make(map[string]string) // container ID to version
+	dockerClient.AddImage("config-image")
+	dockerClient.HandleRun("config-image", fake.WaitForStop(0))
+	dockerClient.HandleExec("config-image", func(process *fake.Process) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		var request map[string]interface{}
+		if err := json.NewDecoder(process.InputStream).Decode(&request); err != nil {
+			return 1
+		}
+		var response interface{}
+		switch request["Action"] {
+		case config.ActionHello:
+			response = map[string]interface{}{
+				"ProtocolVersion": config.ProtocolVersion,
+				"Actions":         []string{config.ActionHello, config.ActionConfigureRelease, config.ActionUploadRelease, config.ActionPrepareTerraform},
+				"Features":        []string{config.FeatureStateShouldExist},
+				"Success":         true,
+			}
+		case config.ActionConfigureRelease:
+			configured[process.Container.ID] = request["Version"].(string)
+			env := map[string]map[string]string{"release": {}}
+			if breakConfigureRelease {
+				env = nil
+			}
+			response = map[string]interface{}{"Env": env, "Success": true}
+		case config.ActionUploadRelease:
+			files := process.Container.Files("/release")
+			files["terraform-image"] = []byte(request["TerraformImage"].(string))
+			releases[configured[process.Container.ID]] = files
+			response = map[string]interface{}{"Message": "uploaded", "Success": true}
+		case config.ActionPrepareTerraform:
+			files, ok := releases[request["Version"].(string)]
+			if !ok || request["StateShouldExist"] == true {
+				response = map[string]interface{}{"Success": false, "Error": map[string]string{"Code": config.ErrorCodeNotFound, "Message": "not found"}}
+				break
+			}
+			for name, content := range files {
+				process.Container.WriteFile("/release/"+name, content)
+			}
+			response = map[string]interface{}{
+				"TerraformImage":       string(files["terraform-image"]),
+				"TerraformBackendType": "s3",
+				"Success":              true,
+			}
+		default:
+			response = map[string]interface{}{"Success": false}
+		}
+		json.NewEncoder(process.OutputStream).Encode(response)
+		return 0
+	})
+}
+
+func createState(dockerClient *fake.Client, output *bytes.Buffer) *command.GlobalState {
+	return &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: output,
+		ErrorStream:  &bytes.Buffer{},
+		GlobalArgs:   &command.GlobalArgs{},
+	}
+}
+
+func TestConformanceConfig(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	handleFakeConfig(dockerClient, false)
+	var output bytes.Buffer
+	args, err := conformance.ParseArgs([]string{"config", "config-image", "--param", "account=test"})
+	if err != nil {
+		t.Fatal("unexpected error parsing args:", err)
+	}
+
+	// When
+	err = conformance.RunCommand(context.Background(), createState(dockerClient, &output), args, map[string]string{})
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err, output.String())
+	}
+	for _, expected := range []string{
+		"PASS  hello\n",
+		"PASS  unknown action\n",
+		"PASS  upload_release\n",
+		"PASS  prepare_terraform\n",
+		"PASS  prepare_terraform (missing release)\n",
+		"PASS  state_should_exist\n",
+		"SKIP  list_releases - action not supported\n",
+		"7 passed, 0 failed, 1 skipped\n",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Fatalf("expected %q in report, got:\n%s", expected, output.String())
+		}
+	}
+}
+
+func TestConformanceConfigFailure(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	handleFakeConfig(dockerClient, true)
+	var output bytes.Buffer
+
+	// When
+	err := conformance.RunCommand(context.Background(), createState(dockerClient, &output), &conformance.CommandArgs{
+		Kind:           "config",
+		Image:          "config-image",
+		EnvName:        conformance.DefaultEnvName,
+		TerraformImage: conformance.DefaultTerraformImage,
+	}, map[string]string{})
+
+	// Then
+	if err != command.Failure(1) {
+		t.Fatal("expected failure, got:", err)
+	}
+	if !strings.Contains(output.String(), "FAIL  configure_release - Env must have an entry for each build") ||
+		!strings.Contains(output.String(), "SKIP  upload_release - configure_release failed") {
+		t.Fatal("unexpected report:", output.String())
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	args, err := conformance.ParseArgs([]string{"config", "config-image", "--param=a=b", "--env", "ci", "--terraform-image", "tf"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if args.Params["a"] != "b" || args.EnvName != "ci" || args.TerraformImage != "tf" {
+		t.Fatalf("unexpected args: %+v", args)
+	}
+	for _, invalid := range [][]string{{}, {"config"}, {"other", "image"}, {"config", "builtin:local"}, {"config", "image", "--param", "x"}} {
+		if _, err := conformance.ParseArgs(invalid); err == nil {
+			t.Fatal("expected error for", invalid)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package conformance
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Outcomes of a check.
+const (
+	Pass = "PASS"
+	Fail = "FAIL"
+	Skip = "SKIP"
+)
+
+// Result is the outcome of a single check.
+type Result struct {
+	Name    string
+	Outcome string
+	// Detail explains a failure or skip.
+	Detail string
+}
+
+// Report collects the results of the checks run against an image.
+type Report struct {
+	Image   string
+	Results []Result
+}
+
+// skipError is returned from a check that can't run (e.g. the image doesn't support an optional action).
+type skipError struct {
+	reason string
+}
+
+func (err *skipError) Error() string {
+	return err.reason
+}
+
+// skip returns an error that marks a check as skipped rather than failed.
+func skip(format string, args ...interface{}) error {
+	return &skipError{fmt.Sprintf(format, args...)}
+}
+
+// Check runs a check and records its result, returning true if it passed.
+func (report *Report) Check(name string, check func() error) bool {
+	err := check()
+	var skipped *skipError
+	if errors.As(err, &skipped) {
+		report.Results = append(report.Results, Result{Name: name, Outcome: Skip, Detail: skipped.reason})
+		return false
+	} else if err != nil {
+		report.Results = append(report.Results, Result{Name: name, Outcome: Fail, Detail: err.Error()})
+		return false
+	}
+	report.Results = append(report.Results, Result{Name: name, Outcome: Pass})
+	return true
+}
+
+// Failed returns true if any check failed.
+func (report *Report) Failed() bool {
+	for _, result := range report.Results {
+		if result.Outcome == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes the report in a human readable form.
+func (report *Report) Write(output io.Writer) error {
+	if _, err := fmt.Fprintf(output, "\nConformance report for %s:\n\n", report.Image); err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	for _, result := range report.Results {
+		counts[result.Outcome]++
+		line := fmt.Sprintf("  %s  %s", result.Outcome, result.Name)
+		if result.Detail != "" {
+			line += " - " + result.Detail
+		}
+		if _, err := fmt.Fprintln(output, line); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(output, "\n%d passed, %d failed, %d skipped\n", counts[Pass], counts[Fail], counts[Skip])
+	return err
+}
@@ -0,0 +1,176 @@
+// Package credentials keeps the credentials terraform is run with fresh during long runs, asking the config container
+// for new ones before they expire.
+package credentials
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/terraform"
+	"github.com/mergermarket/cdflow2/util"
+)
+
+// RefreshMargin is how long before credentials expire they're refreshed - or half the remaining time if that's less.
+const RefreshMargin = 5 * time.Minute
+
+// retryInterval is how long to wait before trying again when refreshing credentials fails.
+const retryInterval = time.Minute
+
+var errUnsupported = errors.New("refresh_credentials not supported")
+
+// Refresher keeps the credentials for a terraform container fresh.
+type Refresher struct {
+	mutex              sync.Mutex
+	env                map[string]string
+	state              *command.GlobalState
+	terraformContainer *terraform.Container
+	envName            string
+	version            string
+	commandEnv         map[string]string
+	cancel             func()
+	done               chan struct{}
+}
+
+// Start writes the credential files from prepare_terraform to the terraform container and, if the credentials expire,
+// starts refreshing them in the background until Stop is called, since long runs can outlast the credentials from the
+// config container. env is the environment of the cdflow2 process, sent to the config container.
+func Start(
+	ctx context.Context,
+	state *command.GlobalState,
+	terraformContainer *terraform.Container,
+	prepareTerraformResponse *config.PrepareTerraformResponse,
+	envName, version string,
+	env map[string]string,
+) (*Refresher, error) {
+	refresher := &Refresher{
+		env:                prepareTerraformResponse.Env,
+		state:              state,
+		terraformContainer: terraformContainer,
+		envName:            envName,
+		version:            version,
+		commandEnv:         env,
+		done:               make(chan struct{}),
+	}
+	if len(prepareTerraformResponse.CredentialFiles) != 0 {
+		if err := terraformContainer.WriteFiles(ctx, config.CredentialsDir, prepareTerraformResponse.CredentialFiles); err != nil {
+			return nil, fmt.Errorf("error writing credential files: %w", err)
+		}
+	}
+	if prepareTerraformResponse.CredentialsExpire.IsZero() {
+		close(refresher.done)
+		refresher.cancel = func() {}
+		return refresher, nil
+	}
+	// not tied to ctx, since Stop must be able to wait for it
+	refreshCtx, cancel := context.WithCancel(context.Background())
+	refresher.cancel = cancel
+	go refresher.run(refreshCtx, prepareTerraformResponse.CredentialsExpire)
+	return refresher, nil
+}
+
+// Env returns the environment to run terraform commands with - the latest credentials.
+func (refresher *Refresher) Env() map[string]string {
+	refresher.mutex.Lock()
+	defer refresher.mutex.Unlock()
+	result := make(map[string]string, len(refresher.env))
+	for key, value := range refresher.env {
+		result[key] = value
+	}
+	return result
+}
+
+// Stop stops refreshing credentials, waiting for any refresh in progress to be cancelled.
+func (refresher *Refresher) Stop() {
+	refresher.cancel()
+	<-refresher.done
+}
+
+// refreshAt returns when to refresh credentials that expire at expires.
+func refreshAt(now, expires time.Time) time.Time {
+	remaining := expires.Sub(now)
+	if remaining < 2*RefreshMargin {
+		return now.Add(remaining / 2)
+	}
+	return expires.Add(-RefreshMargin)
+}
+
+func (refresher *Refresher) run(ctx context.Context, expires time.Time) {
+	defer close(refresher.done)
+	next := refreshAt(time.Now(), expires)
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		response, err := refresher.refresh(ctx)
+		if ctx.Err() != nil {
+			return
+		} else if errors.Is(err, errUnsupported) {
+			fmt.Fprintf(
+				refresher.state.ErrorStream, "\n%s\n",
+				util.FormatInfo(fmt.Sprintf("config image %s does not support refreshing credentials, which expire at %s", refresher.state.Manifest.Config.Image, expires.UTC().Format(time.RFC3339))),
+			)
+			return
+		} else if err != nil {
+			fmt.Fprintf(refresher.state.ErrorStream, "\n%s\n", util.FormatInfo(fmt.Sprintf("error refreshing credentials (retrying in %v): %v", retryInterval, err)))
+			next = time.Now().Add(retryInterval)
+			continue
+		}
+		if response.CredentialsExpire.IsZero() {
+			return
+		}
+		expires = response.CredentialsExpire
+		next = refreshAt(time.Now(), expires)
+	}
+}
+
+// refresh gets fresh credentials from a new config container and updates the terraform container with them.
+func (refresher *Refresher) refresh(ctx context.Context) (_ *config.RefreshCredentialsResponse, returnedError error) {
+	state := refresher.state
+	configContainer, err := config.NewContainer(ctx, state, state.Manifest.Config.Image, "")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := configContainer.Done(); err != nil {
+			if returnedError != nil {
+				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+			} else {
+				returnedError = err
+			}
+		}
+	}()
+	if !configContainer.Supports(config.ActionRefreshCredentials) {
+		return nil, errUnsupported
+	}
+	response, err := configContainer.RefreshCredentials(
+		ctx, refresher.version, state.Component, state.Commit, refresher.envName, state.Manifest.Config.Params, refresher.commandEnv,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.CredentialFiles) != 0 {
+		if err := refresher.terraformContainer.WriteFiles(ctx, config.CredentialsDir, response.CredentialFiles); err != nil {
+			return nil, fmt.Errorf("error writing credential files: %w", err)
+		}
+	}
+	if response.Env != nil {
+		refresher.mutex.Lock()
+		refresher.env = response.Env
+		refresher.mutex.Unlock()
+	}
+	description := "refreshed credentials"
+	if !response.CredentialsExpire.IsZero() {
+		description += " (they expire at " + response.CredentialsExpire.UTC().Format(time.RFC3339) + ")"
+	}
+	fmt.Fprintf(state.ErrorStream, "\n%s\n", util.FormatInfo(description))
+	return response, nil
+}
@@ -0,0 +1,169 @@
+package credentials_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/credentials"
+	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/manifest"
+	"github.com/mergermarket/cdflow2/terraform"
+	"github.com/mergermarket/cdflow2/test"
+)
+
+func TestRefresher(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	requests := make(chan map[string]interface{}, 1)
+	test.HandleFakeConfig(dockerClient, "config-image", func(request map[string]interface{}) interface{} {
+		switch request["Action"] {
+		case config.ActionHello:
+			return map[string]interface{}{
+				"ProtocolVersion": config.ProtocolVersion,
+				"Actions":         []string{config.ActionPrepareTerraform, config.ActionRefreshCredentials},
+				"Success":         true,
+			}
+		case config.ActionRefreshCredentials:
+			requests <- request
+			return map[string]interface{}{
+				"Env":             map[string]string{"TOKEN": "fresh"},
+				"CredentialFiles": map[string]string{"token": "fresh"},
+				"Success":         true,
+			}
+		}
+		return map[string]interface{}{"Success": false}
+	})
+	var mutex sync.Mutex
+	written := make(map[string]string)
+	test.HandleFakeTerraform(dockerClient, "terraform-image", func(process *fake.Process) int {
+		// record files written by the write file script (sh -c SCRIPT sh DIR NAME)
+		if len(process.Cmd) == 6 && process.Cmd[0] == "sh" {
+			content, err := ioutil.ReadAll(process.InputStream)
+			if err != nil {
+				return 1
+			}
+			mutex.Lock()
+			written[path.Join(process.Cmd[4], process.Cmd[5])] = string(content)
+			mutex.Unlock()
+		}
+		return 0
+	})
+	readWritten := func(filename string) string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return written[filename]
+	}
+	for _, image := range []string{"config-image", "terraform-image"} {
+		if err := dockerClient.EnsureImage(context.Background(), image, &bytes.Buffer{}); err != nil {
+			t.Fatal("error pulling image:", err)
+		}
+	}
+	releaseVolume, err := dockerClient.CreateVolume(context.Background(), "")
+	if err != nil {
+		t.Fatal("error creating volume:", err)
+	}
+	terraformContainer, err := terraform.NewContainer(
+		context.Background(), dockerClient, "terraform-image", docker.Limits{}, "", "/code", releaseVolume,
+	)
+	if err != nil {
+		t.Fatal("error creating terraform container:", err)
+	}
+	defer terraformContainer.Done()
+	var errorBuffer bytes.Buffer
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  &errorBuffer,
+		Component:    "test-component",
+		Commit:       "test-commit",
+		Manifest: &manifest.Manifest{
+			Version: 2,
+			Config:  manifest.ImageWithParams{Image: "config-image", Params: map[string]interface{}{"a": "b"}},
+		},
+		GlobalArgs: &command.GlobalArgs{},
+	}
+
+	// When
+	refresher, err := credentials.Start(context.Background(), state, terraformContainer, &config.PrepareTerraformResponse{
+		Env:               map[string]string{"TOKEN": "initial"},
+		CredentialFiles:   map[string]string{"token": "initial"},
+		CredentialsExpire: time.Now().Add(time.Second),
+	}, "test-env", "test-version", map[string]string{})
+	if err != nil {
+		t.Fatal("error starting refresher:", err)
+	}
+	initialEnv := refresher.Env()
+	initialFile := readWritten(config.CredentialsDir + "/token")
+	var request map[string]interface{}
+	select {
+	case request = <-requests:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for refresh", errorBuffer.String())
+	}
+	refresher.Stop()
+
+	// Then
+	if initialEnv["TOKEN"] != "initial" || initialFile != "initial" {
+		t.Fatalf("unexpected initial credentials: %v, %q", initialEnv, initialFile)
+	}
+	if request["EnvName"] != "test-env" || request["Version"] != "test-version" || request["Component"] != "test-component" {
+		t.Fatalf("unexpected request: %v", request)
+	}
+	if refresher.Env()["TOKEN"] != "fresh" {
+		t.Fatalf("expected fresh env, got: %v", refresher.Env())
+	}
+	if file := readWritten(config.CredentialsDir + "/token"); file != "fresh" {
+		t.Fatalf("expected fresh credential file, got: %q", file)
+	}
+	// the release volume is mounted by other containers, so credentials mustn't be written to it
+	files, err := dockerClient.ReadVolume(releaseVolume)
+	if err != nil {
+		t.Fatal("error reading volume:", err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("expected nothing written to the release volume, got: %v", files)
+	}
+}
+
+func TestRefresherWithoutExpiry(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	test.HandleFakeTerraform(dockerClient, "terraform-image", func(process *fake.Process) int {
+		return 0
+	})
+	if err := dockerClient.EnsureImage(context.Background(), "terraform-image", &bytes.Buffer{}); err != nil {
+		t.Fatal("error pulling terraform image:", err)
+	}
+	terraformContainer, err := terraform.NewContainer(
+		context.Background(), dockerClient, "terraform-image", docker.Limits{}, "", "/code", "",
+	)
+	if err != nil {
+		t.Fatal("error creating terraform container:", err)
+	}
+	defer terraformContainer.Done()
+
+	// When
+	refresher, err := credentials.Start(context.Background(), &command.GlobalState{
+		DockerClient: dockerClient,
+		ErrorStream:  &bytes.Buffer{},
+	}, terraformContainer, &config.PrepareTerraformResponse{
+		Env: map[string]string{"TOKEN": "initial"},
+	}, "test-env", "test-version", map[string]string{})
+	if err != nil {
+		t.Fatal("error starting refresher:", err)
+	}
+	refresher.Stop()
+
+	// Then
+	if refresher.Env()["TOKEN"] != "initial" {
+		t.Fatalf("unexpected env: %v", refresher.Env())
+	}
+}
@@ -1,12 +1,18 @@
 package deploy
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/mergermarket/cdflow2/command"
 	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/credentials"
+	"github.com/mergermarket/cdflow2/envlock"
 	"github.com/mergermarket/cdflow2/terraform"
 	"github.com/mergermarket/cdflow2/util"
 )
@@ -17,6 +23,12 @@ type CommandArgs struct {
 	Version          string
 	PlanOnly         bool
 	StateShouldExist *bool
+	// Rollback is set when deploying a rollback, with RollbackFrom set to the version being rolled back from (if known).
+	Rollback     bool
+	RollbackFrom string
+	// Locked is set if the caller already holds the lock on the environment (e.g. rollback, which reads the
+	// deployment history under it).
+	Locked bool
 }
 
 // ParseArgs parses command line arguments to the deploy subcommand.
@@ -46,14 +58,16 @@ func ParseArgs(args []string) (*CommandArgs, bool) {
 }
 
 // RunCommand runs the release command.
-func RunCommand(state *command.GlobalState, args *CommandArgs, env map[string]string) (returnedError error) {
-	prepareTerraformResponse, buildVolume, terraformImage, err := config.SetupTerraform(state, args.StateShouldExist, args.EnvName, args.Version, env)
+func RunCommand(ctx context.Context, state *command.GlobalState, args *CommandArgs, env map[string]string) (returnedError error) {
+	started := time.Now()
+
+	prepareTerraformResponse, buildVolume, terraformImage, err := config.SetupTerraform(ctx, state, args.StateShouldExist, args.EnvName, args.Version, env)
 	if err != nil {
 		return err
 	}
 
 	defer func() {
-		if err := state.DockerClient.RemoveVolume(buildVolume); err != nil {
+		if err := state.DockerClient.RemoveVolume(context.Background(), buildVolume); err != nil {
 			if returnedError != nil {
 				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
 			} else {
@@ -62,9 +76,29 @@ func RunCommand(state *command.GlobalState, args *CommandArgs, env map[string]st
 		}
 	}()
 
+	// the lock covers plan and apply, so a concurrent deploy or destroy can't apply in between
+	if !args.PlanOnly && !args.Locked {
+		release, err := envlock.Acquire(ctx, state, args.EnvName, "deploy "+args.Version, env)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := release(); err != nil {
+				if returnedError != nil {
+					returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+				} else {
+					returnedError = err
+				}
+			}
+		}()
+	}
+
 	terraformContainer, err := terraform.NewContainer(
+		ctx,
 		state.DockerClient,
 		terraformImage,
+		state.Manifest.Terraform.Limits.ContainerLimits(),
+		state.ContainerUser,
 		state.CodeDir,
 		buildVolume,
 	)
@@ -81,15 +115,21 @@ func RunCommand(state *command.GlobalState, args *CommandArgs, env map[string]st
 		}
 	}()
 
-	if err := terraformContainer.CopyTerraformLockIfExists(state.OutputStream, state.ErrorStream); err != nil {
+	refresher, err := credentials.Start(ctx, state, terraformContainer, prepareTerraformResponse, args.EnvName, args.Version, env)
+	if err != nil {
 		return err
 	}
+	defer refresher.Stop()
 
-	if err := terraformContainer.ConfigureBackend(state.OutputStream, state.ErrorStream, prepareTerraformResponse, false); err != nil {
+	if err := terraformContainer.CopyTerraformLockIfExists(ctx, state.OutputStream, state.ErrorStream); err != nil {
 		return err
 	}
 
-	if err := terraformContainer.SwitchWorkspace(args.EnvName, state.OutputStream, state.ErrorStream); err != nil {
+	if err := terraformContainer.ConfigureBackend(ctx, state.OutputStream, state.ErrorStream, prepareTerraformResponse, false); err != nil {
+		return err
+	}
+
+	if err := terraformContainer.SwitchWorkspace(ctx, args.EnvName, state.OutputStream, state.ErrorStream); err != nil {
 		return err
 	}
 
@@ -123,9 +163,12 @@ func RunCommand(state *command.GlobalState, args *CommandArgs, env map[string]st
 		util.FormatCommand(strings.Join(planCommand, " ")),
 	)
 
+	// the plan output is kept to count the changes for the deployment record
+	var planOutput bytes.Buffer
 	if err := terraformContainer.RunCommand(
-		planCommand, prepareTerraformResponse.Env,
-		state.OutputStream, state.ErrorStream,
+		ctx,
+		planCommand, refresher.Env(),
+		io.MultiWriter(state.OutputStream, &planOutput), state.ErrorStream,
 	); err != nil {
 		return err
 	}
@@ -142,11 +185,15 @@ func RunCommand(state *command.GlobalState, args *CommandArgs, env map[string]st
 	)
 
 	if err := terraformContainer.RunCommand(
-		[]string{"terraform", "apply", planFilename}, prepareTerraformResponse.Env,
+		ctx,
+		[]string{"terraform", "apply", planFilename}, refresher.Env(),
 		state.OutputStream, state.ErrorStream,
 	); err != nil {
 		return err
 	}
 
-	return nil
+	// not tied to ctx, so the deployment is still recorded if cdflow2 is interrupted now that it has been applied
+	recordCtx, cancelRecord := context.WithTimeout(context.Background(), recordTimeout)
+	defer cancelRecord()
+	return recordDeployment(recordCtx, state, args, env, buildVolume, started, ParsePlanChanges(planOutput.String()))
 }
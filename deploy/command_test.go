@@ -2,13 +2,19 @@ package deploy_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
 	"github.com/mergermarket/cdflow2/deploy"
+	"github.com/mergermarket/cdflow2/docker/fake"
 	"github.com/mergermarket/cdflow2/manifest"
 	"github.com/mergermarket/cdflow2/test"
 )
@@ -47,7 +53,7 @@ func TestRunCommand(t *testing.T) {
 		},
 	}
 
-	repoDigests, err := state.DockerClient.GetImageRepoDigests(test.GetConfig("TEST_TERRAFORM_IMAGE"))
+	repoDigests, err := state.DockerClient.GetImageRepoDigests(context.Background(), test.GetConfig("TEST_TERRAFORM_IMAGE"))
 	if err != nil {
 		t.Fatal("could not get repo digests for terraform container:", err)
 	}
@@ -58,7 +64,7 @@ func TestRunCommand(t *testing.T) {
 	args, _ := deploy.ParseArgs([]string{"test-env", "test-version"})
 
 	// When
-	if err := deploy.RunCommand(state, args, map[string]string{
+	if err := deploy.RunCommand(context.Background(), state, args, map[string]string{
 		"TERRAFORM_DIGEST": terraformDigest,
 	}); err != nil {
 		t.Fatal("error running deploy command:", err, errorBuffer.String())
@@ -186,7 +192,7 @@ func TestRunCommandPlanOnly(t *testing.T) {
 		},
 	}
 
-	repoDigests, err := state.DockerClient.GetImageRepoDigests(test.GetConfig("TEST_TERRAFORM_IMAGE"))
+	repoDigests, err := state.DockerClient.GetImageRepoDigests(context.Background(), test.GetConfig("TEST_TERRAFORM_IMAGE"))
 	if err != nil {
 		t.Fatal("could not get repo digests for terraform container:", err)
 	}
@@ -197,7 +203,7 @@ func TestRunCommandPlanOnly(t *testing.T) {
 	args, _ := deploy.ParseArgs([]string{"--plan-only", "test-env", "test-version"})
 
 	// When
-	if err := deploy.RunCommand(state, args, map[string]string{
+	if err := deploy.RunCommand(context.Background(), state, args, map[string]string{
 		"TERRAFORM_DIGEST": terraformDigest,
 	}); err != nil {
 		t.Fatal("error running deploy command:", err, errorBuffer.String())
@@ -327,3 +333,245 @@ func TestParseArgs(t *testing.T) {
 		assertMatchBool(t, gotBool, wantBool)
 	})
 }
+
+func TestRunCommandCancelled(t *testing.T) {
+
+	// Given
+	var outputBuffer bytes.Buffer
+	var errorBuffer bytes.Buffer
+
+	codeDir, err := ioutil.TempDir("", "cdflow2-deploy-test")
+	if err != nil {
+		t.Fatal("error creating code dir:", err)
+	}
+	defer os.RemoveAll(codeDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dockerClient := fake.NewClient()
+	test.HandleFakeConfig(dockerClient, "config-image", func(request map[string]interface{}) interface{} {
+		if request["Action"] == config.ActionHello {
+			// answer hello as a config image that predates it does
+			return map[string]interface{}{"Success": false}
+		}
+		return map[string]interface{}{
+			"TerraformImage":       "terraform-image",
+			"TerraformBackendType": "local",
+			"Success":              true,
+		}
+	})
+	var interrupted bool
+	test.HandleFakeTerraform(dockerClient, "terraform-image", func(process *fake.Process) int {
+		if len(process.Cmd) > 1 && process.Cmd[1] == "apply" {
+			// simulate the user interrupting while terraform is applying
+			cancel()
+			<-process.Context.Done()
+			interrupted = true
+			return 130
+		}
+		return 0
+	})
+
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &outputBuffer,
+		ErrorStream:  &errorBuffer,
+		CodeDir:      codeDir,
+		Component:    "test-component",
+		Commit:       "test-commit",
+		Manifest: &manifest.Manifest{
+			Version:   2,
+			Terraform: manifest.Terraform{Image: "terraform-image"},
+			Config:    manifest.ImageWithParams{Image: "config-image"},
+		},
+		GlobalArgs: &command.GlobalArgs{},
+	}
+	args, _ := deploy.ParseArgs([]string{"test-env", "test-version"})
+
+	// When
+	err = deploy.RunCommand(ctx, state, args, map[string]string{})
+
+	// Then
+	if !errors.Is(err, context.Canceled) {
+		t.Fatal("expected cancellation error, got:", err)
+	}
+	if !interrupted {
+		t.Fatal("expected terraform apply to be interrupted")
+	}
+	if containers := dockerClient.Containers(); len(containers) != 0 {
+		t.Fatal("expected all containers to be removed, got:", containers)
+	}
+	if volumes := dockerClient.Volumes(); !reflect.DeepEqual(volumes, []string{"cdflow2-cache"}) {
+		t.Fatal("expected only the cache volume to remain, got:", volumes)
+	}
+}
+
+func TestParsePlanChanges(t *testing.T) {
+	for output, expected := range map[string]*config.PlanChanges{
+		"Terraform will perform the following actions:\n\n\x1b[1mPlan:\x1b[0m 1 to add, 2 to change, 3 to destroy.\n": {Add: 1, Change: 2, Destroy: 3},
+		"Plan: 1 to import, 0 to add, 1 to change, 0 to destroy.\n":                                                   {Change: 1},
+		"\nNo changes. Your infrastructure matches the configuration.\n":                                              {},
+		"something unexpected\n": nil,
+	} {
+		if changes := deploy.ParsePlanChanges(output); !reflect.DeepEqual(changes, expected) {
+			t.Fatalf("unexpected changes for %q: %+v", output, changes)
+		}
+	}
+}
+
+func TestRunCommandRecordsDeployment(t *testing.T) {
+
+	// Given
+	codeDir, err := ioutil.TempDir("", "cdflow2-deploy-test")
+	if err != nil {
+		t.Fatal("error creating code dir:", err)
+	}
+	defer os.RemoveAll(codeDir)
+
+	dockerClient := fake.NewClient()
+	dockerClient.AddImage("config-image")
+	dockerClient.HandleRun("config-image", fake.WaitForStop(0))
+	var recorded *config.Deployment
+	dockerClient.HandleExec("config-image", func(process *fake.Process) int {
+		var request struct {
+			Action     string
+			Component  string
+			Deployment *config.Deployment
+		}
+		if err := json.NewDecoder(process.InputStream).Decode(&request); err != nil {
+			return 1
+		}
+		response := map[string]interface{}{"Success": true}
+		switch request.Action {
+		case config.ActionHello:
+			response["ProtocolVersion"] = config.ProtocolVersion
+			response["Actions"] = []string{config.ActionPrepareTerraform, config.ActionRecordDeployment}
+		case config.ActionPrepareTerraform:
+			process.Container.WriteFile("/release/release-metadata.json", []byte(`{"release": {"commit": "release-commit"}}`))
+			response["TerraformImage"] = "terraform-image"
+			response["TerraformBackendType"] = "local"
+		case config.ActionRecordDeployment:
+			if request.Component != "test-component" {
+				return 1
+			}
+			recorded = request.Deployment
+		}
+		json.NewEncoder(process.OutputStream).Encode(response)
+		return 0
+	})
+	test.HandleFakeTerraform(dockerClient, "terraform-image", func(process *fake.Process) int {
+		if len(process.Cmd) > 1 && process.Cmd[1] == "plan" {
+			process.OutputStream.Write([]byte("Plan: 1 to add, 2 to change, 0 to destroy.\n"))
+		}
+		return 0
+	})
+
+	var errorBuffer bytes.Buffer
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  &errorBuffer,
+		CodeDir:      codeDir,
+		Component:    "test-component",
+		Commit:       "test-commit",
+		Manifest: &manifest.Manifest{
+			Version:   2,
+			Terraform: manifest.Terraform{Image: "terraform-image"},
+			Config:    manifest.ImageWithParams{Image: "config-image"},
+		},
+		GlobalArgs: &command.GlobalArgs{},
+	}
+	args, _ := deploy.ParseArgs([]string{"test-env", "test-version"})
+
+	// When
+	if err := deploy.RunCommand(context.Background(), state, args, map[string]string{}); err != nil {
+		t.Fatal("error running deploy command:", err, errorBuffer.String())
+	}
+
+	// Then
+	if recorded == nil {
+		t.Fatal("expected deployment to be recorded")
+	}
+	if recorded.EnvName != "test-env" || recorded.Version != "test-version" || recorded.Commit != "release-commit" || recorded.User == "" {
+		t.Fatalf("unexpected deployment: %+v", recorded)
+	}
+	if recorded.Started.IsZero() || recorded.Finished.Before(recorded.Started) {
+		t.Fatalf("unexpected deployment times: %+v", recorded)
+	}
+	if !reflect.DeepEqual(recorded.Changes, &config.PlanChanges{Add: 1, Change: 2}) {
+		t.Fatalf("unexpected changes: %+v", recorded.Changes)
+	}
+}
+
+func TestRunCommandRecordsDeploymentWhenCancelledAfterApply(t *testing.T) {
+
+	// Given
+	codeDir, err := ioutil.TempDir("", "cdflow2-deploy-test")
+	if err != nil {
+		t.Fatal("error creating code dir:", err)
+	}
+	defer os.RemoveAll(codeDir)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dockerClient := fake.NewClient()
+	var applied, recorded bool
+	test.HandleFakeConfig(dockerClient, "config-image", func(request map[string]interface{}) interface{} {
+		if applied {
+			// simulate the user interrupting after terraform apply has finished
+			cancel()
+		}
+		switch request["Action"] {
+		case config.ActionHello:
+			return map[string]interface{}{
+				"ProtocolVersion": config.ProtocolVersion,
+				"Actions":         []string{config.ActionPrepareTerraform, config.ActionRecordDeployment},
+				"Success":         true,
+			}
+		case config.ActionRecordDeployment:
+			recorded = true
+			return map[string]interface{}{"Success": true}
+		}
+		return map[string]interface{}{
+			"TerraformImage":       "terraform-image",
+			"TerraformBackendType": "local",
+			"Success":              true,
+		}
+	})
+	test.HandleFakeTerraform(dockerClient, "terraform-image", func(process *fake.Process) int {
+		if len(process.Cmd) > 1 && process.Cmd[1] == "apply" {
+			applied = true
+		}
+		return 0
+	})
+
+	var errorBuffer bytes.Buffer
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  &errorBuffer,
+		CodeDir:      codeDir,
+		Component:    "test-component",
+		Commit:       "test-commit",
+		Manifest: &manifest.Manifest{
+			Version:   2,
+			Terraform: manifest.Terraform{Image: "terraform-image"},
+			Config:    manifest.ImageWithParams{Image: "config-image"},
+		},
+		GlobalArgs: &command.GlobalArgs{},
+	}
+	args, _ := deploy.ParseArgs([]string{"test-env", "test-version"})
+
+	// When
+	err = deploy.RunCommand(ctx, state, args, map[string]string{})
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err, errorBuffer.String())
+	}
+	if !recorded {
+		t.Fatal("expected deployment to be recorded")
+	}
+}
@@ -0,0 +1,103 @@
+package deploy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/util"
+)
+
+// recordTimeout is how long recording a deployment can take, since it isn't cancelled with the command.
+const recordTimeout = 2 * time.Minute
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*m")
+var planSummary = regexp.MustCompile(`(?m)^Plan: .*?(\d+) to add, (\d+) to change, (\d+) to destroy`)
+var noChanges = regexp.MustCompile(`(?m)^No changes\.`)
+
+// ParsePlanChanges finds the summary in the output of terraform plan, returning nil if there isn't one.
+func ParsePlanChanges(output string) *config.PlanChanges {
+	output = ansiEscape.ReplaceAllString(output, "")
+	if match := planSummary.FindStringSubmatch(output); match != nil {
+		add, _ := strconv.Atoi(match[1])
+		change, _ := strconv.Atoi(match[2])
+		destroy, _ := strconv.Atoi(match[3])
+		return &config.PlanChanges{Add: add, Change: change, Destroy: destroy}
+	}
+	if noChanges.MatchString(output) {
+		return &config.PlanChanges{}
+	}
+	return nil
+}
+
+// releaseCommit returns the commit recorded in the release metadata, falling back to the current commit.
+func releaseCommit(ctx context.Context, state *command.GlobalState, configContainer *config.Container) string {
+	data, err := configContainer.ReadReleaseFile(ctx, "release-metadata.json")
+	if err != nil {
+		return state.Commit
+	}
+	var releaseMetadata map[string]map[string]string
+	if err := json.Unmarshal(data, &releaseMetadata); err != nil || releaseMetadata["release"]["commit"] == "" {
+		return state.Commit
+	}
+	return releaseMetadata["release"]["commit"]
+}
+
+// recordDeployment asks the config container to record the deployment, if its image supports it.
+func recordDeployment(
+	ctx context.Context,
+	state *command.GlobalState,
+	args *CommandArgs,
+	env map[string]string,
+	releaseVolume string,
+	started time.Time,
+	changes *config.PlanChanges,
+) (returnedError error) {
+	configContainer, err := config.NewContainer(ctx, state, state.Manifest.Config.Image, releaseVolume)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := configContainer.Done(); err != nil {
+			if returnedError != nil {
+				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+			} else {
+				returnedError = err
+			}
+		}
+	}()
+
+	if !configContainer.Supports(config.ActionRecordDeployment) {
+		return nil
+	}
+
+	deployment := &config.Deployment{
+		EnvName:      args.EnvName,
+		Version:      args.Version,
+		Commit:       releaseCommit(ctx, state, configContainer),
+		User:         util.CurrentUser(env),
+		Started:      started.UTC(),
+		Finished:     time.Now().UTC(),
+		Changes:      changes,
+		Rollback:     args.Rollback,
+		RollbackFrom: args.RollbackFrom,
+	}
+	if err := configContainer.RecordDeployment(ctx, state.Component, state.Manifest.Config.Params, env, deployment); err != nil {
+		return fmt.Errorf("deployment succeeded but could not be recorded: %w", err)
+	}
+	description := fmt.Sprintf("recorded deployment of %s to %s", args.Version, args.EnvName)
+	if args.Rollback {
+		from := args.RollbackFrom
+		if from == "" {
+			from = "an unknown version"
+		}
+		description = fmt.Sprintf("recorded rollback of %s from %s to %s", args.EnvName, from, args.Version)
+	}
+	fmt.Fprintf(state.ErrorStream, "\n%s\n", util.FormatInfo(description))
+	return nil
+}
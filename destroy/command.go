@@ -1,12 +1,15 @@
 package destroy
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
 
 	"github.com/mergermarket/cdflow2/command"
 	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/credentials"
+	"github.com/mergermarket/cdflow2/envlock"
 	"github.com/mergermarket/cdflow2/terraform"
 	"github.com/mergermarket/cdflow2/util"
 )
@@ -45,14 +48,14 @@ func ParseArgs(args []string) (*CommandArgs, bool) {
 }
 
 // RunCommand runs the release command.
-func RunCommand(state *command.GlobalState, args *CommandArgs, env map[string]string) (returnedError error) {
-	prepareTerraformResponse, buildVolume, terraformImage, err := config.SetupTerraform(state, args.StateShouldExist, args.EnvName, args.Version, env)
+func RunCommand(ctx context.Context, state *command.GlobalState, args *CommandArgs, env map[string]string) (returnedError error) {
+	prepareTerraformResponse, buildVolume, terraformImage, err := config.SetupTerraform(ctx, state, args.StateShouldExist, args.EnvName, args.Version, env)
 	if err != nil {
 		return err
 	}
 
 	defer func() {
-		if err := state.DockerClient.RemoveVolume(buildVolume); err != nil {
+		if err := state.DockerClient.RemoveVolume(context.Background(), buildVolume); err != nil {
 			if returnedError != nil {
 				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
 			} else {
@@ -61,9 +64,29 @@ func RunCommand(state *command.GlobalState, args *CommandArgs, env map[string]st
 		}
 	}()
 
+	// the lock covers plan and apply, so a concurrent deploy or destroy can't apply in between
+	if !args.PlanOnly {
+		release, err := envlock.Acquire(ctx, state, args.EnvName, "destroy "+args.Version, env)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := release(); err != nil {
+				if returnedError != nil {
+					returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+				} else {
+					returnedError = err
+				}
+			}
+		}()
+	}
+
 	terraformContainer, err := terraform.NewContainer(
+		ctx,
 		state.DockerClient,
 		terraformImage,
+		state.Manifest.Terraform.Limits.ContainerLimits(),
+		state.ContainerUser,
 		state.CodeDir,
 		buildVolume,
 	)
@@ -80,15 +103,21 @@ func RunCommand(state *command.GlobalState, args *CommandArgs, env map[string]st
 		}
 	}()
 
-	if err := terraformContainer.CopyTerraformLockIfExists(state.OutputStream, state.ErrorStream); err != nil {
+	refresher, err := credentials.Start(ctx, state, terraformContainer, prepareTerraformResponse, args.EnvName, args.Version, env)
+	if err != nil {
+		return err
+	}
+	defer refresher.Stop()
+
+	if err := terraformContainer.CopyTerraformLockIfExists(ctx, state.OutputStream, state.ErrorStream); err != nil {
 		return err
 	}
 
-	if err := terraformContainer.ConfigureBackend(state.OutputStream, state.ErrorStream, prepareTerraformResponse, true); err != nil {
+	if err := terraformContainer.ConfigureBackend(ctx, state.OutputStream, state.ErrorStream, prepareTerraformResponse, true); err != nil {
 		return err
 	}
 
-	if err := terraformContainer.SwitchWorkspace(args.EnvName, state.OutputStream, state.ErrorStream); err != nil {
+	if err := terraformContainer.SwitchWorkspace(ctx, args.EnvName, state.OutputStream, state.ErrorStream); err != nil {
 		return err
 	}
 
@@ -133,7 +162,8 @@ func RunCommand(state *command.GlobalState, args *CommandArgs, env map[string]st
 	)
 
 	if err := terraformContainer.RunCommand(
-		planCommand, prepareTerraformResponse.Env,
+		ctx,
+		planCommand, refresher.Env(),
 		state.OutputStream, state.ErrorStream,
 	); err != nil {
 		return err
@@ -151,7 +181,8 @@ func RunCommand(state *command.GlobalState, args *CommandArgs, env map[string]st
 	)
 
 	if err := terraformContainer.RunCommand(
-		destroyCommand, prepareTerraformResponse.Env,
+		ctx,
+		destroyCommand, refresher.Env(),
 		state.OutputStream, state.ErrorStream,
 	); err != nil {
 		return err
@@ -0,0 +1,90 @@
+// Package archive manages a directory of images saved from docker (with `cdflow2 images save`), so that cdflow2 can
+// run without access to a registry (e.g. on an air-gapped runner).
+package archive
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+// IndexFilename is the name of the file in the archive directory that maps image references to tarballs.
+const IndexFilename = "index.json"
+
+// Entry is an image saved in the archive.
+type Entry struct {
+	// ID is the ID of the image (e.g. "sha256:...").
+	ID string `json:"id"`
+	// File is the name of the tarball within the archive directory, as written by `docker save`.
+	File string `json:"file"`
+	// RepoDigests are the repo digests of the image when it was saved - these are lost by `docker save`/`docker load`.
+	RepoDigests []string `json:"repo_digests"`
+}
+
+// Index maps image references (tags and digests) to entries in the archive.
+type Index struct {
+	Images map[string]*Entry `json:"images"`
+}
+
+// Key normalises an image reference so that e.g. "alpine" and "docker.io/library/alpine:latest" match.
+func Key(image string) string {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return image
+	}
+	return reference.FamiliarString(reference.TagNameOnly(named))
+}
+
+// Filename returns the name of the tarball for an image ID.
+func Filename(id string) string {
+	return strings.Replace(id, ":", "-", 1) + ".tar"
+}
+
+// ReadIndex reads the index from the archive directory, returning an empty index if there isn't one yet.
+func ReadIndex(dir string) (*Index, error) {
+	index := Index{Images: make(map[string]*Entry)}
+	data, err := ioutil.ReadFile(filepath.Join(dir, IndexFilename))
+	if os.IsNotExist(err) {
+		return &index, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading image archive index: %w", err)
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("error parsing image archive index %s: %w", filepath.Join(dir, IndexFilename), err)
+	}
+	if index.Images == nil {
+		index.Images = make(map[string]*Entry)
+	}
+	return &index, nil
+}
+
+// Write writes the index to the archive directory.
+func (index *Index) Write(dir string) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, IndexFilename+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("error writing image archive index: %w", err)
+	}
+	return os.Rename(tmp, filepath.Join(dir, IndexFilename))
+}
+
+// Lookup returns the entry for an image, or nil if the image isn't in the archive.
+func (index *Index) Lookup(image string) *Entry {
+	return index.Images[Key(image)]
+}
+
+// Add adds an image to the index, under the passed reference and each of its repo digests.
+func (index *Index) Add(image string, entry *Entry) {
+	index.Images[Key(image)] = entry
+	for _, repoDigest := range entry.RepoDigests {
+		index.Images[Key(repoDigest)] = entry
+	}
+}
@@ -0,0 +1,69 @@
+package archive_test
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/docker/archive"
+)
+
+func TestKey(t *testing.T) {
+	for image, expected := range map[string]string{
+		"alpine":                          "alpine:latest",
+		"docker.io/library/alpine:3.11":   "alpine:3.11",
+		"registry.example.com/team/image": "registry.example.com/team/image:latest",
+		"hashicorp/terraform@sha256:0123456789012345678901234567890123456789012345678901234567890123": "hashicorp/terraform@sha256:0123456789012345678901234567890123456789012345678901234567890123",
+	} {
+		if key := archive.Key(image); key != expected {
+			t.Fatalf("expected key %v for %v, got %v", expected, image, key)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "cdflow2-image-archive")
+	if err != nil {
+		t.Fatal("error creating temp dir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	index, err := archive.ReadIndex(dir)
+	if err != nil {
+		t.Fatal("error reading empty index:", err)
+	}
+	entry := &archive.Entry{
+		ID:          "sha256:abc",
+		File:        archive.Filename("sha256:abc"),
+		RepoDigests: []string{"hashicorp/terraform@sha256:0123456789012345678901234567890123456789012345678901234567890123"},
+	}
+	index.Add("hashicorp/terraform:0.12.23", entry)
+
+	// When
+	if err := index.Write(dir); err != nil {
+		t.Fatal("error writing index:", err)
+	}
+	index, err = archive.ReadIndex(dir)
+	if err != nil {
+		t.Fatal("error reading index:", err)
+	}
+
+	// Then
+	for _, image := range []string{
+		"hashicorp/terraform:0.12.23",
+		"docker.io/hashicorp/terraform:0.12.23",
+		"hashicorp/terraform@sha256:0123456789012345678901234567890123456789012345678901234567890123",
+	} {
+		if found := index.Lookup(image); !reflect.DeepEqual(found, entry) {
+			t.Fatalf("unexpected entry for %v: %+v", image, found)
+		}
+	}
+	if index.Lookup("hashicorp/terraform:0.13.0") != nil {
+		t.Fatal("expected no entry for image not in archive")
+	}
+	if entry.File != "sha256-abc.tar" {
+		t.Fatal("unexpected filename:", entry.File)
+	}
+}
@@ -0,0 +1,39 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+// ErrNoRepoDigest is returned by RepoDigest for an image that has never been pushed to or pulled from a registry.
+var ErrNoRepoDigest = errors.New("no repo digest available (images built locally have no digest until they are pushed)")
+
+// RepoDigest returns the repo digest (e.g. "repo@sha256:...") of a local image for the repository it came from - an
+// image can have digests for several repositories if it has been retagged.
+func RepoDigest(ctx context.Context, dockerClient Iface, image string) (string, error) {
+	repoDigests, err := dockerClient.GetImageRepoDigests(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	if len(repoDigests) == 0 {
+		return "", fmt.Errorf("%s: %w", image, ErrNoRepoDigest)
+	}
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image %s: %w", image, err)
+	}
+	for _, repoDigest := range repoDigests {
+		repository, err := reference.ParseNormalizedNamed(strings.SplitN(repoDigest, "@", 2)[0])
+		if err != nil {
+			continue
+		}
+		if repository.Name() == named.Name() {
+			return repoDigest, nil
+		}
+	}
+	return "", fmt.Errorf("no repo digest for the repository of %s (got %s)", image, strings.Join(repoDigests, ", "))
+}
@@ -0,0 +1,16 @@
+package docker
+
+// NotStartedError is returned by Run and Exec when creating the container or exec failed, so no process was started
+// and it is safe to try again. Run only returns it once any container the failed create may have made has been removed.
+type NotStartedError struct {
+	Err error
+}
+
+func (e *NotStartedError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *NotStartedError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,845 @@
+// Package fake provides an in-memory implementation of docker.Iface for hermetic tests.
+//
+// Images, containers and volumes are simulated in memory. Processes run in containers (via Run or Exec) are
+// simulated by handlers registered against the image - they can read their arguments, environment and input,
+// write output, manipulate the container filesystem and return an exit status.
+package fake
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/docker/archive"
+	"github.com/mergermarket/cdflow2/util"
+	"github.com/rs/xid"
+)
+
+// Handler simulates a process running in a container, returning its exit status.
+type Handler func(process *Process) int
+
+// WaitForStop returns a handler that runs until the container is stopped, then exits with the given status
+// (e.g. 128+15 to simulate a process killed with SIGTERM).
+func WaitForStop(status int) Handler {
+	return func(process *Process) int {
+		<-process.Stopped()
+		return status
+	}
+}
+
+// Process is a simulated process running in a container.
+type Process struct {
+	// Context is the context passed to Run or Exec - a handler can simulate being interrupted by watching it.
+	Context      context.Context
+	Container    *Container
+	Cmd          []string
+	Env          map[string]string
+	WorkingDir   string
+	User         string
+	InputStream  io.Reader
+	OutputStream io.Writer
+	ErrorStream  io.Writer
+}
+
+// Stopped returns a channel that is closed when the container the process is running in is stopped.
+func (process *Process) Stopped() <-chan struct{} {
+	return process.Container.stopped
+}
+
+type mount struct {
+	target  string
+	storage storage
+}
+
+// Container is a simulated container.
+type Container struct {
+	ID         string
+	Name       string
+	Image      string
+	Binds      []string
+	Env        []string
+	WorkingDir string
+	Labels     map[string]string
+	Limits     docker.Limits
+	User       string
+	Created    time.Time
+	root       *memoryFilesystem
+	mounts     []mount
+	running    bool
+	stopped    chan struct{}
+	stopOnce   sync.Once
+}
+
+func (container *Container) stop() {
+	container.stopOnce.Do(func() {
+		close(container.stopped)
+	})
+}
+
+// resolve finds the storage for a path within the container, taking mounts into account.
+func (container *Container) resolve(name string) (storage, string) {
+	name = cleanPath(name)
+	var best *mount
+	for i := range container.mounts {
+		candidate := &container.mounts[i]
+		if _, ok := relativeTo(name, candidate.target); !ok {
+			continue
+		}
+		if best == nil || len(candidate.target) > len(best.target) {
+			best = candidate
+		}
+	}
+	if best == nil {
+		return container.root, name
+	}
+	relative, _ := relativeTo(name, best.target)
+	return best.storage, "/" + relative
+}
+
+// ReadFile reads a file from the container's filesystem.
+func (container *Container) ReadFile(name string) ([]byte, error) {
+	storage, relative := container.resolve(name)
+	content, ok := storage.readFile(relative)
+	if !ok {
+		return nil, fmt.Errorf("no such file in container %s: %s", container.ID, name)
+	}
+	return content, nil
+}
+
+// WriteFile writes a file to the container's filesystem.
+func (container *Container) WriteFile(name string, content []byte) error {
+	storage, relative := container.resolve(name)
+	return storage.writeFile(relative, content)
+}
+
+// Files returns all files at or below a path in the container's filesystem, keyed by path relative to it.
+func (container *Container) Files(dir string) map[string][]byte {
+	dir = cleanPath(dir)
+	storage, relative := container.resolve(dir)
+	result := storage.list(relative)
+	if storage != container.root {
+		return result
+	}
+	for _, mount := range container.mounts {
+		mountRelative, ok := relativeTo(mount.target, dir)
+		if !ok || mount.target == dir {
+			continue
+		}
+		for filename, content := range mount.storage.list("/") {
+			result[path.Join(mountRelative, filename)] = content
+		}
+	}
+	return result
+}
+
+type volume struct {
+	files   *memoryFilesystem
+	labels  map[string]string
+	created time.Time
+}
+
+// Client is a fake implementation of our docker interface.
+type Client struct {
+	mutex        sync.Mutex
+	registry     map[string][]string
+	images       map[string][]string
+	containers   map[string]*Container
+	volumes      map[string]*volume
+	runHandlers  map[string]Handler
+	execHandlers map[string]Handler
+	debugVolume  string
+	labels       map[string]string
+	now          func() time.Time
+	pulls        []string
+	loads        []string
+	proxies      int
+	imageArchive string
+	imageLabels  map[string]map[string]string
+}
+
+// NewClient creates and returns a new fake client with no images, containers or volumes.
+func NewClient() *Client {
+	return &Client{
+		registry:     make(map[string][]string),
+		images:       make(map[string][]string),
+		containers:   make(map[string]*Container),
+		volumes:      make(map[string]*volume),
+		runHandlers:  make(map[string]Handler),
+		execHandlers: make(map[string]Handler),
+		imageLabels:  make(map[string]map[string]string),
+		now:          time.Now,
+	}
+}
+
+// SetNow sets the function used to get the creation time of new containers and volumes.
+func (dockerClient *Client) SetNow(now func() time.Time) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	dockerClient.now = now
+}
+
+func (dockerClient *Client) newVolume() *volume {
+	return &volume{
+		files:   newMemoryFilesystem(),
+		labels:  dockerClient.labels,
+		created: dockerClient.now(),
+	}
+}
+
+// AddImage adds an image to the fake registry so that it can be pulled.
+func (dockerClient *Client) AddImage(image string, repoDigests ...string) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	dockerClient.registry[image] = repoDigests
+}
+
+// AddLocalImage adds an image as if it had already been pulled or built locally.
+func (dockerClient *Client) AddLocalImage(image string, repoDigests ...string) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	dockerClient.images[image] = repoDigests
+}
+
+// SetImageLabels sets the labels returned by GetImageLabels for an image (once it has been pulled).
+func (dockerClient *Client) SetImageLabels(image string, labels map[string]string) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	dockerClient.imageLabels[image] = labels
+}
+
+// HandleRun sets the handler that simulates the main process of containers run from an image.
+func (dockerClient *Client) HandleRun(image string, handler Handler) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	dockerClient.runHandlers[image] = handler
+}
+
+// HandleExec sets the handler that simulates processes exec'd in containers run from an image.
+func (dockerClient *Client) HandleExec(image string, handler Handler) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	dockerClient.execHandlers[image] = handler
+}
+
+// Pulls returns the images that have been pulled, in order.
+func (dockerClient *Client) Pulls() []string {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	return append([]string(nil), dockerClient.pulls...)
+}
+
+// Loads returns the images that have been loaded from the image archive, in order.
+func (dockerClient *Client) Loads() []string {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	return append([]string(nil), dockerClient.loads...)
+}
+
+// Containers returns the containers that currently exist (i.e. have not been removed), sorted by name.
+func (dockerClient *Client) Containers() []*Container {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	result := make([]*Container, 0, len(dockerClient.containers))
+	for _, container := range dockerClient.containers {
+		result = append(result, container)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// Volumes returns the names of the volumes that currently exist, sorted.
+func (dockerClient *Client) Volumes() []string {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	result := make([]string, 0, len(dockerClient.volumes))
+	for name := range dockerClient.volumes {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// ReadVolume returns the files in a volume keyed by path (without a leading slash).
+func (dockerClient *Client) ReadVolume(name string) (map[string][]byte, error) {
+	dockerClient.mutex.Lock()
+	volume, ok := dockerClient.volumes[name]
+	dockerClient.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no such volume: %s", name)
+	}
+	return volume.files.list("/"), nil
+}
+
+// WriteVolumeFile writes a file into a volume.
+func (dockerClient *Client) WriteVolumeFile(name, filename string, content []byte) error {
+	dockerClient.mutex.Lock()
+	volume, ok := dockerClient.volumes[name]
+	dockerClient.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no such volume: %s", name)
+	}
+	return volume.files.writeFile(filename, content)
+}
+
+// FakeDockerSocketProxy is the socket path returned by ProxyDockerSocket.
+const FakeDockerSocketProxy = "/tmp/cdflow2-fake-docker-proxy/docker.sock"
+
+// ProxyDockerSocket pretends to start a docker socket proxy, returning a fixed path - see DockerSocketProxies.
+func (dockerClient *Client) ProxyDockerSocket(ctx context.Context, user string) (string, func() error, error) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	dockerClient.proxies++
+	var once sync.Once
+	return FakeDockerSocketProxy, func() error {
+		once.Do(func() {
+			dockerClient.mutex.Lock()
+			defer dockerClient.mutex.Unlock()
+			dockerClient.proxies--
+		})
+		return nil
+	}, nil
+}
+
+// DockerSocketProxies returns the number of docker socket proxies that have been started and not stopped.
+func (dockerClient *Client) DockerSocketProxies() int {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	return dockerClient.proxies
+}
+
+// SetImageArchive sets a directory of images saved with SaveImage, which are loaded in preference to the fake registry.
+func (dockerClient *Client) SetImageArchive(dir string) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	dockerClient.imageArchive = dir
+}
+
+// SaveImage saves a local image to an archive directory - the tarball contains just the image name.
+func (dockerClient *Client) SaveImage(ctx context.Context, image, dir string) error {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	repoDigests, ok := dockerClient.images[image]
+	if !ok {
+		return fmt.Errorf("No such image: %s", image)
+	}
+	index, err := archive.ReadIndex(dir)
+	if err != nil {
+		return err
+	}
+	id := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(image)))
+	entry := &archive.Entry{ID: id, File: archive.Filename(id), RepoDigests: repoDigests}
+	if err := ioutil.WriteFile(filepath.Join(dir, entry.File), []byte(image), 0644); err != nil {
+		return err
+	}
+	index.Add(image, entry)
+	return index.Write(dir)
+}
+
+// SetLabels sets labels that will be added to each container and volume created.
+func (dockerClient *Client) SetLabels(labels map[string]string) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	dockerClient.labels = labels
+}
+
+// SetDebugVolume sets a volume that will be mapped to /debug in each container, for an out of band way to get data out for testing.
+func (dockerClient *Client) SetDebugVolume(volume string) {
+	dockerClient.debugVolume = volume
+}
+
+func (dockerClient *Client) createContainer(image, name string, binds, env []string, workingDir string) (*Container, error) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	if _, ok := dockerClient.images[image]; !ok {
+		return nil, fmt.Errorf("No such image: %s", image)
+	}
+	container := &Container{
+		ID:         xid.New().String(),
+		Name:       name,
+		Image:      image,
+		Binds:      binds,
+		Env:        env,
+		WorkingDir: workingDir,
+		Labels:     dockerClient.labels,
+		Created:    dockerClient.now(),
+		root:       newMemoryFilesystem(),
+		stopped:    make(chan struct{}),
+	}
+	for _, bind := range binds {
+		parts := strings.Split(bind, ":")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("invalid bind: %s", bind)
+		}
+		source, target := parts[0], cleanPath(parts[1])
+		readOnly := len(parts) > 2 && parts[2] == "ro"
+		if strings.HasPrefix(source, "/") {
+			container.mounts = append(container.mounts, mount{target, &hostFilesystem{dir: source, readOnly: readOnly}})
+			continue
+		}
+		volume, ok := dockerClient.volumes[source]
+		if !ok {
+			// like docker, named volumes are created on demand
+			volume = dockerClient.newVolume()
+			dockerClient.volumes[source] = volume
+		}
+		container.mounts = append(container.mounts, mount{target, volume.files})
+	}
+	dockerClient.containers[container.ID] = container
+	return container, nil
+}
+
+func (dockerClient *Client) getContainer(id string) (*Container, error) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	container, ok := dockerClient.containers[id]
+	if !ok {
+		return nil, fmt.Errorf("No such container: %s", id)
+	}
+	return container, nil
+}
+
+func envToMap(env []string) map[string]string {
+	result := make(map[string]string)
+	for _, e := range env {
+		pair := strings.SplitN(e, "=", 2)
+		if len(pair) == 2 {
+			result[pair[0]] = pair[1]
+		} else {
+			result[pair[0]] = ""
+		}
+	}
+	return result
+}
+
+func orEmpty(reader io.Reader) io.Reader {
+	if reader == nil {
+		return strings.NewReader("")
+	}
+	return reader
+}
+
+func orDiscard(writer io.Writer) io.Writer {
+	if writer == nil {
+		return ioutil.Discard
+	}
+	return writer
+}
+
+// Run runs a container (much like `docker run` in the cli).
+func (dockerClient *Client) Run(ctx context.Context, options *docker.RunOptions) error {
+	dockerClient.mutex.Lock()
+	handler, ok := dockerClient.runHandlers[options.Image]
+	dockerClient.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("fake docker client has no run handler for image %s", options.Image)
+	}
+
+	binds := options.Binds
+	if dockerClient.debugVolume != "" {
+		binds = append(binds, dockerClient.debugVolume+":/debug")
+	}
+	container, err := dockerClient.createContainer(options.Image, util.RandomName(options.NamePrefix), binds, options.Env, options.WorkingDir)
+	if err != nil {
+		return err
+	}
+
+	dockerClient.mutex.Lock()
+	container.Limits = options.Limits
+	container.User = options.User
+	container.running = true
+	dockerClient.mutex.Unlock()
+
+	if options.Started != nil {
+		options.Started <- container.ID
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			container.stop()
+		case <-finished:
+		}
+	}()
+
+	exitCode := handler(&Process{
+		Context:      ctx,
+		Container:    container,
+		Cmd:          append(append([]string{}, options.Entrypoint...), options.Cmd...),
+		Env:          envToMap(options.Env),
+		WorkingDir:   options.WorkingDir,
+		User:         options.User,
+		InputStream:  orEmpty(options.InputStream),
+		OutputStream: orDiscard(options.OutputStream),
+		ErrorStream:  orDiscard(options.ErrorStream),
+	})
+
+	close(finished)
+	dockerClient.mutex.Lock()
+	container.running = false
+	dockerClient.mutex.Unlock()
+	container.stop()
+
+	if ctx.Err() != nil || exitCode != options.SuccessStatus {
+		extra := ""
+		if err := dockerClient.RemoveContainer(context.Background(), container.ID); err != nil {
+			extra = "\nerror removing container: " + err.Error()
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("container stopped%s: %w", extra, ctx.Err())
+		}
+		return fmt.Errorf("container exited with unsuccessful exit code %d%s", exitCode, extra)
+	}
+
+	if options.BeforeRemove != nil {
+		if err := options.BeforeRemove(container.ID); err != nil {
+			return fmt.Errorf("error in BeforeRemove function for container: %w", err)
+		}
+	}
+	return dockerClient.RemoveContainer(context.Background(), container.ID)
+}
+
+// EnsureImage pulls an image if it does not exist locally.
+func (dockerClient *Client) EnsureImage(ctx context.Context, image string, outputStream io.Writer) error {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	// as in the official client, images in the image archive get their repo digests from it even if already loaded
+	if loaded, err := dockerClient.loadFromArchive(image, outputStream); err != nil || loaded {
+		return err
+	}
+	if _, ok := dockerClient.images[image]; ok {
+		return nil
+	}
+	return dockerClient.pullImage(image, outputStream)
+}
+
+// PullImage loads an image from the image archive if set, otherwise pulls it from the fake registry.
+func (dockerClient *Client) PullImage(ctx context.Context, image string, outputStream io.Writer) error {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	if loaded, err := dockerClient.loadFromArchive(image, outputStream); err != nil || loaded {
+		return err
+	}
+	return dockerClient.pullImage(image, outputStream)
+}
+
+// loadFromArchive simulates loading an image from the image archive (unless it's already loaded), returning true if
+// the image is in the archive. The mutex must be held.
+func (dockerClient *Client) loadFromArchive(image string, outputStream io.Writer) (bool, error) {
+	if dockerClient.imageArchive == "" {
+		return false, nil
+	}
+	index, err := archive.ReadIndex(dockerClient.imageArchive)
+	if err != nil {
+		return false, err
+	}
+	entry := index.Lookup(image)
+	if entry == nil {
+		return false, nil
+	}
+	if _, err := os.Stat(filepath.Join(dockerClient.imageArchive, entry.File)); err != nil {
+		return false, fmt.Errorf("error loading image %s from image archive: %w", image, err)
+	}
+	if _, ok := dockerClient.images[image]; !ok {
+		dockerClient.loads = append(dockerClient.loads, image)
+		fmt.Fprintf(orDiscard(outputStream), "Loaded %s from image archive %s\n", image, dockerClient.imageArchive)
+	}
+	dockerClient.images[image] = entry.RepoDigests
+	return true, nil
+}
+
+// pullImage simulates pulling an image from the fake registry. The mutex must be held.
+func (dockerClient *Client) pullImage(image string, outputStream io.Writer) error {
+	repoDigests, ok := dockerClient.registry[image]
+	if !ok {
+		return fmt.Errorf("pull access denied for %s, repository does not exist or may require 'docker login'", image)
+	}
+	dockerClient.pulls = append(dockerClient.pulls, image)
+	dockerClient.images[image] = repoDigests
+	if progress, ok := outputStream.(docker.PullProgress); ok {
+		progress.PullUpdate(image, "", "Downloaded newer image for "+image, 0, 0)
+	} else {
+		fmt.Fprintf(orDiscard(outputStream), "Status: Downloaded newer image for %s\n", image)
+	}
+	return nil
+}
+
+// GetImageRepoDigests returns the repo digests of a local image.
+func (dockerClient *Client) GetImageRepoDigests(ctx context.Context, image string) ([]string, error) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	repoDigests, ok := dockerClient.images[image]
+	if !ok {
+		return nil, fmt.Errorf("No such image: %s", image)
+	}
+	return repoDigests, nil
+}
+
+// GetImageLabels returns the labels of a local image.
+func (dockerClient *Client) GetImageLabels(ctx context.Context, image string) (map[string]string, error) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	if _, ok := dockerClient.images[image]; !ok {
+		return nil, fmt.Errorf("No such image: %s", image)
+	}
+	return dockerClient.imageLabels[image], nil
+}
+
+// Exec execs a simulated process in a running container (like `docker exec` in the cli).
+func (dockerClient *Client) Exec(ctx context.Context, options *docker.ExecOptions) error {
+	container, err := dockerClient.getContainer(options.ID)
+	if err != nil {
+		return fmt.Errorf("error creating docker exec: %w", err)
+	}
+	dockerClient.mutex.Lock()
+	running := container.running
+	handler, ok := dockerClient.execHandlers[container.Image]
+	dockerClient.mutex.Unlock()
+	if !running {
+		return fmt.Errorf("error creating docker exec: container %s is not running", options.ID)
+	}
+	if !ok {
+		return fmt.Errorf("error creating docker exec: fake docker client has no exec handler for image %s", container.Image)
+	}
+	workingDir := options.WorkingDir
+	if workingDir == "" {
+		workingDir = container.WorkingDir
+	}
+	env := envToMap(container.Env)
+	for key, value := range options.Env {
+		env[key] = value
+	}
+	user := options.User
+	if user == "" {
+		user = container.User
+	}
+	exitCode := handler(&Process{
+		Context:      ctx,
+		Container:    container,
+		Cmd:          options.Cmd,
+		Env:          env,
+		WorkingDir:   workingDir,
+		User:         user,
+		InputStream:  orEmpty(options.InputStream),
+		OutputStream: orDiscard(options.OutputStream),
+		ErrorStream:  orDiscard(options.ErrorStream),
+	})
+	if ctx.Err() != nil {
+		return fmt.Errorf("exec process interrupted (exit status code %d): %w", exitCode, ctx.Err())
+	}
+	if exitCode != 0 {
+		return fmt.Errorf("exec process exited with error status code %d", exitCode)
+	}
+	return nil
+}
+
+// Stop stops a container, signalling its main process to exit.
+func (dockerClient *Client) Stop(ctx context.Context, id string, timeout time.Duration) error {
+	container, err := dockerClient.getContainer(id)
+	if err != nil {
+		return err
+	}
+	container.stop()
+	return nil
+}
+
+// CreateVolume creates a volume and returns its name (a random one is generated if name is empty).
+func (dockerClient *Client) CreateVolume(ctx context.Context, name string) (string, error) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	if name == "" {
+		name = xid.New().String()
+	}
+	if _, ok := dockerClient.volumes[name]; !ok {
+		dockerClient.volumes[name] = dockerClient.newVolume()
+	}
+	return name, nil
+}
+
+// VolumeExists checks if a named volume exists.
+func (dockerClient *Client) VolumeExists(ctx context.Context, name string) (bool, error) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	_, ok := dockerClient.volumes[name]
+	return ok, nil
+}
+
+// RemoveVolume removes a volume, failing if it is in use by a container.
+func (dockerClient *Client) RemoveVolume(ctx context.Context, id string) error {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	volume, ok := dockerClient.volumes[id]
+	if !ok {
+		return fmt.Errorf("get %s: no such volume", id)
+	}
+	for _, container := range dockerClient.containers {
+		for _, mount := range container.mounts {
+			if mount.storage == volume.files {
+				return fmt.Errorf("remove %s: volume is in use - [%s]", id, container.ID)
+			}
+		}
+	}
+	delete(dockerClient.volumes, id)
+	return nil
+}
+
+// CreateContainer creates a container without starting it.
+func (dockerClient *Client) CreateContainer(ctx context.Context, options *docker.CreateContainerOptions) (string, error) {
+	container, err := dockerClient.createContainer(options.Image, "", options.Binds, nil, "")
+	if err != nil {
+		return "", err
+	}
+	return container.ID, nil
+}
+
+// RemoveContainer removes a container, failing if it is running.
+func (dockerClient *Client) RemoveContainer(ctx context.Context, id string) error {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	container, ok := dockerClient.containers[id]
+	if !ok {
+		return fmt.Errorf("No such container: %s", id)
+	}
+	if container.running {
+		return fmt.Errorf("You cannot remove a running container %s. Stop the container before attempting removal", id)
+	}
+	delete(dockerClient.containers, id)
+	return nil
+}
+
+func hasLabel(labels map[string]string, label string) bool {
+	_, ok := labels[label]
+	return ok
+}
+
+// ListContainers lists all containers (running or not) that have a label.
+func (dockerClient *Client) ListContainers(ctx context.Context, label string) ([]*docker.Resource, error) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	result := []*docker.Resource{}
+	for _, container := range dockerClient.containers {
+		if !hasLabel(container.Labels, label) {
+			continue
+		}
+		result = append(result, &docker.Resource{
+			ID:      container.ID,
+			Name:    container.Name,
+			Labels:  container.Labels,
+			Created: container.Created,
+			Running: container.running,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// ListVolumes lists all volumes that have a label.
+func (dockerClient *Client) ListVolumes(ctx context.Context, label string) ([]*docker.Resource, error) {
+	dockerClient.mutex.Lock()
+	defer dockerClient.mutex.Unlock()
+	result := []*docker.Resource{}
+	for name, volume := range dockerClient.volumes {
+		if !hasLabel(volume.labels, label) {
+			continue
+		}
+		result = append(result, &docker.Resource{
+			ID:      name,
+			Name:    name,
+			Labels:  volume.labels,
+			Created: volume.created,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// CopyFromContainer returns a tar stream for a path within a container (like `docker cp CONTAINER -`).
+func (dockerClient *Client) CopyFromContainer(ctx context.Context, id, name string) (io.ReadCloser, error) {
+	container, err := dockerClient.getContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	base := path.Base(cleanPath(name))
+
+	var buffer bytes.Buffer
+	tarWriter := tar.NewWriter(&buffer)
+	writeFile := func(name string, content []byte) error {
+		if err := tarWriter.WriteHeader(&tar.Header{
+			Name: name,
+			Mode: 0644,
+			Size: int64(len(content)),
+		}); err != nil {
+			return err
+		}
+		_, err := tarWriter.Write(content)
+		return err
+	}
+
+	if content, err := container.ReadFile(name); err == nil {
+		if err := writeFile(base, content); err != nil {
+			return nil, err
+		}
+	} else {
+		files := container.Files(name)
+		if len(files) == 0 {
+			return nil, fmt.Errorf("Could not find the file %s in container %s", name, id)
+		}
+		if err := tarWriter.WriteHeader(&tar.Header{
+			Name:     base + "/",
+			Mode:     0755,
+			Typeflag: tar.TypeDir,
+		}); err != nil {
+			return nil, err
+		}
+		for _, filename := range sortedKeys(files) {
+			if err := writeFile(base+"/"+filename, files[filename]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(&buffer), nil
+}
+
+// CopyToContainer takes a tar stream and copies it into the container.
+func (dockerClient *Client) CopyToContainer(ctx context.Context, id, name string, reader io.Reader) error {
+	container, err := dockerClient.getContainer(id)
+	if err != nil {
+		return err
+	}
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		var content bytes.Buffer
+		if _, err := io.Copy(&content, tarReader); err != nil {
+			return err
+		}
+		if err := container.WriteFile(path.Join(name, header.Name), content.Bytes()); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package fake_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/docker/fake"
+)
+
+func TestRun(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	dockerClient.AddLocalImage("test-image")
+	dockerClient.HandleRun("test-image", func(process *fake.Process) int {
+		fmt.Fprintln(process.OutputStream, strings.Join(process.Cmd, " "))
+		fmt.Fprintln(process.ErrorStream, process.Env["FOO"])
+		return 0
+	})
+
+	var outputBuffer bytes.Buffer
+	var errorBuffer bytes.Buffer
+
+	// When
+	if err := dockerClient.Run(context.Background(), &docker.RunOptions{
+		Image:        "test-image",
+		Entrypoint:   []string{"/bin/echo"},
+		Cmd:          []string{"hello", "world"},
+		Env:          []string{"FOO=bar"},
+		OutputStream: &outputBuffer,
+		ErrorStream:  &errorBuffer,
+		NamePrefix:   "cdflow2-test-fake",
+	}); err != nil {
+		t.Fatal("error running container:", err)
+	}
+
+	// Then
+	if outputBuffer.String() != "/bin/echo hello world\n" {
+		t.Fatalf("unexpected output: %#v", outputBuffer.String())
+	}
+	if errorBuffer.String() != "bar\n" {
+		t.Fatalf("unexpected error output: %#v", errorBuffer.String())
+	}
+	if len(dockerClient.Containers()) != 0 {
+		t.Fatal("expected container to be removed, got:", dockerClient.Containers())
+	}
+}
+
+func TestRunSuccessStatus(t *testing.T) {
+	dockerClient := fake.NewClient()
+	dockerClient.AddLocalImage("test-image")
+	dockerClient.HandleRun("test-image", func(process *fake.Process) int {
+		return 3
+	})
+
+	if err := dockerClient.Run(context.Background(), &docker.RunOptions{Image: "test-image", SuccessStatus: 3}); err != nil {
+		t.Fatal("expected exit code matching SuccessStatus to succeed, got:", err)
+	}
+
+	err := dockerClient.Run(context.Background(), &docker.RunOptions{Image: "test-image"})
+	if err == nil || err.Error() != "container exited with unsuccessful exit code 3" {
+		t.Fatal("unexpected error:", err)
+	}
+	if len(dockerClient.Containers()) != 0 {
+		t.Fatal("expected failed container to be removed, got:", dockerClient.Containers())
+	}
+}
+
+func TestRunMissingImage(t *testing.T) {
+	dockerClient := fake.NewClient()
+	dockerClient.HandleRun("test-image", fake.WaitForStop(0))
+
+	if err := dockerClient.Run(context.Background(), &docker.RunOptions{Image: "test-image"}); err == nil {
+		t.Fatal("expected error running image that has not been pulled")
+	}
+}
+
+func TestExecAndStop(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	dockerClient.AddLocalImage("test-image")
+	dockerClient.HandleRun("test-image", fake.WaitForStop(128+15))
+	dockerClient.HandleExec("test-image", func(process *fake.Process) int {
+		input, _ := ioutil.ReadAll(process.InputStream)
+		fmt.Fprintf(process.OutputStream, "%s %s %s", process.WorkingDir, process.Cmd[0], input)
+		if process.Cmd[0] == "fail" {
+			return 2
+		}
+		return 0
+	})
+
+	started := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- dockerClient.Run(context.Background(), &docker.RunOptions{
+			Image:         "test-image",
+			WorkingDir:    "/code",
+			Started:       started,
+			SuccessStatus: 128 + 15,
+		})
+	}()
+	id := <-started
+
+	// When
+	var outputBuffer bytes.Buffer
+	if err := dockerClient.Exec(context.Background(), &docker.ExecOptions{
+		ID:           id,
+		Cmd:          []string{"cat"},
+		InputStream:  strings.NewReader("input"),
+		OutputStream: &outputBuffer,
+	}); err != nil {
+		t.Fatal("error in exec:", err)
+	}
+	failErr := dockerClient.Exec(context.Background(), &docker.ExecOptions{ID: id, Cmd: []string{"fail"}})
+
+	if err := dockerClient.Stop(context.Background(), id, time.Second); err != nil {
+		t.Fatal("error stopping container:", err)
+	}
+
+	// Then
+	if err := <-done; err != nil {
+		t.Fatal("unexpected error from run:", err)
+	}
+	if outputBuffer.String() != "/code cat input" {
+		t.Fatalf("unexpected exec output: %#v", outputBuffer.String())
+	}
+	if failErr == nil || failErr.Error() != "exec process exited with error status code 2" {
+		t.Fatal("unexpected exec error:", failErr)
+	}
+	if err := dockerClient.Exec(context.Background(), &docker.ExecOptions{ID: id, Cmd: []string{"cat"}}); err == nil {
+		t.Fatal("expected error exec'ing in removed container")
+	}
+}
+
+func TestVolumesAndCopy(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	dockerClient.AddLocalImage("test-image")
+
+	volume, err := dockerClient.CreateVolume(context.Background(), "")
+	if err != nil {
+		t.Fatal("error creating volume:", err)
+	}
+	if err := dockerClient.WriteVolumeFile(volume, "existing", []byte("existing content")); err != nil {
+		t.Fatal("error writing volume file:", err)
+	}
+
+	id, err := dockerClient.CreateContainer(context.Background(), &docker.CreateContainerOptions{
+		Image: "test-image",
+		Binds: []string{volume + ":/release"},
+	})
+	if err != nil {
+		t.Fatal("error creating container:", err)
+	}
+
+	var input bytes.Buffer
+	tarWriter := tar.NewWriter(&input)
+	content := []byte("new content")
+	tarWriter.WriteHeader(&tar.Header{Name: "/release/new", Mode: 0644, Size: int64(len(content))})
+	tarWriter.Write(content)
+	tarWriter.Close()
+
+	// When
+	if err := dockerClient.CopyToContainer(context.Background(), id, "/", &input); err != nil {
+		t.Fatal("error copying to container:", err)
+	}
+	reader, err := dockerClient.CopyFromContainer(context.Background(), id, "/release/")
+	if err != nil {
+		t.Fatal("error copying from container:", err)
+	}
+	copied := readTar(t, reader)
+
+	// Then
+	if !reflect.DeepEqual(copied, map[string]string{
+		"release/existing": "existing content",
+		"release/new":      "new content",
+	}) {
+		t.Fatal("unexpected files copied from container:", copied)
+	}
+
+	if err := dockerClient.RemoveVolume(context.Background(), volume); err == nil {
+		t.Fatal("expected error removing volume in use")
+	}
+	if err := dockerClient.RemoveContainer(context.Background(), id); err != nil {
+		t.Fatal("error removing container:", err)
+	}
+	if err := dockerClient.RemoveVolume(context.Background(), volume); err != nil {
+		t.Fatal("error removing volume:", err)
+	}
+	if exists, _ := dockerClient.VolumeExists(context.Background(), volume); exists {
+		t.Fatal("expected volume to be removed")
+	}
+}
+
+func TestPullImage(t *testing.T) {
+	dockerClient := fake.NewClient()
+	dockerClient.AddImage("test-image:latest", "test-image@sha256:1234")
+
+	if err := dockerClient.EnsureImage(context.Background(), "test-image:latest", nil); err != nil {
+		t.Fatal("error ensuring image:", err)
+	}
+	if err := dockerClient.EnsureImage(context.Background(), "test-image:latest", nil); err != nil {
+		t.Fatal("error ensuring image:", err)
+	}
+	if err := dockerClient.PullImage(context.Background(), "missing-image", nil); err == nil {
+		t.Fatal("expected error pulling missing image")
+	}
+
+	if !reflect.DeepEqual(dockerClient.Pulls(), []string{"test-image:latest"}) {
+		t.Fatal("expected a single pull, got:", dockerClient.Pulls())
+	}
+	repoDigests, err := dockerClient.GetImageRepoDigests(context.Background(), "test-image:latest")
+	if err != nil {
+		t.Fatal("error getting repo digests:", err)
+	}
+	if !reflect.DeepEqual(repoDigests, []string{"test-image@sha256:1234"}) {
+		t.Fatal("unexpected repo digests:", repoDigests)
+	}
+}
+
+func readTar(t *testing.T, reader io.ReadCloser) map[string]string {
+	defer reader.Close()
+	result := make(map[string]string)
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return result
+		}
+		if err != nil {
+			t.Fatal("error reading tar:", err)
+		}
+		if header.Typeflag == tar.TypeDir {
+			continue
+		}
+		content, _ := ioutil.ReadAll(tarReader)
+		result[header.Name] = string(content)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	dockerClient := fake.NewClient()
+	dockerClient.AddLocalImage("test-image")
+	dockerClient.HandleRun("test-image", fake.WaitForStop(128+15))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan string, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- dockerClient.Run(ctx, &docker.RunOptions{Image: "test-image", Started: started})
+	}()
+	<-started
+	cancel()
+
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatal("expected cancellation error, got:", err)
+	}
+	if len(dockerClient.Containers()) != 0 {
+		t.Fatal("expected container to be removed, got:", dockerClient.Containers())
+	}
+}
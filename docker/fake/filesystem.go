@@ -0,0 +1,134 @@
+package fake
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// storage is somewhere a container path can resolve to - a volume, the container's own filesystem or a host directory.
+type storage interface {
+	readFile(name string) ([]byte, bool)
+	writeFile(name string, content []byte) error
+	// list returns all files at or below name, keyed by their path relative to name.
+	list(name string) map[string][]byte
+}
+
+// memoryFilesystem is an in-memory filesystem holding files only (directories are implied by the files they contain).
+type memoryFilesystem struct {
+	mutex sync.Mutex
+	files map[string][]byte
+}
+
+func newMemoryFilesystem() *memoryFilesystem {
+	return &memoryFilesystem{files: make(map[string][]byte)}
+}
+
+func (filesystem *memoryFilesystem) readFile(name string) ([]byte, bool) {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	content, ok := filesystem.files[cleanPath(name)]
+	return content, ok
+}
+
+func (filesystem *memoryFilesystem) writeFile(name string, content []byte) error {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	filesystem.files[cleanPath(name)] = append([]byte(nil), content...)
+	return nil
+}
+
+func (filesystem *memoryFilesystem) list(name string) map[string][]byte {
+	filesystem.mutex.Lock()
+	defer filesystem.mutex.Unlock()
+	name = cleanPath(name)
+	result := make(map[string][]byte)
+	for filename, content := range filesystem.files {
+		if relative, ok := relativeTo(filename, name); ok {
+			result[relative] = content
+		}
+	}
+	return result
+}
+
+// hostFilesystem is a directory on the host that has been bind mounted into a container.
+type hostFilesystem struct {
+	dir      string
+	readOnly bool
+}
+
+func (filesystem *hostFilesystem) readFile(name string) ([]byte, bool) {
+	content, err := ioutil.ReadFile(filepath.Join(filesystem.dir, name))
+	if err != nil {
+		return nil, false
+	}
+	return content, true
+}
+
+func (filesystem *hostFilesystem) writeFile(name string, content []byte) error {
+	if filesystem.readOnly {
+		return &os.PathError{Op: "write", Path: name, Err: os.ErrPermission}
+	}
+	fullPath := filepath.Join(filesystem.dir, name)
+	if err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fullPath, content, 0644)
+}
+
+func (filesystem *hostFilesystem) list(name string) map[string][]byte {
+	result := make(map[string][]byte)
+	root := filepath.Join(filesystem.dir, name)
+	filepath.Walk(root, func(fullPath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		content, err := ioutil.ReadFile(fullPath)
+		if err != nil {
+			return nil
+		}
+		relative, err := filepath.Rel(root, fullPath)
+		if err != nil {
+			return nil
+		}
+		if relative == "." {
+			relative = ""
+		}
+		result[filepath.ToSlash(relative)] = content
+		return nil
+	})
+	return result
+}
+
+// cleanPath normalises a path so it is absolute with no trailing slash.
+func cleanPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// relativeTo returns filename relative to dir ("" if they are the same), and whether filename is at or below dir.
+func relativeTo(filename, dir string) (string, bool) {
+	if filename == dir {
+		return "", true
+	}
+	prefix := dir
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	if !strings.HasPrefix(filename, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(filename, prefix), true
+}
+
+func sortedKeys(files map[string][]byte) []string {
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
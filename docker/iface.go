@@ -1,26 +1,38 @@
 package docker
 
 import (
+	"context"
 	"io"
 	"time"
 )
 
 // Iface is an interface for interracting with docker.
+//
+// Cancelling the context passed to Run stops the container, and cancelling the context passed to Exec interrupts
+// the exec'd process (with SIGINT) and waits for it to exit - so callers should use a context that is not cancelled
+// (e.g. context.Background()) for cleanup.
 type Iface interface {
-	Run(options *RunOptions) error
-	EnsureImage(image string, outputStream io.Writer) error
-	PullImage(image string, outputStream io.Writer) error
-	GetImageRepoDigests(image string) ([]string, error)
-	Exec(options *ExecOptions) error
-	Stop(id string, timeout time.Duration) error
-	CreateVolume(name string) (string, error)
-	VolumeExists(name string) (bool, error)
-	RemoveVolume(id string) error
-	CreateContainer(options *CreateContainerOptions) (string, error)
-	RemoveContainer(id string) error
-	CopyFromContainer(id, path string) (io.ReadCloser, error)
-	CopyToContainer(id, path string, reader io.Reader) error
+	Run(ctx context.Context, options *RunOptions) error
+	EnsureImage(ctx context.Context, image string, outputStream io.Writer) error
+	PullImage(ctx context.Context, image string, outputStream io.Writer) error
+	GetImageRepoDigests(ctx context.Context, image string) ([]string, error)
+	GetImageLabels(ctx context.Context, image string) (map[string]string, error)
+	Exec(ctx context.Context, options *ExecOptions) error
+	Stop(ctx context.Context, id string, timeout time.Duration) error
+	CreateVolume(ctx context.Context, name string) (string, error)
+	VolumeExists(ctx context.Context, name string) (bool, error)
+	RemoveVolume(ctx context.Context, id string) error
+	CreateContainer(ctx context.Context, options *CreateContainerOptions) (string, error)
+	RemoveContainer(ctx context.Context, id string) error
+	CopyFromContainer(ctx context.Context, id, path string) (io.ReadCloser, error)
+	CopyToContainer(ctx context.Context, id, path string, reader io.Reader) error
+	ListContainers(ctx context.Context, label string) ([]*Resource, error)
+	ListVolumes(ctx context.Context, label string) ([]*Resource, error)
+	ProxyDockerSocket(ctx context.Context, user string) (string, func() error, error)
+	SaveImage(ctx context.Context, image, dir string) error
 	SetDebugVolume(volume string)
+	SetLabels(labels map[string]string)
+	SetImageArchive(dir string)
 }
 
 // RunOptions represents the options to the Run method.
@@ -39,6 +51,9 @@ type RunOptions struct {
 	Init          bool
 	SuccessStatus int
 	BeforeRemove  func(id string) error
+	Limits        Limits
+	User          string
+	GroupAdd      []string
 }
 
 // CreateContainerOptions represents the options to the CreateContainer method.
@@ -57,4 +72,5 @@ type ExecOptions struct {
 	ErrorStream  io.Writer
 	Tty          bool
 	WorkingDir   string
+	User         string
 }
@@ -0,0 +1,21 @@
+package docker
+
+import "time"
+
+// Labels added to every container and volume cdflow2 creates, so that orphaned resources can be found.
+const (
+	LabelRunID     = "cdflow2.run-id"
+	LabelComponent = "cdflow2.component"
+	LabelCommand   = "cdflow2.command"
+	LabelPID       = "cdflow2.pid"
+	LabelHost      = "cdflow2.host"
+)
+
+// Resource is a container or volume as returned by ListContainers or ListVolumes.
+type Resource struct {
+	ID      string
+	Name    string
+	Labels  map[string]string
+	Created time.Time
+	Running bool
+}
@@ -0,0 +1,56 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Limits represents resource limits and security options for a container - the zero value means no limits.
+type Limits struct {
+	// Memory is the memory limit in bytes (0 for no limit).
+	Memory int64
+	// CPUs is the number of CPUs the container can use (e.g. 1.5), 0 for no limit.
+	CPUs float64
+	// PidsLimit is the maximum number of processes in the container (0 for no limit).
+	PidsLimit int64
+	// ReadOnlyRootfs mounts the root filesystem of the container read only (with a tmpfs at /tmp).
+	ReadOnlyRootfs bool
+	// CapDrop is a list of capabilities to drop (e.g. "NET_RAW" or "ALL").
+	CapDrop []string
+	// NoNewPrivileges prevents processes in the container from gaining privileges (e.g. via setuid binaries).
+	NoNewPrivileges bool
+}
+
+// IsZero returns true if no limits are set.
+func (limits *Limits) IsZero() bool {
+	return limits.Memory == 0 &&
+		limits.CPUs == 0 &&
+		limits.PidsLimit == 0 &&
+		!limits.ReadOnlyRootfs &&
+		len(limits.CapDrop) == 0 &&
+		!limits.NoNewPrivileges
+}
+
+// String returns a description of the limits that are set, for use in messages.
+func (limits *Limits) String() string {
+	var parts []string
+	if limits.Memory != 0 {
+		parts = append(parts, fmt.Sprintf("memory=%d", limits.Memory))
+	}
+	if limits.CPUs != 0 {
+		parts = append(parts, fmt.Sprintf("cpus=%g", limits.CPUs))
+	}
+	if limits.PidsLimit != 0 {
+		parts = append(parts, fmt.Sprintf("pids=%d", limits.PidsLimit))
+	}
+	if limits.ReadOnlyRootfs {
+		parts = append(parts, "read_only")
+	}
+	if len(limits.CapDrop) != 0 {
+		parts = append(parts, "cap_drop="+strings.Join(limits.CapDrop, ","))
+	}
+	if limits.NoNewPrivileges {
+		parts = append(parts, "no_new_privileges")
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,149 @@
+package official
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mergermarket/cdflow2/docker/archive"
+)
+
+// SetImageArchive sets a directory of images saved with SaveImage, which are loaded in preference to pulling from a registry.
+func (dockerClient *Client) SetImageArchive(dir string) {
+	dockerClient.imageArchive = dir
+}
+
+// SaveImage saves a local image to an archive directory, so it can later be loaded without access to a registry.
+func (dockerClient *Client) SaveImage(ctx context.Context, image, dir string) error {
+	details, _, err := dockerClient.client.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return err
+	}
+
+	index, err := archive.ReadIndex(dir)
+	if err != nil {
+		return err
+	}
+	entry := &archive.Entry{
+		ID:          details.ID,
+		File:        archive.Filename(details.ID),
+		RepoDigests: details.RepoDigests,
+	}
+
+	filename := filepath.Join(dir, entry.File)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if err := dockerClient.saveImageToFile(ctx, image, filename); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	index.Add(image, entry)
+	return index.Write(dir)
+}
+
+func (dockerClient *Client) saveImageToFile(ctx context.Context, image, filename string) (returnedError error) {
+	reader, err := dockerClient.client.ImageSave(ctx, []string{image})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// write to a temporary file so an interrupted save doesn't leave a truncated tarball
+	tmp := filename + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if returnedError != nil {
+			os.Remove(tmp)
+		}
+	}()
+	if _, err := io.Copy(file, reader); err != nil {
+		file.Close()
+		return fmt.Errorf("error saving image %s: %w", image, err)
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// archivedImage returns the archive entry for an image that has been loaded from the image archive, or nil if it wasn't.
+func (dockerClient *Client) archivedImage(image string) *archive.Entry {
+	dockerClient.archiveMutex.Lock()
+	defer dockerClient.archiveMutex.Unlock()
+	return dockerClient.archived[archive.Key(image)]
+}
+
+// resolveImage returns the image ID for images loaded from the image archive - needed for images referenced by
+// digest, since repo digests are lost by docker save/load.
+func (dockerClient *Client) resolveImage(image string) string {
+	if entry := dockerClient.archivedImage(image); entry != nil {
+		return entry.ID
+	}
+	return image
+}
+
+// loadFromArchive loads an image from the image archive directory if there is one and it contains the image (unless
+// it's already loaded), returning true if the image is in the archive.
+func (dockerClient *Client) loadFromArchive(ctx context.Context, image string, outputStream io.Writer) (bool, error) {
+	if dockerClient.imageArchive == "" {
+		return false, nil
+	}
+	index, err := archive.ReadIndex(dockerClient.imageArchive)
+	if err != nil {
+		return false, err
+	}
+	entry := index.Lookup(image)
+	if entry == nil {
+		return false, nil
+	}
+
+	if _, _, err := dockerClient.client.ImageInspectWithRaw(ctx, entry.ID); err != nil {
+		if err := dockerClient.loadImageFromFile(ctx, filepath.Join(dockerClient.imageArchive, entry.File)); err != nil {
+			return false, fmt.Errorf("error loading image %s from image archive: %w", image, err)
+		}
+		fmt.Fprintf(outputStream, "Loaded %s from image archive %s\n", image, dockerClient.imageArchive)
+	}
+
+	dockerClient.archiveMutex.Lock()
+	defer dockerClient.archiveMutex.Unlock()
+	dockerClient.archived[archive.Key(image)] = entry
+	return true, nil
+}
+
+func (dockerClient *Client) loadImageFromFile(ctx context.Context, filename string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	response, err := dockerClient.client.ImageLoad(ctx, file, true)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	scanner := bufio.NewScanner(response.Body)
+	for scanner.Scan() {
+		var message struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			return err
+		}
+		if message.Error != "" {
+			return errors.New(message.Error)
+		}
+	}
+	return scanner.Err()
+}
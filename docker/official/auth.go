@@ -0,0 +1,222 @@
+package official
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/registry"
+)
+
+const cdflowDockerAuthPrefix = "CDFLOW2_DOCKER_AUTH_"
+
+// dockerConfigFile is the subset of the docker cli's config.json that is used to find registry credentials.
+type dockerConfigFile struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+// dockerConfigAuth is a static credential in the auths section of config.json.
+type dockerConfigAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// credentialHelperResponse is the output of `docker-credential-<helper> get`.
+type credentialHelperResponse struct {
+	Username string
+	Secret   string
+}
+
+// credentialsNotFound is the message credential helpers output when they don't have credentials for a registry.
+const credentialsNotFound = "credentials not found in native keychain"
+
+// registryOfImage returns the registry hostname for an image (e.g. index.docker.io for images on the docker hub).
+func registryOfImage(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("error parsing image name %v: %w", image, err)
+	}
+	domain := reference.Domain(named)
+	if domain == "docker.io" {
+		return registry.IndexHostname, nil
+	}
+	return domain, nil
+}
+
+// serverAddress returns the address a registry is stored under by the docker cli.
+func serverAddress(registryHostname string) string {
+	if registryHostname == registry.IndexHostname {
+		return registry.IndexServer
+	}
+	return registryHostname
+}
+
+// ResolveRegistryAuth finds the credentials to pull an image in the same way as the docker cli, with the
+// CDFLOW2_DOCKER_AUTH_<REGISTRY>_USERNAME/PASSWORD environment variables taking priority. An empty AuthConfig
+// is returned if no credentials are found.
+func ResolveRegistryAuth(image string) (*types.AuthConfig, error) {
+	registryHostname, err := registryOfImage(image)
+	if err != nil {
+		return nil, err
+	}
+
+	if authConfig := getAuthFromEnv(registryHostname); authConfig != nil {
+		return authConfig, nil
+	}
+
+	configFile, err := loadDockerConfigFile()
+	if err != nil {
+		return nil, err
+	}
+	if configFile == nil {
+		return &types.AuthConfig{}, nil
+	}
+
+	if helper, ok := configFile.CredHelpers[registryHostname]; ok {
+		return getAuthFromHelper(helper, serverAddress(registryHostname))
+	}
+	if configFile.CredsStore != "" {
+		authConfig, err := getAuthFromHelper(configFile.CredsStore, serverAddress(registryHostname))
+		if err != nil {
+			return nil, err
+		}
+		if authConfig.Username != "" || authConfig.IdentityToken != "" {
+			return authConfig, nil
+		}
+	}
+	return getAuthFromConfigFile(configFile, registryHostname)
+}
+
+func getAuthFromEnv(registryHostname string) *types.AuthConfig {
+	registryVarName := strings.ToUpper(
+		strings.NewReplacer(
+			".", "_",
+			":", "_",
+			"-", "_",
+		).Replace(registryHostname),
+	)
+	username := os.Getenv(cdflowDockerAuthPrefix + registryVarName + "_USERNAME")
+	if username == "" {
+		return nil
+	}
+	return &types.AuthConfig{
+		Username: username,
+		Password: os.Getenv(cdflowDockerAuthPrefix + registryVarName + "_PASSWORD"),
+	}
+}
+
+// loadDockerConfigFile loads config.json from $DOCKER_CONFIG or ~/.docker, returning nil if it doesn't exist.
+func loadDockerConfigFile() (*dockerConfigFile, error) {
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+	filename := filepath.Join(dir, "config.json")
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading docker config %v: %w", filename, err)
+	}
+	var result dockerConfigFile
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("error parsing docker config %v: %w", filename, err)
+	}
+	return &result, nil
+}
+
+// getAuthFromHelper runs a docker credential helper (e.g. docker-credential-ecr-login) to get credentials.
+func getAuthFromHelper(helper, serverAddress string) (*types.AuthConfig, error) {
+	var outputBuffer bytes.Buffer
+	var errorBuffer bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverAddress)
+	cmd.Stdout = &outputBuffer
+	cmd.Stderr = &errorBuffer
+	if err := cmd.Run(); err != nil {
+		// helpers report missing credentials on stdout with a non-zero exit status
+		if strings.Contains(outputBuffer.String(), credentialsNotFound) {
+			return &types.AuthConfig{}, nil
+		}
+		return nil, fmt.Errorf(
+			"error getting credentials for %v from docker-credential-%v: %w: %v",
+			serverAddress, helper, err, strings.TrimSpace(outputBuffer.String()+errorBuffer.String()),
+		)
+	}
+	var response credentialHelperResponse
+	if err := json.Unmarshal(outputBuffer.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("error decoding credentials for %v from docker-credential-%v: %w", serverAddress, helper, err)
+	}
+	// a username of <token> signifies the secret is an identity token rather than a password
+	if response.Username == "<token>" {
+		return &types.AuthConfig{IdentityToken: response.Secret, ServerAddress: serverAddress}, nil
+	}
+	return &types.AuthConfig{Username: response.Username, Password: response.Secret, ServerAddress: serverAddress}, nil
+}
+
+// getAuthFromConfigFile gets static credentials from the auths section of config.json.
+func getAuthFromConfigFile(configFile *dockerConfigFile, registryHostname string) (*types.AuthConfig, error) {
+	for key, auth := range configFile.Auths {
+		if convertToHostname(key) != registryHostname {
+			continue
+		}
+		result := &types.AuthConfig{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			IdentityToken: auth.IdentityToken,
+			ServerAddress: key,
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding docker config auth for %v: %w", key, err)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid docker config auth for %v", key)
+			}
+			result.Username, result.Password = parts[0], parts[1]
+		}
+		return result, nil
+	}
+	return &types.AuthConfig{}, nil
+}
+
+// convertToHostname strips the scheme and path from a key in config.json (e.g. https://index.docker.io/v1/).
+func convertToHostname(key string) string {
+	hostname := key
+	if strings.HasPrefix(hostname, "http://") {
+		hostname = strings.TrimPrefix(hostname, "http://")
+	} else if strings.HasPrefix(hostname, "https://") {
+		hostname = strings.TrimPrefix(hostname, "https://")
+	}
+	return strings.SplitN(hostname, "/", 2)[0]
+}
+
+func getRegistryAuthToLoginToRegistryOfImage(image string) (string, error) {
+	authConfig, err := ResolveRegistryAuth(image)
+	if err != nil {
+		return "", err
+	}
+	authBytes, err := json.Marshal(authConfig)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(authBytes), nil
+}
@@ -0,0 +1,101 @@
+package official_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/docker/official"
+)
+
+const testDockerConfig = `{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViLXVzZXI6aHViLXBhc3N3b3Jk"},
+		"static.example.com": {"username": "static-user", "password": "static-password"},
+		"store.example.com": {"auth": "c3RhdGljOnN0YXRpYw=="}
+	},
+	"credHelpers": {
+		"helper.example.com": "test"
+	},
+	"credsStore": "test"
+}`
+
+const testCredentialHelper = `#!/bin/sh
+read server
+case "$server" in
+	helper.example.com) echo '{"ServerURL":"helper.example.com","Username":"helper-user","Secret":"helper-secret"}' ;;
+	store.example.com) echo '{"ServerURL":"store.example.com","Username":"<token>","Secret":"store-token"}' ;;
+	broken.example.com) echo "helper exploded" >&2; exit 2 ;;
+	*) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`
+
+func setupDockerConfig(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "cdflow2-docker-config")
+	if err != nil {
+		t.Fatal("error creating temp dir:", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(testDockerConfig), 0644); err != nil {
+		t.Fatal("error writing docker config:", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(testCredentialHelper), 0755); err != nil {
+		t.Fatal("error writing credential helper:", err)
+	}
+	oldDockerConfig, oldPath := os.Getenv("DOCKER_CONFIG"), os.Getenv("PATH")
+	os.Setenv("DOCKER_CONFIG", dir)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+oldPath)
+	return func() {
+		os.Setenv("DOCKER_CONFIG", oldDockerConfig)
+		os.Setenv("PATH", oldPath)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestResolveRegistryAuth(t *testing.T) {
+	defer setupDockerConfig(t)()
+
+	for _, testCase := range []struct {
+		image, username, password, identityToken string
+	}{
+		{"alpine:latest", "hub-user", "hub-password", ""},
+		{"static.example.com/team/image:1", "static-user", "static-password", ""},
+		{"helper.example.com/image", "helper-user", "helper-secret", ""},
+		{"store.example.com/image", "", "", "store-token"},
+		{"unknown.example.com:5000/image", "", "", ""},
+	} {
+		t.Run(testCase.image, func(t *testing.T) {
+			authConfig, err := official.ResolveRegistryAuth(testCase.image)
+			if err != nil {
+				t.Fatal("unexpected error:", err)
+			}
+			if authConfig.Username != testCase.username || authConfig.Password != testCase.password || authConfig.IdentityToken != testCase.identityToken {
+				t.Fatalf("unexpected auth config for %v: %+v", testCase.image, authConfig)
+			}
+		})
+	}
+}
+
+func TestResolveRegistryAuthEnvOverride(t *testing.T) {
+	defer setupDockerConfig(t)()
+	os.Setenv("CDFLOW2_DOCKER_AUTH_HELPER_EXAMPLE_COM_USERNAME", "env-user")
+	os.Setenv("CDFLOW2_DOCKER_AUTH_HELPER_EXAMPLE_COM_PASSWORD", "env-password")
+	defer os.Unsetenv("CDFLOW2_DOCKER_AUTH_HELPER_EXAMPLE_COM_USERNAME")
+	defer os.Unsetenv("CDFLOW2_DOCKER_AUTH_HELPER_EXAMPLE_COM_PASSWORD")
+
+	authConfig, err := official.ResolveRegistryAuth("helper.example.com/image")
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if authConfig.Username != "env-user" || authConfig.Password != "env-password" {
+		t.Fatalf("expected env vars to take priority, got: %+v", authConfig)
+	}
+}
+
+func TestResolveRegistryAuthHelperError(t *testing.T) {
+	defer setupDockerConfig(t)()
+
+	if _, err := official.ResolveRegistryAuth("broken.example.com/image"); err == nil {
+		t.Fatal("expected error from failing credential helper")
+	}
+}
@@ -3,28 +3,32 @@ package official
 import (
 	"bufio"
 	"context"
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
-	"github.com/docker/docker/registry"
 	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/docker/archive"
 	"github.com/mergermarket/cdflow2/util"
 )
 
 // Client is a concrete implementation of our docker interface that uses the official client library.
 type Client struct {
-	client      *client.Client
-	debugVolume string
+	client       *client.Client
+	debugVolume  string
+	labels       map[string]string
+	imageArchive string
+	archiveMutex sync.Mutex
+	archived     map[string]*archive.Entry
 }
 
 // NewClient creates and returns a new client.
@@ -34,7 +38,8 @@ func NewClient() (*Client, error) {
 		return nil, err
 	}
 	return &Client{
-		client: client,
+		client:   client,
+		archived: make(map[string]*archive.Entry),
 	}, nil
 }
 
@@ -43,8 +48,13 @@ func (dockerClient *Client) SetDebugVolume(volume string) {
 	dockerClient.debugVolume = volume
 }
 
+// SetLabels sets labels that will be added to each container and volume created.
+func (dockerClient *Client) SetLabels(labels map[string]string) {
+	dockerClient.labels = labels
+}
+
 // Run runs a container (much like `docker run` in the cli).
-func (dockerClient *Client) Run(options *docker.RunOptions) error {
+func (dockerClient *Client) Run(ctx context.Context, options *docker.RunOptions) error {
 	stdin := false
 	if options.InputStream != nil {
 		stdin = true
@@ -53,10 +63,11 @@ func (dockerClient *Client) Run(options *docker.RunOptions) error {
 	if dockerClient.debugVolume != "" {
 		binds = append(binds, dockerClient.debugVolume+":/debug")
 	}
+	name := util.RandomName(options.NamePrefix)
 	response, err := dockerClient.client.ContainerCreate(
-		context.Background(),
+		ctx,
 		&container.Config{
-			Image:        options.Image,
+			Image:        dockerClient.resolveImage(options.Image),
 			OpenStdin:    stdin,
 			AttachStdin:  stdin,
 			AttachStdout: true,
@@ -65,35 +76,45 @@ func (dockerClient *Client) Run(options *docker.RunOptions) error {
 			Entrypoint:   options.Entrypoint,
 			Cmd:          options.Cmd,
 			Env:          options.Env,
+			Labels:       dockerClient.labels,
+			User:         options.User,
 		},
-		&container.HostConfig{
+		hostConfigWithLimits(&container.HostConfig{
 			LogConfig: container.LogConfig{Type: "none"},
 			Binds:     binds,
 			Init:      &options.Init,
-		},
+			GroupAdd:  options.GroupAdd,
+		}, &options.Limits),
 		nil,
-		util.RandomName(options.NamePrefix),
+		name,
 	)
 	if err != nil {
-		return err
+		return dockerClient.createFailed(name, err, &options.Limits)
 	}
 
 	statusChannel := dockerClient.waitForContainerExit(response.ID)
 
-	if err := dockerClient.runContainer(response.ID, options.InputStream, options.OutputStream, options.ErrorStream, options.Started); err != nil {
-		return err
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go dockerClient.stopOnCancel(ctx, response.ID, stopped)
+
+	if err := dockerClient.runContainer(ctx, response.ID, options.InputStream, options.OutputStream, options.ErrorStream, options.Started); err != nil {
+		return limitsError(err, &options.Limits)
 	}
 
 	status := <-statusChannel
 	if status.err != nil {
-		return err
+		return status.err
 	}
 
-	if status.exitCode != options.SuccessStatus {
+	if ctx.Err() != nil || status.exitCode != options.SuccessStatus {
 		extra := ""
 		if err := dockerClient.client.ContainerRemove(context.Background(), response.ID, types.ContainerRemoveOptions{}); err != nil {
 			extra = "\nerror removing container: " + err.Error()
 		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("container stopped%s: %w", extra, ctx.Err())
+		}
 		return fmt.Errorf("container exited with unsuccessful exit code %d%s", status.exitCode, extra)
 	}
 
@@ -105,6 +126,63 @@ func (dockerClient *Client) Run(options *docker.RunOptions) error {
 	return dockerClient.client.ContainerRemove(context.Background(), response.ID, types.ContainerRemoveOptions{})
 }
 
+// createFailed handles an error creating a container. The create may still have succeeded in the daemon (e.g. if the
+// response timed out), so any container with the name is removed first - the error is only returned as a
+// docker.NotStartedError (so the caller can safely try again) once there is nothing left behind.
+func (dockerClient *Client) createFailed(name string, createErr error, limits *docker.Limits) error {
+	err := limitsError(createErr, limits)
+	if client.IsErrConnectionFailed(createErr) {
+		// the request never reached the daemon
+		return &docker.NotStartedError{Err: err}
+	}
+	if removeErr := dockerClient.client.ContainerRemove(context.Background(), name, types.ContainerRemoveOptions{
+		Force: true,
+	}); removeErr != nil && !client.IsErrNotFound(removeErr) {
+		return fmt.Errorf("%w, also error removing container %s that may have been created: %v", err, name, removeErr)
+	}
+	return &docker.NotStartedError{Err: err}
+}
+
+// hostConfigWithLimits adds resource limits and security options to the host config for a container.
+func hostConfigWithLimits(hostConfig *container.HostConfig, limits *docker.Limits) *container.HostConfig {
+	hostConfig.Memory = limits.Memory
+	hostConfig.NanoCPUs = int64(limits.CPUs * 1e9)
+	if limits.PidsLimit != 0 {
+		pidsLimit := limits.PidsLimit
+		hostConfig.PidsLimit = &pidsLimit
+	}
+	hostConfig.CapDrop = limits.CapDrop
+	if limits.ReadOnlyRootfs {
+		hostConfig.ReadonlyRootfs = true
+		// most tools need somewhere to write temporary files
+		hostConfig.Tmpfs = map[string]string{"/tmp": ""}
+	}
+	if limits.NoNewPrivileges {
+		hostConfig.SecurityOpt = []string{"no-new-privileges"}
+	}
+	return hostConfig
+}
+
+// limitsError adds context to an error creating or starting a container if limits were set, since the daemon
+// rejecting one of them (e.g. due to missing kernel support) is a likely cause.
+func limitsError(err error, limits *docker.Limits) error {
+	if limits.IsZero() {
+		return err
+	}
+	return fmt.Errorf("%w (the container had limits set in cdflow.yaml: %v - check these are supported by your docker daemon)", err, limits)
+}
+
+// stopOnCancel stops the container if the context is cancelled before stopped is closed.
+func (dockerClient *Client) stopOnCancel(ctx context.Context, id string, stopped chan struct{}) {
+	select {
+	case <-ctx.Done():
+		timeout := 10 * time.Second
+		// the context is already cancelled, so the stop itself needs a fresh one
+		dockerClient.client.ContainerStop(context.Background(), id, &timeout)
+	case <-stopped:
+	}
+}
+
 type status struct {
 	exitCode int
 	err      error
@@ -132,12 +210,12 @@ func (dockerClient *Client) waitForContainerExit(id string) chan status {
 	return statusChannel
 }
 
-func (dockerClient *Client) runContainer(id string, inputStream io.Reader, outputStream, errorStream io.Writer, started chan string) error {
+func (dockerClient *Client) runContainer(ctx context.Context, id string, inputStream io.Reader, outputStream, errorStream io.Writer, started chan string) error {
 	stdin := false
 	if inputStream != nil {
 		stdin = true
 	}
-	hijackedResponse, err := dockerClient.client.ContainerAttach(context.Background(), id, types.ContainerAttachOptions{
+	hijackedResponse, err := dockerClient.client.ContainerAttach(ctx, id, types.ContainerAttachOptions{
 		Stream: true,
 		Stdout: true,
 		Stderr: true,
@@ -149,7 +227,7 @@ func (dockerClient *Client) runContainer(id string, inputStream io.Reader, outpu
 
 	return dockerClient.streamHijackedResponse(hijackedResponse, inputStream, outputStream, errorStream, func() error {
 		if err := dockerClient.client.ContainerStart(
-			context.Background(),
+			ctx,
 			id,
 			types.ContainerStartOptions{},
 		); err != nil {
@@ -163,15 +241,20 @@ func (dockerClient *Client) runContainer(id string, inputStream io.Reader, outpu
 }
 
 // EnsureImage pulls an image if it does not exist locally.
-func (dockerClient *Client) EnsureImage(image string, outputStream io.Writer) error {
+func (dockerClient *Client) EnsureImage(ctx context.Context, image string, outputStream io.Writer) error {
+	// images in the image archive are registered even if they're already loaded, since their repo digests (lost by
+	// docker save/load) come from the archive index
+	if loaded, err := dockerClient.loadFromArchive(ctx, image, outputStream); err != nil || loaded {
+		return err
+	}
 	// TODO bit lax, this should check the error type
 	if _, _, err := dockerClient.client.ImageInspectWithRaw(
-		context.Background(),
+		ctx,
 		image,
 	); err == nil {
 		return nil
 	}
-	return dockerClient.PullImage(image, outputStream)
+	return dockerClient.PullImage(ctx, image, outputStream)
 }
 
 // PullProgressDetail is the progress returned from docker for an image pull.
@@ -186,16 +269,27 @@ type PullMessage struct {
 	Status         string
 	ProgressDetail PullProgressDetail
 	ID             string
+	Error          string
 }
 
-func writePullProgress(reader io.ReadCloser, outputStream io.Writer) error {
+// writePullProgress writes the progress of an image pull - through the PullProgress interface if outputStream
+// implements it (e.g. to combine the progress of concurrent pulls), otherwise as plain lines.
+func writePullProgress(reader io.ReadCloser, image string, outputStream io.Writer) error {
+	progress, isPullProgress := outputStream.(docker.PullProgress)
 	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
 		var message PullMessage
 		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
 			return err
 		}
-		if message.Status != "Downloading" && message.Status != "Extracting" {
+		if message.Error != "" {
+			// e.g. the registry failing part way through the pull
+			reader.Close()
+			return fmt.Errorf("error pulling image %s: %s", image, message.Error)
+		}
+		if isPullProgress {
+			progress.PullUpdate(image, message.ID, message.Status, message.ProgressDetail.Current, message.ProgressDetail.Total)
+		} else if message.Status != "Downloading" && message.Status != "Extracting" {
 			if message.ID != "" {
 				fmt.Fprintf(outputStream, "%s: %s\n", message.ID, message.Status)
 			} else {
@@ -209,45 +303,21 @@ func writePullProgress(reader io.ReadCloser, outputStream io.Writer) error {
 	return reader.Close()
 }
 
-func getRegistryAuthToLoginToRegistryOfImage(image string) (string, error) {
-	imageRegistry := registry.IndexHostname
-	if strings.Count(image, "/") > 1 {
-		imageRegistry = strings.Split(image, "/")[0]
+// PullImage pulls an image, using credentials found as described in ResolveRegistryAuth.
+func (dockerClient *Client) PullImage(ctx context.Context, image string, outputStream io.Writer) error {
+	if loaded, err := dockerClient.loadFromArchive(ctx, image, outputStream); err != nil || loaded {
+		return err
 	}
-
-	registryVarName := strings.ToUpper(
-		strings.NewReplacer(
-			".", "_",
-			":", "_",
-			"-", "_",
-		).Replace(imageRegistry),
-	)
-	cdflowDockerAuthPrefix := "CDFLOW2_DOCKER_AUTH_"
-	authBytes, err := json.Marshal(
-		types.AuthConfig{
-			Username: os.Getenv(cdflowDockerAuthPrefix + registryVarName + "_USERNAME"),
-			Password: os.Getenv(cdflowDockerAuthPrefix + registryVarName + "_PASSWORD"),
-		},
-	)
-
+	registryAuth, err := getRegistryAuthToLoginToRegistryOfImage(image)
 	if err != nil {
-		return "", err
+		return err
 	}
-
-	return base64.URLEncoding.EncodeToString(authBytes), nil
-}
-
-// PullImage pulls and image.
-func (dockerClient *Client) PullImage(image string, outputStream io.Writer) error {
-	RegistryAuth, err := getRegistryAuthToLoginToRegistryOfImage(image)
-	imagePullOptions := types.ImagePullOptions{}
-
-	if err == nil {
-		imagePullOptions.RegistryAuth = RegistryAuth
+	imagePullOptions := types.ImagePullOptions{
+		RegistryAuth: registryAuth,
 	}
 
 	reader, err := dockerClient.client.ImagePull(
-		context.Background(),
+		ctx,
 		image,
 		imagePullOptions,
 	)
@@ -255,20 +325,38 @@ func (dockerClient *Client) PullImage(image string, outputStream io.Writer) erro
 		return err
 	}
 
-	return writePullProgress(reader, outputStream)
+	return writePullProgress(reader, image, outputStream)
 }
 
 // GetImageRepoDigests inspects an image and pulls out the repo digests.
-func (dockerClient *Client) GetImageRepoDigests(image string) ([]string, error) {
-	details, _, err := dockerClient.client.ImageInspectWithRaw(context.Background(), image)
+func (dockerClient *Client) GetImageRepoDigests(ctx context.Context, image string) ([]string, error) {
+	// repo digests are lost by docker save/load, so use those recorded when the image was saved
+	if entry := dockerClient.archivedImage(image); entry != nil {
+		return entry.RepoDigests, nil
+	}
+	details, _, err := dockerClient.client.ImageInspectWithRaw(ctx, image)
 	if err != nil {
 		return nil, err
 	}
 	return details.RepoDigests, nil
 }
 
+// GetImageLabels inspects an image and returns its labels.
+func (dockerClient *Client) GetImageLabels(ctx context.Context, image string) (map[string]string, error) {
+	details, _, err := dockerClient.client.ImageInspectWithRaw(ctx, dockerClient.resolveImage(image))
+	if err != nil {
+		return nil, err
+	}
+	if details.Config == nil {
+		return nil, nil
+	}
+	return details.Config.Labels, nil
+}
+
 // Exec execs a process in a docker container (like `docker exec` in the cli).
-func (dockerClient *Client) Exec(options *docker.ExecOptions) error {
+// If the context is cancelled while the process is running it is interrupted (see interruptExecs) and Exec
+// waits for it to exit, so that e.g. terraform gets the chance to stop cleanly and release its state lock.
+func (dockerClient *Client) Exec(ctx context.Context, options *docker.ExecOptions) error {
 	stdin := false
 	if options.InputStream != nil {
 		stdin = true
@@ -279,7 +367,7 @@ func (dockerClient *Client) Exec(options *docker.ExecOptions) error {
 	}
 
 	exec, err := dockerClient.client.ContainerExecCreate(
-		context.Background(),
+		ctx,
 		options.ID,
 		types.ExecConfig{
 			AttachStdin:  stdin,
@@ -289,14 +377,15 @@ func (dockerClient *Client) Exec(options *docker.ExecOptions) error {
 			Env:          env,
 			Tty:          options.Tty,
 			WorkingDir:   options.WorkingDir,
+			User:         options.User,
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("error creating docker exec: %w", err)
+		return &docker.NotStartedError{Err: fmt.Errorf("error creating docker exec: %w", err)}
 	}
 
 	attachResponse, err := dockerClient.client.ContainerExecAttach(
-		context.Background(),
+		ctx,
 		exec.ID,
 		types.ExecStartCheck{},
 	)
@@ -305,6 +394,16 @@ func (dockerClient *Client) Exec(options *docker.ExecOptions) error {
 	}
 	defer attachResponse.Close() // does not return error
 
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			dockerClient.interruptExecs(options.ID)
+		case <-finished:
+		}
+	}()
+
 	if err := dockerClient.streamHijackedResponse(
 		attachResponse,
 		options.InputStream,
@@ -325,6 +424,10 @@ func (dockerClient *Client) Exec(options *docker.ExecOptions) error {
 		return fmt.Errorf("error inspecting exec: %w", err)
 	}
 
+	if ctx.Err() != nil {
+		return fmt.Errorf("exec process interrupted (exit status code %d): %w", details.ExitCode, ctx.Err())
+	}
+
 	if details.ExitCode != 0 {
 		return fmt.Errorf("exec process exited with error status code %d", details.ExitCode)
 	}
@@ -332,15 +435,37 @@ func (dockerClient *Client) Exec(options *docker.ExecOptions) error {
 	return nil
 }
 
+// interruptScript sends SIGINT to the top level processes started with docker exec - these are the processes
+// other than PID 1 with a parent outside of the container's PID namespace (i.e. a parent PID of 0).
+const interruptScript = `for dir in /proc/[0-9]*; do
+	pid="${dir#/proc/}"
+	if [ "$pid" = 1 ] || [ "$pid" = $$ ]; then continue; fi
+	set -- $(cat "$dir/stat" 2>/dev/null)
+	if [ "$4" = 0 ]; then kill -s INT "$pid"; fi
+done`
+
+// interruptExecs interrupts processes exec'd in a container (best effort - requires /bin/sh in the container).
+func (dockerClient *Client) interruptExecs(id string) {
+	// the context that triggered this has been cancelled, so this runs with a fresh one
+	exec, err := dockerClient.client.ContainerExecCreate(context.Background(), id, types.ExecConfig{
+		Cmd: []string{"/bin/sh", "-c", interruptScript},
+	})
+	if err != nil {
+		return
+	}
+	dockerClient.client.ContainerExecStart(context.Background(), exec.ID, types.ExecStartCheck{Detach: true})
+}
+
 // Stop stops a container.
-func (dockerClient *Client) Stop(id string, timeout time.Duration) error {
-	return dockerClient.client.ContainerStop(context.Background(), id, &timeout)
+func (dockerClient *Client) Stop(ctx context.Context, id string, timeout time.Duration) error {
+	return dockerClient.client.ContainerStop(ctx, id, &timeout)
 }
 
 // CreateVolume creates a docker volume and returns its ID.
-func (dockerClient *Client) CreateVolume(name string) (string, error) {
-	volume, err := dockerClient.client.VolumeCreate(context.Background(), volume.VolumeCreateBody{
-		Name: name,
+func (dockerClient *Client) CreateVolume(ctx context.Context, name string) (string, error) {
+	volume, err := dockerClient.client.VolumeCreate(ctx, volume.VolumeCreateBody{
+		Name:   name,
+		Labels: dockerClient.labels,
 	})
 	if err != nil {
 		return "", err
@@ -349,13 +474,13 @@ func (dockerClient *Client) CreateVolume(name string) (string, error) {
 }
 
 // RemoveVolume removes a docker volume given its ID.
-func (dockerClient *Client) RemoveVolume(id string) error {
-	return dockerClient.client.VolumeRemove(context.Background(), id, false)
+func (dockerClient *Client) RemoveVolume(ctx context.Context, id string) error {
+	return dockerClient.client.VolumeRemove(ctx, id, false)
 }
 
 // VolumeExists checks if a named volume exists.
-func (dockerClient *Client) VolumeExists(name string) (bool, error) {
-	_, err := dockerClient.client.VolumeInspect(context.Background(), name)
+func (dockerClient *Client) VolumeExists(ctx context.Context, name string) (bool, error) {
+	_, err := dockerClient.client.VolumeInspect(ctx, name)
 	if err != nil {
 		if client.IsErrNotFound(err) {
 			return false, nil
@@ -366,11 +491,12 @@ func (dockerClient *Client) VolumeExists(name string) (bool, error) {
 }
 
 // CreateContainer creates a docker container.
-func (dockerClient *Client) CreateContainer(options *docker.CreateContainerOptions) (string, error) {
+func (dockerClient *Client) CreateContainer(ctx context.Context, options *docker.CreateContainerOptions) (string, error) {
 	container, err := dockerClient.client.ContainerCreate(
-		context.Background(),
+		ctx,
 		&container.Config{
-			Image: options.Image,
+			Image:  dockerClient.resolveImage(options.Image),
+			Labels: dockerClient.labels,
 		},
 		&container.HostConfig{
 			Binds: options.Binds,
@@ -385,19 +511,65 @@ func (dockerClient *Client) CreateContainer(options *docker.CreateContainerOptio
 }
 
 // RemoveContainer removes a docker container.
-func (dockerClient *Client) RemoveContainer(id string) error {
-	return dockerClient.client.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{})
+func (dockerClient *Client) RemoveContainer(ctx context.Context, id string) error {
+	return dockerClient.client.ContainerRemove(ctx, id, types.ContainerRemoveOptions{})
+}
+
+// ListContainers lists all containers (running or not) that have a label.
+func (dockerClient *Client) ListContainers(ctx context.Context, label string) ([]*docker.Resource, error) {
+	containers, err := dockerClient.client.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", label)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*docker.Resource, len(containers))
+	for i, container := range containers {
+		name := ""
+		if len(container.Names) > 0 {
+			name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		result[i] = &docker.Resource{
+			ID:      container.ID,
+			Name:    name,
+			Labels:  container.Labels,
+			Created: time.Unix(container.Created, 0),
+			Running: container.State == "running",
+		}
+	}
+	return result, nil
+}
+
+// ListVolumes lists all volumes that have a label.
+func (dockerClient *Client) ListVolumes(ctx context.Context, label string) ([]*docker.Resource, error) {
+	volumes, err := dockerClient.client.VolumeList(ctx, filters.NewArgs(filters.Arg("label", label)))
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*docker.Resource, len(volumes.Volumes))
+	for i, volume := range volumes.Volumes {
+		// zero if missing or unparseable, which is treated as old
+		created, _ := time.Parse(time.RFC3339, volume.CreatedAt)
+		result[i] = &docker.Resource{
+			ID:      volume.Name,
+			Name:    volume.Name,
+			Labels:  volume.Labels,
+			Created: created,
+		}
+	}
+	return result, nil
 }
 
 // CopyFromContainer returns a tar stream for a path within a container (like `docker cp CONTAINER -`).
-func (dockerClient *Client) CopyFromContainer(id string, path string) (io.ReadCloser, error) {
-	reader, _, err := dockerClient.client.CopyFromContainer(context.Background(), id, path)
+func (dockerClient *Client) CopyFromContainer(ctx context.Context, id string, path string) (io.ReadCloser, error) {
+	reader, _, err := dockerClient.client.CopyFromContainer(ctx, id, path)
 	return reader, err
 }
 
 // CopyToContainer takes a tar stream and copies it into the container.
-func (dockerClient *Client) CopyToContainer(id string, path string, reader io.Reader) error {
-	return dockerClient.client.CopyToContainer(context.Background(), id, path, reader, types.CopyToContainerOptions{})
+func (dockerClient *Client) CopyToContainer(ctx context.Context, id string, path string, reader io.Reader) error {
+	return dockerClient.client.CopyToContainer(ctx, id, path, reader, types.CopyToContainerOptions{})
 }
 
 func (dockerClient *Client) streamHijackedResponse(hijackedResponse types.HijackedResponse, inputStream io.Reader, outputStream, errorStream io.Writer, start func() error) error {
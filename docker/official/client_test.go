@@ -2,7 +2,14 @@ package official_test
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/mergermarket/cdflow2/docker"
@@ -20,12 +27,12 @@ func TestRun(t *testing.T) {
 	var errorBuffer bytes.Buffer
 
 	image := "alpine:latest"
-	if err := dockerClient.EnsureImage(image, nil); err != nil {
+	if err := dockerClient.EnsureImage(context.Background(), image, nil); err != nil {
 		log.Panicln("could not pull image:", err)
 	}
 
 	// When
-	if err := dockerClient.Run(&docker.RunOptions{
+	if err := dockerClient.Run(context.Background(), &docker.RunOptions{
 		Image:        image,
 		OutputStream: &outputBuffer,
 		ErrorStream:  &errorBuffer,
@@ -48,3 +55,82 @@ func TestRun(t *testing.T) {
 		log.Panicf("unexpected output: %#v", outputBuffer.String())
 	}
 }
+
+// fakeDaemon simulates a docker daemon whose container create fails (as if it timed out after creating the
+// container), recording the containers removed.
+func fakeDaemon(t *testing.T, removeStatus int) (*official.Client, func() (string, []string), func()) {
+	var mutex sync.Mutex
+	var created string
+	var removed []string
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch {
+		case request.Method == http.MethodPost && strings.HasSuffix(request.URL.Path, "/containers/create"):
+			created = request.URL.Query().Get("name")
+			http.Error(response, `{"message":"timed out"}`, http.StatusInternalServerError)
+		case request.Method == http.MethodDelete && strings.Contains(request.URL.Path, "/containers/"):
+			if request.URL.Query().Get("force") != "1" {
+				t.Error("expected forced remove, got:", request.URL.RawQuery)
+			}
+			removed = append(removed, request.URL.Path[strings.LastIndex(request.URL.Path, "/")+1:])
+			http.Error(response, `{"message":"remove failed"}`, removeStatus)
+		default:
+			t.Error("unexpected request:", request.Method, request.URL.Path)
+			http.Error(response, `{"message":"unexpected"}`, http.StatusNotImplemented)
+		}
+	}))
+	oldHost, oldVersion := os.Getenv("DOCKER_HOST"), os.Getenv("DOCKER_API_VERSION")
+	os.Setenv("DOCKER_HOST", "tcp://"+server.Listener.Addr().String())
+	os.Setenv("DOCKER_API_VERSION", "1.40")
+	defer func() {
+		os.Setenv("DOCKER_HOST", oldHost)
+		os.Setenv("DOCKER_API_VERSION", oldVersion)
+	}()
+	dockerClient, err := official.NewClient()
+	if err != nil {
+		t.Fatal("error creating docker client:", err)
+	}
+	return dockerClient, func() (string, []string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return created, removed
+	}, server.Close
+}
+
+func TestRunRemovesContainerAfterFailedCreate(t *testing.T) {
+	// Given
+	dockerClient, requests, stop := fakeDaemon(t, http.StatusNoContent)
+	defer stop()
+
+	// When
+	err := dockerClient.Run(context.Background(), &docker.RunOptions{Image: "alpine:latest", NamePrefix: "cdflow2-test"})
+
+	// Then
+	var notStarted *docker.NotStartedError
+	if !errors.As(err, &notStarted) {
+		t.Fatal("expected not started error, got:", err)
+	}
+	created, removed := requests()
+	if !strings.HasPrefix(created, "cdflow2-test-") || len(removed) != 1 || removed[0] != created {
+		t.Fatalf("expected container %q to be removed, got: %v", created, removed)
+	}
+}
+
+func TestRunFailedCreateNotRetryableIfNotRemoved(t *testing.T) {
+	// Given
+	dockerClient, requests, stop := fakeDaemon(t, http.StatusInternalServerError)
+	defer stop()
+
+	// When
+	err := dockerClient.Run(context.Background(), &docker.RunOptions{Image: "alpine:latest", NamePrefix: "cdflow2-test"})
+
+	// Then
+	var notStarted *docker.NotStartedError
+	if err == nil || errors.As(err, &notStarted) {
+		t.Fatal("expected error that isn't safe to retry, got:", err)
+	}
+	if created, _ := requests(); !strings.Contains(err.Error(), created) {
+		t.Fatal("expected error to name the container, got:", err)
+	}
+}
@@ -0,0 +1,61 @@
+package official
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/mergermarket/cdflow2/docker/proxy"
+)
+
+// ProxyDockerSocket starts a proxy giving restricted access to the docker API (see the proxy package) on a unix socket,
+// returning the path of the socket (for binding into a container run as user) and a function to stop the proxy.
+func (dockerClient *Client) ProxyDockerSocket(ctx context.Context, user string) (string, func() error, error) {
+	dir, err := ioutil.TempDir("", "cdflow2-docker-proxy")
+	if err != nil {
+		return "", nil, err
+	}
+	socket := filepath.Join(dir, "docker.sock")
+	var listenConfig net.ListenConfig
+	listener, err := listenConfig.Listen(ctx, "unix", socket)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", nil, fmt.Errorf("error listening on docker proxy socket: %w", err)
+	}
+	// only the container user (or root, if that's empty) can connect
+	if err := restrictSocket(socket, user); err != nil {
+		listener.Close()
+		os.RemoveAll(dir)
+		return "", nil, err
+	}
+
+	server := &http.Server{Handler: proxy.New(dockerClient.client.Dialer())}
+	go server.Serve(listener)
+
+	return socket, func() error {
+		err := server.Close()
+		if removeErr := os.RemoveAll(dir); err == nil {
+			err = removeErr
+		}
+		return err
+	}, nil
+}
+
+// restrictSocket makes the socket accessible only to its owner, which is changed to user ("UID:GID") if set.
+func restrictSocket(socket, user string) error {
+	if err := os.Chmod(socket, 0600); err != nil {
+		return err
+	}
+	if user == "" {
+		return nil
+	}
+	var uid, gid int
+	if _, err := fmt.Sscanf(user, "%d:%d", &uid, &gid); err != nil {
+		return fmt.Errorf("invalid container user %q: %w", user, err)
+	}
+	return os.Chown(socket, uid, gid)
+}
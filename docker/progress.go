@@ -0,0 +1,10 @@
+package docker
+
+import "io"
+
+// PullProgress receives progress for image pulls. If the output stream passed to PullImage implements it then
+// progress is reported through it (including per-layer download progress), otherwise it is written as text lines.
+type PullProgress interface {
+	io.Writer
+	PullUpdate(image, layer, status string, current, total int64)
+}
@@ -0,0 +1,207 @@
+// Package progress renders the combined progress of concurrent image pulls.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// renderInterval limits how often the progress is redrawn for download progress (status changes are drawn immediately).
+const renderInterval = 100 * time.Millisecond
+
+const barWidth = 30
+
+// Renderer renders the progress of one or more concurrent image pulls. When writing to a terminal it shows a line per
+// layer that is updated in place, otherwise it writes a plain line for each change in status (skipping download and
+// extract progress).
+type Renderer struct {
+	mutex      sync.Mutex
+	out        io.Writer
+	tty        bool
+	images     []*image
+	lines      int
+	lastRender time.Time
+	now        func() time.Time
+}
+
+type image struct {
+	name   string
+	status string
+	layers []*layer
+}
+
+type layer struct {
+	id      string
+	status  string
+	current int64
+	total   int64
+}
+
+// New creates a renderer writing to out, redrawing in place if tty is true.
+func New(out io.Writer, tty bool) *Renderer {
+	return &Renderer{out: out, tty: tty, now: time.Now}
+}
+
+// NewForStream creates a renderer writing to out, redrawing in place if out is a terminal.
+func NewForStream(out io.Writer) *Renderer {
+	return New(out, IsTerminal(out))
+}
+
+// wrapper is implemented by writers that wrap another stream (e.g. to redact secrets), so whether the stream they
+// write to is a terminal can be checked.
+type wrapper interface {
+	Unwrap() io.Writer
+}
+
+// IsTerminal returns true if the stream (or the stream it wraps) is a terminal.
+func IsTerminal(stream io.Writer) bool {
+	for {
+		wrapped, ok := stream.(wrapper)
+		if !ok {
+			break
+		}
+		stream = wrapped.Unwrap()
+	}
+	file, ok := stream.(*os.File)
+	if !ok {
+		return false
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+func (renderer *Renderer) getImage(name string) *image {
+	for _, image := range renderer.images {
+		if image.name == name {
+			return image
+		}
+	}
+	result := &image{name: name}
+	renderer.images = append(renderer.images, result)
+	return result
+}
+
+func (image *image) getLayer(id string) *layer {
+	for _, layer := range image.layers {
+		if layer.id == id {
+			return layer
+		}
+	}
+	result := &layer{id: id}
+	image.layers = append(image.layers, result)
+	return result
+}
+
+// PullUpdate records progress for a layer of an image being pulled (or for the image as a whole if layer is empty).
+func (renderer *Renderer) PullUpdate(imageName, layerID, status string, current, total int64) {
+	renderer.mutex.Lock()
+	defer renderer.mutex.Unlock()
+
+	if !renderer.tty {
+		if status == "Downloading" || status == "Extracting" {
+			return
+		}
+		if layerID != "" {
+			fmt.Fprintf(renderer.out, "%s: %s: %s\n", imageName, layerID, status)
+		} else {
+			fmt.Fprintf(renderer.out, "%s: %s\n", imageName, status)
+		}
+		return
+	}
+
+	image := renderer.getImage(imageName)
+	changed := false
+	if layerID == "" {
+		changed = image.status != status
+		image.status = status
+	} else {
+		layer := image.getLayer(layerID)
+		changed = layer.status != status
+		layer.status = status
+		layer.current = current
+		layer.total = total
+	}
+	if changed || renderer.now().Sub(renderer.lastRender) >= renderInterval {
+		renderer.render()
+	}
+}
+
+// Write writes text output (e.g. from something other than a pull), keeping it above the progress when redrawing.
+func (renderer *Renderer) Write(p []byte) (int, error) {
+	renderer.mutex.Lock()
+	defer renderer.mutex.Unlock()
+	if !renderer.tty {
+		return renderer.out.Write(p)
+	}
+	renderer.clear()
+	n, err := renderer.out.Write(p)
+	renderer.lines = 0
+	renderer.render()
+	return n, err
+}
+
+// Close draws the final state of the progress - output written after this will appear below it.
+func (renderer *Renderer) Close() error {
+	renderer.mutex.Lock()
+	defer renderer.mutex.Unlock()
+	if renderer.tty {
+		renderer.render()
+		renderer.images = nil
+		renderer.lines = 0
+	}
+	return nil
+}
+
+// clear moves the cursor back to the start of the progress display, clearing it.
+func (renderer *Renderer) clear() {
+	if renderer.lines > 0 {
+		fmt.Fprintf(renderer.out, "\x1b[%dA\x1b[J", renderer.lines)
+	}
+}
+
+func (renderer *Renderer) render() {
+	var builder strings.Builder
+	lines := 0
+	for _, image := range renderer.images {
+		status := image.status
+		if status == "" {
+			status = "Pulling"
+		}
+		fmt.Fprintf(&builder, "%s: %s\x1b[K\n", image.name, status)
+		lines++
+		for _, layer := range image.layers {
+			fmt.Fprintf(&builder, "  %s: %s%s\x1b[K\n", layer.id, layer.status, formatProgress(layer.current, layer.total))
+			lines++
+		}
+	}
+	if renderer.lines > 0 {
+		fmt.Fprintf(renderer.out, "\x1b[%dA", renderer.lines)
+	}
+	io.WriteString(renderer.out, builder.String())
+	renderer.lines = lines
+	renderer.lastRender = renderer.now()
+}
+
+func formatProgress(current, total int64) string {
+	if total <= 0 {
+		return ""
+	}
+	if current > total {
+		current = total
+	}
+	filled := int(current * barWidth / total)
+	bar := strings.Repeat("=", filled)
+	if filled < barWidth {
+		bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+	}
+	return fmt.Sprintf(" [%s] %s/%s", bar, units.HumanSize(float64(current)), units.HumanSize(float64(total)))
+}
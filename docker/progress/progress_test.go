@@ -0,0 +1,83 @@
+package progress_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/docker/progress"
+	"github.com/mergermarket/cdflow2/redact"
+)
+
+func TestPlain(t *testing.T) {
+	// Given
+	var output bytes.Buffer
+	renderer := progress.New(&output, false)
+
+	// When
+	renderer.PullUpdate("alpine:latest", "abc", "Pulling fs layer", 0, 0)
+	renderer.PullUpdate("alpine:latest", "abc", "Downloading", 10, 100)
+	renderer.PullUpdate("alpine:latest", "abc", "Pull complete", 0, 0)
+	renderer.Write([]byte("other output\n"))
+	renderer.PullUpdate("alpine:latest", "", "Status: Downloaded newer image for alpine:latest", 0, 0)
+	renderer.Close()
+
+	// Then
+	expected := "alpine:latest: abc: Pulling fs layer\n" +
+		"alpine:latest: abc: Pull complete\n" +
+		"other output\n" +
+		"alpine:latest: Status: Downloaded newer image for alpine:latest\n"
+	if output.String() != expected {
+		t.Fatalf("unexpected output:\n%q", output.String())
+	}
+}
+
+func TestTerminal(t *testing.T) {
+	// Given
+	var output bytes.Buffer
+	renderer := progress.New(&output, true)
+
+	// When
+	renderer.PullUpdate("alpine:latest", "abc", "Downloading", 50, 100)
+	renderer.PullUpdate("terraform:latest", "def", "Downloading", 100, 100)
+	renderer.PullUpdate("alpine:latest", "abc", "Pull complete", 0, 0)
+	renderer.Close()
+
+	// Then
+	// the last render is after the cursor was last moved up
+	renders := strings.Split(output.String(), "\x1b[4A")
+	last := strings.Replace(renders[len(renders)-1], "\x1b[K", "", -1)
+	expected := "alpine:latest: Pulling\n" +
+		"  abc: Pull complete\n" +
+		"terraform:latest: Pulling\n" +
+		"  def: Downloading [==============================] 100B/100B\n"
+	if last != expected {
+		t.Fatalf("unexpected final render:\n%q", last)
+	}
+	if !strings.Contains(output.String(), "[===============>              ] 50B/100B") {
+		t.Fatalf("expected progress bar in output:\n%q", output.String())
+	}
+}
+
+func TestIsTerminalWrapped(t *testing.T) {
+	// Given
+	// a character device, as a terminal is
+	device, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("no", os.DevNull)
+	}
+	defer device.Close()
+
+	// When
+	wrapped := progress.IsTerminal(redact.NewWriter(device, redact.NewSecrets()))
+	buffered := progress.IsTerminal(redact.NewWriter(&bytes.Buffer{}, redact.NewSecrets()))
+
+	// Then
+	if !wrapped {
+		t.Fatal("expected a redacted terminal stream to be a terminal")
+	}
+	if buffered {
+		t.Fatal("expected a redacted buffer not to be a terminal")
+	}
+}
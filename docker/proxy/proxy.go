@@ -0,0 +1,340 @@
+// Package proxy implements a filtering proxy for the docker API, used to give build containers restricted access to docker.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Proxy is an http.Handler that forwards a subset of the docker API to the docker daemon - enough to build, push and
+// inspect images and to run unprivileged containers, but not to create privileged containers or touch containers or
+// volumes it didn't create.
+type Proxy struct {
+	reverseProxy *httputil.ReverseProxy
+	mutex        sync.Mutex
+	containers   map[string]bool
+	volumes      map[string]bool
+}
+
+// New creates a proxy that connects to the docker daemon using the passed dial function.
+func New(dial func(ctx context.Context) (net.Conn, error)) *Proxy {
+	return NewWithTransport(&http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx)
+		},
+	}, &url.URL{Scheme: "http", Host: "docker"})
+}
+
+// NewWithTransport creates a proxy that forwards requests to target using the passed transport.
+func NewWithTransport(transport http.RoundTripper, target *url.URL) *Proxy {
+	proxy := &Proxy{containers: make(map[string]bool), volumes: make(map[string]bool)}
+	proxy.reverseProxy = httputil.NewSingleHostReverseProxy(target)
+	proxy.reverseProxy.Transport = transport
+	// build and push output is streamed
+	proxy.reverseProxy.FlushInterval = -1
+	proxy.reverseProxy.ModifyResponse = proxy.recordCreated
+	return proxy
+}
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9]+(\.[0-9]+)*/`)
+
+type rule struct {
+	method string
+	path   *regexp.Regexp
+}
+
+var allowedRules = []rule{
+	{"GET", regexp.MustCompile(`^/_ping$`)},
+	{"HEAD", regexp.MustCompile(`^/_ping$`)},
+	{"GET", regexp.MustCompile(`^/version$`)},
+	{"GET", regexp.MustCompile(`^/info$`)},
+	{"POST", regexp.MustCompile(`^/build$`)},
+	{"POST", regexp.MustCompile(`^/session$`)},
+	{"GET", regexp.MustCompile(`^/images/json$`)},
+	{"GET", regexp.MustCompile(`^/images/.+/json$`)},
+	{"GET", regexp.MustCompile(`^/images/.+/history$`)},
+	{"POST", regexp.MustCompile(`^/images/create$`)},
+	{"POST", regexp.MustCompile(`^/images/.+/push$`)},
+	{"POST", regexp.MustCompile(`^/images/.+/tag$`)},
+}
+
+var containerPath = regexp.MustCompile(`^/containers/([^/]+)(/(start|wait|attach|stop|kill|resize|json|logs))?$`)
+
+var volumePath = regexp.MustCompile(`^/volumes/([^/]+)$`)
+
+func forbidden(w http.ResponseWriter, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "cdflow2 restricted docker socket: " + message,
+	})
+}
+
+// ServeHTTP forwards the request to the docker daemon if it is allowed, otherwise it responds with 403 Forbidden.
+func (proxy *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := versionPrefix.ReplaceAllString(r.URL.Path, "/")
+
+	for _, rule := range allowedRules {
+		if r.Method == rule.method && rule.path.MatchString(path) {
+			if path == "/build" {
+				if err := checkBuild(r.URL.Query()); err != nil {
+					forbidden(w, err.Error())
+					return
+				}
+			}
+			proxy.reverseProxy.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	if r.Method == "POST" && (path == "/containers/create" || path == "/volumes/create") {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		check := proxy.checkCreateContainer
+		if path == "/volumes/create" {
+			check = checkCreateVolume
+		}
+		if err := check(body); err != nil {
+			forbidden(w, err.Error())
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		proxy.reverseProxy.ServeHTTP(w, r)
+		return
+	}
+
+	if match := volumePath.FindStringSubmatch(path); match != nil && (r.Method == "GET" || r.Method == "DELETE") {
+		if !proxy.isOwnVolume(match[1]) {
+			forbidden(w, "only volumes created through this socket can be accessed")
+			return
+		}
+		proxy.reverseProxy.ServeHTTP(w, r)
+		return
+	}
+
+	if match := containerPath.FindStringSubmatch(path); match != nil {
+		operation := match[3]
+		allowedMethod := "POST"
+		if operation == "" {
+			allowedMethod = "DELETE"
+		} else if operation == "json" || operation == "logs" {
+			allowedMethod = "GET"
+		}
+		if r.Method == allowedMethod {
+			if !proxy.isOwnContainer(match[1]) {
+				forbidden(w, "only containers created through this socket can be accessed")
+				return
+			}
+			proxy.reverseProxy.ServeHTTP(w, r)
+			return
+		}
+	}
+
+	forbidden(w, fmt.Sprintf("%s %s is not allowed", r.Method, path))
+}
+
+func (proxy *Proxy) isOwnContainer(idOrName string) bool {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	return proxy.containers[idOrName]
+}
+
+func (proxy *Proxy) isOwnVolume(name string) bool {
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	return proxy.volumes[name]
+}
+
+// recordCreated records the ID and name of containers and the name of volumes created through the proxy, so they can
+// be accessed.
+func (proxy *Proxy) recordCreated(response *http.Response) error {
+	path := versionPrefix.ReplaceAllString(response.Request.URL.Path, "/")
+	if (path != "/containers/create" && path != "/volumes/create") || response.StatusCode != http.StatusCreated {
+		return nil
+	}
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	response.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var created struct {
+		ID   string `json:"Id"`
+		Name string
+	}
+	if err := json.Unmarshal(body, &created); err != nil {
+		return fmt.Errorf("error decoding create response: %w", err)
+	}
+
+	proxy.mutex.Lock()
+	defer proxy.mutex.Unlock()
+	if path == "/volumes/create" {
+		proxy.volumes[created.Name] = true
+		return nil
+	}
+	proxy.containers[created.ID] = true
+	if name := response.Request.URL.Query().Get("name"); name != "" {
+		proxy.containers[name] = true
+	}
+	return nil
+}
+
+// isSharedNamespace returns true if a namespace mode (e.g. NetworkMode) shares the host's or another container's.
+func isSharedNamespace(mode string) bool {
+	return mode == "host" || strings.HasPrefix(mode, "container:")
+}
+
+// checkBuild returns an error if a build would run with access to the host or another container.
+func checkBuild(query url.Values) error {
+	if isSharedNamespace(query.Get("networkmode")) {
+		return fmt.Errorf("builds sharing host or container networking are not allowed")
+	}
+	if query.Get("cgroupparent") != "" {
+		return fmt.Errorf("builds with a cgroup parent are not allowed")
+	}
+	return nil
+}
+
+type createContainerRequest struct {
+	HostConfig struct {
+		Privileged bool
+		CapAdd     []string
+		Binds      []string
+		Mounts     []struct {
+			Type          string
+			Source        string
+			VolumeOptions *struct {
+				DriverConfig *struct {
+					Name    string
+					Options map[string]string
+				}
+			}
+		}
+		VolumesFrom       []string
+		Devices           []json.RawMessage
+		DeviceCgroupRules []string
+		DeviceRequests    []json.RawMessage
+		SecurityOpt       []string
+		// any value (even an empty list) replaces the default paths masked or made read only, e.g. in /proc
+		MaskedPaths   json.RawMessage
+		ReadonlyPaths json.RawMessage
+		Sysctls       map[string]string
+		Runtime       string
+		NetworkMode   string
+		PidMode       string
+		IpcMode       string
+		UTSMode       string
+		UsernsMode    string
+		CgroupnsMode  string
+		Cgroup        string
+		CgroupParent  string
+	}
+}
+
+// isSet returns true if a field decoded as a json.RawMessage was present and not null.
+func isSet(value json.RawMessage) bool {
+	return len(value) != 0 && string(value) != "null"
+}
+
+// checkCreateContainer returns an error if the request to create a container would give it privileges on the host or
+// access to volumes not created through the proxy.
+func (proxy *Proxy) checkCreateContainer(body []byte) error {
+	var request createContainerRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return fmt.Errorf("error decoding create container request: %w", err)
+	}
+	hostConfig := request.HostConfig
+	if hostConfig.Privileged {
+		return fmt.Errorf("privileged containers are not allowed")
+	}
+	if len(hostConfig.CapAdd) != 0 {
+		return fmt.Errorf("adding capabilities is not allowed")
+	}
+	for _, bind := range hostConfig.Binds {
+		source := strings.SplitN(bind, ":", 2)[0]
+		if strings.ContainsAny(source, `/\`) || strings.HasPrefix(source, ".") {
+			return fmt.Errorf("bind mounting host paths is not allowed")
+		}
+		if !proxy.isOwnVolume(source) {
+			return fmt.Errorf("volume %s was not created through this socket", source)
+		}
+	}
+	for _, mount := range hostConfig.Mounts {
+		if mount.Type != "volume" && mount.Type != "tmpfs" {
+			return fmt.Errorf("%s mounts are not allowed", mount.Type)
+		}
+		// the local driver can bind mount host paths (e.g. with o=bind and device=/)
+		if mount.VolumeOptions != nil && mount.VolumeOptions.DriverConfig != nil &&
+			(mount.VolumeOptions.DriverConfig.Name != "" || len(mount.VolumeOptions.DriverConfig.Options) != 0) {
+			return fmt.Errorf("volume driver config is not allowed")
+		}
+		// an empty source is an anonymous volume
+		if mount.Type == "volume" && mount.Source != "" && !proxy.isOwnVolume(mount.Source) {
+			return fmt.Errorf("volume %s was not created through this socket", mount.Source)
+		}
+	}
+	if len(hostConfig.VolumesFrom) != 0 {
+		return fmt.Errorf("mounting volumes from other containers is not allowed")
+	}
+	if len(hostConfig.Devices) != 0 || len(hostConfig.DeviceCgroupRules) != 0 || len(hostConfig.DeviceRequests) != 0 {
+		return fmt.Errorf("devices are not allowed")
+	}
+	if isSet(hostConfig.MaskedPaths) || isSet(hostConfig.ReadonlyPaths) {
+		return fmt.Errorf("changing masked or read only paths is not allowed")
+	}
+	if len(hostConfig.Sysctls) != 0 {
+		return fmt.Errorf("sysctls are not allowed")
+	}
+	if hostConfig.Runtime != "" && hostConfig.Runtime != "runc" {
+		return fmt.Errorf("runtime %s is not allowed", hostConfig.Runtime)
+	}
+	if hostConfig.CgroupnsMode == "host" || hostConfig.Cgroup != "" || hostConfig.CgroupParent != "" {
+		return fmt.Errorf("sharing host or container cgroups is not allowed")
+	}
+	for _, option := range hostConfig.SecurityOpt {
+		if option != "no-new-privileges" && option != "no-new-privileges:true" {
+			return fmt.Errorf("security option %s is not allowed", option)
+		}
+	}
+	for _, mode := range []string{hostConfig.NetworkMode, hostConfig.PidMode, hostConfig.IpcMode, hostConfig.UTSMode, hostConfig.UsernsMode} {
+		if isSharedNamespace(mode) {
+			return fmt.Errorf("sharing host or container namespaces is not allowed")
+		}
+	}
+	return nil
+}
+
+type createVolumeRequest struct {
+	Driver     string
+	DriverOpts map[string]string
+}
+
+// checkCreateVolume returns an error if the request to create a volume could give access to the host - i.e. uses
+// driver options (the local driver can bind mount host paths) or a driver other than local.
+func checkCreateVolume(body []byte) error {
+	var request createVolumeRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return fmt.Errorf("error decoding create volume request: %w", err)
+	}
+	if request.Driver != "" && request.Driver != "local" {
+		return fmt.Errorf("volume driver %s is not allowed", request.Driver)
+	}
+	if len(request.DriverOpts) != 0 {
+		return fmt.Errorf("volume driver options are not allowed")
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package proxy_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/docker/proxy"
+)
+
+func setup(t *testing.T) (*httptest.Server, *[]string) {
+	var forwarded []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.Method+" "+r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/containers/create") {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id":"created-id"}`))
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/volumes/create") {
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Name":"created-volume"}`))
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	target, err := url.Parse(upstream.URL)
+	if err != nil {
+		t.Fatal("error parsing upstream url:", err)
+	}
+	server := httptest.NewServer(proxy.NewWithTransport(http.DefaultTransport, target))
+	return server, &forwarded
+}
+
+func request(t *testing.T, server *httptest.Server, method, path, body string) int {
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal("error creating request:", err)
+	}
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("error making request:", err)
+	}
+	defer response.Body.Close()
+	ioutil.ReadAll(response.Body)
+	return response.StatusCode
+}
+
+func TestAllowed(t *testing.T) {
+	// Given
+	server, forwarded := setup(t)
+	defer server.Close()
+
+	for _, testCase := range []struct{ method, path string }{
+		{"GET", "/_ping"},
+		{"GET", "/v1.40/version"},
+		{"POST", "/v1.40/build?t=test"},
+		{"POST", "/v1.40/images/registry.example.com/team/image:1/push"},
+		{"GET", "/v1.40/images/image:1/json"},
+	} {
+		// When
+		status := request(t, server, testCase.method, testCase.path, "")
+
+		// Then
+		if status != http.StatusOK {
+			t.Fatalf("expected %s %s to be allowed, got status %d", testCase.method, testCase.path, status)
+		}
+	}
+	if len(*forwarded) != 5 {
+		t.Fatal("expected all requests to be forwarded, got:", *forwarded)
+	}
+}
+
+func TestForbidden(t *testing.T) {
+	// Given
+	server, forwarded := setup(t)
+	defer server.Close()
+
+	for _, testCase := range []struct{ method, path, body string }{
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"Privileged":true}}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"Binds":["/:/host"]}}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"CapAdd":["SYS_ADMIN"]}}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"PidMode":"host"}}`},
+		{"POST", "/v1.40/containers/other-id/start", ""},
+		{"POST", "/v1.40/containers/other-id/exec", ""},
+		{"DELETE", "/v1.40/images/image:1", ""},
+		{"POST", "/v1.40/build?networkmode=host", ""},
+		{"GET", "/v1.40/volumes", ""},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"Mounts":[{"Type":"volume","VolumeOptions":{"DriverConfig":{"Name":"local","Options":{"o":"bind","device":"/"}}}}]}}`},
+		{"POST", "/v1.40/volumes/create", `{"Name":"host","DriverOpts":{"o":"bind","device":"/","type":"none"}}`},
+		{"POST", "/v1.40/volumes/create", `{"Name":"remote","Driver":"other"}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"DeviceCgroupRules":["c 1:3 mr"]}}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"DeviceRequests":[{"Count":-1,"Capabilities":[["gpu"]]}]}}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"CgroupnsMode":"host"}}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"Cgroup":"container:other"}}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"Binds":["cdflow2-cache:/cache"]}}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"Mounts":[{"Type":"volume","Source":"cdflow2-cache","Target":"/cache"}]}}`},
+		{"DELETE", "/v1.40/volumes/cdflow2-cache", ""},
+		{"POST", "/v1.40/build?networkmode=container:other-id", ""},
+		{"POST", "/v1.40/build?cgroupparent=/", ""},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"VolumesFrom":["other-id"]}}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"CgroupParent":"/"}}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"Runtime":"other"}}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"Sysctls":{"kernel.shm_rmid_forced":"1"}}}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"MaskedPaths":[]}}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"ReadonlyPaths":[]}}`},
+		{"POST", "/v1.40/containers/create", `{"HostConfig":{"NetworkMode":"container:other-id"}}`},
+	} {
+		// When
+		status := request(t, server, testCase.method, testCase.path, testCase.body)
+
+		// Then
+		if status != http.StatusForbidden {
+			t.Fatalf("expected %s %s %s to be forbidden, got status %d", testCase.method, testCase.path, testCase.body, status)
+		}
+	}
+	if len(*forwarded) != 0 {
+		t.Fatal("expected no requests to be forwarded, got:", *forwarded)
+	}
+}
+
+func TestOwnContainers(t *testing.T) {
+	// Given
+	server, forwarded := setup(t)
+	defer server.Close()
+
+	// When
+	volumeStatus := request(t, server, "POST", "/v1.40/volumes/create", `{"Name":"created-volume"}`)
+	createStatus := request(t, server, "POST", "/v1.40/containers/create", `{"Image":"test","HostConfig":{"Binds":["created-volume:/cache"],"Mounts":[{"Type":"volume","Target":"/anonymous"}],"MaskedPaths":null,"Runtime":"runc"}}`)
+	startStatus := request(t, server, "POST", "/v1.40/containers/created-id/start", "")
+	removeStatus := request(t, server, "DELETE", "/v1.40/containers/created-id", "")
+	removeVolumeStatus := request(t, server, "DELETE", "/v1.40/volumes/created-volume", "")
+
+	// Then
+	if volumeStatus != http.StatusCreated || createStatus != http.StatusCreated || startStatus != http.StatusOK ||
+		removeStatus != http.StatusOK || removeVolumeStatus != http.StatusOK {
+		t.Fatalf(
+			"unexpected statuses: create volume %d, create %d, start %d, remove %d, remove volume %d",
+			volumeStatus, createStatus, startStatus, removeStatus, removeVolumeStatus,
+		)
+	}
+	if len(*forwarded) != 5 {
+		t.Fatal("expected all requests to be forwarded, got:", *forwarded)
+	}
+}
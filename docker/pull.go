@@ -0,0 +1,67 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// DefaultPullWorkers is the number of images pulled at once by PullAll.
+const DefaultPullWorkers = 4
+
+// PullAll pulls the distinct images passed concurrently, with at most workers pulls at once. If a pull fails the
+// remaining pulls are cancelled, and the error(s) returned. The output stream is shared by all the pulls, so should
+// implement PullProgress to combine their progress.
+func PullAll(parentCtx context.Context, dockerClient Iface, images []string, workers int, outputStream io.Writer) error {
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	queue := make(chan string)
+	go func() {
+		defer close(queue)
+		seen := make(map[string]bool)
+		for _, image := range images {
+			if seen[image] {
+				continue
+			}
+			seen[image] = true
+			select {
+			case queue <- image:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var mutex sync.Mutex
+	var failures []string
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for image := range queue {
+				if err := dockerClient.PullImage(ctx, image, outputStream); err != nil {
+					mutex.Lock()
+					if ctx.Err() == nil || len(failures) == 0 {
+						failures = append(failures, fmt.Sprintf("error pulling image %v: %v", image, err))
+					}
+					mutex.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := parentCtx.Err(); err != nil {
+		return fmt.Errorf("image pulls interrupted: %w", err)
+	}
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package docker_test
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/docker/fake"
+)
+
+// slowClient wraps the fake client to make pulls take a while and track how many happen at once.
+type slowClient struct {
+	*fake.Client
+	mutex      sync.Mutex
+	running    int
+	maxRunning int
+}
+
+func (client *slowClient) PullImage(ctx context.Context, image string, outputStream io.Writer) error {
+	client.mutex.Lock()
+	client.running++
+	if client.running > client.maxRunning {
+		client.maxRunning = client.running
+	}
+	client.mutex.Unlock()
+	defer func() {
+		client.mutex.Lock()
+		client.running--
+		client.mutex.Unlock()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	return client.Client.PullImage(ctx, image, outputStream)
+}
+
+func TestPullAll(t *testing.T) {
+	// Given
+	dockerClient := &slowClient{Client: fake.NewClient()}
+	images := []string{"a", "b", "c", "d", "e", "a", "b"}
+	for _, image := range images {
+		dockerClient.AddImage(image)
+	}
+
+	// When
+	if err := docker.PullAll(context.Background(), dockerClient, images, 2, nil); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// Then
+	pulls := dockerClient.Pulls()
+	sort.Strings(pulls)
+	if !reflect.DeepEqual(pulls, []string{"a", "b", "c", "d", "e"}) {
+		t.Fatal("expected each image to be pulled once, got:", pulls)
+	}
+	if dockerClient.maxRunning != 2 {
+		t.Fatal("expected two pulls at once, got:", dockerClient.maxRunning)
+	}
+}
+
+func TestPullAllError(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	dockerClient.AddImage("a")
+
+	// When
+	err := docker.PullAll(context.Background(), dockerClient, []string{"a", "missing"}, 1, nil)
+
+	// Then
+	if err == nil || !strings.Contains(err.Error(), "error pulling image missing") {
+		t.Fatal("expected error pulling missing image, got:", err)
+	}
+}
@@ -0,0 +1,269 @@
+// Package retry wraps a docker client to retry operations that fail due to transient errors talking to the docker
+// daemon or an image registry.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/mergermarket/cdflow2/docker"
+)
+
+// DefaultRetries is the number of times an operation is retried by default.
+const DefaultRetries = 3
+
+// DefaultInitialDelay is the delay before the first retry by default - it doubles for each subsequent retry.
+const DefaultInitialDelay = time.Second
+
+// DefaultMaxDelay is the default maximum delay between retries.
+const DefaultMaxDelay = 30 * time.Second
+
+// Policy controls how many times and how quickly operations are retried.
+type Policy struct {
+	// Retries is the maximum number of retries after the first attempt (0 to disable retries).
+	Retries int
+	// InitialDelay is the delay before the first retry.
+	InitialDelay time.Duration
+	// MaxDelay caps the delay between retries.
+	MaxDelay time.Duration
+	// Log is where messages about retries are written (nil to not write messages).
+	Log io.Writer
+}
+
+// Client is a docker.Iface that retries idempotent operations when they fail with a transient error.
+//
+// Operations that may have started a process - i.e. Run and Exec once the container or exec has been created - are
+// never retried, since running something like terraform apply twice is not safe. Run and Exec are only retried if
+// they return a docker.NotStartedError, which the wrapped client only returns from Run once it has removed any
+// container a timed out create may have made (so a retry doesn't leave it behind).
+type Client struct {
+	docker.Iface
+	policy Policy
+}
+
+// New wraps a docker client so that operations are retried according to policy.
+func New(dockerClient docker.Iface, policy Policy) *Client {
+	return &Client{Iface: dockerClient, policy: policy}
+}
+
+// IsTransient returns true if an error is likely to be temporary (e.g. a timeout, a reset connection or a 5xx
+// response from a registry), so that the failed operation could succeed if tried again.
+func IsTransient(err error) bool {
+	if err == nil {
+		return false
+	}
+	// cancellation and deadlines from our own context mean give up, not try again
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if inChain(err, errdefs.IsNotFound, errdefs.IsInvalidParameter, errdefs.IsUnauthorized, errdefs.IsForbidden,
+		errdefs.IsConflict, errdefs.IsNotImplemented) {
+		return false
+	}
+	if inChain(err, errdefs.IsUnavailable, errdefs.IsSystem, errdefs.IsDeadline, client.IsErrConnectionFailed) {
+		return true
+	}
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	// registry errors during a pull only reach us as text in the progress stream
+	message := strings.ToLower(err.Error())
+	for _, pattern := range transientMessages {
+		if strings.Contains(message, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// inChain returns true if any of the checks match the error or an error it wraps - the docker client's checks only
+// look through errors wrapped with github.com/pkg/errors, not with fmt.Errorf.
+func inChain(err error, checks ...func(error) bool) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		for _, check := range checks {
+			if check(err) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var transientMessages = []string{
+	"connection reset by peer",
+	"connection refused",
+	"broken pipe",
+	"i/o timeout",
+	"tls handshake timeout",
+	"timeout exceeded while awaiting headers",
+	"request canceled while waiting for connection",
+	"unexpected eof",
+	"unexpected http status: 5",
+	"500 internal server error",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+	"toomanyrequests",
+	"429 too many requests",
+}
+
+// delay returns the jittered delay before the retry following the passed (zero based) attempt.
+func (policy *Policy) delay(attempt int) time.Duration {
+	delay := policy.InitialDelay
+	for i := 0; i < attempt && delay < policy.MaxDelay; i++ {
+		delay *= 2
+	}
+	if policy.MaxDelay > 0 && delay > policy.MaxDelay {
+		delay = policy.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+	// "equal jitter" - between half and all of the delay, so concurrent retries don't all hit the registry together
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// Do runs operation, retrying it according to policy while it fails with an error accepted by retryable. The last
+// error is returned if it doesn't succeed (or ctx is cancelled while waiting to retry).
+func Do(ctx context.Context, policy *Policy, description string, retryable func(error) bool, operation func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := operation()
+		if err == nil || attempt >= policy.Retries || !retryable(err) || ctx.Err() != nil {
+			return err
+		}
+		delay := policy.delay(attempt)
+		if policy.Log != nil {
+			fmt.Fprintf(
+				policy.Log, "%s failed with a transient error (%v), retrying in %s (retry %d of %d)...\n",
+				description, err, delay.Round(time.Millisecond), attempt+1, policy.Retries,
+			)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (dockerClient *Client) do(ctx context.Context, description string, retryable func(error) bool, operation func() error) error {
+	return Do(ctx, &dockerClient.policy, description, retryable, operation)
+}
+
+// isTransientNotStarted returns true for transient errors from Run or Exec where no process was started.
+func isTransientNotStarted(err error) bool {
+	var notStarted *docker.NotStartedError
+	return errors.As(err, &notStarted) && IsTransient(notStarted.Err)
+}
+
+// Run runs a container, retrying only if the container could not be created.
+func (dockerClient *Client) Run(ctx context.Context, options *docker.RunOptions) error {
+	return dockerClient.do(ctx, "creating container for "+options.Image, isTransientNotStarted, func() error {
+		return dockerClient.Iface.Run(ctx, options)
+	})
+}
+
+// Exec execs a process in a container, retrying only if the exec could not be created.
+func (dockerClient *Client) Exec(ctx context.Context, options *docker.ExecOptions) error {
+	return dockerClient.do(ctx, "creating exec", isTransientNotStarted, func() error {
+		return dockerClient.Iface.Exec(ctx, options)
+	})
+}
+
+// EnsureImage pulls an image if it does not exist locally.
+func (dockerClient *Client) EnsureImage(ctx context.Context, image string, outputStream io.Writer) error {
+	return dockerClient.do(ctx, "pulling "+image, IsTransient, func() error {
+		return dockerClient.Iface.EnsureImage(ctx, image, outputStream)
+	})
+}
+
+// PullImage pulls an image.
+func (dockerClient *Client) PullImage(ctx context.Context, image string, outputStream io.Writer) error {
+	return dockerClient.do(ctx, "pulling "+image, IsTransient, func() error {
+		return dockerClient.Iface.PullImage(ctx, image, outputStream)
+	})
+}
+
+// GetImageRepoDigests inspects an image and pulls out the repo digests.
+func (dockerClient *Client) GetImageRepoDigests(ctx context.Context, image string) (result []string, returnedError error) {
+	returnedError = dockerClient.do(ctx, "inspecting "+image, IsTransient, func() error {
+		var err error
+		result, err = dockerClient.Iface.GetImageRepoDigests(ctx, image)
+		return err
+	})
+	return result, returnedError
+}
+
+// GetImageLabels inspects an image and returns its labels.
+func (dockerClient *Client) GetImageLabels(ctx context.Context, image string) (result map[string]string, returnedError error) {
+	returnedError = dockerClient.do(ctx, "inspecting "+image, IsTransient, func() error {
+		var err error
+		result, err = dockerClient.Iface.GetImageLabels(ctx, image)
+		return err
+	})
+	return result, returnedError
+}
+
+// VolumeExists returns true if the named volume exists.
+func (dockerClient *Client) VolumeExists(ctx context.Context, name string) (result bool, returnedError error) {
+	returnedError = dockerClient.do(ctx, "inspecting volume "+name, IsTransient, func() error {
+		var err error
+		result, err = dockerClient.Iface.VolumeExists(ctx, name)
+		return err
+	})
+	return result, returnedError
+}
+
+// CopyFromContainer returns a tar stream for the path in the container.
+func (dockerClient *Client) CopyFromContainer(ctx context.Context, id, path string) (result io.ReadCloser, returnedError error) {
+	returnedError = dockerClient.do(ctx, "copying "+path+" from container", IsTransient, func() error {
+		var err error
+		result, err = dockerClient.Iface.CopyFromContainer(ctx, id, path)
+		return err
+	})
+	return result, returnedError
+}
+
+// ListContainers returns the containers with the label.
+func (dockerClient *Client) ListContainers(ctx context.Context, label string) (result []*docker.Resource, returnedError error) {
+	returnedError = dockerClient.do(ctx, "listing containers", IsTransient, func() error {
+		var err error
+		result, err = dockerClient.Iface.ListContainers(ctx, label)
+		return err
+	})
+	return result, returnedError
+}
+
+// ListVolumes returns the volumes with the label.
+func (dockerClient *Client) ListVolumes(ctx context.Context, label string) (result []*docker.Resource, returnedError error) {
+	returnedError = dockerClient.do(ctx, "listing volumes", IsTransient, func() error {
+		var err error
+		result, err = dockerClient.Iface.ListVolumes(ctx, label)
+		return err
+	})
+	return result, returnedError
+}
+
+// SaveImage saves an image to the archive in dir.
+func (dockerClient *Client) SaveImage(ctx context.Context, image, dir string) error {
+	return dockerClient.do(ctx, "saving "+image, IsTransient, func() error {
+		return dockerClient.Iface.SaveImage(ctx, image, dir)
+	})
+}
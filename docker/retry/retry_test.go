@@ -0,0 +1,180 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/docker/retry"
+)
+
+// flakyClient wraps the fake client to fail the first few calls with a given error.
+type flakyClient struct {
+	*fake.Client
+	failures int
+	err      error
+	calls    int
+}
+
+func (client *flakyClient) fail() error {
+	client.calls++
+	if client.calls <= client.failures {
+		return client.err
+	}
+	return nil
+}
+
+func (client *flakyClient) PullImage(ctx context.Context, image string, outputStream io.Writer) error {
+	if err := client.fail(); err != nil {
+		return err
+	}
+	return client.Client.PullImage(ctx, image, outputStream)
+}
+
+func (client *flakyClient) Exec(ctx context.Context, options *docker.ExecOptions) error {
+	if err := client.fail(); err != nil {
+		return err
+	}
+	return client.Client.Exec(ctx, options)
+}
+
+func testPolicy(log io.Writer) retry.Policy {
+	return retry.Policy{Retries: 3, InitialDelay: time.Millisecond, MaxDelay: 2 * time.Millisecond, Log: log}
+}
+
+func TestRetriesTransientPullFailure(t *testing.T) {
+	// Given
+	flaky := &flakyClient{Client: fake.NewClient(), failures: 2, err: errors.New("received unexpected HTTP status: 502 Bad Gateway")}
+	flaky.AddImage("test-image")
+	var log strings.Builder
+	dockerClient := retry.New(flaky, testPolicy(&log))
+
+	// When
+	err := dockerClient.PullImage(context.Background(), "test-image", nil)
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if flaky.calls != 3 {
+		t.Fatal("expected 3 attempts, got:", flaky.calls)
+	}
+	if !strings.Contains(log.String(), "retry 2 of 3") {
+		t.Fatal("expected retries to be logged, got:", log.String())
+	}
+}
+
+func TestGivesUpAfterRetries(t *testing.T) {
+	// Given
+	flaky := &flakyClient{Client: fake.NewClient(), failures: 10, err: fmt.Errorf("error pulling: %w", syscall.ECONNRESET)}
+	dockerClient := retry.New(flaky, testPolicy(nil))
+
+	// When
+	err := dockerClient.PullImage(context.Background(), "test-image", nil)
+
+	// Then
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatal("expected the last error to be returned, got:", err)
+	}
+	if flaky.calls != 4 {
+		t.Fatal("expected 4 attempts, got:", flaky.calls)
+	}
+}
+
+func TestDoesNotRetryPermanentFailure(t *testing.T) {
+	// Given
+	flaky := &flakyClient{Client: fake.NewClient(), failures: 1, err: errors.New("manifest for test-image:latest not found")}
+	dockerClient := retry.New(flaky, testPolicy(nil))
+
+	// When
+	err := dockerClient.PullImage(context.Background(), "test-image", nil)
+
+	// Then
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if flaky.calls != 1 {
+		t.Fatal("expected a single attempt, got:", flaky.calls)
+	}
+}
+
+func TestDoesNotRetryStartedExec(t *testing.T) {
+	// Given
+	flaky := &flakyClient{Client: fake.NewClient(), failures: 1, err: fmt.Errorf("error streaming data from exec: %w", syscall.ECONNRESET)}
+	dockerClient := retry.New(flaky, testPolicy(nil))
+
+	// When
+	err := dockerClient.Exec(context.Background(), &docker.ExecOptions{Cmd: []string{"terraform", "apply"}})
+
+	// Then
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if flaky.calls != 1 {
+		t.Fatal("expected exec not to be retried, got attempts:", flaky.calls)
+	}
+}
+
+func TestRetriesExecThatWasNotStarted(t *testing.T) {
+	// Given
+	flaky := &flakyClient{
+		Client:   fake.NewClient(),
+		failures: 1,
+		err:      &docker.NotStartedError{Err: fmt.Errorf("error creating docker exec: %w", syscall.ECONNRESET)},
+	}
+	dockerClient := retry.New(flaky, testPolicy(nil))
+
+	// When
+	dockerClient.Exec(context.Background(), &docker.ExecOptions{Cmd: []string{"terraform", "apply"}})
+
+	// Then
+	if flaky.calls != 2 {
+		t.Fatal("expected exec to be retried once, got attempts:", flaky.calls)
+	}
+}
+
+func TestStopsRetryingWhenCancelled(t *testing.T) {
+	// Given
+	flaky := &flakyClient{Client: fake.NewClient(), failures: 10, err: errors.New("i/o timeout")}
+	dockerClient := retry.New(flaky, retry.Policy{Retries: 3, InitialDelay: time.Hour, MaxDelay: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	// When
+	err := dockerClient.PullImage(ctx, "test-image", nil)
+
+	// Then
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if flaky.calls != 1 {
+		t.Fatal("expected no further attempts after cancellation, got:", flaky.calls)
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	for _, testCase := range []struct {
+		err      error
+		expected bool
+	}{
+		{errors.New("Get https://registry/v2/: net/http: TLS handshake timeout"), true},
+		{fmt.Errorf("error creating docker exec: %w", syscall.ECONNRESET), true},
+		{io.ErrUnexpectedEOF, true},
+		{errors.New("error pulling image a: toomanyrequests: rate limit exceeded"), true},
+		{errors.New("unauthorized: authentication required"), false},
+		{fmt.Errorf("interrupted: %w", context.Canceled), false},
+		{errors.New("exec process exited with error status code 500"), false},
+		{nil, false},
+	} {
+		if actual := retry.IsTransient(testCase.err); actual != testCase.expected {
+			t.Errorf("expected IsTransient(%v) to be %v", testCase.err, testCase.expected)
+		}
+	}
+}
@@ -13,7 +13,17 @@ export default {
       'Deploy',
       'Destroy',
       'Common Terraform Setup',
-      'Shell'
+      'Shell',
+      'Gc',
+      'Images',
+      'Pin',
+      'Lock',
+      'Verify Release',
+      'Releases',
+      'Status',
+      'Rollback',
+      'Unlock',
+      'Conformance'
     ] },
     'cdflow.yaml Reference',
     'Design'
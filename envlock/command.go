@@ -0,0 +1,175 @@
+package envlock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/util"
+)
+
+// LockArgs contains specific arguments to the lock ENV command.
+type LockArgs struct {
+	EnvName string
+	Reason  string
+	TTL     time.Duration
+}
+
+// UnlockArgs contains specific arguments to the unlock command.
+type UnlockArgs struct {
+	EnvName string
+	Force   bool
+	Reason  string
+}
+
+// parseArgs parses ENV followed by options, calling handle for each option with a function to take its value.
+func parseArgs(args []string, handle func(name string, value func() (string, error)) error) (string, error) {
+	var envName string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") {
+			if envName != "" {
+				return "", fmt.Errorf("unexpected argument %q", arg)
+			}
+			envName = arg
+			continue
+		}
+		name := arg
+		inline, hasInline := "", false
+		if index := strings.Index(arg, "="); index != -1 {
+			name, inline, hasInline = arg[:index], arg[index+1:], true
+		}
+		if err := handle(name, func() (string, error) {
+			if hasInline {
+				return inline, nil
+			}
+			i++
+			if i >= len(args) {
+				return "", errors.New("missing value for " + name)
+			}
+			return args[i], nil
+		}); err != nil {
+			return "", err
+		}
+	}
+	if envName == "" {
+		return "", errors.New("missing ENV")
+	}
+	return envName, nil
+}
+
+// ParseLockArgs parses command line arguments to the lock ENV subcommand.
+func ParseLockArgs(args []string) (*LockArgs, error) {
+	result := LockArgs{TTL: DefaultTTL}
+	envName, err := parseArgs(args, func(name string, value func() (string, error)) error {
+		switch name {
+		case "--reason":
+			reason, err := value()
+			result.Reason = reason
+			return err
+		case "--ttl":
+			text, err := value()
+			if err != nil {
+				return err
+			}
+			ttl, err := time.ParseDuration(text)
+			if err != nil || ttl <= 0 {
+				return fmt.Errorf("invalid --ttl %q (expected a duration, e.g. \"2h\")", text)
+			}
+			result.TTL = ttl
+			return nil
+		}
+		return errors.New("Unknown lock option: " + name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.EnvName = envName
+	return &result, nil
+}
+
+// ParseUnlockArgs parses command line arguments to the unlock subcommand.
+func ParseUnlockArgs(args []string) (*UnlockArgs, error) {
+	var result UnlockArgs
+	envName, err := parseArgs(args, func(name string, value func() (string, error)) error {
+		switch name {
+		case "--force", "-f":
+			result.Force = true
+			return nil
+		case "--reason":
+			reason, err := value()
+			result.Reason = reason
+			return err
+		}
+		return errors.New("Unknown unlock option: " + name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Force && result.Reason == "" {
+		return nil, errors.New("--force requires --reason, which is recorded for audit")
+	}
+	result.EnvName = envName
+	return &result, nil
+}
+
+// RunLockCommand runs the lock ENV command, locking an environment until it is unlocked (or the lock expires) - e.g.
+// to stop deployments during an incident.
+func RunLockCommand(ctx context.Context, state *command.GlobalState, args *LockArgs, env map[string]string) error {
+	if err := config.Pull(ctx, state); err != nil {
+		return err
+	}
+	reason := args.Reason
+	if reason == "" {
+		reason = "locked with cdflow2 lock"
+	}
+	return withConfigContainer(ctx, state, func(configContainer *config.Container) error {
+		lock, err := configContainer.AcquireLock(ctx, state.Component, state.Manifest.Config.Params, env, args.EnvName, util.Holder(env), reason, args.TTL)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(
+			state.ErrorStream, "\n%s\n",
+			util.FormatInfo(fmt.Sprintf("locked %s until %s (lock ID %s)", args.EnvName, lock.Expires.UTC().Format(time.RFC3339), lock.ID)),
+		)
+		return nil
+	})
+}
+
+// RunUnlockCommand runs the unlock command, releasing a lock on an environment held by the current user - or with
+// --force, whoever holds it.
+func RunUnlockCommand(ctx context.Context, state *command.GlobalState, args *UnlockArgs, env map[string]string) error {
+	if err := config.Pull(ctx, state); err != nil {
+		return err
+	}
+	holder := util.Holder(env)
+	return withConfigContainer(ctx, state, func(configContainer *config.Container) error {
+		lock, err := configContainer.ReleaseLock(ctx, state.Component, state.Manifest.Config.Params, env, args.EnvName, "", holder, args.Force, args.Reason)
+		if err != nil {
+			return err
+		}
+		if lock == nil {
+			if args.Force {
+				return fmt.Errorf("%s is not locked", args.EnvName)
+			}
+			return fmt.Errorf("%s is not locked by %s - pass --force --reason REASON to release someone else's lock", args.EnvName, holder)
+		}
+		if args.Force {
+			// printed for the CI log as well as being recorded by the config container
+			fmt.Fprintf(
+				state.ErrorStream, "\n%s\n",
+				util.FormatInfo(fmt.Sprintf(
+					"force-unlocked %s at %s by %s (reason: %s) - the lock was held by %s (%s)",
+					args.EnvName, time.Now().UTC().Format(time.RFC3339), holder, args.Reason, lock.Holder, lock.Reason,
+				)),
+			)
+			return nil
+		}
+		fmt.Fprintf(state.ErrorStream, "\n%s\n", util.FormatInfo("unlocked "+args.EnvName))
+		return nil
+	})
+}
@@ -0,0 +1,239 @@
+package envlock_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/envlock"
+	"github.com/mergermarket/cdflow2/manifest"
+	"github.com/mergermarket/cdflow2/test"
+)
+
+func TestParseLockArgs(t *testing.T) {
+	args, err := envlock.ParseLockArgs([]string{"live", "--reason", "incident 123", "--ttl=4h"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !reflect.DeepEqual(args, &envlock.LockArgs{EnvName: "live", Reason: "incident 123", TTL: 4 * time.Hour}) {
+		t.Fatalf("unexpected args: %+v", args)
+	}
+	for _, invalid := range [][]string{{}, {"live", "--ttl", "forever"}, {"live", "--reason"}, {"live", "aslive"}} {
+		if _, err := envlock.ParseLockArgs(invalid); err == nil {
+			t.Fatal("expected error for", invalid)
+		}
+	}
+}
+
+func TestParseUnlockArgs(t *testing.T) {
+	args, err := envlock.ParseUnlockArgs([]string{"--force", "live", "--reason", "stale lock"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !reflect.DeepEqual(args, &envlock.UnlockArgs{EnvName: "live", Force: true, Reason: "stale lock"}) {
+		t.Fatalf("unexpected args: %+v", args)
+	}
+	if _, err := envlock.ParseUnlockArgs([]string{"live", "--force"}); err == nil {
+		t.Fatal("expected error for --force without --reason")
+	}
+}
+
+// handleLocks simulates a config image that supports locks, with a lock on each environment in locks.
+func handleLocks(dockerClient *fake.Client, locks map[string]*config.EnvLock, requests *[]map[string]interface{}) {
+	test.HandleFakeConfig(dockerClient, "config-image", func(request map[string]interface{}) interface{} {
+		envName, _ := request["EnvName"].(string)
+		switch request["Action"] {
+		case config.ActionHello:
+			return map[string]interface{}{
+				"ProtocolVersion": config.ProtocolVersion,
+				"Actions":         []string{config.ActionAcquireLock, config.ActionReleaseLock},
+				"Success":         true,
+			}
+		case config.ActionAcquireLock:
+			*requests = append(*requests, request)
+			if lock, ok := locks[envName]; ok {
+				return map[string]interface{}{"Acquired": false, "Lock": lock, "Success": true}
+			}
+			locks[envName] = &config.EnvLock{EnvName: envName, ID: "lock-1", Holder: request["Holder"].(string), Reason: request["Reason"].(string)}
+			return map[string]interface{}{"Acquired": true, "Lock": locks[envName], "Success": true}
+		case config.ActionReleaseLock:
+			*requests = append(*requests, request)
+			lock, ok := locks[envName]
+			if !ok || (request["Force"] != true && request["Holder"] != lock.Holder) {
+				return map[string]interface{}{"Released": false, "Success": true}
+			}
+			delete(locks, envName)
+			return map[string]interface{}{"Released": true, "Lock": lock, "Success": true}
+		}
+		return map[string]interface{}{"Success": false}
+	})
+}
+
+func createState(dockerClient *fake.Client, errorStream *bytes.Buffer) *command.GlobalState {
+	// deploy, destroy and shell acquire the lock after the config image has been pulled
+	dockerClient.AddLocalImage("config-image")
+	return &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  errorStream,
+		Component:    "test-component",
+		Manifest:     &manifest.Manifest{Version: 2, Config: manifest.ImageWithParams{Image: "config-image"}},
+		GlobalArgs:   &command.GlobalArgs{},
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	locks := make(map[string]*config.EnvLock)
+	var requests []map[string]interface{}
+	handleLocks(dockerClient, locks, &requests)
+	state := createState(dockerClient, &bytes.Buffer{})
+
+	// When
+	release, err := envlock.Acquire(context.Background(), state, "live", "deploy 1", map[string]string{})
+	if err != nil {
+		t.Fatal("unexpected error acquiring lock:", err)
+	}
+	_, secondErr := envlock.Acquire(context.Background(), state, "live", "deploy 2", map[string]string{})
+	if err := release(); err != nil {
+		t.Fatal("unexpected error releasing lock:", err)
+	}
+
+	// Then
+	var lockedError *config.EnvLockedError
+	if !errors.As(secondErr, &lockedError) || lockedError.ExitCode() != 6 {
+		t.Fatal("expected locked error, got:", secondErr)
+	}
+	if !strings.Contains(secondErr.Error(), "environment live is locked by") || !strings.Contains(secondErr.Error(), "(deploy 1)") {
+		t.Fatal("unexpected error message:", secondErr)
+	}
+	if len(locks) != 0 {
+		t.Fatal("expected lock to be released, got:", locks)
+	}
+	if requests[0]["TTLSeconds"] != float64(envlock.DefaultTTL.Seconds()) || requests[0]["Component"] != "test-component" {
+		t.Fatal("unexpected acquire_lock request:", requests[0])
+	}
+	if requests[2]["ID"] != "lock-1" || requests[2]["Force"] != false {
+		t.Fatal("unexpected release_lock request:", requests[2])
+	}
+}
+
+func TestAcquireUnsupported(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	test.HandleFakeConfig(dockerClient, "config-image", func(request map[string]interface{}) interface{} {
+		return map[string]interface{}{"Success": false}
+	})
+	var errorBuffer bytes.Buffer
+	state := createState(dockerClient, &errorBuffer)
+
+	// When
+	release, err := envlock.Acquire(context.Background(), state, "live", "deploy 1", map[string]string{})
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if err := release(); err != nil {
+		t.Fatal("unexpected error releasing:", err)
+	}
+	if !strings.Contains(errorBuffer.String(), "does not support environment locks") {
+		t.Fatal("expected message about locks not being supported, got:", errorBuffer.String())
+	}
+}
+
+func TestForceUnlock(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	locks := map[string]*config.EnvLock{"live": {EnvName: "live", ID: "lock-1", Holder: "someone@elsewhere", Reason: "deploy 1"}}
+	var requests []map[string]interface{}
+	handleLocks(dockerClient, locks, &requests)
+	var errorBuffer bytes.Buffer
+	state := createState(dockerClient, &errorBuffer)
+
+	// When
+	unlockErr := envlock.RunUnlockCommand(context.Background(), state, &envlock.UnlockArgs{EnvName: "live"}, map[string]string{})
+	forceErr := envlock.RunUnlockCommand(context.Background(), state, &envlock.UnlockArgs{EnvName: "live", Force: true, Reason: "runner died"}, map[string]string{})
+
+	// Then
+	if unlockErr == nil || !strings.Contains(unlockErr.Error(), "--force") {
+		t.Fatal("expected error releasing someone else's lock without --force, got:", unlockErr)
+	}
+	if forceErr != nil {
+		t.Fatal("unexpected error force unlocking:", forceErr)
+	}
+	if len(locks) != 0 {
+		t.Fatal("expected lock to be released")
+	}
+	if requests[1]["Reason"] != "runner died" {
+		t.Fatal("expected reason to be sent for audit, got:", requests[1])
+	}
+	if !strings.Contains(errorBuffer.String(), "force-unlocked live") || !strings.Contains(errorBuffer.String(), "held by someone@elsewhere (deploy 1)") {
+		t.Fatal("expected force unlock to be logged, got:", errorBuffer.String())
+	}
+}
+
+func TestAcquireRenews(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	renewals := make(chan map[string]interface{}, 10)
+	var releaseRequest map[string]interface{}
+	test.HandleFakeConfig(dockerClient, "config-image", func(request map[string]interface{}) interface{} {
+		switch request["Action"] {
+		case config.ActionHello:
+			return map[string]interface{}{
+				"ProtocolVersion": config.ProtocolVersion,
+				"Actions":         []string{config.ActionAcquireLock, config.ActionReleaseLock},
+				"Success":         true,
+			}
+		case config.ActionAcquireLock:
+			// the renewed lock has a new ID, as if it had expired first
+			lock := &config.EnvLock{EnvName: "live", ID: "lock-1", Expires: time.Now().Add(time.Second)}
+			if request["ID"] != nil {
+				renewals <- request
+				lock.ID = "lock-2"
+			}
+			return map[string]interface{}{"Acquired": true, "Lock": lock, "Success": true}
+		case config.ActionReleaseLock:
+			releaseRequest = request
+			return map[string]interface{}{"Released": true, "Success": true}
+		}
+		return map[string]interface{}{"Success": false}
+	})
+	var errorBuffer bytes.Buffer
+	state := createState(dockerClient, &errorBuffer)
+
+	// When
+	release, err := envlock.Acquire(context.Background(), state, "live", "deploy 1", map[string]string{})
+	if err != nil {
+		t.Fatal("unexpected error acquiring lock:", err)
+	}
+	var renewal map[string]interface{}
+	select {
+	case renewal = <-renewals:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for renewal")
+	}
+	if err := release(); err != nil {
+		t.Fatal("unexpected error releasing lock:", err)
+	}
+
+	// Then
+	if renewal["ID"] != "lock-1" || renewal["TTLSeconds"] != float64(envlock.DefaultTTL.Seconds()) {
+		t.Fatal("unexpected renewal request:", renewal)
+	}
+	if releaseRequest["ID"] != "lock-2" {
+		t.Fatal("expected the renewed lock to be released, got:", releaseRequest)
+	}
+	if !strings.Contains(errorBuffer.String(), "expired at") {
+		t.Fatal("expected warning that the lock expired before it was renewed, got:", errorBuffer.String())
+	}
+}
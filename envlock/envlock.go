@@ -0,0 +1,163 @@
+package envlock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/util"
+)
+
+// DefaultTTL is how long a lock lasts if it isn't released (e.g. because cdflow2 was killed) - it is renewed while
+// the command holding it runs.
+const DefaultTTL = 2 * time.Hour
+
+// RenewMargin is how long before a lock expires it's renewed - or half the remaining time if that's less.
+const RenewMargin = 30 * time.Minute
+
+// renewRetryInterval is how long to wait before trying again when renewing a lock fails.
+const renewRetryInterval = time.Minute
+
+// withConfigContainer runs a function with a config container, which is stopped afterwards. The config image must
+// already have been pulled.
+func withConfigContainer(ctx context.Context, state *command.GlobalState, f func(*config.Container) error) (returnedError error) {
+	configContainer, err := config.NewContainer(ctx, state, state.Manifest.Config.Image, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := configContainer.Done(); err != nil {
+			if returnedError != nil {
+				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+			} else {
+				returnedError = err
+			}
+		}
+	}()
+	return f(configContainer)
+}
+
+// Acquire locks an environment for the critical section of a command (e.g. plan and apply in deploy), returning a
+// function that releases the lock. Nothing is locked if the config image doesn't support locks.
+func Acquire(ctx context.Context, state *command.GlobalState, envName, reason string, env map[string]string) (func() error, error) {
+	holder := util.Holder(env)
+	var lock *config.EnvLock
+	if err := withConfigContainer(ctx, state, func(configContainer *config.Container) error {
+		if !configContainer.Supports(config.ActionAcquireLock) || !configContainer.Supports(config.ActionReleaseLock) {
+			fmt.Fprintf(state.ErrorStream, "\n%s\n", util.FormatInfo("config image does not support environment locks, not locking "+envName))
+			return nil
+		}
+		var err error
+		lock, err = configContainer.AcquireLock(ctx, state.Component, state.Manifest.Config.Params, env, envName, holder, reason, DefaultTTL)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if lock == nil {
+		return func() error { return nil }, nil
+	}
+	fmt.Fprintf(state.ErrorStream, "\n%s\n", util.FormatInfo(fmt.Sprintf("locked %s (%s)", envName, reason)))
+	// not tied to ctx, since release must be able to wait for it
+	renewCtx, cancel := context.WithCancel(context.Background())
+	renewer := &renewer{state: state, envName: envName, holder: holder, reason: reason, env: env, lock: lock, done: make(chan struct{})}
+	go renewer.run(renewCtx)
+	return func() error {
+		cancel()
+		<-renewer.done
+		// not tied to ctx since the lock must be released on cancellation
+		return withConfigContainer(context.Background(), state, func(configContainer *config.Container) error {
+			if _, err := configContainer.ReleaseLock(context.Background(), state.Component, state.Manifest.Config.Params, env, envName, renewer.lock.ID, holder, false, ""); err != nil {
+				return fmt.Errorf("error releasing lock on %s: %w", envName, err)
+			}
+			fmt.Fprintf(state.ErrorStream, "\n%s\n", util.FormatInfo("released lock on "+envName))
+			return nil
+		})
+	}, nil
+}
+
+// renewer renews a lock before it expires, until the command holding it releases it.
+type renewer struct {
+	state   *command.GlobalState
+	envName string
+	holder  string
+	reason  string
+	env     map[string]string
+	// lock is only accessed by run until done is closed
+	lock *config.EnvLock
+	done chan struct{}
+}
+
+// expiry returns when a lock expires - or DefaultTTL from now if the config container doesn't say.
+func expiry(lock *config.EnvLock) time.Time {
+	if lock.Expires.IsZero() {
+		return time.Now().Add(DefaultTTL)
+	}
+	return lock.Expires
+}
+
+// renewAt returns when to renew a lock that expires at expires.
+func renewAt(now, expires time.Time) time.Time {
+	remaining := expires.Sub(now)
+	if remaining < 2*RenewMargin {
+		return now.Add(remaining / 2)
+	}
+	return expires.Add(-RenewMargin)
+}
+
+func (renewer *renewer) run(ctx context.Context) {
+	defer close(renewer.done)
+	expires := expiry(renewer.lock)
+	next := renewAt(time.Now(), expires)
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		// an in-flight renewal isn't cancelled, so release uses the ID of the lock that's actually held
+		lock, err := renewer.renew(context.Background())
+		var lockedError *config.EnvLockedError
+		if errors.As(err, &lockedError) {
+			renewer.warn(fmt.Sprintf(
+				"could not renew lock on %s, which expires at %s (the config image may not support renewing locks): %v",
+				renewer.envName, expires.UTC().Format(time.RFC3339), err,
+			))
+			return
+		} else if err != nil {
+			renewer.warn(fmt.Sprintf("error renewing lock on %s (retrying in %v): %v", renewer.envName, renewRetryInterval, err))
+			next = time.Now().Add(renewRetryInterval)
+			continue
+		}
+		if lock.ID != renewer.lock.ID {
+			renewer.warn(fmt.Sprintf(
+				"lock on %s expired at %s before it was renewed, so another command may have changed %s since - it has been locked again",
+				renewer.envName, expires.UTC().Format(time.RFC3339), renewer.envName,
+			))
+		}
+		renewer.lock = lock
+		expires = expiry(lock)
+		next = renewAt(time.Now(), expires)
+	}
+}
+
+func (renewer *renewer) renew(ctx context.Context) (*config.EnvLock, error) {
+	state := renewer.state
+	var lock *config.EnvLock
+	err := withConfigContainer(ctx, state, func(configContainer *config.Container) error {
+		var err error
+		lock, err = configContainer.RenewLock(
+			ctx, state.Component, state.Manifest.Config.Params, renewer.env, renewer.envName, renewer.lock.ID, renewer.holder, renewer.reason, DefaultTTL,
+		)
+		return err
+	})
+	return lock, err
+}
+
+func (renewer *renewer) warn(message string) {
+	fmt.Fprintf(renewer.state.ErrorStream, "\n%s\n", util.FormatInfo(message))
+}
@@ -0,0 +1,177 @@
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/util"
+)
+
+// DefaultOlderThan is the age after which resources are removed even if the run that created them can't be confirmed dead.
+const DefaultOlderThan = 24 * time.Hour
+
+// CommandArgs contains specific arguments to the gc command.
+type CommandArgs struct {
+	DryRun    bool
+	All       bool
+	OlderThan time.Duration
+}
+
+func handleArgs(arg string, commandArgs *CommandArgs, take func() (string, error)) error {
+	if arg == "-n" || arg == "--dry-run" {
+		commandArgs.DryRun = true
+	} else if arg == "-a" || arg == "--all" {
+		commandArgs.All = true
+	} else if arg == "--older-than" || strings.HasPrefix(arg, "--older-than=") {
+		value := strings.TrimPrefix(arg, "--older-than=")
+		if arg == "--older-than" {
+			var err error
+			value, err = take()
+			if err != nil {
+				return err
+			}
+		}
+		olderThan, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid --older-than duration: %w", err)
+		}
+		commandArgs.OlderThan = olderThan
+	} else {
+		return errors.New("Unknown gc option: " + arg)
+	}
+	return nil
+}
+
+// ParseArgs parses command line arguments to the gc subcommand.
+func ParseArgs(args []string) (*CommandArgs, error) {
+	result := CommandArgs{OlderThan: DefaultOlderThan}
+	i := 0
+	take := func() (string, error) {
+		i++
+		if i >= len(args) {
+			return "", errors.New("missing value")
+		}
+
+		return args[i], nil
+	}
+	for ; i < len(args); i++ {
+		if err := handleArgs(args[i], &result, take); err != nil {
+			return nil, err
+		}
+	}
+	return &result, nil
+}
+
+// orphanReason returns why a resource should be removed, or an empty string if it should be left alone.
+func orphanReason(resource *docker.Resource, args *CommandArgs, host string, now time.Time) string {
+	if args.All {
+		return "--all"
+	}
+	if resource.Labels[docker.LabelHost] == host {
+		pid, err := strconv.Atoi(resource.Labels[docker.LabelPID])
+		if err == nil && !isProcessRunning(pid) {
+			return fmt.Sprintf("process %d is no longer running", pid)
+		}
+	}
+	if age := now.Sub(resource.Created); age > args.OlderThan {
+		return fmt.Sprintf("older than %v", args.OlderThan)
+	}
+	return ""
+}
+
+func describe(resource *docker.Resource) string {
+	return fmt.Sprintf(
+		"%s (component %s, command %s, pid %s on %s)",
+		resource.Name,
+		resource.Labels[docker.LabelComponent],
+		resource.Labels[docker.LabelCommand],
+		resource.Labels[docker.LabelPID],
+		resource.Labels[docker.LabelHost],
+	)
+}
+
+// RunCommand runs the gc command, removing containers and volumes left behind by cdflow2 runs that are no longer alive.
+func RunCommand(ctx context.Context, state *command.GlobalState, args *CommandArgs) error {
+	dockerClient := state.DockerClient
+
+	containers, err := dockerClient.ListContainers(ctx, docker.LabelRunID)
+	if err != nil {
+		return fmt.Errorf("error listing containers: %w", err)
+	}
+	volumes, err := dockerClient.ListVolumes(ctx, docker.LabelRunID)
+	if err != nil {
+		return fmt.Errorf("error listing volumes: %w", err)
+	}
+
+	host, _ := os.Hostname()
+	now := time.Now()
+	action := "removing"
+	if args.DryRun {
+		action = "would remove"
+	}
+
+	var failures []string
+	removedContainers := 0
+	// containers first, since volumes can't be removed while a container is using them
+	for _, container := range containers {
+		reason := orphanReason(container, args, host, now)
+		if reason == "" {
+			continue
+		}
+		fmt.Fprintf(state.OutputStream, "%s container %s: %s\n", action, describe(container), reason)
+		if args.DryRun {
+			continue
+		}
+		if container.Running {
+			if err := dockerClient.Stop(ctx, container.ID, 10*time.Second); err != nil {
+				failures = append(failures, fmt.Sprintf("error stopping container %s: %v", container.Name, err))
+				continue
+			}
+		}
+		if err := dockerClient.RemoveContainer(ctx, container.ID); err != nil {
+			failures = append(failures, fmt.Sprintf("error removing container %s: %v", container.Name, err))
+			continue
+		}
+		removedContainers++
+	}
+
+	removedVolumes := 0
+	for _, volume := range volumes {
+		if volume.Name == util.CacheVolumeName {
+			continue
+		}
+		reason := orphanReason(volume, args, host, now)
+		if reason == "" {
+			continue
+		}
+		fmt.Fprintf(state.OutputStream, "%s volume %s: %s\n", action, describe(volume), reason)
+		if args.DryRun {
+			continue
+		}
+		if err := dockerClient.RemoveVolume(ctx, volume.ID); err != nil {
+			failures = append(failures, fmt.Sprintf("error removing volume %s: %v", volume.Name, err))
+			continue
+		}
+		removedVolumes++
+	}
+
+	if !args.DryRun {
+		fmt.Fprintf(
+			state.ErrorStream,
+			"\n%s\n",
+			util.FormatInfo(fmt.Sprintf("removed %d container(s) and %d volume(s)", removedContainers, removedVolumes)),
+		)
+	}
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "\n"))
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package gc_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/gc"
+)
+
+const deadPID = "99999999"
+
+func labels(pid, host string) map[string]string {
+	return map[string]string{
+		docker.LabelRunID:     "test-run-" + pid + "-" + host,
+		docker.LabelComponent: "test-component",
+		docker.LabelCommand:   "deploy",
+		docker.LabelPID:       pid,
+		docker.LabelHost:      host,
+	}
+}
+
+func createResources(t *testing.T, dockerClient *fake.Client, name string) {
+	if _, err := dockerClient.CreateVolume(context.Background(), name); err != nil {
+		t.Fatal("error creating volume:", err)
+	}
+	if _, err := dockerClient.CreateContainer(context.Background(), &docker.CreateContainerOptions{
+		Image: "test-image",
+		Binds: []string{name + ":/build"},
+	}); err != nil {
+		t.Fatal("error creating container:", err)
+	}
+}
+
+func setupResources(t *testing.T) *fake.Client {
+	host, _ := os.Hostname()
+	dockerClient := fake.NewClient()
+	dockerClient.AddLocalImage("test-image")
+
+	// created by a run that has died
+	dockerClient.SetLabels(labels(deadPID, host))
+	createResources(t, dockerClient, "dead")
+	if _, err := dockerClient.CreateVolume(context.Background(), "cdflow2-cache"); err != nil {
+		t.Fatal("error creating cache volume:", err)
+	}
+
+	// created by a run that is still going (this process)
+	dockerClient.SetLabels(labels(strconv.Itoa(os.Getpid()), host))
+	createResources(t, dockerClient, "alive")
+
+	// created on another host, so can't tell whether the run is alive
+	dockerClient.SetLabels(labels(deadPID, "another-host"))
+	createResources(t, dockerClient, "recent-other-host")
+	dockerClient.SetNow(func() time.Time { return time.Now().Add(-48 * time.Hour) })
+	createResources(t, dockerClient, "old-other-host")
+
+	// not created by cdflow2
+	dockerClient.SetLabels(nil)
+	createResources(t, dockerClient, "unlabelled")
+
+	return dockerClient
+}
+
+func TestRunCommand(t *testing.T) {
+	// Given
+	dockerClient := setupResources(t)
+	var outputBuffer bytes.Buffer
+	var errorBuffer bytes.Buffer
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &outputBuffer,
+		ErrorStream:  &errorBuffer,
+	}
+	args, err := gc.ParseArgs([]string{})
+	if err != nil {
+		t.Fatal("error parsing args:", err)
+	}
+
+	// When
+	if err := gc.RunCommand(context.Background(), state, args); err != nil {
+		t.Fatal("error running gc:", err, errorBuffer.String())
+	}
+
+	// Then
+	if !reflect.DeepEqual(dockerClient.Volumes(), []string{"alive", "cdflow2-cache", "recent-other-host", "unlabelled"}) {
+		t.Fatal("unexpected volumes after gc:", dockerClient.Volumes(), outputBuffer.String())
+	}
+	if len(dockerClient.Containers()) != 3 {
+		t.Fatal("expected three containers to remain, got:", dockerClient.Containers())
+	}
+}
+
+func TestRunCommandDryRun(t *testing.T) {
+	// Given
+	dockerClient := setupResources(t)
+	var outputBuffer bytes.Buffer
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &outputBuffer,
+		ErrorStream:  &bytes.Buffer{},
+	}
+	args, _ := gc.ParseArgs([]string{"--dry-run"})
+
+	// When
+	if err := gc.RunCommand(context.Background(), state, args); err != nil {
+		t.Fatal("error running gc:", err)
+	}
+
+	// Then
+	if len(dockerClient.Volumes()) != 6 || len(dockerClient.Containers()) != 5 {
+		t.Fatal("expected nothing to be removed in a dry run, got:", dockerClient.Volumes(), dockerClient.Containers())
+	}
+	if bytes.Count(outputBuffer.Bytes(), []byte("would remove")) != 4 {
+		t.Fatalf("expected four resources listed for removal, got:\n%s", outputBuffer.String())
+	}
+}
+
+func TestRunCommandAll(t *testing.T) {
+	// Given
+	dockerClient := setupResources(t)
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  &bytes.Buffer{},
+	}
+	args, _ := gc.ParseArgs([]string{"--all"})
+
+	// When
+	if err := gc.RunCommand(context.Background(), state, args); err != nil {
+		t.Fatal("error running gc:", err)
+	}
+
+	// Then
+	if !reflect.DeepEqual(dockerClient.Volumes(), []string{"cdflow2-cache", "unlabelled"}) {
+		t.Fatal("unexpected volumes after gc --all:", dockerClient.Volumes())
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	args, err := gc.ParseArgs([]string{"-n", "--older-than", "2h"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !args.DryRun || args.All || args.OlderThan != 2*time.Hour {
+		t.Fatalf("unexpected args: %+v", args)
+	}
+
+	args, err = gc.ParseArgs([]string{"--older-than=30m", "--all"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if args.DryRun || !args.All || args.OlderThan != 30*time.Minute {
+		t.Fatalf("unexpected args: %+v", args)
+	}
+
+	if _, err := gc.ParseArgs([]string{"--older-than", "soon"}); err == nil {
+		t.Fatal("expected error for invalid duration")
+	}
+	if _, err := gc.ParseArgs([]string{"--unknown"}); err == nil {
+		t.Fatal("expected error for unknown option")
+	}
+}
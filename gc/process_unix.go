@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package gc
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// isProcessRunning checks whether a process exists on this host.
+func isProcessRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	// EPERM means the process exists but belongs to another user
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
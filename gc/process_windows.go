@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package gc
+
+import "os"
+
+// isProcessRunning checks whether a process exists on this host.
+func isProcessRunning(pid int) bool {
+	// on windows FindProcess opens a handle to the process, so fails if it doesn't exist
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
@@ -0,0 +1,110 @@
+package images
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/manifest"
+	"github.com/mergermarket/cdflow2/util"
+)
+
+// CommandArgs contains specific arguments to the images command.
+type CommandArgs struct {
+	Subcommand string
+	Dir        string
+	EnvName    string
+	Version    string
+}
+
+// ParseArgs parses command line arguments to the images subcommand.
+func ParseArgs(args []string) (*CommandArgs, error) {
+	if len(args) == 0 || args[0] != "save" {
+		return nil, errors.New("expected images subcommand 'save'")
+	}
+	if len(args) != 2 && len(args) != 4 {
+		return nil, errors.New("expected DIR, optionally followed by ENV and VERSION")
+	}
+	result := CommandArgs{Subcommand: args[0], Dir: args[1]}
+	if len(args) == 4 {
+		result.EnvName = args[2]
+		result.Version = args[3]
+	}
+	return &result, nil
+}
+
+type imageToSave struct {
+	image  string
+	noPull bool
+}
+
+// RunCommand runs the images command, saving the images needed to run cdflow2 to an archive directory that can be
+// used with the --image-archive global option.
+func RunCommand(ctx context.Context, state *command.GlobalState, args *CommandArgs, env map[string]string) error {
+	dockerClient := state.DockerClient
+
+	if err := os.MkdirAll(args.Dir, 0755); err != nil {
+		return fmt.Errorf("error creating image archive directory: %w", err)
+	}
+
+	var images []imageToSave
+	if !manifest.IsBuiltinImage(state.Manifest.Config.Image) {
+		images = append(images, imageToSave{state.Manifest.Config.Image, state.GlobalArgs.NoPullConfig})
+	}
+	for _, buildID := range state.Manifest.BuildIDs() {
+		images = append(images, imageToSave{state.Manifest.Builds[buildID].Image, state.GlobalArgs.NoPullRelease})
+	}
+	images = append(images, imageToSave{state.Manifest.Terraform.Image, state.GlobalArgs.NoPullTerraform})
+
+	if args.Version != "" {
+		terraformImage, err := getReleaseTerraformImage(ctx, state, args.EnvName, args.Version, env)
+		if err != nil {
+			return err
+		}
+		// already pulled by the config container setup
+		images = append(images, imageToSave{terraformImage, true})
+	}
+
+	saved := make(map[string]bool)
+	for _, image := range images {
+		if saved[image.image] {
+			continue
+		}
+		saved[image.image] = true
+
+		if !image.noPull {
+			fmt.Fprintf(state.ErrorStream, "\nPulling image %v...\n\n", image.image)
+			if err := dockerClient.PullImage(ctx, image.image, state.ErrorStream); err != nil {
+				return fmt.Errorf("error pulling image %v: %w", image.image, err)
+			}
+		}
+		fmt.Fprintf(state.ErrorStream, "\n%s\n", util.FormatInfo(fmt.Sprintf("saving %v to %v", image.image, args.Dir)))
+		if err := dockerClient.SaveImage(ctx, image.image, args.Dir); err != nil {
+			return fmt.Errorf("error saving image %v: %w", image.image, err)
+		}
+	}
+
+	fmt.Fprintf(state.ErrorStream, "\n%s\n", util.FormatInfo(fmt.Sprintf("saved %d image(s) to %v", len(saved), args.Dir)))
+	return nil
+}
+
+// getReleaseTerraformImage gets the terraform image (by digest) recorded in a release.
+func getReleaseTerraformImage(ctx context.Context, state *command.GlobalState, envName, version string, env map[string]string) (returnedImage string, returnedError error) {
+	_, buildVolume, terraformImage, err := config.SetupTerraform(ctx, state, nil, envName, version, env)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := state.DockerClient.RemoveVolume(context.Background(), buildVolume); err != nil {
+			if returnedError != nil {
+				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+			} else {
+				returnedError = err
+			}
+		}
+	}()
+	return terraformImage, nil
+}
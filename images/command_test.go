@@ -0,0 +1,105 @@
+package images_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/images"
+	"github.com/mergermarket/cdflow2/manifest"
+	"github.com/mergermarket/cdflow2/test"
+)
+
+func TestRunCommand(t *testing.T) {
+	// Given
+	dir, err := ioutil.TempDir("", "cdflow2-image-archive")
+	if err != nil {
+		t.Fatal("error creating temp dir:", err)
+	}
+	defer os.RemoveAll(dir)
+
+	dockerClient := fake.NewClient()
+	test.HandleFakeConfig(dockerClient, "config-image", func(request map[string]interface{}) interface{} {
+		if request["Action"] == config.ActionHello {
+			// answer hello as a config image that predates it does
+			return map[string]interface{}{"Success": false}
+		}
+		return map[string]interface{}{
+			"TerraformImage":       "terraform-image@sha256:1111",
+			"TerraformBackendType": "local",
+			"Success":              true,
+		}
+	})
+	dockerClient.AddImage("build-image", "build-image@sha256:2222")
+	dockerClient.AddImage("terraform-image:latest", "terraform-image@sha256:3333")
+	dockerClient.AddImage("terraform-image@sha256:1111", "terraform-image@sha256:1111")
+
+	var errorBuffer bytes.Buffer
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  &errorBuffer,
+		Component:    "test-component",
+		Commit:       "test-commit",
+		Manifest: &manifest.Manifest{
+			Version:   2,
+			Config:    manifest.ImageWithParams{Image: "config-image"},
+			Builds:    map[string]manifest.ImageWithParams{"release": {Image: "build-image"}},
+			Terraform: manifest.Terraform{Image: "terraform-image:latest"},
+		},
+		GlobalArgs: &command.GlobalArgs{},
+	}
+	args, err := images.ParseArgs([]string{"save", dir, "test-env", "test-version"})
+	if err != nil {
+		t.Fatal("error parsing args:", err)
+	}
+
+	// When
+	if err := images.RunCommand(context.Background(), state, args, map[string]string{}); err != nil {
+		t.Fatal("error saving images:", err, errorBuffer.String())
+	}
+
+	// Then
+	offlineClient := fake.NewClient()
+	offlineClient.SetImageArchive(dir)
+	// already loaded (e.g. by an earlier run), so docker has lost its repo digests
+	offlineClient.AddLocalImage("terraform-image:latest")
+	for _, image := range []string{"config-image", "build-image", "terraform-image:latest", "terraform-image@sha256:1111"} {
+		if err := offlineClient.EnsureImage(context.Background(), image, nil); err != nil {
+			t.Fatal("error loading image from archive:", err)
+		}
+	}
+	if len(offlineClient.Pulls()) != 0 {
+		t.Fatal("expected no pulls from the registry, got:", offlineClient.Pulls())
+	}
+	if repoDigests, _ := offlineClient.GetImageRepoDigests(context.Background(), "terraform-image:latest"); !reflect.DeepEqual(repoDigests, []string{"terraform-image@sha256:3333"}) {
+		t.Fatal("expected repo digests to be preserved, got:", repoDigests)
+	}
+	if loads := offlineClient.Loads(); len(loads) != 3 {
+		t.Fatal("expected images not already loaded to be loaded, got:", loads)
+	}
+	if err := offlineClient.EnsureImage(context.Background(), "other-image", nil); err == nil {
+		t.Fatal("expected error for image not in archive or registry")
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	args, err := images.ParseArgs([]string{"save", "dir"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !reflect.DeepEqual(args, &images.CommandArgs{Subcommand: "save", Dir: "dir"}) {
+		t.Fatalf("unexpected args: %+v", args)
+	}
+	for _, invalid := range [][]string{{}, {"load", "dir"}, {"save"}, {"save", "dir", "env"}} {
+		if _, err := images.ParseArgs(invalid); err == nil {
+			t.Fatal("expected error for args:", invalid)
+		}
+	}
+}
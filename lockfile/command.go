@@ -0,0 +1,86 @@
+// Package lockfile implements the pin command, which pins the images in cdflow.yaml to digests in cdflow.lock, and
+// applies the lock for other commands.
+package lockfile
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/docker/progress"
+	"github.com/mergermarket/cdflow2/manifest"
+	"github.com/mergermarket/cdflow2/util"
+)
+
+// RunCommand runs the pin command, resolving each image in cdflow.yaml to a repo digest and writing cdflow.lock.
+// The manifest in state is updated to use the locked digests.
+func RunCommand(ctx context.Context, state *command.GlobalState) error {
+	images := state.Manifest.Images()
+
+	if err := pullImages(ctx, state, images); err != nil {
+		return err
+	}
+
+	lock := manifest.Lock{Images: make(map[string]manifest.LockedImage)}
+	for key, image := range images {
+		digest, err := docker.RepoDigest(ctx, state.DockerClient, image)
+		if err != nil {
+			return fmt.Errorf("error locking %s image: %w", key, err)
+		}
+		lock.Images[key] = manifest.LockedImage{Image: image, Digest: digest}
+	}
+
+	if err := lock.Write(state.CodeDir); err != nil {
+		return err
+	}
+	fmt.Fprintf(state.ErrorStream, "\n%s\n", util.FormatInfo(fmt.Sprintf("locked %d image(s) in %s", len(images), manifest.LockFilename)))
+
+	state.Manifest.ApplyLock(&lock)
+	return nil
+}
+
+// Apply makes the manifest in state use the digests from cdflow.lock if there is one, returning an error if it is
+// stale. With the --update-lock global option the lock is updated first (as with the pin command).
+func Apply(ctx context.Context, state *command.GlobalState) error {
+	if state.GlobalArgs.UpdateLock {
+		return RunCommand(ctx, state)
+	}
+	lock, err := manifest.LoadLock(state.CodeDir)
+	if err != nil {
+		return err
+	}
+	if lock == nil {
+		return nil
+	}
+	if err := lock.Check(state.Manifest); err != nil {
+		return fmt.Errorf("%w - run \"cdflow2 pin\" or pass --update-lock to update it", err)
+	}
+	state.Manifest.ApplyLock(lock)
+	return nil
+}
+
+// pullImages pulls the images to lock, so their digests are the current ones in the registry - except those
+// disabled with the --no-pull-* global options, which must exist locally.
+func pullImages(ctx context.Context, state *command.GlobalState, images map[string]string) error {
+	var toPull []string
+	for key, image := range images {
+		if key == "config" && state.GlobalArgs.NoPullConfig ||
+			key == "terraform" && state.GlobalArgs.NoPullTerraform ||
+			strings.HasPrefix(key, "build/") && state.GlobalArgs.NoPullRelease {
+			continue
+		}
+		toPull = append(toPull, image)
+	}
+	if len(toPull) == 0 {
+		return nil
+	}
+	sort.Strings(toPull)
+
+	fmt.Fprintf(state.ErrorStream, "\n%s\n\n", util.FormatInfo(fmt.Sprintf("pulling images to lock: %v", strings.Join(toPull, ", "))))
+	renderer := progress.NewForStream(state.ErrorStream)
+	defer renderer.Close()
+	return docker.PullAll(ctx, state.DockerClient, toPull, docker.DefaultPullWorkers, renderer)
+}
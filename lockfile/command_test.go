@@ -0,0 +1,127 @@
+package lockfile_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/lockfile"
+	"github.com/mergermarket/cdflow2/manifest"
+)
+
+func newState(t *testing.T, dockerClient *fake.Client, globalArgs *command.GlobalArgs) *command.GlobalState {
+	dir, err := ioutil.TempDir("", "cdflow2-lock")
+	if err != nil {
+		t.Fatal("error creating temp dir:", err)
+	}
+	return &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  &bytes.Buffer{},
+		CodeDir:      dir,
+		Manifest: &manifest.Manifest{
+			Version:   2,
+			Config:    manifest.ImageWithParams{Image: "config-image"},
+			Builds:    map[string]manifest.ImageWithParams{"release": {Image: "registry.example.com/build-image:1"}},
+			Terraform: manifest.Terraform{Image: "terraform-image:latest"},
+		},
+		GlobalArgs: globalArgs,
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	dockerClient.AddImage("config-image", "config-image@sha256:1111")
+	dockerClient.AddImage(
+		"registry.example.com/build-image:1",
+		"other-registry.example.com/build-image@sha256:9999",
+		"registry.example.com/build-image@sha256:2222",
+	)
+	dockerClient.AddImage("terraform-image:latest", "terraform-image@sha256:3333")
+	state := newState(t, dockerClient, &command.GlobalArgs{})
+	defer os.RemoveAll(state.CodeDir)
+
+	// When
+	if err := lockfile.RunCommand(context.Background(), state); err != nil {
+		t.Fatal("error locking images:", err)
+	}
+
+	// Then
+	lock, err := manifest.LoadLock(state.CodeDir)
+	if err != nil || lock == nil {
+		t.Fatal("error loading lock:", err)
+	}
+	if !reflect.DeepEqual(lock.Images, map[string]manifest.LockedImage{
+		"config":        {Image: "config-image", Digest: "config-image@sha256:1111"},
+		"build/release": {Image: "registry.example.com/build-image:1", Digest: "registry.example.com/build-image@sha256:2222"},
+		"terraform":     {Image: "terraform-image:latest", Digest: "terraform-image@sha256:3333"},
+	}) {
+		t.Fatal("unexpected lock:", lock.Images)
+	}
+	if state.Manifest.Config.Image != "config-image@sha256:1111" {
+		t.Fatal("expected manifest to use locked digest, got:", state.Manifest.Config.Image)
+	}
+}
+
+func TestApplyStaleLock(t *testing.T) {
+	// Given
+	state := newState(t, fake.NewClient(), &command.GlobalArgs{})
+	defer os.RemoveAll(state.CodeDir)
+	lock := &manifest.Lock{Images: map[string]manifest.LockedImage{
+		"config":        {Image: "config-image", Digest: "config-image@sha256:1111"},
+		"build/release": {Image: "registry.example.com/build-image:0", Digest: "registry.example.com/build-image@sha256:0000"},
+		"terraform":     {Image: "terraform-image:latest", Digest: "terraform-image@sha256:3333"},
+	}}
+	if err := lock.Write(state.CodeDir); err != nil {
+		t.Fatal("error writing lock:", err)
+	}
+
+	// When
+	err := lockfile.Apply(context.Background(), state)
+
+	// Then
+	if err == nil || !strings.Contains(err.Error(), "--update-lock") {
+		t.Fatal("expected stale lock error, got:", err)
+	}
+	if state.Manifest.Config.Image != "config-image" {
+		t.Fatal("expected manifest not to be changed, got:", state.Manifest.Config.Image)
+	}
+}
+
+func TestApplyUpdateLock(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	dockerClient.AddImage("config-image", "config-image@sha256:1111")
+	dockerClient.AddImage("registry.example.com/build-image:1", "registry.example.com/build-image@sha256:2222")
+	dockerClient.AddImage("terraform-image:latest", "terraform-image@sha256:3333")
+	state := newState(t, dockerClient, &command.GlobalArgs{UpdateLock: true})
+	defer os.RemoveAll(state.CodeDir)
+
+	// When
+	if err := lockfile.Apply(context.Background(), state); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// Then
+	if state.Manifest.Builds["release"].Image != "registry.example.com/build-image@sha256:2222" {
+		t.Fatal("expected updated lock to be applied, got:", state.Manifest.Builds["release"].Image)
+	}
+}
+
+func TestApplyNoLock(t *testing.T) {
+	state := newState(t, fake.NewClient(), &command.GlobalArgs{})
+	defer os.RemoveAll(state.CodeDir)
+	if err := lockfile.Apply(context.Background(), state); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if state.Manifest.Config.Image != "config-image" {
+		t.Fatal("expected manifest not to be changed, got:", state.Manifest.Config.Image)
+	}
+}
@@ -1,16 +1,30 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/conformance"
 	"github.com/mergermarket/cdflow2/deploy"
 	"github.com/mergermarket/cdflow2/destroy"
+	"github.com/mergermarket/cdflow2/envlock"
+	"github.com/mergermarket/cdflow2/gc"
+	"github.com/mergermarket/cdflow2/images"
+	"github.com/mergermarket/cdflow2/lockfile"
 	release "github.com/mergermarket/cdflow2/release/command"
+	"github.com/mergermarket/cdflow2/releases"
+	"github.com/mergermarket/cdflow2/rollback"
 	"github.com/mergermarket/cdflow2/setup"
 	"github.com/mergermarket/cdflow2/shell"
+	"github.com/mergermarket/cdflow2/status"
 	"github.com/mergermarket/cdflow2/util"
+	"github.com/mergermarket/cdflow2/verify"
 )
 
 var version = "undefined"
@@ -22,7 +36,13 @@ const globalOptions string = `Global options:
   --no-pull-config             - don't pull the config container (must exist).
   --no-pull-release            - don't pull the release container (must exist).
   --no-pull-terraform          - don't pull the terraform container (must exist).
+  --image-archive DIR          - load images from DIR (see "cdflow2 help images") before pulling from a registry.
   --quiet | -q                 - hide verbose description of what's going on.
+  --host-user                  - run terraform and build containers as the current user (default on Linux).
+  --no-host-user               - run terraform and build containers as the image's user (e.g. root).
+  --update-lock                - resolve the images in cdflow.yaml and update cdflow.lock before running the command.
+  --retries N                  - retry docker and registry operations that fail transiently up to N times (default 3).
+  --retry-max-delay DURATION   - maximum delay between retries, e.g. "10s" (default 30s).
   --version                    - print the version number and exit. 
   --help                       - print the help message and exit.
 `
@@ -39,6 +59,16 @@ Commands:
   deploy  [ OPTS ] ENV VERSION            - create & update infrastructure using software artefact
   destroy [ OPTS ] ENV VERSION            - destroy all Terraform managed infrastructure in ENV
   shell   ENV [ OPTS ] [ SHELLARGS ]      - access terraform for debugging and tf state manipulation
+  gc      [ OPTS ]                        - remove containers and volumes left behind by crashed runs
+  images  save DIR [ ENV VERSION ]        - save the images needed to run offline to DIR
+  pin                                     - pin the images in cdflow.yaml to digests in cdflow.lock
+  lock    ENV [ OPTS ]                    - lock ENV to stop deploys, destroys and shells until it is unlocked
+  unlock  ENV [ OPTS ]                    - release a lock on ENV
+  verify-release [ OPTS ] VERSION         - check a release was built with the images in cdflow.yaml
+  releases [ OPTS ]                       - list the component's releases
+  status  [ OPTS ] [ ENV... ]             - show the version deployed to each environment
+  rollback [ OPTS ] ENV                   - redeploy the version deployed to ENV before the current one
+  conformance config|build IMAGE [ OPTS ] - check a config or build image follows the protocol cdflow2 uses
   help    [ COMMAND ]                     - display detailed help and usage information for a command
 
 ` + globalOptions
@@ -56,6 +86,7 @@ Args:
 Options:
 
   --release-data | -r    - add key/value to release metadata (i.e. --release-data foo=bar).
+  --jobs | -j N          - run up to N builds at the same time, each waiting for the builds it depends on (default 1).
 
 ` + globalOptions
 
@@ -119,6 +150,179 @@ Options:
 
 ` + globalOptions
 
+const gcHelp string = `
+Usage:
+
+  cdflow2 [ GLOBALOPTS ] gc [ OPTS ]
+
+Removes containers and volumes created by cdflow2 where the run that created them is no longer running on this
+host, or they are older than a threshold. Does not require a cdflow.yaml.
+
+Options:
+
+  --dry-run | -n              - list what would be removed, without removing anything.
+  --all | -a                  - remove all cdflow2 containers and volumes, even if the run is still going.
+  --older-than DURATION       - remove resources older than this, even if the run can't be confirmed dead (default 24h).
+
+` + globalOptions
+
+const imagesHelp string = `
+Usage:
+
+  cdflow2 [ GLOBALOPTS ] images save DIR [ ENV VERSION ]
+
+Saves the config, build and terraform images in cdflow.yaml to DIR, so that cdflow2 can be run without access to a
+registry (e.g. on an air-gapped runner) by passing --image-archive DIR.
+
+Args:
+
+  DIR                 - the directory to save the images to (created if it doesn't exist).
+  ENV VERSION         - also save the terraform image recorded in this release (requires access to the release in ENV).
+
+` + globalOptions
+
+const pinHelp string = `
+Usage:
+
+  cdflow2 [ GLOBALOPTS ] pin
+
+Pulls the config, build and terraform images in cdflow.yaml and writes the repo digest of each to cdflow.lock. When
+cdflow.lock exists, other commands run the pinned digests rather than pulling by tag, and fail if cdflow.yaml has
+changed since it was written (pass --update-lock to update it).
+
+` + globalOptions
+
+const lockHelp string = `
+Usage:
+
+  cdflow2 [ GLOBALOPTS ] lock ENV [ OPTS ]
+
+Locks the environment via the config container (which must support the acquire_lock action), so that deploy,
+destroy and shell fail until it is unlocked (see "cdflow2 help unlock") or the lock expires. Deploy, destroy and
+shell take the same lock while they run.
+
+Options:
+
+  --reason REASON       - why the environment is locked, shown to anyone who tries to deploy.
+  --ttl DURATION        - how long until the lock expires if it isn't released, e.g. "24h" (default 2h).
+
+` + globalOptions
+
+const unlockHelp string = `
+Usage:
+
+  cdflow2 [ GLOBALOPTS ] unlock ENV [ OPTS ]
+
+Releases your lock on ENV (taken with "cdflow2 lock ENV").
+
+Options:
+
+  --force | -f          - release the lock whoever holds it (e.g. if a CI runner died while deploying).
+  --reason REASON       - why the lock is being forced (required with --force, and recorded for audit).
+
+` + globalOptions
+
+const verifyReleaseHelp string = `
+Usage:
+
+  cdflow2 [ GLOBALOPTS ] verify-release [ OPTS ] VERSION
+
+Checks that the config and build images in cdflow.yaml (or their digests in cdflow.lock) are the ones that were used
+to build a release, as recorded in its release metadata. Exits with an error listing the differences if not.
+
+Args:
+
+  VERSION                - the version of the release to check.
+
+Options:
+
+  --env | -e ENV         - the environment passed to the config container to fetch the release (if it needs one).
+
+` + globalOptions
+
+const releasesHelp string = `
+Usage:
+
+  cdflow2 [ GLOBALOPTS ] releases [ OPTS ]
+
+Lists the component's releases, newest first, via the config container (which must support the list_releases action).
+
+Options:
+
+  --since DATE           - only list releases created on or after DATE (e.g. "2020-01-31" or "2020-01-31T15:04:05Z").
+  --commit COMMIT        - only list releases built from COMMIT.
+  --prefix PREFIX        - only list releases whose version starts with PREFIX.
+  --limit N              - the number of releases to list per page (default 20).
+  --page-token TOKEN     - list the next page of releases, using the token output after the previous page.
+  --all | -a             - list all matching releases, fetching every page.
+  --json                 - output JSON rather than a table.
+
+` + globalOptions
+
+const statusHelp string = `
+Usage:
+
+  cdflow2 [ GLOBALOPTS ] status [ OPTS ] [ ENV... ]
+
+Shows the version last deployed to each environment (as recorded by deploy), who deployed it and when, and how many
+releases behind the latest it is. Requires a config image that supports the get_deployments action (and
+list_releases to show how far behind each environment is).
+
+Args:
+
+  ENV                 - only show these environments (all environments by default).
+
+Options:
+
+  --json              - output JSON rather than a table.
+
+` + globalOptions
+
+const rollbackHelp string = `
+Usage:
+
+  cdflow2 [ GLOBALOPTS ] rollback [ OPTS ] ENV
+
+Redeploys the version that was deployed to ENV before the current one (skipping versions that were rolled back
+from), found in the deployment history recorded by deploy. The deployment is recorded as a rollback. Requires a
+config image that supports the get_deployments action, unless --to is passed.
+
+Args:
+
+  ENV                 - the environment to roll back.
+
+Options:
+
+  --to VERSION        - roll back to VERSION rather than the previously deployed version.
+  --plan-only | -p    - create the terraform plan only, don't apply.
+
+` + globalOptions
+
+const conformanceHelp string = `
+Usage:
+
+  cdflow2 [ GLOBALOPTS ] conformance config IMAGE [ OPTS ]
+  cdflow2 [ GLOBALOPTS ] conformance build IMAGE [ OPTS ]
+
+Checks an image follows the protocol cdflow2 uses to talk to it, using throwaway volumes, and prints a pass/fail
+report - for authors of config and build images. For a config image, a release with a random version is configured,
+uploaded and prepared for terraform, so use params and credentials for a test account. A build image is run against
+a scratch code directory. Does not require a cdflow.yaml.
+
+Args:
+
+  IMAGE                      - the config or build image to check.
+
+Options:
+
+  --param KEY=VALUE          - add a param (i.e. under config or the build in cdflow.yaml), can be repeated.
+  --env ENV                  - config only: the environment name to send (default "conformance").
+  --terraform-image IMAGE    - config only: the terraform image recorded in the release (default
+                               "hashicorp/terraform:latest").
+  --code DIR                 - build only: copy DIR to the scratch code directory (empty by default).
+
+` + globalOptions
+
 func usage(subcommand string) {
 	if subcommand == "release" {
 		fmt.Println(releaseHelp)
@@ -130,6 +334,26 @@ func usage(subcommand string) {
 		fmt.Println(setupHelp)
 	} else if subcommand == "destroy" {
 		fmt.Println(destroyHelp)
+	} else if subcommand == "gc" {
+		fmt.Println(gcHelp)
+	} else if subcommand == "images" {
+		fmt.Println(imagesHelp)
+	} else if subcommand == "pin" {
+		fmt.Println(pinHelp)
+	} else if subcommand == "lock" {
+		fmt.Println(lockHelp)
+	} else if subcommand == "unlock" {
+		fmt.Println(unlockHelp)
+	} else if subcommand == "verify-release" {
+		fmt.Println(verifyReleaseHelp)
+	} else if subcommand == "releases" {
+		fmt.Println(releasesHelp)
+	} else if subcommand == "status" {
+		fmt.Println(statusHelp)
+	} else if subcommand == "rollback" {
+		fmt.Println(rollbackHelp)
+	} else if subcommand == "conformance" {
+		fmt.Println(conformanceHelp)
 	} else {
 		fmt.Println(help)
 	}
@@ -147,6 +371,64 @@ For usage run:
 
 `
 
+// errorStream is where errors are output - once the state has been created this is its (redacted) ErrorStream.
+var errorStream io.Writer = os.Stderr
+
+// flushOutput writes any output held back by redaction before exiting.
+var flushOutput = func() {}
+
+// useState sends errors to the state's error stream and flushes its output on exit.
+func useState(state *command.GlobalState) {
+	errorStream = state.ErrorStream
+	flushOutput = state.Flush
+}
+
+// exit flushes output and exits with status.
+func exit(status int) {
+	flushOutput()
+	os.Exit(status)
+}
+
+// exitWithError exits with a status appropriate to the error returned from a command.
+func exitWithError(err error, message string) {
+	if status, ok := err.(command.Failure); ok {
+		exit(int(status))
+	}
+	fmt.Fprintln(errorStream, message)
+	if errors.Is(err, context.Canceled) {
+		exit(130)
+	}
+	// e.g. structured errors from the config container
+	var exitCoder interface{ ExitCode() int }
+	if errors.As(err, &exitCoder) {
+		exit(exitCoder.ExitCode())
+	}
+	exit(1)
+}
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM, giving the command the chance to
+// interrupt what it is doing and clean up its containers and volumes. A second signal exits immediately.
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case received := <-signals:
+			fmt.Fprintf(os.Stderr, "\ncdflow2: received %v, cleaning up (repeat to exit immediately)...\n", received)
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+		<-signals
+		os.Exit(130)
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
 func main() {
 	globalArgs, remainingArgs, err := command.ParseArgs(os.Args[1:])
 
@@ -167,11 +449,75 @@ func main() {
 		os.Exit(0)
 	}
 
+	ctx, stop := signalContext()
+	defer stop()
+
+	if globalArgs.Command == "gc" {
+		gcArgs, err := gc.ParseArgs(remainingArgs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Error: %s", err))
+			usage("gc")
+		}
+		state, err := command.GetDockerState(globalArgs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		useState(state)
+		defer state.Flush()
+		if err := gc.RunCommand(ctx, state, gcArgs); err != nil {
+			exitWithError(err, err.Error())
+		}
+		return
+	}
+
+	if globalArgs.Command == "conformance" {
+		conformanceArgs, err := conformance.ParseArgs(remainingArgs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Error: %s", err))
+			usage("conformance")
+		}
+		state, err := command.GetDockerState(globalArgs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		state.Component = globalArgs.Component
+		state.Commit = globalArgs.Commit
+		// so gc can find containers and volumes left behind if conformance is killed
+		state.DockerClient.SetLabels(command.ResourceLabels(state))
+		useState(state)
+		defer state.Flush()
+		if err := conformance.RunCommand(ctx, state, conformanceArgs, util.GetEnv(os.Environ())); err != nil {
+			exitWithError(err, err.Error())
+		}
+		return
+	}
+
 	state, err := command.GetGlobalState(globalArgs)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+	useState(state)
+	defer state.Flush()
+
+	if globalArgs.Command == "pin" {
+		if len(remainingArgs) != 0 {
+			usage("pin")
+		}
+		if err := lockfile.RunCommand(ctx, state); err != nil {
+			exitWithError(err, err.Error())
+		}
+		return
+	}
+
+	// unlock must work even when cdflow.lock is stale, since it may be needed to recover from a failed deploy
+	if globalArgs.Command != "unlock" {
+		if err := lockfile.Apply(ctx, state); err != nil {
+			exitWithError(err, err.Error())
+		}
+	}
 
 	env := util.GetEnv(os.Environ())
 
@@ -181,60 +527,103 @@ func main() {
 			fmt.Fprintln(os.Stderr, fmt.Sprintf("Error: %s", ok))
 			usage("release")
 		}
-		if err := release.RunCommand(state, *releaseArgs, env); err != nil {
-			if status, ok := err.(command.Failure); ok {
-				os.Exit(int(status))
-			}
-			fmt.Fprintln(os.Stderr, "\n"+err.Error())
-			os.Exit(1)
+		if err := release.RunCommand(ctx, state, *releaseArgs, env); err != nil {
+			exitWithError(err, "\n"+err.Error())
 		}
 	} else if globalArgs.Command == "deploy" {
 		deployArgs, ok := deploy.ParseArgs(remainingArgs)
 		if !ok {
 			usage("deploy")
 		}
-		if err := deploy.RunCommand(state, deployArgs, env); err != nil {
-			if status, ok := err.(command.Failure); ok {
-				os.Exit(int(status))
-			}
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+		if err := deploy.RunCommand(ctx, state, deployArgs, env); err != nil {
+			exitWithError(err, err.Error())
 		}
 	} else if globalArgs.Command == "shell" {
 		shellArgs, ok := shell.ParseArgs(remainingArgs)
 		if ok != nil {
 			usage("shell")
 		}
-		if err := shell.RunCommand(state, shellArgs, env); err != nil {
-			if status, ok := err.(command.Failure); ok {
-				os.Exit(int(status))
-			}
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+		if err := shell.RunCommand(ctx, state, shellArgs, env); err != nil {
+			exitWithError(err, err.Error())
 		}
 
 	} else if globalArgs.Command == "setup" {
 		if len(remainingArgs) != 0 {
 			usage("setup")
 		}
-		if err := setup.RunCommand(state, env); err != nil {
-			if status, ok := err.(command.Failure); ok {
-				os.Exit(int(status))
-			}
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+		if err := setup.RunCommand(ctx, state, env); err != nil {
+			exitWithError(err, err.Error())
 		}
 	} else if globalArgs.Command == "destroy" {
 		destroyArgs, ok := destroy.ParseArgs(remainingArgs)
 		if !ok {
 			usage("destroy")
 		}
-		if err := destroy.RunCommand(state, destroyArgs, env); err != nil {
-			if status, ok := err.(command.Failure); ok {
-				os.Exit(int(status))
-			}
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+		if err := destroy.RunCommand(ctx, state, destroyArgs, env); err != nil {
+			exitWithError(err, err.Error())
+		}
+	} else if globalArgs.Command == "images" {
+		imagesArgs, err := images.ParseArgs(remainingArgs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Error: %s", err))
+			usage("images")
+		}
+		if err := images.RunCommand(ctx, state, imagesArgs, env); err != nil {
+			exitWithError(err, err.Error())
+		}
+	} else if globalArgs.Command == "verify-release" {
+		verifyArgs, err := verify.ParseArgs(remainingArgs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Error: %s", err))
+			usage("verify-release")
+		}
+		if err := verify.RunCommand(ctx, state, verifyArgs, env); err != nil {
+			exitWithError(err, err.Error())
+		}
+	} else if globalArgs.Command == "releases" {
+		releasesArgs, err := releases.ParseArgs(remainingArgs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Error: %s", err))
+			usage("releases")
+		}
+		if err := releases.RunCommand(ctx, state, releasesArgs, env); err != nil {
+			exitWithError(err, err.Error())
+		}
+	} else if globalArgs.Command == "status" {
+		statusArgs, err := status.ParseArgs(remainingArgs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Error: %s", err))
+			usage("status")
+		}
+		if err := status.RunCommand(ctx, state, statusArgs, env); err != nil {
+			exitWithError(err, err.Error())
+		}
+	} else if globalArgs.Command == "lock" {
+		lockArgs, err := envlock.ParseLockArgs(remainingArgs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Error: %s", err))
+			usage("lock")
+		}
+		if err := envlock.RunLockCommand(ctx, state, lockArgs, env); err != nil {
+			exitWithError(err, err.Error())
+		}
+	} else if globalArgs.Command == "unlock" {
+		unlockArgs, err := envlock.ParseUnlockArgs(remainingArgs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Error: %s", err))
+			usage("unlock")
+		}
+		if err := envlock.RunUnlockCommand(ctx, state, unlockArgs, env); err != nil {
+			exitWithError(err, err.Error())
+		}
+	} else if globalArgs.Command == "rollback" {
+		rollbackArgs, err := rollback.ParseArgs(remainingArgs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, fmt.Sprintf("Error: %s", err))
+			usage("rollback")
+		}
+		if err := rollback.RunCommand(ctx, state, rollbackArgs, env); err != nil {
+			exitWithError(err, err.Error())
 		}
 	} else {
 		usage("")
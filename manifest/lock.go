@@ -0,0 +1,109 @@
+package manifest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LockFilename is the name of the file that pins the images in cdflow.yaml to digests.
+const LockFilename = "cdflow.lock"
+
+const lockHeader = "# Generated by \"cdflow2 pin\" - commit this file, and run \"cdflow2 pin\" again to update the images.\n"
+
+// LockedImage is an image from cdflow.yaml and the digest it resolved to when it was locked.
+type LockedImage struct {
+	Image  string `yaml:"image"`
+	Digest string `yaml:"digest"`
+}
+
+// Lock represents the cdflow.lock file, which pins each image in cdflow.yaml to a repo digest, keyed as in Images.
+type Lock struct {
+	Images map[string]LockedImage `yaml:"images"`
+}
+
+// Images returns the images in the manifest keyed by what they are used for - "config", "build/BUILD_ID" and
+// "terraform". Builtin config images aren't docker images, so aren't included.
+func (manifest *Manifest) Images() map[string]string {
+	result := map[string]string{
+		"terraform": manifest.Terraform.Image,
+	}
+	if !IsBuiltinImage(manifest.Config.Image) {
+		result["config"] = manifest.Config.Image
+	}
+	for buildID, build := range manifest.Builds {
+		result["build/"+buildID] = build.Image
+	}
+	return result
+}
+
+// LoadLock loads the cdflow.lock file from dir, returning nil if there isn't one.
+func LoadLock(dir string) (*Lock, error) {
+	data, err := ioutil.ReadFile(path.Join(dir, LockFilename))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error loading %s: %w", LockFilename, err)
+	}
+	var result Lock
+	if err := yaml.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", LockFilename, err)
+	}
+	return &result, nil
+}
+
+// Write writes the lock to cdflow.lock in dir.
+func (lock *Lock) Write(dir string) error {
+	data, err := yaml.Marshal(lock)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dir, LockFilename), append([]byte(lockHeader), data...), 0644); err != nil {
+		return fmt.Errorf("error writing %s: %w", LockFilename, err)
+	}
+	return nil
+}
+
+// Check returns an error describing the differences if the lock is stale - i.e. it doesn't have a digest for
+// exactly the images in the manifest.
+func (lock *Lock) Check(manifest *Manifest) error {
+	images := manifest.Images()
+	var problems []string
+	for key, image := range images {
+		locked, ok := lock.Images[key]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s image %s is not locked", key, image))
+		} else if locked.Image != image {
+			problems = append(problems, fmt.Sprintf("%s image is %s but %s is locked", key, image, locked.Image))
+		} else if locked.Digest == "" {
+			problems = append(problems, fmt.Sprintf("%s image %s has no digest", key, image))
+		}
+	}
+	for key := range lock.Images {
+		if _, ok := images[key]; !ok {
+			problems = append(problems, fmt.Sprintf("%s is locked but not in cdflow.yaml", key))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("%s is out of date with cdflow.yaml (%s)", LockFilename, strings.Join(problems, ", "))
+}
+
+// ApplyLock replaces the images in the manifest with the locked digests - the lock must be up to date (see Check).
+func (manifest *Manifest) ApplyLock(lock *Lock) {
+	if locked, ok := lock.Images["config"]; ok {
+		manifest.Config.Image = locked.Digest
+	}
+	manifest.Terraform.Image = lock.Images["terraform"].Digest
+	for buildID, build := range manifest.Builds {
+		build.Image = lock.Images["build/"+buildID].Digest
+		manifest.Builds[buildID] = build
+	}
+}
@@ -0,0 +1,119 @@
+package manifest_test
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/manifest"
+)
+
+func TestLockRoundTrip(t *testing.T) {
+	// Given
+	dir := writeManifest(t, `
+version: 2
+config:
+  image: test-config-image
+builds:
+  release:
+    image: test-build-image:1
+terraform:
+  image: test-terraform-image
+`)
+	defer os.RemoveAll(dir)
+	loadedManifest, err := manifest.Load(dir)
+	if err != nil {
+		t.Fatal("error loading manifest:", err)
+	}
+	lock := &manifest.Lock{Images: map[string]manifest.LockedImage{
+		"config":        {Image: "test-config-image", Digest: "test-config-image@sha256:1111"},
+		"build/release": {Image: "test-build-image:1", Digest: "test-build-image@sha256:2222"},
+		"terraform":     {Image: "test-terraform-image", Digest: "test-terraform-image@sha256:3333"},
+	}}
+
+	// When
+	if err := lock.Write(dir); err != nil {
+		t.Fatal("error writing lock:", err)
+	}
+	loadedLock, err := manifest.LoadLock(dir)
+	if err != nil {
+		t.Fatal("error loading lock:", err)
+	}
+	if err := loadedLock.Check(loadedManifest); err != nil {
+		t.Fatal("unexpected stale lock:", err)
+	}
+	loadedManifest.ApplyLock(loadedLock)
+
+	// Then
+	if loadedManifest.Config.Image != "test-config-image@sha256:1111" ||
+		loadedManifest.Builds["release"].Image != "test-build-image@sha256:2222" ||
+		loadedManifest.Terraform.Image != "test-terraform-image@sha256:3333" {
+		t.Fatal("expected locked digests to be applied, got:", loadedManifest.Images())
+	}
+}
+
+func TestLoadLockMissing(t *testing.T) {
+	dir := writeManifest(t, "version: 2\n")
+	defer os.RemoveAll(dir)
+	lock, err := manifest.LoadLock(dir)
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if lock != nil {
+		t.Fatal("expected no lock, got:", lock)
+	}
+}
+
+func TestLockCheckStale(t *testing.T) {
+	// Given
+	loadedManifest := &manifest.Manifest{
+		Config:    manifest.ImageWithParams{Image: "test-config-image"},
+		Builds:    map[string]manifest.ImageWithParams{"release": {Image: "test-build-image:2"}},
+		Terraform: manifest.Terraform{Image: "test-terraform-image"},
+	}
+	lock := &manifest.Lock{Images: map[string]manifest.LockedImage{
+		"config":        {Image: "test-config-image", Digest: "test-config-image@sha256:1111"},
+		"build/release": {Image: "test-build-image:1", Digest: "test-build-image@sha256:2222"},
+		"build/old":     {Image: "test-old-image", Digest: "test-old-image@sha256:4444"},
+	}}
+
+	// When
+	err := lock.Check(loadedManifest)
+
+	// Then
+	if err == nil {
+		t.Fatal("expected stale lock error")
+	}
+	for _, expected := range []string{
+		"build/release image is test-build-image:2 but test-build-image:1 is locked",
+		"build/old is locked but not in cdflow.yaml",
+		"terraform image test-terraform-image is not locked",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected %q in error, got: %v", expected, err)
+		}
+	}
+}
+
+func TestLockBuiltinConfigImage(t *testing.T) {
+	// Given
+	loadedManifest := &manifest.Manifest{
+		Config:    manifest.ImageWithParams{Image: "builtin:local"},
+		Terraform: manifest.Terraform{Image: "test-terraform-image"},
+	}
+	lock := &manifest.Lock{Images: map[string]manifest.LockedImage{
+		"terraform": {Image: "test-terraform-image", Digest: "test-terraform-image@sha256:3333"},
+	}}
+
+	// When
+	err := lock.Check(loadedManifest)
+	loadedManifest.ApplyLock(lock)
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if loadedManifest.Config.Image != "builtin:local" || loadedManifest.Terraform.Image != "test-terraform-image@sha256:3333" {
+		t.Fatalf("unexpected images after applying lock: %+v", loadedManifest)
+	}
+}
@@ -1,10 +1,15 @@
 package manifest
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"path"
+	"sort"
+	"strings"
 
+	"github.com/docker/go-units"
+	"github.com/mergermarket/cdflow2/docker"
 	"gopkg.in/yaml.v2"
 )
 
@@ -16,17 +21,202 @@ type Manifest struct {
 	Terraform Terraform                  `yaml:"terraform"`
 }
 
+// BuildIDs returns the IDs of the builds in the manifest, sorted so the order is stable.
+func (manifest *Manifest) BuildIDs() []string {
+	buildIDs := make([]string, 0, len(manifest.Builds))
+	for buildID := range manifest.Builds {
+		buildIDs = append(buildIDs, buildID)
+	}
+	sort.Strings(buildIDs)
+	return buildIDs
+}
+
+// BuildOrder returns the IDs of the builds in an order where each build comes after those it depends on, or an error
+// if depends_on refers to an unknown build or the dependencies form a cycle.
+func (manifest *Manifest) BuildOrder() ([]string, error) {
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	states := make(map[string]int)
+	var order, stack []string
+	var visit func(buildID string) error
+	visit = func(buildID string) error {
+		switch states[buildID] {
+		case visited:
+			return nil
+		case visiting:
+			start := 0
+			for stack[start] != buildID {
+				start++
+			}
+			return fmt.Errorf("builds in cdflow.yaml depend on each other in a cycle: %s", strings.Join(append(stack[start:], buildID), " -> "))
+		}
+		states[buildID] = visiting
+		stack = append(stack, buildID)
+		for _, dependency := range manifest.Builds[buildID].DependsOn {
+			if _, ok := manifest.Builds[dependency]; !ok {
+				return fmt.Errorf("build '%v' in cdflow.yaml depends on unknown build '%v'", buildID, dependency)
+			}
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		states[buildID] = visited
+		order = append(order, buildID)
+		return nil
+	}
+	for _, buildID := range manifest.BuildIDs() {
+		if err := visit(buildID); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// BuiltinImagePrefix marks a config image as built into cdflow2 rather than a docker image (e.g. "builtin:local").
+const BuiltinImagePrefix = "builtin:"
+
+// IsBuiltinImage returns true if the image is built into cdflow2 rather than a docker image.
+func IsBuiltinImage(image string) bool {
+	return strings.HasPrefix(image, BuiltinImagePrefix)
+}
+
 // ImageWithParams represents either the config or a build key in cdflow.yaml.
 type ImageWithParams struct {
-	Image  string                 `yaml:"image"`
-	Params map[string]interface{} `yaml:"params"`
+	Image        string                 `yaml:"image"`
+	Params       map[string]interface{} `yaml:"params"`
+	Limits       Limits                 `yaml:"limits"`
+	DockerSocket DockerSocketMode       `yaml:"docker_socket"`
+	DependsOn    []string               `yaml:"depends_on"`
+}
+
+// DockerSocketMode controls the access a build container has to docker.
+type DockerSocketMode string
+
+const (
+	// DockerSocketFull mounts the docker socket into the build container, giving it full control of docker (and
+	// therefore root on the host).
+	DockerSocketFull DockerSocketMode = "full"
+	// DockerSocketNone gives the build container no access to docker.
+	DockerSocketNone DockerSocketMode = "none"
+	// DockerSocketRestricted gives the build container access to a filtered docker API that allows building,
+	// pushing and inspecting images, but not creating privileged containers.
+	DockerSocketRestricted DockerSocketMode = "restricted"
+)
+
+// UnmarshalYAML parses the docker_socket key, which can be true, false or "restricted".
+func (mode *DockerSocketMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value interface{}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	switch value {
+	case true:
+		*mode = DockerSocketFull
+	case false:
+		*mode = DockerSocketNone
+	case string(DockerSocketRestricted):
+		*mode = DockerSocketRestricted
+	default:
+		return fmt.Errorf("invalid docker_socket %v (must be true, false or restricted)", value)
+	}
+	return nil
+}
+
+// lastVersionWithDockerSocketDefault is the last manifest version where build containers get the docker socket by
+// default - later versions will need to opt in.
+const lastVersionWithDockerSocketDefault = 2
+
+// DockerSocketMode returns the access the build container has to docker, taking the default into account.
+func (build ImageWithParams) DockerSocketMode(version int8) DockerSocketMode {
+	if build.DockerSocket != "" {
+		return build.DockerSocket
+	}
+	if version <= lastVersionWithDockerSocketDefault {
+		return DockerSocketFull
+	}
+	return DockerSocketNone
 }
 
 // Terraform represents the data in the terraform key in cdflow.yaml.
 type Terraform struct {
-	Image string `yaml:"image"`
+	Image  string `yaml:"image"`
+	Limits Limits `yaml:"limits"`
 }
 
+// Limits represents the resource limits and security options for a container in cdflow.yaml - anything not set
+// is left at the docker default (i.e. no limit).
+type Limits struct {
+	Memory          ByteSize `yaml:"memory"`
+	CPUs            float64  `yaml:"cpus"`
+	Pids            int64    `yaml:"pids"`
+	ReadOnly        bool     `yaml:"read_only"`
+	CapDrop         []string `yaml:"cap_drop"`
+	NoNewPrivileges bool     `yaml:"no_new_privileges"`
+}
+
+// minimumMemory is the smallest memory limit docker will accept.
+const minimumMemory = 6 * units.MiB
+
+func (limits Limits) validate() error {
+	if limits.Memory < 0 || (limits.Memory > 0 && limits.Memory < minimumMemory) {
+		return fmt.Errorf("memory must be at least %s", units.BytesSize(minimumMemory))
+	}
+	if limits.CPUs < 0 {
+		return fmt.Errorf("cpus must not be negative")
+	}
+	if limits.Pids < 0 {
+		return fmt.Errorf("pids must not be negative")
+	}
+	return nil
+}
+
+// ContainerLimits converts the limits from cdflow.yaml to those passed to docker.
+func (limits Limits) ContainerLimits() docker.Limits {
+	var capDrop []string
+	for _, capability := range limits.CapDrop {
+		capDrop = append(capDrop, strings.ToUpper(capability))
+	}
+	return docker.Limits{
+		Memory:          int64(limits.Memory),
+		CPUs:            limits.CPUs,
+		PidsLimit:       limits.Pids,
+		ReadOnlyRootfs:  limits.ReadOnly,
+		CapDrop:         capDrop,
+		NoNewPrivileges: limits.NoNewPrivileges,
+	}
+}
+
+// ByteSize is a number of bytes, which can be given in cdflow.yaml as a number or a string with a unit (e.g. "512m" or "2g").
+type ByteSize int64
+
+// UnmarshalYAML parses a ByteSize from a number or string.
+func (size *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value interface{}
+	if err := unmarshal(&value); err != nil {
+		return err
+	}
+	switch value := value.(type) {
+	case int:
+		*size = ByteSize(value)
+	case string:
+		bytes, err := units.RAMInBytes(value)
+		if err != nil {
+			return err
+		}
+		*size = ByteSize(bytes)
+	default:
+		return fmt.Errorf("invalid size %v", value)
+	}
+	return nil
+}
+
+// ImageDigestsFilename is the file in the release where the digests of the config and build images used to create the
+// release are recorded (keyed as in Manifest.Images) - not in release-metadata.json, which is passed to terraform.
+const ImageDigestsFilename = "cdflow2-images.json"
+
 // Load loads the cdflow.yaml manifest file into a Manifest struct.
 func Load(dir string) (*Manifest, error) {
 	data, err := ioutil.ReadFile(path.Join(dir, "cdflow.yaml"))
@@ -37,5 +227,22 @@ func Load(dir string) (*Manifest, error) {
 	if err := yaml.Unmarshal(data, &result); err != nil {
 		return nil, fmt.Errorf("error parsing cdflow.yaml: %w", err)
 	}
+	if err := result.Config.Limits.validate(); err != nil {
+		return nil, fmt.Errorf("invalid limits for config in cdflow.yaml: %w", err)
+	}
+	if len(result.Config.DependsOn) != 0 {
+		return nil, errors.New("depends_on in cdflow.yaml is only valid for builds, not config")
+	}
+	for buildID, build := range result.Builds {
+		if err := build.Limits.validate(); err != nil {
+			return nil, fmt.Errorf("invalid limits for build '%v' in cdflow.yaml: %w", buildID, err)
+		}
+	}
+	if err := result.Terraform.Limits.validate(); err != nil {
+		return nil, fmt.Errorf("invalid limits for terraform in cdflow.yaml: %w", err)
+	}
+	if _, err := result.BuildOrder(); err != nil {
+		return nil, err
+	}
 	return &result, nil
 }
@@ -1,10 +1,14 @@
 package manifest_test
 
 import (
+	"io/ioutil"
 	"log"
+	"os"
+	"path"
 	"reflect"
 	"testing"
 
+	"github.com/mergermarket/cdflow2/docker"
 	"github.com/mergermarket/cdflow2/manifest"
 	"github.com/mergermarket/cdflow2/test"
 )
@@ -32,3 +36,216 @@ func TestLoad(t *testing.T) {
 		log.Fatalln("unexpected config params from manifest:", loadedManifest.Config.Params)
 	}
 }
+
+func writeManifest(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "cdflow2-manifest")
+	if err != nil {
+		t.Fatal("error creating temp dir:", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, "cdflow.yaml"), []byte(content), 0644); err != nil {
+		t.Fatal("error writing manifest:", err)
+	}
+	return dir
+}
+
+func TestLoadLimits(t *testing.T) {
+	// Given
+	dir := writeManifest(t, `
+version: 2
+config:
+  image: test-config-image
+  limits:
+    memory: 256m
+builds:
+  release:
+    image: test-release-image
+    limits:
+      memory: 2g
+      cpus: 1.5
+      pids: 512
+      read_only: true
+      cap_drop: [net_raw, MKNOD]
+      no_new_privileges: true
+terraform:
+  image: test-terraform-image
+  limits:
+    memory: 1073741824
+`)
+	defer os.RemoveAll(dir)
+
+	// When
+	loadedManifest, err := manifest.Load(dir)
+	if err != nil {
+		t.Fatal("error loading manifest:", err)
+	}
+
+	// Then
+	if limits := loadedManifest.Config.Limits.ContainerLimits(); !reflect.DeepEqual(limits, docker.Limits{Memory: 256 * 1024 * 1024}) {
+		t.Fatalf("unexpected config limits: %+v", limits)
+	}
+	if limits := loadedManifest.Builds["release"].Limits.ContainerLimits(); !reflect.DeepEqual(limits, docker.Limits{
+		Memory:          2 * 1024 * 1024 * 1024,
+		CPUs:            1.5,
+		PidsLimit:       512,
+		ReadOnlyRootfs:  true,
+		CapDrop:         []string{"NET_RAW", "MKNOD"},
+		NoNewPrivileges: true,
+	}) {
+		t.Fatalf("unexpected build limits: %+v", limits)
+	}
+	if limits := loadedManifest.Terraform.Limits.ContainerLimits(); limits.Memory != 1024*1024*1024 {
+		t.Fatalf("unexpected terraform limits: %+v", limits)
+	}
+}
+
+func TestLoadInvalidLimits(t *testing.T) {
+	for _, limits := range []string{"memory: lots", "memory: 1k", "cpus: -1", "pids: -5"} {
+		t.Run(limits, func(t *testing.T) {
+			// Given
+			dir := writeManifest(t, "version: 2\nbuilds:\n  release:\n    image: test-release-image\n    limits:\n      "+limits+"\n")
+			defer os.RemoveAll(dir)
+
+			// When
+			_, err := manifest.Load(dir)
+
+			// Then
+			if err == nil {
+				t.Fatal("expected error for invalid limits")
+			}
+		})
+	}
+}
+
+func TestLoadDockerSocket(t *testing.T) {
+	// Given
+	dir := writeManifest(t, `
+version: 2
+builds:
+  default:
+    image: test-image
+  full:
+    image: test-image
+    docker_socket: true
+  none:
+    image: test-image
+    docker_socket: false
+  restricted:
+    image: test-image
+    docker_socket: restricted
+`)
+	defer os.RemoveAll(dir)
+
+	// When
+	loadedManifest, err := manifest.Load(dir)
+	if err != nil {
+		t.Fatal("error loading manifest:", err)
+	}
+
+	// Then
+	for buildID, expected := range map[string]manifest.DockerSocketMode{
+		"default":    manifest.DockerSocketFull,
+		"full":       manifest.DockerSocketFull,
+		"none":       manifest.DockerSocketNone,
+		"restricted": manifest.DockerSocketRestricted,
+	} {
+		if mode := loadedManifest.Builds[buildID].DockerSocketMode(loadedManifest.Version); mode != expected {
+			t.Fatalf("expected docker socket mode %v for build %v, got %v", expected, buildID, mode)
+		}
+	}
+	if mode := loadedManifest.Builds["default"].DockerSocketMode(3); mode != manifest.DockerSocketNone {
+		t.Fatal("expected no docker socket by default in later manifest versions, got:", mode)
+	}
+
+	invalidDir := writeManifest(t, "version: 2\nbuilds:\n  release:\n    image: test-image\n    docker_socket: sometimes\n")
+	defer os.RemoveAll(invalidDir)
+	if _, err := manifest.Load(invalidDir); err == nil {
+		t.Fatal("expected error for invalid docker_socket")
+	}
+}
+
+func TestLoadDependsOn(t *testing.T) {
+	// Given
+	dir := writeManifest(t, `
+version: 2
+builds:
+  lambda:
+    image: test-release-image
+    depends_on: [docker, assets]
+  docker:
+    image: test-release-image
+    depends_on: [assets]
+  assets:
+    image: test-release-image
+`)
+	defer os.RemoveAll(dir)
+
+	// When
+	loadedManifest, err := manifest.Load(dir)
+	if err != nil {
+		t.Fatal("error loading manifest:", err)
+	}
+	order, err := loadedManifest.BuildOrder()
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !reflect.DeepEqual(order, []string{"assets", "docker", "lambda"}) {
+		t.Fatal("unexpected build order:", order)
+	}
+}
+
+func TestLoadInvalidDependsOn(t *testing.T) {
+	for _, example := range []struct {
+		manifest, expected string
+	}{
+		{`
+version: 2
+builds:
+  a:
+    image: test-release-image
+    depends_on: [b]
+  b:
+    image: test-release-image
+    depends_on: [c]
+  c:
+    image: test-release-image
+    depends_on: [b]
+`, "builds in cdflow.yaml depend on each other in a cycle: b -> c -> b"},
+		{`
+version: 2
+builds:
+  a:
+    image: test-release-image
+    depends_on: [a]
+`, "builds in cdflow.yaml depend on each other in a cycle: a -> a"},
+		{`
+version: 2
+builds:
+  a:
+    image: test-release-image
+    depends_on: [missing]
+`, "build 'a' in cdflow.yaml depends on unknown build 'missing'"},
+		{`
+version: 2
+config:
+  image: test-config-image
+  depends_on: [a]
+builds:
+  a:
+    image: test-release-image
+`, "depends_on in cdflow.yaml is only valid for builds, not config"},
+	} {
+		// Given
+		dir := writeManifest(t, example.manifest)
+		defer os.RemoveAll(dir)
+
+		// When
+		_, err := manifest.Load(dir)
+
+		// Then
+		if err == nil || err.Error() != example.expected {
+			t.Fatalf("expected error %q, got: %v", example.expected, err)
+		}
+	}
+}
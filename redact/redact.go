@@ -0,0 +1,164 @@
+package redact
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Mask is written in place of secret values.
+const Mask = "[redacted]"
+
+// MinimumLength is the length below which values aren't redacted, since masking every occurrence of a short value
+// (e.g. "1" or "yes") would mangle the output without hiding anything worth hiding.
+const MinimumLength = 4
+
+// holdTimeout is how long output that might be the start of a secret is held back waiting for more output, before
+// it is written anyway (e.g. an interactive prompt).
+const holdTimeout = 100 * time.Millisecond
+
+// Secrets is a set of values to redact, shared by Writers and added to as they are discovered.
+type Secrets struct {
+	mutex  sync.RWMutex
+	values [][]byte
+}
+
+// NewSecrets returns an empty set of secrets.
+func NewSecrets() *Secrets {
+	return &Secrets{}
+}
+
+// Add adds values to redact. Calling it on nil Secrets does nothing, so code that discovers secrets doesn't need to
+// check redaction is enabled.
+func (secrets *Secrets) Add(values ...string) {
+	if secrets == nil {
+		return
+	}
+	secrets.mutex.Lock()
+	defer secrets.mutex.Unlock()
+	// copied since writers use the previous slice without holding the lock
+	updated := append([][]byte{}, secrets.values...)
+	for _, value := range values {
+		if len(value) < MinimumLength || contains(updated, value) {
+			continue
+		}
+		updated = append(updated, []byte(value))
+	}
+	// longest first, so a secret containing another is masked whole
+	sort.Slice(updated, func(i, j int) bool { return len(updated[i]) > len(updated[j]) })
+	secrets.values = updated
+}
+
+func contains(values [][]byte, value string) bool {
+	for _, existing := range values {
+		if string(existing) == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Writer masks secrets in what is written to it before writing it to the underlying writer, including secrets split
+// across writes.
+type Writer struct {
+	mutex   sync.Mutex
+	output  io.Writer
+	secrets *Secrets
+	pending []byte
+	timer   *time.Timer
+	err     error
+}
+
+// NewWriter returns a Writer that masks secrets in what is written to output.
+func NewWriter(output io.Writer, secrets *Secrets) *Writer {
+	return &Writer{output: output, secrets: secrets}
+}
+
+// Unwrap returns the stream the writer writes to (e.g. to check whether it's a terminal).
+func (writer *Writer) Unwrap() io.Writer {
+	return writer.output
+}
+
+// Write masks secrets in data and writes it, holding back any trailing bytes that could be the start of a secret
+// until the next write (or a short timeout).
+func (writer *Writer) Write(data []byte) (int, error) {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if writer.err != nil {
+		return 0, writer.err
+	}
+	if writer.timer != nil {
+		writer.timer.Stop()
+		writer.timer = nil
+	}
+	writer.pending = append(writer.pending, data...)
+	if err := writer.writeRedacted(false); err != nil {
+		return 0, err
+	}
+	if len(writer.pending) != 0 {
+		writer.timer = time.AfterFunc(holdTimeout, func() { writer.Flush() })
+	}
+	return len(data), nil
+}
+
+// Flush writes any output held back because it could have been the start of a secret.
+func (writer *Writer) Flush() error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	if writer.timer != nil {
+		writer.timer.Stop()
+		writer.timer = nil
+	}
+	if writer.err != nil {
+		return writer.err
+	}
+	return writer.writeRedacted(true)
+}
+
+// writeRedacted writes the pending output with secrets masked, keeping back a trailing partial secret unless final.
+func (writer *Writer) writeRedacted(final bool) error {
+	var values [][]byte
+	if writer.secrets != nil {
+		writer.secrets.mutex.RLock()
+		values = writer.secrets.values
+		writer.secrets.mutex.RUnlock()
+	}
+
+	var output bytes.Buffer
+	pending := writer.pending
+	start := 0 // start of the output not yet copied
+	i := 0
+scan:
+	for i < len(pending) {
+		for _, value := range values {
+			if bytes.HasPrefix(pending[i:], value) {
+				output.Write(pending[start:i])
+				output.WriteString(Mask)
+				i += len(value)
+				start = i
+				continue scan
+			}
+		}
+		if !final {
+			for _, value := range values {
+				if len(pending)-i < len(value) && bytes.HasPrefix(value, pending[i:]) {
+					break scan
+				}
+			}
+		}
+		i++
+	}
+	output.Write(pending[start:i])
+	writer.pending = append([]byte{}, pending[i:]...)
+
+	if output.Len() == 0 {
+		return nil
+	}
+	if _, err := writer.output.Write(output.Bytes()); err != nil {
+		writer.err = err
+		return err
+	}
+	return nil
+}
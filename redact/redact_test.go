@@ -0,0 +1,108 @@
+package redact_test
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/cdflow2/redact"
+)
+
+func TestWriterMasksSecrets(t *testing.T) {
+	// Given
+	secrets := redact.NewSecrets()
+	secrets.Add("hunter2", "abc", "hunter2-extended")
+	var output bytes.Buffer
+	writer := redact.NewWriter(&output, secrets)
+
+	// When
+	writer.Write([]byte("password is hunter2, or hunter2-extended, abc is too short\n"))
+
+	// Then
+	if output.String() != "password is [redacted], or [redacted], abc is too short\n" {
+		t.Fatalf("unexpected output: %q", output.String())
+	}
+}
+
+func TestWriterMasksSecretsAcrossWrites(t *testing.T) {
+	// Given
+	secrets := redact.NewSecrets()
+	secrets.Add("s3cr3t-value")
+	var output bytes.Buffer
+	writer := redact.NewWriter(&output, secrets)
+
+	// When
+	for _, chunk := range []string{"token: s3c", "r3t", "-val", "ue\n", "s3cret (not it)\n"} {
+		writer.Write([]byte(chunk))
+	}
+	writer.Flush()
+
+	// Then
+	if output.String() != "token: [redacted]\ns3cret (not it)\n" {
+		t.Fatalf("unexpected output: %q", output.String())
+	}
+}
+
+func TestWriterFlushesPartialMatch(t *testing.T) {
+	// Given
+	secrets := redact.NewSecrets()
+	secrets.Add("password")
+	var output bytes.Buffer
+	writer := redact.NewWriter(&output, secrets)
+
+	// When
+	writer.Write([]byte("enter pass"))
+
+	// Then
+	if output.String() != "enter " {
+		t.Fatalf("expected possible start of secret to be held back, got: %q", output.String())
+	}
+	writer.Flush()
+	if output.String() != "enter pass" {
+		t.Fatalf("expected held output to be flushed, got: %q", output.String())
+	}
+}
+
+func TestWriterFlushesAfterTimeout(t *testing.T) {
+	// Given
+	secrets := redact.NewSecrets()
+	secrets.Add("password")
+	var output syncBuffer
+	writer := redact.NewWriter(&output, secrets)
+
+	// When
+	writer.Write([]byte("$ p"))
+
+	// Then
+	deadline := time.Now().Add(5 * time.Second)
+	for output.String() != "$ p" {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected held output to be written after a timeout, got: %q", output.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNilSecrets(t *testing.T) {
+	var secrets *redact.Secrets
+	secrets.Add("ignored")
+}
+
+// syncBuffer is a bytes.Buffer that can be written to by the writer's timer while the test reads it.
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (buffer *syncBuffer) Write(data []byte) (int, error) {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	return buffer.buffer.Write(data)
+}
+
+func (buffer *syncBuffer) String() string {
+	buffer.mutex.Lock()
+	defer buffer.mutex.Unlock()
+	return buffer.buffer.String()
+}
@@ -0,0 +1,213 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/release/container"
+)
+
+// DependencyMetadataEnv is the environment variable the release metadata of the builds a build depends on is passed
+// in, as a JSON object keyed by build ID.
+const DependencyMetadataEnv = "DEPENDENCY_METADATA"
+
+type buildResult struct {
+	buildID  string
+	metadata map[string]string
+	err      error
+}
+
+// runBuilds runs the builds in the manifest, up to jobs at a time, with each build waiting for those it depends on -
+// returning the release metadata from each, keyed by build ID. If a build fails the others are cancelled.
+func runBuilds(ctx context.Context, state *command.GlobalState, buildVolume, version string, releaseEnv map[string]map[string]string, jobs int) (map[string]map[string]string, error) {
+	order, err := state.Manifest.BuildOrder()
+	if err != nil {
+		return nil, err
+	}
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	outputStream, errorStream := state.OutputStream, state.ErrorStream
+	var outputMutex sync.Mutex
+	width := 0
+	for _, buildID := range order {
+		if len(buildID) > width {
+			width = len(buildID)
+		}
+	}
+
+	results := make(chan *buildResult)
+	started := make(map[string]bool)
+	releaseMetadata := make(map[string]map[string]string)
+	running := 0
+	var returnedError error
+	for {
+		for _, buildID := range order {
+			if returnedError != nil || running >= jobs {
+				break
+			}
+			if started[buildID] || !dependenciesDone(state.Manifest.Builds[buildID].DependsOn, releaseMetadata) {
+				continue
+			}
+			env, err := buildEnv(state, buildID, version, releaseEnv[buildID], releaseMetadata)
+			if err != nil {
+				// the builds already running are waited for, since they use the build volume
+				returnedError = err
+				cancel()
+				break
+			}
+			started[buildID] = true
+			running++
+			// output is prefixed with the build ID when there's more than one build, so it can be told apart
+			buildOutputStream, buildErrorStream := outputStream, errorStream
+			var prefixers []*linePrefixer
+			if len(order) > 1 {
+				prefix := fmt.Sprintf("%-*s | ", width, buildID)
+				prefixers = []*linePrefixer{
+					newLinePrefixer(outputStream, prefix, &outputMutex),
+					newLinePrefixer(errorStream, prefix, &outputMutex),
+				}
+				buildOutputStream, buildErrorStream = prefixers[0], prefixers[1]
+			}
+			go func(buildID string) {
+				metadata, err := runBuild(ctx, state, buildID, buildVolume, buildOutputStream, buildErrorStream, env)
+				for _, prefixer := range prefixers {
+					if flushErr := prefixer.Flush(); err == nil {
+						err = flushErr
+					}
+				}
+				results <- &buildResult{buildID, metadata, err}
+			}(buildID)
+		}
+		if running == 0 {
+			break
+		}
+		result := <-results
+		running--
+		if result.err != nil {
+			if returnedError == nil {
+				returnedError = fmt.Errorf("cdflow2: error running build '%v' - %w", result.buildID, result.err)
+				cancel()
+			}
+			continue
+		}
+		releaseMetadata[result.buildID] = result.metadata
+	}
+	if returnedError != nil {
+		return nil, returnedError
+	}
+	return releaseMetadata, nil
+}
+
+func dependenciesDone(dependencies []string, releaseMetadata map[string]map[string]string) bool {
+	for _, dependency := range dependencies {
+		if _, ok := releaseMetadata[dependency]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func buildEnv(state *command.GlobalState, buildID, version string, configEnv map[string]string, releaseMetadata map[string]map[string]string) (map[string]string, error) {
+	build := state.Manifest.Builds[buildID]
+	env := make(map[string]string, len(configEnv))
+	for key, value := range configEnv {
+		env[key] = value
+	}
+	// these are built in and cannot be overridden by the config container (since choosing the clashing name would likely be an accident)
+	env["VERSION"] = version
+	env["COMPONENT"] = state.Component
+	env["COMMIT"] = state.Commit
+	env["BUILD_ID"] = buildID
+	manifestParams, err := json.Marshal(build.Params)
+	if err != nil {
+		return nil, err
+	}
+	env["MANIFEST_PARAMS"] = string(manifestParams)
+	if len(build.DependsOn) != 0 {
+		dependencyMetadata := make(map[string]map[string]string)
+		for _, dependency := range build.DependsOn {
+			dependencyMetadata[dependency] = releaseMetadata[dependency]
+		}
+		encoded, err := json.Marshal(dependencyMetadata)
+		if err != nil {
+			return nil, err
+		}
+		env[DependencyMetadataEnv] = string(encoded)
+	}
+	return env, nil
+}
+
+func runBuild(ctx context.Context, state *command.GlobalState, buildID, buildVolume string, outputStream, errorStream io.Writer, env map[string]string) (map[string]string, error) {
+	build := state.Manifest.Builds[buildID]
+	return container.Run(
+		ctx,
+		state.DockerClient,
+		build.Image,
+		build.Limits.ContainerLimits(),
+		build.DockerSocketMode(state.Manifest.Version),
+		state.ContainerUser,
+		state.CodeDir,
+		buildVolume,
+		outputStream,
+		errorStream,
+		env,
+	)
+}
+
+// linePrefixer writes whole lines to an output with a prefix, so output from builds run at the same time can be told
+// apart. The mutex is shared by the prefixers for each output, so lines aren't interleaved.
+type linePrefixer struct {
+	output  io.Writer
+	prefix  []byte
+	mutex   *sync.Mutex
+	pending []byte
+}
+
+func newLinePrefixer(output io.Writer, prefix string, mutex *sync.Mutex) *linePrefixer {
+	return &linePrefixer{output: output, prefix: []byte(prefix), mutex: mutex}
+}
+
+func (prefixer *linePrefixer) Write(data []byte) (int, error) {
+	prefixer.mutex.Lock()
+	defer prefixer.mutex.Unlock()
+	prefixer.pending = append(prefixer.pending, data...)
+	end := bytes.LastIndexByte(prefixer.pending, '\n') + 1
+	if end == 0 {
+		return len(data), nil
+	}
+	var buffer bytes.Buffer
+	for _, line := range bytes.SplitAfter(prefixer.pending[:end], []byte("\n")) {
+		if len(line) != 0 {
+			buffer.Write(prefixer.prefix)
+			buffer.Write(line)
+		}
+	}
+	prefixer.pending = append([]byte(nil), prefixer.pending[end:]...)
+	if _, err := prefixer.output.Write(buffer.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Flush writes any partial line that's left.
+func (prefixer *linePrefixer) Flush() error {
+	prefixer.mutex.Lock()
+	defer prefixer.mutex.Unlock()
+	if len(prefixer.pending) == 0 {
+		return nil
+	}
+	line := append(append(append([]byte(nil), prefixer.prefix...), prefixer.pending...), '\n')
+	prefixer.pending = nil
+	_, err := prefixer.output.Write(line)
+	return err
+}
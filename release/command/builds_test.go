@@ -0,0 +1,302 @@
+package command_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/manifest"
+	release "github.com/mergermarket/cdflow2/release/command"
+)
+
+// setupFakeRelease simulates config and terraform images for a release, returning a function that returns the
+// release metadata and image digests uploaded.
+func setupFakeRelease(dockerClient *fake.Client, buildIDs []string) func() (map[string]map[string]string, map[string]string) {
+	var mutex sync.Mutex
+	var uploaded map[string]map[string]string
+	var uploadedDigests map[string]string
+	dockerClient.AddImage("config-image")
+	dockerClient.HandleRun("config-image", fake.WaitForStop(0))
+	dockerClient.HandleExec("config-image", func(process *fake.Process) int {
+		var request map[string]interface{}
+		if err := json.NewDecoder(process.InputStream).Decode(&request); err != nil {
+			return 1
+		}
+		response := map[string]interface{}{"Success": true}
+		switch request["Action"] {
+		case config.ActionHello:
+			response["ProtocolVersion"] = config.ProtocolVersion
+			response["Actions"] = []string{config.ActionConfigureRelease, config.ActionUploadRelease}
+		case config.ActionConfigureRelease:
+			env := make(map[string]map[string]string)
+			for _, buildID := range buildIDs {
+				env[buildID] = map[string]string{"FROM_CONFIG": "value"}
+			}
+			response["Env"] = env
+		case config.ActionUploadRelease:
+			mutex.Lock()
+			json.Unmarshal(process.Container.Files("/release")["release-metadata.json"], &uploaded)
+			json.Unmarshal(process.Container.Files("/release")[manifest.ImageDigestsFilename], &uploadedDigests)
+			mutex.Unlock()
+			response["Message"] = "uploaded"
+		}
+		json.NewEncoder(process.OutputStream).Encode(response)
+		return 0
+	})
+	dockerClient.AddImage("terraform-image", "terraform-image@sha256:0000")
+	// terraform init is run with the repo digest, which docker resolves to the pulled image
+	dockerClient.AddLocalImage("terraform-image@sha256:0000")
+	dockerClient.HandleRun("terraform-image@sha256:0000", func(process *fake.Process) int {
+		return 0
+	})
+	return func() (map[string]map[string]string, map[string]string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return uploaded, uploadedDigests
+	}
+}
+
+func createReleaseState(t *testing.T, dockerClient *fake.Client, builds map[string]manifest.ImageWithParams, outputStream, errorStream *bytes.Buffer) (*command.GlobalState, func()) {
+	codeDir, err := ioutil.TempDir("", "cdflow2-release")
+	if err != nil {
+		t.Fatal("error creating code dir:", err)
+	}
+	return &command.GlobalState{
+		DockerClient: dockerClient,
+		Component:    "test-component",
+		Commit:       "test-commit",
+		OutputStream: outputStream,
+		ErrorStream:  errorStream,
+		CodeDir:      codeDir,
+		Manifest: &manifest.Manifest{
+			Version:   2,
+			Builds:    builds,
+			Terraform: manifest.Terraform{Image: "terraform-image"},
+			Config:    manifest.ImageWithParams{Image: "config-image"},
+		},
+		GlobalArgs: &command.GlobalArgs{},
+	}, func() { os.RemoveAll(codeDir) }
+}
+
+// handleBuild simulates a build image, with run called for each build (i.e. not for requirements).
+func handleBuild(dockerClient *fake.Client, image string, run func(process *fake.Process) int) {
+	dockerClient.AddImage(image)
+	dockerClient.HandleRun(image, func(process *fake.Process) int {
+		if len(process.Cmd) == 1 && process.Cmd[0] == "requirements" {
+			fmt.Fprintln(process.OutputStream, `{"Needs": []}`)
+			return 0
+		}
+		return run(process)
+	})
+}
+
+func TestRunCommandWithDependencies(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	uploaded := setupFakeRelease(dockerClient, []string{"assets", "docker", "lambda"})
+	// assets and docker each wait for the other to start, so only finish if run at the same time
+	started := map[string]chan struct{}{"assets": make(chan struct{}), "docker": make(chan struct{})}
+	var dependencyMetadata string
+	handleBuild(dockerClient, "build-image", func(process *fake.Process) int {
+		buildID := process.Env["BUILD_ID"]
+		fmt.Fprintf(process.OutputStream, "building %s\n", buildID)
+		fmt.Fprintf(process.ErrorStream, "partial line from %s", buildID)
+		if buildID == "lambda" {
+			dependencyMetadata = process.Env[release.DependencyMetadataEnv]
+		} else {
+			close(started[buildID])
+			other := map[string]string{"assets": "docker", "docker": "assets"}[buildID]
+			select {
+			case <-started[other]:
+			case <-time.After(5 * time.Second):
+				return 1
+			}
+		}
+		if process.Env["FROM_CONFIG"] != "value" {
+			return 1
+		}
+		process.Container.WriteFile("/release-metadata.json", []byte(`{"built": "`+buildID+`"}`))
+		return 0
+	})
+	var outputBuffer, errorBuffer bytes.Buffer
+	state, cleanup := createReleaseState(t, dockerClient, map[string]manifest.ImageWithParams{
+		"assets": {Image: "build-image"},
+		"docker": {Image: "build-image"},
+		"lambda": {Image: "build-image", DependsOn: []string{"assets", "docker"}},
+	}, &outputBuffer, &errorBuffer)
+	defer cleanup()
+	args, err := release.ParseArgs([]string{"--jobs", "2", "test-version"})
+	if err != nil {
+		t.Fatal("error parsing args:", err)
+	}
+
+	// When
+	err = release.RunCommand(context.Background(), state, *args, map[string]string{})
+
+	// Then
+	if err != nil {
+		t.Fatal("error running release:", err, errorBuffer.String())
+	}
+	var decoded map[string]map[string]string
+	if err := json.Unmarshal([]byte(dependencyMetadata), &decoded); err != nil {
+		t.Fatalf("error decoding %s: %v", release.DependencyMetadataEnv, err)
+	}
+	if decoded["assets"]["built"] != "assets" || decoded["docker"]["built"] != "docker" {
+		t.Fatal("unexpected dependency metadata:", decoded)
+	}
+	metadata, imageDigests := uploaded()
+	if metadata["lambda"]["built"] != "lambda" || metadata["release"]["version"] != "test-version" {
+		t.Fatal("unexpected release metadata:", metadata)
+	}
+	// kept out of the release metadata, since that's passed to terraform as variables
+	if imageDigests["config"] == "" || imageDigests["build/lambda"] == "" || len(metadata) != 4 {
+		t.Fatalf("expected image digests in their own file, got: %v, %v", imageDigests, metadata)
+	}
+	for _, expected := range []string{"assets | building assets\n", "docker | building docker\n", "lambda | building lambda\n"} {
+		if !strings.Contains(outputBuffer.String(), expected) {
+			t.Fatalf("expected %q in output, got:\n%s", expected, outputBuffer.String())
+		}
+	}
+	if !strings.Contains(errorBuffer.String(), "lambda | partial line from lambda\n") {
+		t.Fatal("expected partial line to be flushed, got:", errorBuffer.String())
+	}
+}
+
+func TestRunCommandBuildFailure(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	setupFakeRelease(dockerClient, []string{"a", "b"})
+	var ran []string
+	handleBuild(dockerClient, "build-image", func(process *fake.Process) int {
+		ran = append(ran, process.Env["BUILD_ID"])
+		return 1
+	})
+	var outputBuffer, errorBuffer bytes.Buffer
+	state, cleanup := createReleaseState(t, dockerClient, map[string]manifest.ImageWithParams{
+		"a": {Image: "build-image"},
+		"b": {Image: "build-image", DependsOn: []string{"a"}},
+	}, &outputBuffer, &errorBuffer)
+	defer cleanup()
+
+	// When
+	err := release.RunCommand(context.Background(), state, release.CommandArgs{Version: "test-version"}, map[string]string{})
+
+	// Then
+	if err == nil || !strings.Contains(err.Error(), "error running build 'a'") {
+		t.Fatal("expected error from build a, got:", err)
+	}
+	if len(ran) != 1 {
+		t.Fatal("expected build b not to run, ran:", ran)
+	}
+}
+
+func TestParseArgsJobs(t *testing.T) {
+	args, err := release.ParseArgs([]string{"-j", "4", "version1"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if args.Jobs != 4 || args.Version != "version1" {
+		t.Fatalf("unexpected args: %+v", args)
+	}
+	if args, _ := release.ParseArgs([]string{"version1"}); args.Jobs != 1 {
+		t.Fatal("expected one job by default, got:", args.Jobs)
+	}
+	for _, invalid := range []string{"0", "-1", "x"} {
+		if _, err := release.ParseArgs([]string{"--jobs", invalid, "version1"}); err == nil {
+			t.Fatal("expected error for --jobs", invalid)
+		}
+	}
+}
+
+func TestRunCommandPreparesBuildVolume(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	setupFakeRelease(dockerClient, []string{"app"})
+	var mutex sync.Mutex
+	var ran []string
+	// build images may not include chown, so it's run in the terraform image
+	dockerClient.HandleRun("terraform-image", func(process *fake.Process) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if process.User == "0:0" && len(process.Cmd) > 1 && process.Cmd[0] == "sh" {
+			ran = append(ran, "chown "+strings.Join(process.Cmd[len(process.Cmd)-2:], " "))
+		}
+		return 0
+	})
+	handleBuild(dockerClient, "build-image", func(process *fake.Process) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		ran = append(ran, "build as "+process.User)
+		process.Container.WriteFile("/release-metadata.json", []byte(`{}`))
+		return 0
+	})
+	var outputBuffer, errorBuffer bytes.Buffer
+	state, cleanup := createReleaseState(t, dockerClient, map[string]manifest.ImageWithParams{
+		"app": {Image: "build-image"},
+	}, &outputBuffer, &errorBuffer)
+	defer cleanup()
+	state.ContainerUser = "1000:1000"
+
+	// When
+	err := release.RunCommand(context.Background(), state, release.CommandArgs{Version: "test-version"}, map[string]string{})
+
+	// Then
+	if err != nil {
+		t.Fatal("error running release:", err, errorBuffer.String())
+	}
+	if len(ran) != 2 || ran[0] != "chown 1000:1000 /volume0" || ran[1] != "build as 1000:1000" {
+		t.Fatal("expected the build volume to be prepared before the build, got:", ran)
+	}
+}
+
+func TestRunCommandBuildEnvFailure(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	setupFakeRelease(dockerClient, []string{"a", "b"})
+	var mutex sync.Mutex
+	var finished bool
+	handleBuild(dockerClient, "build-image", func(process *fake.Process) int {
+		// slow, so still running when the env for b can't be created
+		select {
+		case <-process.Context.Done():
+		case <-time.After(5 * time.Second):
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		finished = true
+		return 1
+	})
+	var outputBuffer, errorBuffer bytes.Buffer
+	state, cleanup := createReleaseState(t, dockerClient, map[string]manifest.ImageWithParams{
+		"a": {Image: "build-image"},
+		// params that can't be encoded as JSON for MANIFEST_PARAMS
+		"b": {Image: "build-image", Params: map[string]interface{}{"invalid": make(chan int)}},
+	}, &outputBuffer, &errorBuffer)
+	defer cleanup()
+
+	// When
+	err := release.RunCommand(context.Background(), state, release.CommandArgs{Version: "test-version", Jobs: 2}, map[string]string{})
+
+	// Then
+	if err == nil || !strings.Contains(err.Error(), "json") {
+		t.Fatal("expected error encoding params, got:", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !finished {
+		t.Fatal("expected the running build to finish before the release returned")
+	}
+	if containers := dockerClient.Containers(); len(containers) != 0 {
+		t.Fatal("expected all containers to be removed, got:", containers)
+	}
+}
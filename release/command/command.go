@@ -1,6 +1,7 @@
 package command
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,12 +9,17 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/mergermarket/cdflow2/command"
 	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/docker/progress"
+	"github.com/mergermarket/cdflow2/manifest"
 	"github.com/mergermarket/cdflow2/release/container"
 	"github.com/mergermarket/cdflow2/terraform"
+	"github.com/mergermarket/cdflow2/util"
 )
 
 type terraformResult struct {
@@ -31,6 +37,8 @@ type output struct {
 type CommandArgs struct {
 	ReleaseData map[string]string
 	Version     string
+	// Jobs is the number of builds to run at the same time.
+	Jobs int
 }
 
 func parseReleaseData(value string) (map[string]string, error) {
@@ -55,6 +63,16 @@ func handleArgs(arg string, commandArgs *CommandArgs, take func() (string, error
 		for k, v := range releaseData {
 			commandArgs.ReleaseData[k] = v
 		}
+	} else if arg == "-j" || arg == "--jobs" {
+		value, err := take()
+		if err != nil {
+			return false, err
+		}
+		jobs, err := strconv.Atoi(value)
+		if err != nil || jobs < 1 {
+			return false, fmt.Errorf("invalid --jobs %q (must be a positive number)", value)
+		}
+		commandArgs.Jobs = jobs
 	} else if commandArgs.Version == "" {
 		commandArgs.Version = arg
 	} else {
@@ -67,6 +85,7 @@ func handleArgs(arg string, commandArgs *CommandArgs, take func() (string, error
 func ParseArgs(args []string) (*CommandArgs, error) {
 	var result CommandArgs
 	result.ReleaseData = make(map[string]string)
+	result.Jobs = 1
 	i := 0
 	take := func() (string, error) {
 		i++
@@ -127,17 +146,10 @@ func streamOutput(terraformOutputChan chan *output, outputStream, errorStream io
 	}
 }
 
-func terraformRelease(state *command.GlobalState, buildVolume string, outputStream, errorStream io.Writer) (string, error) {
+func terraformRelease(ctx context.Context, state *command.GlobalState, buildVolume string, outputStream, errorStream io.Writer) (string, error) {
 	dockerClient := state.DockerClient
 
-	if !state.GlobalArgs.NoPullTerraform {
-		fmt.Fprintf(errorStream, "\nPulling terraform image %v...\n\n", state.Manifest.Terraform.Image)
-		if err := dockerClient.PullImage(state.Manifest.Terraform.Image, errorStream); err != nil {
-			return "", fmt.Errorf("error pulling terraform image: %w", err)
-		}
-	}
-
-	repoDigests, err := dockerClient.GetImageRepoDigests(state.Manifest.Terraform.Image)
+	repoDigests, err := dockerClient.GetImageRepoDigests(ctx, state.Manifest.Terraform.Image)
 	if err != nil {
 		return "", err
 	}
@@ -153,8 +165,11 @@ func terraformRelease(state *command.GlobalState, buildVolume string, outputStre
 	}
 
 	return savedTerraformImage, terraform.InitInitial(
+		ctx,
 		dockerClient,
 		savedTerraformImage,
+		state.Manifest.Terraform.Limits.ContainerLimits(),
+		state.ContainerUser,
 		state.CodeDir,
 		buildVolume,
 		outputStream,
@@ -163,16 +178,16 @@ func terraformRelease(state *command.GlobalState, buildVolume string, outputStre
 }
 
 // RunCommand runs the release command.
-func RunCommand(state *command.GlobalState, releaseArgs CommandArgs, env map[string]string) (returnedError error) {
+func RunCommand(ctx context.Context, state *command.GlobalState, releaseArgs CommandArgs, env map[string]string) (returnedError error) {
 
 	dockerClient := state.DockerClient
 
-	buildVolume, err := dockerClient.CreateVolume("")
+	buildVolume, err := dockerClient.CreateVolume(ctx, "")
 	if err != nil {
 		return err
 	}
 	defer func() {
-		if err := dockerClient.RemoveVolume(buildVolume); err != nil {
+		if err := dockerClient.RemoveVolume(context.Background(), buildVolume); err != nil {
 			if returnedError != nil {
 				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
 			} else {
@@ -182,21 +197,30 @@ func RunCommand(state *command.GlobalState, releaseArgs CommandArgs, env map[str
 		}
 	}()
 
+	if err := PullImages(ctx, state, true); err != nil {
+		return err
+	}
+
+	// before terraform init and the builds write to it, since they run as the container user
+	if err := util.PrepareVolumes(ctx, dockerClient, state.Manifest.Terraform.Image, state.ContainerUser, buildVolume); err != nil {
+		return err
+	}
+
 	terraformOutputChan, terraformOutputStream, terraformErrorStream := getOutputCapture()
 
 	terraformResultChan := make(chan *terraformResult, 1)
+	terraformDone := make(chan struct{})
 	go func() {
-		savedTerraformImage, err := terraformRelease(state, buildVolume, terraformOutputStream, terraformErrorStream)
+		defer close(terraformDone)
+		savedTerraformImage, err := terraformRelease(ctx, state, buildVolume, terraformOutputStream, terraformErrorStream)
 		terraformOutputStream.Close()
 		terraformErrorStream.Close()
 		terraformResultChan <- &terraformResult{savedTerraformImage, err}
 	}()
+	// the build volume can't be removed until terraform init has finished with it (e.g. after an error or cancellation)
+	defer func() { <-terraformDone }()
 
-	if err := config.Pull(state); err != nil {
-		return err
-	}
-
-	message, err := buildAndUploadRelease(state, buildVolume, releaseArgs.Version, releaseArgs.ReleaseData, terraformResultChan, terraformOutputChan, env)
+	message, err := buildAndUploadRelease(ctx, state, buildVolume, releaseArgs.Version, releaseArgs.Jobs, releaseArgs.ReleaseData, terraformResultChan, terraformOutputChan, env)
 	if err != nil {
 		return err
 	}
@@ -207,15 +231,14 @@ func RunCommand(state *command.GlobalState, releaseArgs CommandArgs, env map[str
 	return nil
 }
 
-func buildAndUploadRelease(state *command.GlobalState, buildVolume, version string, releaseData map[string]string, terraformResultChan chan *terraformResult, terraformOutputChan chan *output, env map[string]string) (returnedMessage string, returnedError error) {
+func buildAndUploadRelease(ctx context.Context, state *command.GlobalState, buildVolume, version string, jobs int, releaseData map[string]string, terraformResultChan chan *terraformResult, terraformOutputChan chan *output, env map[string]string) (returnedMessage string, returnedError error) {
 
-	releaseRequirements, err := GetReleaseRequirements(state)
+	releaseRequirements, err := GetReleaseRequirements(ctx, state)
 	if err != nil {
 		return "", err
 	}
 
-	dockerClient := state.DockerClient
-	configContainer, err := config.NewContainer(state, state.Manifest.Config.Image, buildVolume)
+	configContainer, err := config.NewContainer(ctx, state, state.Manifest.Config.Image, buildVolume)
 	if err != nil {
 		return "", err
 	}
@@ -230,9 +253,10 @@ func buildAndUploadRelease(state *command.GlobalState, buildVolume, version stri
 		}
 	}()
 
-	fmt.Print("\ncdflow2: getting release configuration...\n\n")
+	fmt.Fprint(state.OutputStream, "\ncdflow2: getting release configuration...\n\n")
 
 	configureReleaseResponse, err := configContainer.ConfigureRelease(
+		ctx,
 		version,
 		state.Component,
 		state.Commit,
@@ -246,32 +270,14 @@ func buildAndUploadRelease(state *command.GlobalState, buildVolume, version stri
 
 	releaseEnv := configureReleaseResponse.Env
 
-	releaseMetadata := make(map[string]map[string]string)
-	for buildID, build := range state.Manifest.Builds {
-		env := releaseEnv[buildID]
-		// these are built in and cannot be overridden by the config container (since choosing the clashing name would likely be an accident)
-		env["VERSION"] = version
-		env["COMPONENT"] = state.Component
-		env["COMMIT"] = state.Commit
-		env["BUILD_ID"] = buildID
-		manifestParams, err := json.Marshal(build.Params)
-		if err != nil {
-			return "", err
-		}
-		env["MANIFEST_PARAMS"] = string(manifestParams)
-		metadata, err := container.Run(
-			dockerClient,
-			build.Image,
-			state.CodeDir,
-			buildVolume,
-			state.OutputStream,
-			state.ErrorStream,
-			env,
-		)
-		if err != nil {
-			return "", fmt.Errorf("cdflow2: error running build '%v' - %w", buildID, err)
-		}
-		releaseMetadata[buildID] = metadata
+	imageDigests, err := ImageDigests(ctx, state)
+	if err != nil {
+		return "", err
+	}
+
+	releaseMetadata, err := runBuilds(ctx, state, buildVolume, version, releaseEnv, jobs)
+	if err != nil {
+		return "", err
 	}
 	if releaseMetadata["release"] == nil {
 		releaseMetadata["release"] = make(map[string]string)
@@ -286,7 +292,14 @@ func buildAndUploadRelease(state *command.GlobalState, buildVolume, version stri
 		releaseMetadata["release"][k] = v
 	}
 
-	if err := configContainer.WriteReleaseMetadata(releaseMetadata); err != nil {
+	if err := configContainer.WriteReleaseMetadata(ctx, releaseMetadata); err != nil {
+		return "", err
+	}
+	encodedImageDigests, err := json.Marshal(imageDigests)
+	if err != nil {
+		return "", err
+	}
+	if err := configContainer.CopyFileToRelease(ctx, manifest.ImageDigestsFilename, encodedImageDigests); err != nil {
 		return "", err
 	}
 
@@ -305,15 +318,16 @@ func buildAndUploadRelease(state *command.GlobalState, buildVolume, version stri
 		if err != nil {
 			return "", fmt.Errorf("error on reading .terraform.lock.hcl %w", err)
 		}
-		if err := configContainer.CopyFileToRelease(".terraform.lock.hcl", b); err != nil {
+		if err := configContainer.CopyFileToRelease(ctx, ".terraform.lock.hcl", b); err != nil {
 			return "", err
 		}
 
 	}
 
-	fmt.Print("\ncdflow2: uploading release...\n\n")
+	fmt.Fprint(state.OutputStream, "\ncdflow2: uploading release...\n\n")
 
 	uploadReleaseResponse, err := configContainer.UploadRelease(
+		ctx,
 		terraformResult.savedTerraformImage,
 	)
 	if err != nil {
@@ -323,17 +337,57 @@ func buildAndUploadRelease(state *command.GlobalState, buildVolume, version stri
 	return uploadReleaseResponse.Message, nil
 }
 
-// GetReleaseRequirements runs the release containers in order to get their requirements.
-func GetReleaseRequirements(state *command.GlobalState) (map[string]*config.ReleaseRequirements, error) {
+// ImageDigests returns the repo digests of the config and build images, keyed as in manifest.Images, for recording
+// in the release metadata. Images without a repo digest (i.e. built locally and never pushed) are recorded as is.
+func ImageDigests(ctx context.Context, state *command.GlobalState) (map[string]string, error) {
+	result := make(map[string]string)
+	for key, image := range state.Manifest.Images() {
+		if key == "terraform" {
+			// recorded separately by the config container when the release is uploaded
+			continue
+		}
+		digest, err := docker.RepoDigest(ctx, state.DockerClient, image)
+		if errors.Is(err, docker.ErrNoRepoDigest) {
+			digest = image
+		} else if err != nil {
+			return nil, fmt.Errorf("error getting digest for %s image: %w", key, err)
+		}
+		result[key] = digest
+	}
+	return result, nil
+}
+
+// PullImages pulls the config and build images, and the terraform image if includeTerraform is set, concurrently -
+// except those disabled with the --no-pull-* global options.
+func PullImages(ctx context.Context, state *command.GlobalState, includeTerraform bool) error {
+	var images []string
+	if !state.GlobalArgs.NoPullConfig && !manifest.IsBuiltinImage(state.Manifest.Config.Image) {
+		images = append(images, state.Manifest.Config.Image)
+	}
+	if !state.GlobalArgs.NoPullRelease {
+		for _, buildID := range state.Manifest.BuildIDs() {
+			images = append(images, state.Manifest.Builds[buildID].Image)
+		}
+	}
+	if includeTerraform && !state.GlobalArgs.NoPullTerraform {
+		images = append(images, state.Manifest.Terraform.Image)
+	}
+	if len(images) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(state.ErrorStream, "\n%s\n\n", util.FormatInfo(fmt.Sprintf("pulling images: %v", strings.Join(images, ", "))))
+	renderer := progress.NewForStream(state.ErrorStream)
+	defer renderer.Close()
+	return docker.PullAll(ctx, state.DockerClient, images, docker.DefaultPullWorkers, renderer)
+}
+
+// GetReleaseRequirements runs the release containers in order to get their requirements - the images must already
+// have been pulled (see PullImages).
+func GetReleaseRequirements(ctx context.Context, state *command.GlobalState) (map[string]*config.ReleaseRequirements, error) {
 	result := make(map[string]*config.ReleaseRequirements)
 	for buildID, build := range state.Manifest.Builds {
-		if !state.GlobalArgs.NoPullRelease {
-			fmt.Fprintf(state.ErrorStream, "\nPulling build image (%v): %v...\n\n", buildID, build.Image)
-			if err := state.DockerClient.PullImage(build.Image, state.ErrorStream); err != nil {
-				return nil, fmt.Errorf("error pulling build image (%v): %w", buildID, err)
-			}
-		}
-		requirements, err := container.GetReleaseRequirements(state, buildID, build.Image, state.ErrorStream)
+		requirements, err := container.GetReleaseRequirements(ctx, state, buildID, build.Image, state.ErrorStream)
 		if err != nil {
 			return nil, err
 		}
@@ -2,6 +2,7 @@ package command_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"log"
@@ -138,6 +139,7 @@ func TestRunCommand(t *testing.T) {
 
 	// When
 	if err := release.RunCommand(
+		context.Background(),
 		&command.GlobalState{
 			DockerClient: dockerClient,
 			Component:    "test-component",
@@ -269,4 +271,5 @@ func checkUploadReleaseOutput(t *testing.T, debugOutput []byte) {
 	if decoded.ReleaseMetadata["buildid"]["manifest_params"] != "{\"a\":\"b\"}" {
 		t.Fatal("unexpected manifest_params:", decoded.ReleaseMetadata["buildid"]["manifest_params"])
 	}
+
 }
@@ -3,6 +3,7 @@ package container
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,17 +12,19 @@ import (
 	"github.com/mergermarket/cdflow2/command"
 	"github.com/mergermarket/cdflow2/config"
 	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/manifest"
 )
 
 // GetReleaseRequirements runs the container in order to get requirements.
-func GetReleaseRequirements(state *command.GlobalState, buildID, image string, errorStream io.Writer) (*config.ReleaseRequirements, error) {
+func GetReleaseRequirements(ctx context.Context, state *command.GlobalState, buildID, image string, errorStream io.Writer) (*config.ReleaseRequirements, error) {
 	var outputBuffer bytes.Buffer
-	if err := state.DockerClient.Run(&docker.RunOptions{
+	if err := state.DockerClient.Run(ctx, &docker.RunOptions{
 		Image:        image,
 		OutputStream: &outputBuffer,
 		ErrorStream:  errorStream,
 		NamePrefix:   "cdflow2-release-requirements",
 		Cmd:          []string{"requirements"},
+		Limits:       state.Manifest.Builds[buildID].Limits.ContainerLimits(),
 	}); err != nil {
 		return nil, err
 	}
@@ -32,36 +35,68 @@ func GetReleaseRequirements(state *command.GlobalState, buildID, image string, e
 	return &result, nil
 }
 
-// Run creates and runs the release container, returning a map of release metadata.
-func Run(dockerClient docker.Iface, image, codeDir, buildVolume string, outputStream, errorStream io.Writer, env map[string]string) (map[string]string, error) {
+// Run creates and runs the release container, returning a map of release metadata. If user is set the build volume
+// must already be owned by it (see util.PrepareVolumes).
+func Run(ctx context.Context, dockerClient docker.Iface, image string, limits docker.Limits, dockerSocket manifest.DockerSocketMode, user, codeDir, buildVolume string, outputStream, errorStream io.Writer, env map[string]string) (returnedMetadata map[string]string, returnedError error) {
+
+	binds := []string{
+		codeDir + ":/code:ro",
+		buildVolume + ":/build",
+	}
+	var groupAdd []string
+	switch dockerSocket {
+	case manifest.DockerSocketFull:
+		binds = append(binds, "/var/run/docker.sock:/var/run/docker.sock")
+		// when not running as root the build needs to be in the group that owns the socket in order to use it
+		if group := socketGroup("/var/run/docker.sock"); user != "" && group != "" {
+			groupAdd = []string{group}
+		}
+	case manifest.DockerSocketRestricted:
+		socket, stopProxy, err := dockerClient.ProxyDockerSocket(ctx, user)
+		if err != nil {
+			return nil, fmt.Errorf("error starting restricted docker socket: %w", err)
+		}
+		defer func() {
+			if err := stopProxy(); err != nil {
+				if returnedError != nil {
+					returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+				} else {
+					returnedError = err
+				}
+			}
+		}()
+		binds = append(binds, socket+":/var/run/docker.sock")
+	}
 
 	var releaseMetadata map[string]string
 
-	return releaseMetadata, dockerClient.Run(&docker.RunOptions{
+	if err := dockerClient.Run(ctx, &docker.RunOptions{
 		Image:        image,
 		OutputStream: outputStream,
 		ErrorStream:  errorStream,
 		WorkingDir:   "/code",
 		Env:          append(mapToDockerEnv(env), "CDFLOW2_CODE_DIR="+codeDir),
-		Binds: []string{
-			codeDir + ":/code:ro",
-			buildVolume + ":/build",
-			"/var/run/docker.sock:/var/run/docker.sock",
-		},
-		NamePrefix: "cdflow2-release",
+		Binds:        binds,
+		NamePrefix:   "cdflow2-release",
+		Limits:       limits,
+		User:         user,
+		GroupAdd:     groupAdd,
 		BeforeRemove: func(id string) error {
-			result, err := getReleaseMetadataFromContainer(dockerClient, id)
+			result, err := getReleaseMetadataFromContainer(ctx, dockerClient, id)
 			if err != nil {
 				return fmt.Errorf("could not get release metadata from container: %w", err)
 			}
 			releaseMetadata = result
 			return nil
 		},
-	})
+	}); err != nil {
+		return nil, err
+	}
+	return releaseMetadata, nil
 }
 
-func getReleaseMetadataFromContainer(dockerClient docker.Iface, id string) (returnedMetadata map[string]string, returnedError error) {
-	reader, err := dockerClient.CopyFromContainer(id, "/release-metadata.json")
+func getReleaseMetadataFromContainer(ctx context.Context, dockerClient docker.Iface, id string) (returnedMetadata map[string]string, returnedError error) {
+	reader, err := dockerClient.CopyFromContainer(ctx, id, "/release-metadata.json")
 	if err != nil {
 		return nil, err
 	}
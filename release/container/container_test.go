@@ -2,9 +2,15 @@ package container_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"reflect"
 	"testing"
 
+	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/manifest"
 	"github.com/mergermarket/cdflow2/release/container"
 	"github.com/mergermarket/cdflow2/test"
 )
@@ -23,8 +29,12 @@ func TestRelese(t *testing.T) {
 
 	// When
 	releaseMetadata, err := container.Run(
+		context.Background(),
 		dockerClient,
 		test.GetConfig("TEST_RELEASE_IMAGE"),
+		docker.Limits{},
+		manifest.DockerSocketFull,
+		"",
 		codeDir,
 		buildVolume,
 		&outputBuffer,
@@ -60,3 +70,83 @@ func TestRelese(t *testing.T) {
 		t.Fatalf("unexpected release metadata: %v\n", releaseMetadata)
 	}
 }
+
+func TestReleaseWithFakeDocker(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	dockerClient.AddLocalImage("test-release-image")
+	var limits docker.Limits
+	var binds []string
+	var user string
+	dockerClient.HandleRun("test-release-image", func(process *fake.Process) int {
+		limits = process.Container.Limits
+		binds = process.Container.Binds
+		user = process.User
+		fmt.Fprintln(process.ErrorStream, "building", process.Env["BUILD_ID"])
+		if err := process.Container.WriteFile("/build/artefact", []byte("built")); err != nil {
+			return 1
+		}
+		metadata, _ := json.Marshal(map[string]string{"version": process.Env["VERSION"]})
+		if err := process.Container.WriteFile("/release-metadata.json", metadata); err != nil {
+			return 1
+		}
+		return 0
+	})
+
+	var outputBuffer bytes.Buffer
+	var errorBuffer bytes.Buffer
+
+	buildVolume, _ := dockerClient.CreateVolume(context.Background(), "")
+
+	// When
+	releaseMetadata, err := container.Run(
+		context.Background(),
+		dockerClient,
+		"test-release-image",
+		docker.Limits{Memory: 512 * 1024 * 1024, PidsLimit: 100},
+		manifest.DockerSocketRestricted,
+		"1000:1000",
+		"/code-dir",
+		buildVolume,
+		&outputBuffer,
+		&errorBuffer,
+		map[string]string{
+			"VERSION":  "test-version",
+			"BUILD_ID": "test-build-id",
+		},
+	)
+	if err != nil {
+		t.Fatal("unexpected error: ", err)
+	}
+
+	// Then
+	if errorBuffer.String() != "building test-build-id\n" {
+		t.Fatalf("unexpected stderr output: '%v'", errorBuffer.String())
+	}
+	if !reflect.DeepEqual(releaseMetadata, map[string]string{"version": "test-version"}) {
+		t.Fatalf("unexpected release metadata: %v\n", releaseMetadata)
+	}
+	if limits.Memory != 512*1024*1024 || limits.PidsLimit != 100 {
+		t.Fatalf("unexpected limits for release container: %+v\n", limits)
+	}
+	if !reflect.DeepEqual(binds, []string{
+		"/code-dir:/code:ro",
+		buildVolume + ":/build",
+		fake.FakeDockerSocketProxy + ":/var/run/docker.sock",
+	}) {
+		t.Fatalf("unexpected binds for release container: %v\n", binds)
+	}
+	if user != "1000:1000" {
+		t.Fatalf("expected release container to run as host user, got: '%v'\n", user)
+	}
+	if dockerClient.DockerSocketProxies() != 0 {
+		t.Fatal("docker socket proxy not stopped")
+	}
+	buildFiles, err := dockerClient.ReadVolume(buildVolume)
+	if err != nil {
+		t.Fatal("error reading build volume:", err)
+	}
+	if string(buildFiles["artefact"]) != "built" {
+		t.Fatalf("unexpected build volume contents: %v\n", buildFiles)
+	}
+}
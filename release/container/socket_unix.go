@@ -0,0 +1,23 @@
+//go:build !windows
+// +build !windows
+
+package container
+
+import (
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// socketGroup returns the gid of the group that owns the socket, or an empty string if it can't be determined.
+func socketGroup(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return strconv.FormatUint(uint64(stat.Gid), 10)
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package container
+
+// socketGroup returns an empty string since containers aren't run as the host user on windows.
+func socketGroup(path string) string {
+	return ""
+}
@@ -0,0 +1,196 @@
+package releases
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+)
+
+// DefaultLimit is the number of releases listed if --limit isn't passed.
+const DefaultLimit = 20
+
+// CommandArgs contains specific arguments to the releases command.
+type CommandArgs struct {
+	Filter config.ReleaseFilter
+	All    bool
+	JSON   bool
+}
+
+// parseSince accepts a date or an RFC 3339 timestamp.
+func parseSince(value string) (time.Time, error) {
+	if result, err := time.Parse("2006-01-02", value); err == nil {
+		return result, nil
+	}
+	result, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid --since %q (expected e.g. 2020-01-31 or 2020-01-31T15:04:05Z)", value)
+	}
+	return result, nil
+}
+
+func handleArgs(arg string, commandArgs *CommandArgs, take func() (string, error)) error {
+	if arg == "-a" || arg == "--all" {
+		commandArgs.All = true
+		return nil
+	} else if arg == "--json" {
+		commandArgs.JSON = true
+		return nil
+	}
+	name := arg
+	if index := strings.Index(arg, "="); index != -1 {
+		name = arg[:index]
+	}
+	if name != "--since" && name != "--commit" && name != "--prefix" && name != "--limit" && name != "--page-token" {
+		return errors.New("Unknown releases option: " + arg)
+	}
+	value := strings.TrimPrefix(arg, name+"=")
+	if arg == name {
+		var err error
+		value, err = take()
+		if err != nil {
+			return err
+		}
+	}
+	switch name {
+	case "--since":
+		since, err := parseSince(value)
+		if err != nil {
+			return err
+		}
+		commandArgs.Filter.Since = since
+	case "--commit":
+		commandArgs.Filter.Commit = value
+	case "--prefix":
+		commandArgs.Filter.Prefix = value
+	case "--limit":
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit < 1 {
+			return fmt.Errorf("invalid --limit %q (expected a positive number)", value)
+		}
+		commandArgs.Filter.Limit = limit
+	case "--page-token":
+		commandArgs.Filter.PageToken = value
+	}
+	return nil
+}
+
+// ParseArgs parses command line arguments to the releases subcommand.
+func ParseArgs(args []string) (*CommandArgs, error) {
+	result := CommandArgs{Filter: config.ReleaseFilter{Limit: DefaultLimit}}
+	i := 0
+	take := func() (string, error) {
+		i++
+		if i >= len(args) {
+			return "", errors.New("missing value for " + args[i-1])
+		}
+		return args[i], nil
+	}
+	for ; i < len(args); i++ {
+		if err := handleArgs(args[i], &result, take); err != nil {
+			return nil, err
+		}
+	}
+	return &result, nil
+}
+
+// RunCommand runs the releases command, listing the component's releases via the config container.
+func RunCommand(ctx context.Context, state *command.GlobalState, args *CommandArgs, env map[string]string) (returnedError error) {
+	if err := config.Pull(ctx, state); err != nil {
+		return err
+	}
+
+	configContainer, err := config.NewContainer(ctx, state, state.Manifest.Config.Image, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := configContainer.Done(); err != nil {
+			if returnedError != nil {
+				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+			} else {
+				returnedError = err
+			}
+		}
+	}()
+
+	result, err := listReleases(ctx, state, configContainer, args, env)
+	if err != nil {
+		return err
+	}
+
+	if args.JSON {
+		encoder := json.NewEncoder(state.OutputStream)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+	if err := WriteTable(state.OutputStream, result.Releases); err != nil {
+		return err
+	}
+	if result.NextPageToken != "" {
+		fmt.Fprintf(state.ErrorStream, "\nmore releases available - pass --page-token %s for the next page (or --all)\n", result.NextPageToken)
+	}
+	return nil
+}
+
+// listReleases fetches a page of releases, or all of them with --all.
+func listReleases(ctx context.Context, state *command.GlobalState, configContainer *config.Container, args *CommandArgs, env map[string]string) (*config.ListReleasesResponse, error) {
+	filter := args.Filter
+	result := &config.ListReleasesResponse{Releases: []*config.Release{}, Success: true}
+	for {
+		response, err := configContainer.ListReleases(ctx, state.Component, state.Manifest.Config.Params, env, &filter)
+		if err != nil {
+			return nil, err
+		}
+		result.Releases = append(result.Releases, response.Releases...)
+		result.NextPageToken = response.NextPageToken
+		if !args.All || response.NextPageToken == "" {
+			return result, nil
+		}
+		filter.PageToken = response.NextPageToken
+	}
+}
+
+// WriteTable writes releases as a table with a column per field.
+func WriteTable(output io.Writer, releases []*config.Release) error {
+	writer := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "VERSION\tCREATED\tCOMMIT\tTERRAFORM IMAGE\tMETADATA")
+	for _, release := range releases {
+		created := "-"
+		if !release.Created.IsZero() {
+			created = release.Created.UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(
+			writer, "%s\t%s\t%s\t%s\t%s\n",
+			release.Version, created, orDash(release.Commit), orDash(release.TerraformImage),
+			orDash(formatMetadata(release.AdditionalMetadata)),
+		)
+	}
+	return writer.Flush()
+}
+
+// formatMetadata formats metadata as comma separated key=value pairs, sorted by key.
+func formatMetadata(metadata map[string]string) string {
+	var pairs []string
+	for key, value := range metadata {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,200 @@
+package releases_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/manifest"
+	"github.com/mergermarket/cdflow2/releases"
+	"github.com/mergermarket/cdflow2/test"
+)
+
+func TestParseArgs(t *testing.T) {
+	// When
+	args, err := releases.ParseArgs([]string{
+		"--since", "2020-01-31", "--commit=abc123", "--prefix", "34-", "--limit", "5", "--page-token", "next", "--all", "--json",
+	})
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !reflect.DeepEqual(args, &releases.CommandArgs{
+		Filter: config.ReleaseFilter{
+			Since:     time.Date(2020, 1, 31, 0, 0, 0, 0, time.UTC),
+			Commit:    "abc123",
+			Prefix:    "34-",
+			Limit:     5,
+			PageToken: "next",
+		},
+		All:  true,
+		JSON: true,
+	}) {
+		t.Fatalf("unexpected args: %+v", args)
+	}
+}
+
+func TestParseArgsDefaults(t *testing.T) {
+	args, err := releases.ParseArgs([]string{})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if args.Filter.Limit != releases.DefaultLimit || args.All || args.JSON {
+		t.Fatalf("unexpected args: %+v", args)
+	}
+}
+
+func TestParseArgsInvalid(t *testing.T) {
+	for _, args := range [][]string{{"--since", "yesterday"}, {"--limit", "0"}, {"--limit"}, {"--unknown"}} {
+		if _, err := releases.ParseArgs(args); err == nil {
+			t.Fatal("expected error for", args)
+		}
+	}
+}
+
+// handleListReleases simulates a config image that pages through two releases a release at a time, returning the
+// list_releases requests it receives.
+func handleListReleases(dockerClient *fake.Client) *[]map[string]interface{} {
+	var requests []map[string]interface{}
+	pages := map[string]map[string]interface{}{
+		"": {
+			"Releases": []map[string]interface{}{{
+				"Version":            "2-def",
+				"Commit":             "def",
+				"Created":            "2020-02-01T10:00:00Z",
+				"TerraformImage":     "terraform@sha256:2222",
+				"AdditionalMetadata": map[string]string{"b": "2", "a": "1"},
+			}},
+			"NextPageToken": "page-2",
+			"Success":       true,
+		},
+		"page-2": {
+			"Releases": []map[string]interface{}{{
+				"Version":        "1-abc",
+				"Commit":         "abc",
+				"TerraformImage": "terraform@sha256:1111",
+			}},
+			"Success": true,
+		},
+	}
+	test.HandleFakeConfig(dockerClient, "config-image", func(request map[string]interface{}) interface{} {
+		if request["Action"] == config.ActionHello {
+			return map[string]interface{}{
+				"ProtocolVersion": config.ProtocolVersion,
+				"Actions":         []string{config.ActionHello, config.ActionListReleases},
+				"Success":         true,
+			}
+		}
+		requests = append(requests, request)
+		pageToken, _ := request["PageToken"].(string)
+		return pages[pageToken]
+	})
+	return &requests
+}
+
+func runReleases(t *testing.T, dockerClient *fake.Client, args []string) (string, string) {
+	var outputBuffer, errorBuffer bytes.Buffer
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &outputBuffer,
+		ErrorStream:  &errorBuffer,
+		Component:    "test-component",
+		Manifest: &manifest.Manifest{
+			Version: 2,
+			Config:  manifest.ImageWithParams{Image: "config-image"},
+		},
+		GlobalArgs: &command.GlobalArgs{},
+	}
+	commandArgs, err := releases.ParseArgs(args)
+	if err != nil {
+		t.Fatal("unexpected error parsing args:", err)
+	}
+	if err := releases.RunCommand(context.Background(), state, commandArgs, map[string]string{}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	return outputBuffer.String(), errorBuffer.String()
+}
+
+func TestRunCommandTable(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	requests := handleListReleases(dockerClient)
+
+	// When
+	output, errors := runReleases(t, dockerClient, []string{"--prefix", "2-"})
+
+	// Then
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	if len(lines) != 2 {
+		t.Fatal("expected header and one release, got:", output)
+	}
+	if strings.Join(strings.Fields(lines[1]), " ") != "2-def 2020-02-01T10:00:00Z def terraform@sha256:2222 a=1,b=2" {
+		t.Fatal("unexpected release line:", lines[1])
+	}
+	if !strings.Contains(errors, "--page-token page-2") {
+		t.Fatal("expected next page token to be output, got:", errors)
+	}
+	if len(*requests) != 1 {
+		t.Fatal("expected one list_releases request, got:", *requests)
+	}
+	request := (*requests)[0]
+	if request["Component"] != "test-component" || request["Prefix"] != "2-" || request["Limit"] != float64(releases.DefaultLimit) {
+		t.Fatal("unexpected request:", request)
+	}
+}
+
+func TestRunCommandAllJSON(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	requests := handleListReleases(dockerClient)
+
+	// When
+	output, _ := runReleases(t, dockerClient, []string{"--all", "--json"})
+
+	// Then
+	var result config.ListReleasesResponse
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Fatal("error decoding output:", err, output)
+	}
+	if len(result.Releases) != 2 || result.Releases[0].Version != "2-def" || result.Releases[1].Version != "1-abc" {
+		t.Fatal("unexpected releases:", output)
+	}
+	if result.NextPageToken != "" {
+		t.Fatal("unexpected next page token:", result.NextPageToken)
+	}
+	if len(*requests) != 2 || (*requests)[1]["PageToken"] != "page-2" {
+		t.Fatal("expected second page to be requested, got:", *requests)
+	}
+}
+
+func TestRunCommandUnsupported(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	test.HandleFakeConfig(dockerClient, "config-image", func(request map[string]interface{}) interface{} {
+		return map[string]interface{}{"Success": false}
+	})
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  &bytes.Buffer{},
+		Manifest:     &manifest.Manifest{Version: 2, Config: manifest.ImageWithParams{Image: "config-image"}},
+		GlobalArgs:   &command.GlobalArgs{},
+	}
+	args, _ := releases.ParseArgs([]string{})
+
+	// When
+	err := releases.RunCommand(context.Background(), state, args, map[string]string{})
+
+	// Then
+	if err == nil || !strings.Contains(err.Error(), "does not support the list_releases action") {
+		t.Fatal("expected unsupported action error, got:", err)
+	}
+}
@@ -0,0 +1,169 @@
+package rollback
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/deploy"
+	"github.com/mergermarket/cdflow2/envlock"
+	"github.com/mergermarket/cdflow2/util"
+)
+
+// historyLimit is the number of deployments to the environment searched for a version to roll back to.
+const historyLimit = 50
+
+// CommandArgs contains specific arguments to the rollback command.
+type CommandArgs struct {
+	EnvName  string
+	To       string
+	PlanOnly bool
+}
+
+// ParseArgs parses command line arguments to the rollback subcommand.
+func ParseArgs(args []string) (*CommandArgs, error) {
+	var result CommandArgs
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-p" || arg == "--plan-only" {
+			result.PlanOnly = true
+		} else if arg == "--to" {
+			i++
+			if i >= len(args) {
+				return nil, errors.New("missing value for --to")
+			}
+			result.To = args[i]
+		} else if strings.HasPrefix(arg, "--to=") {
+			result.To = strings.TrimPrefix(arg, "--to=")
+		} else if strings.HasPrefix(arg, "-") {
+			return nil, errors.New("Unknown rollback option: " + arg)
+		} else if result.EnvName == "" {
+			result.EnvName = arg
+		} else {
+			return nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+	}
+	if result.EnvName == "" {
+		return nil, errors.New("missing ENV")
+	}
+	return &result, nil
+}
+
+// SelectTarget returns the version to roll back to from the deployment history of an environment (newest first) -
+// the most recent version that was deployed before the current one, skipping versions that were themselves rolled
+// back from.
+func SelectTarget(history []*config.Deployment) (string, error) {
+	if len(history) == 0 {
+		return "", errors.New("no deployments recorded")
+	}
+	avoid := map[string]bool{history[0].Version: true}
+	for _, deployment := range history {
+		if deployment.RollbackFrom != "" {
+			avoid[deployment.RollbackFrom] = true
+		}
+		if !avoid[deployment.Version] {
+			return deployment.Version, nil
+		}
+	}
+	return "", fmt.Errorf("no previous version found in the last %d deployments", len(history))
+}
+
+// RunCommand runs the rollback command, redeploying the previously deployed version (or the one passed with --to).
+func RunCommand(ctx context.Context, state *command.GlobalState, args *CommandArgs, env map[string]string) (returnedError error) {
+	if err := config.Pull(ctx, state); err != nil {
+		return err
+	}
+
+	// the history is read under the lock, so a concurrent deploy can't change the current version before the rollback
+	if !args.PlanOnly {
+		release, err := envlock.Acquire(ctx, state, args.EnvName, "rollback", env)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := release(); err != nil {
+				if returnedError != nil {
+					returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+				} else {
+					returnedError = err
+				}
+			}
+		}()
+	}
+
+	current, target, err := getVersions(ctx, state, args, env)
+	if err != nil {
+		return err
+	}
+	if current == target {
+		return fmt.Errorf("%s is already deployed to %s", target, args.EnvName)
+	}
+
+	from := current
+	if from == "" {
+		from = "unknown version"
+	}
+	fmt.Fprintf(
+		state.ErrorStream, "\n%s\n",
+		util.FormatInfo(fmt.Sprintf("rolling back %s from %s to %s - the plan shows the changes from the current deployment", args.EnvName, from, target)),
+	)
+
+	stateShouldExist := true
+	return deploy.RunCommand(ctx, state, &deploy.CommandArgs{
+		EnvName:          args.EnvName,
+		Version:          target,
+		PlanOnly:         args.PlanOnly,
+		StateShouldExist: &stateShouldExist,
+		Rollback:         true,
+		RollbackFrom:     current,
+		Locked:           true,
+	}, env)
+}
+
+// getVersions looks up the deployment history of the environment via the config container, returning the currently
+// deployed version (empty if it isn't known) and the version to roll back to.
+func getVersions(ctx context.Context, state *command.GlobalState, args *CommandArgs, env map[string]string) (current, target string, returnedError error) {
+	configContainer, err := config.NewContainer(ctx, state, state.Manifest.Config.Image, "")
+	if err != nil {
+		return "", "", err
+	}
+	defer func() {
+		if err := configContainer.Done(); err != nil {
+			if returnedError != nil {
+				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+			} else {
+				returnedError = err
+			}
+		}
+	}()
+
+	if !configContainer.Supports(config.ActionGetDeployments) && args.To != "" {
+		// without the history the rollback can still be done, it just can't say what it is rolling back from
+		return "", args.To, nil
+	}
+
+	response, err := configContainer.GetDeployments(ctx, state.Component, state.Manifest.Config.Params, env, []string{args.EnvName}, historyLimit)
+	if err != nil {
+		return "", "", err
+	}
+	var history []*config.Deployment
+	for _, deployment := range response.Deployments {
+		if deployment.EnvName == args.EnvName {
+			history = append(history, deployment)
+		}
+	}
+	if len(history) != 0 {
+		current = history[0].Version
+	}
+	if args.To != "" {
+		return current, args.To, nil
+	}
+	target, err = SelectTarget(history)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to find a version to roll back %s to (%v) - pass --to VERSION", args.EnvName, err)
+	}
+	return current, target, nil
+}
@@ -0,0 +1,179 @@
+package rollback_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/manifest"
+	"github.com/mergermarket/cdflow2/rollback"
+	"github.com/mergermarket/cdflow2/test"
+)
+
+func TestParseArgs(t *testing.T) {
+	args, err := rollback.ParseArgs([]string{"live", "--to", "34-a5dbc4a7", "-p"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !reflect.DeepEqual(args, &rollback.CommandArgs{EnvName: "live", To: "34-a5dbc4a7", PlanOnly: true}) {
+		t.Fatalf("unexpected args: %+v", args)
+	}
+	for _, invalid := range [][]string{{}, {"live", "aslive"}, {"live", "--to"}, {"live", "--unknown"}} {
+		if _, err := rollback.ParseArgs(invalid); err == nil {
+			t.Fatal("expected error for", invalid)
+		}
+	}
+}
+
+func TestSelectTarget(t *testing.T) {
+	for _, testCase := range []struct {
+		history  []*config.Deployment
+		expected string
+	}{
+		{
+			history:  []*config.Deployment{{Version: "3"}, {Version: "3"}, {Version: "2"}, {Version: "1"}},
+			expected: "2",
+		},
+		{
+			// 3 was rolled back from, so rolling back again should go to 1 rather than redeploying 3
+			history:  []*config.Deployment{{Version: "2", RollbackFrom: "3"}, {Version: "3"}, {Version: "2"}, {Version: "1"}},
+			expected: "1",
+		},
+	} {
+		target, err := rollback.SelectTarget(testCase.history)
+		if err != nil {
+			t.Fatal("unexpected error:", err)
+		}
+		if target != testCase.expected {
+			t.Fatalf("expected %s, got %s", testCase.expected, target)
+		}
+	}
+	if _, err := rollback.SelectTarget([]*config.Deployment{{Version: "1"}}); err == nil {
+		t.Fatal("expected error with no previous version")
+	}
+}
+
+// runRollback runs a rollback with a config image that supports actions, returning the actions requested, the version
+// prepared and the deployment recorded.
+func runRollback(t *testing.T, actions []string, rollbackArgs []string) ([]string, string, *config.Deployment) {
+	codeDir, err := ioutil.TempDir("", "cdflow2-rollback-test")
+	if err != nil {
+		t.Fatal("error creating code dir:", err)
+	}
+	defer os.RemoveAll(codeDir)
+
+	dockerClient := fake.NewClient()
+	var requested []string
+	var preparedVersion string
+	var recorded *config.Deployment
+	test.HandleFakeConfig(dockerClient, "config-image", func(request map[string]interface{}) interface{} {
+		action := request["Action"].(string)
+		if action != config.ActionHello {
+			requested = append(requested, action)
+		}
+		switch action {
+		case config.ActionHello:
+			return map[string]interface{}{
+				"ProtocolVersion": config.ProtocolVersion,
+				"Actions":         actions,
+				"Success":         true,
+			}
+		case config.ActionGetDeployments:
+			return map[string]interface{}{
+				"Deployments": []map[string]string{
+					{"EnvName": "live", "Version": "3-ghi"},
+					{"EnvName": "live", "Version": "2-def"},
+				},
+				"Success": true,
+			}
+		case config.ActionPrepareTerraform:
+			preparedVersion = request["Version"].(string)
+			return map[string]interface{}{
+				"TerraformImage":       "terraform-image",
+				"TerraformBackendType": "local",
+				"Success":              true,
+			}
+		case config.ActionAcquireLock:
+			return map[string]interface{}{"Acquired": true, "Lock": map[string]string{"ID": "lock-1"}, "Success": true}
+		case config.ActionReleaseLock:
+			return map[string]interface{}{"Released": true, "Success": true}
+		case config.ActionRecordDeployment:
+			encoded, _ := json.Marshal(request["Deployment"])
+			json.Unmarshal(encoded, &recorded)
+		}
+		return map[string]interface{}{"Success": true}
+	})
+	test.HandleFakeTerraform(dockerClient, "terraform-image", func(process *fake.Process) int {
+		return 0
+	})
+
+	var errorBuffer bytes.Buffer
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &bytes.Buffer{},
+		ErrorStream:  &errorBuffer,
+		CodeDir:      codeDir,
+		Component:    "test-component",
+		Commit:       "test-commit",
+		Manifest: &manifest.Manifest{
+			Version:   2,
+			Terraform: manifest.Terraform{Image: "terraform-image"},
+			Config:    manifest.ImageWithParams{Image: "config-image"},
+		},
+		GlobalArgs: &command.GlobalArgs{},
+	}
+	args, err := rollback.ParseArgs(rollbackArgs)
+	if err != nil {
+		t.Fatal("error parsing args:", err)
+	}
+
+	if err := rollback.RunCommand(context.Background(), state, args, map[string]string{}); err != nil {
+		t.Fatal("error running rollback command:", err, errorBuffer.String())
+	}
+	return requested, preparedVersion, recorded
+}
+
+func TestRunCommand(t *testing.T) {
+	// When
+	requested, preparedVersion, recorded := runRollback(t, []string{
+		config.ActionPrepareTerraform, config.ActionGetDeployments, config.ActionRecordDeployment,
+		config.ActionAcquireLock, config.ActionReleaseLock,
+	}, []string{"live"})
+
+	// Then
+	if preparedVersion != "2-def" {
+		t.Fatal("expected previous version to be deployed, got:", preparedVersion)
+	}
+	if recorded == nil || recorded.Version != "2-def" || !recorded.Rollback || recorded.RollbackFrom != "3-ghi" {
+		t.Fatalf("expected rollback to be recorded, got: %+v", recorded)
+	}
+	// the history is read under the lock, which deploy doesn't take again
+	if !reflect.DeepEqual(requested, []string{
+		config.ActionAcquireLock, config.ActionGetDeployments, config.ActionPrepareTerraform,
+		config.ActionRecordDeployment, config.ActionReleaseLock,
+	}) {
+		t.Fatal("unexpected actions:", requested)
+	}
+}
+
+func TestRunCommandWithoutHistory(t *testing.T) {
+	// When
+	_, preparedVersion, recorded := runRollback(t, []string{
+		config.ActionPrepareTerraform, config.ActionRecordDeployment,
+	}, []string{"live", "--to", "2-def"})
+
+	// Then
+	if preparedVersion != "2-def" {
+		t.Fatal("expected the version passed with --to to be deployed, got:", preparedVersion)
+	}
+	if recorded == nil || !recorded.Rollback || recorded.RollbackFrom != "" {
+		t.Fatalf("expected rollback from an unknown version to be recorded, got: %+v", recorded)
+	}
+}
@@ -1,6 +1,7 @@
 package setup
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/mergermarket/cdflow2/command"
@@ -9,20 +10,20 @@ import (
 )
 
 // RunCommand runs the setup command.
-func RunCommand(state *command.GlobalState, env map[string]string) (returnedError error) {
+func RunCommand(ctx context.Context, state *command.GlobalState, env map[string]string) (returnedError error) {
 
 	// TODO check cdflow.yaml setup
 
-	releaseRequirements, err := release.GetReleaseRequirements(state)
-	if err != nil {
+	if err := release.PullImages(ctx, state, false); err != nil {
 		return err
 	}
 
-	if err := config.Pull(state); err != nil {
+	releaseRequirements, err := release.GetReleaseRequirements(ctx, state)
+	if err != nil {
 		return err
 	}
 
-	configContainer, err := config.NewContainer(state, state.Manifest.Config.Image, "")
+	configContainer, err := config.NewContainer(ctx, state, state.Manifest.Config.Image, "")
 	if err != nil {
 		return err
 	}
@@ -37,5 +38,5 @@ func RunCommand(state *command.GlobalState, env map[string]string) (returnedErro
 		}
 	}()
 
-	return configContainer.Setup(state.Manifest.Config.Params, env, state.Component, state.Commit, releaseRequirements)
+	return configContainer.Setup(ctx, state.Manifest.Config.Params, env, state.Component, state.Commit, releaseRequirements)
 }
@@ -1,6 +1,7 @@
 package shell
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -8,6 +9,8 @@ import (
 
 	"github.com/mergermarket/cdflow2/command"
 	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/credentials"
+	"github.com/mergermarket/cdflow2/envlock"
 	"github.com/mergermarket/cdflow2/terraform"
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -88,14 +91,29 @@ func ParseArgs(args []string) (*CommandArgs, error) {
 }
 
 // RunCommand runs the shell command.
-func RunCommand(state *command.GlobalState, args *CommandArgs, env map[string]string) (returnedError error) {
-	prepareTerraformResponse, buildVolume, terraformImage, err := config.SetupTerraform(state, args.StateShouldExist, args.EnvName, args.Version, env)
+func RunCommand(ctx context.Context, state *command.GlobalState, args *CommandArgs, env map[string]string) (returnedError error) {
+	prepareTerraformResponse, buildVolume, terraformImage, err := config.SetupTerraform(ctx, state, args.StateShouldExist, args.EnvName, args.Version, env)
 	if err != nil {
 		return err
 	}
 
 	defer func() {
-		if err := state.DockerClient.RemoveVolume(buildVolume); err != nil {
+		if err := state.DockerClient.RemoveVolume(context.Background(), buildVolume); err != nil {
+			if returnedError != nil {
+				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+			} else {
+				returnedError = err
+			}
+		}
+	}()
+
+	// the lock covers the session, so a concurrent deploy or destroy can't change the state underneath it
+	release, err := envlock.Acquire(ctx, state, args.EnvName, "shell", env)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := release(); err != nil {
 			if returnedError != nil {
 				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
 			} else {
@@ -105,8 +123,11 @@ func RunCommand(state *command.GlobalState, args *CommandArgs, env map[string]st
 	}()
 
 	terraformContainer, err := terraform.NewContainer(
+		ctx,
 		state.DockerClient,
 		terraformImage,
+		state.Manifest.Terraform.Limits.ContainerLimits(),
+		state.ContainerUser,
 		state.CodeDir,
 		buildVolume,
 	)
@@ -123,11 +144,17 @@ func RunCommand(state *command.GlobalState, args *CommandArgs, env map[string]st
 		}
 	}()
 
-	if err := terraformContainer.ConfigureBackend(state.OutputStream, state.ErrorStream, prepareTerraformResponse, true); err != nil {
+	refresher, err := credentials.Start(ctx, state, terraformContainer, prepareTerraformResponse, args.EnvName, args.Version, env)
+	if err != nil {
+		return err
+	}
+	defer refresher.Stop()
+
+	if err := terraformContainer.ConfigureBackend(ctx, state.OutputStream, state.ErrorStream, prepareTerraformResponse, true); err != nil {
 		return err
 	}
 
-	if err := terraformContainer.SwitchWorkspace(args.EnvName, state.OutputStream, state.ErrorStream); err != nil {
+	if err := terraformContainer.SwitchWorkspace(ctx, args.EnvName, state.OutputStream, state.ErrorStream); err != nil {
 		return err
 	}
 
@@ -147,8 +174,9 @@ func RunCommand(state *command.GlobalState, args *CommandArgs, env map[string]st
 	shellCommandandArgs = append(shellCommand, args.ShellArgs...)
 
 	if err := terraformContainer.RunInteractiveCommand(
+		ctx,
 		shellCommandandArgs,
-		prepareTerraformResponse.Env,
+		refresher.Env(),
 		state.InputStream,
 		state.OutputStream,
 		state.ErrorStream,
@@ -2,6 +2,7 @@ package shell_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"reflect"
@@ -48,7 +49,7 @@ func TestRunCommand(t *testing.T) {
 		},
 	}
 
-	repoDigests, err := state.DockerClient.GetImageRepoDigests(test.GetConfig("TEST_TERRAFORM_IMAGE"))
+	repoDigests, err := state.DockerClient.GetImageRepoDigests(context.Background(), test.GetConfig("TEST_TERRAFORM_IMAGE"))
 	if err != nil {
 		t.Fatal("could not get repo digests for terraform container:", err)
 	}
@@ -59,7 +60,7 @@ func TestRunCommand(t *testing.T) {
 	args, _ := shell.ParseArgs([]string{"test-env", "-v", "test-version", "--", "-c", "terraform -v"})
 
 	// When
-	if err := shell.RunCommand(state, args, map[string]string{
+	if err := shell.RunCommand(context.Background(), state, args, map[string]string{
 		"TERRAFORM_DIGEST": terraformDigest,
 	}); err != nil {
 		t.Fatal("error running shell command:", err, errorBuffer.String())
@@ -0,0 +1,176 @@
+package status
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+)
+
+// releasesPageSize is the number of releases fetched at a time when working out how far behind deployments are.
+const releasesPageSize = 100
+
+// CommandArgs contains specific arguments to the status command.
+type CommandArgs struct {
+	EnvNames []string
+	JSON     bool
+}
+
+// ParseArgs parses command line arguments to the status subcommand.
+func ParseArgs(args []string) (*CommandArgs, error) {
+	var result CommandArgs
+	for _, arg := range args {
+		if arg == "--json" {
+			result.JSON = true
+		} else if len(arg) > 0 && arg[0] == '-' {
+			return nil, errors.New("Unknown status option: " + arg)
+		} else {
+			result.EnvNames = append(result.EnvNames, arg)
+		}
+	}
+	return &result, nil
+}
+
+// EnvironmentStatus is the latest deployment to an environment.
+type EnvironmentStatus struct {
+	*config.Deployment
+	// Behind is the number of releases newer than the one deployed (nil if it isn't known).
+	Behind *int
+}
+
+// Status is the output of the status command.
+type Status struct {
+	// Latest is the latest release (empty if it isn't known).
+	Latest       string
+	Environments []*EnvironmentStatus
+}
+
+// RunCommand runs the status command, showing the version deployed to each environment.
+func RunCommand(ctx context.Context, state *command.GlobalState, args *CommandArgs, env map[string]string) (returnedError error) {
+	if err := config.Pull(ctx, state); err != nil {
+		return err
+	}
+
+	configContainer, err := config.NewContainer(ctx, state, state.Manifest.Config.Image, "")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := configContainer.Done(); err != nil {
+			if returnedError != nil {
+				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+			} else {
+				returnedError = err
+			}
+		}
+	}()
+
+	status, err := getStatus(ctx, state, configContainer, args, env)
+	if err != nil {
+		return err
+	}
+
+	if args.JSON {
+		encoder := json.NewEncoder(state.OutputStream)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(status)
+	}
+	return WriteTable(state.OutputStream, status)
+}
+
+func getStatus(ctx context.Context, state *command.GlobalState, configContainer *config.Container, args *CommandArgs, env map[string]string) (*Status, error) {
+	response, err := configContainer.GetDeployments(ctx, state.Component, state.Manifest.Config.Params, env, args.EnvNames, 0)
+	if err != nil {
+		return nil, err
+	}
+	status := &Status{Environments: []*EnvironmentStatus{}}
+	for _, deployment := range response.Deployments {
+		status.Environments = append(status.Environments, &EnvironmentStatus{Deployment: deployment})
+	}
+	sort.Slice(status.Environments, func(i, j int) bool {
+		return status.Environments[i].EnvName < status.Environments[j].EnvName
+	})
+	if !configContainer.Supports(config.ActionListReleases) {
+		return status, nil
+	}
+	if err := countBehind(ctx, state, configContainer, env, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// countBehind pages through the releases (newest first) until the deployed version of each environment is found,
+// counting the releases newer than it.
+func countBehind(ctx context.Context, state *command.GlobalState, configContainer *config.Container, env map[string]string, status *Status) error {
+	remaining := make(map[string][]*EnvironmentStatus)
+	for _, environment := range status.Environments {
+		remaining[environment.Version] = append(remaining[environment.Version], environment)
+	}
+	filter := config.ReleaseFilter{Limit: releasesPageSize}
+	newer := 0
+	for {
+		response, err := configContainer.ListReleases(ctx, state.Component, state.Manifest.Config.Params, env, &filter)
+		if err != nil {
+			return err
+		}
+		for _, release := range response.Releases {
+			if status.Latest == "" {
+				status.Latest = release.Version
+			}
+			for _, environment := range remaining[release.Version] {
+				behind := newer
+				environment.Behind = &behind
+			}
+			delete(remaining, release.Version)
+			newer++
+		}
+		if len(remaining) == 0 || response.NextPageToken == "" {
+			return nil
+		}
+		filter.PageToken = response.NextPageToken
+	}
+}
+
+// WriteTable writes the status as a table with a row per environment.
+func WriteTable(output io.Writer, status *Status) error {
+	if status.Latest != "" {
+		fmt.Fprintf(output, "latest release: %s\n\n", status.Latest)
+	}
+	writer := tabwriter.NewWriter(output, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(writer, "ENV\tVERSION\tCOMMIT\tDEPLOYED BY\tDEPLOYED AT\tCHANGES\tBEHIND")
+	for _, environment := range status.Environments {
+		deployedAt := "-"
+		if !environment.Finished.IsZero() {
+			deployedAt = environment.Finished.UTC().Format(time.RFC3339)
+		}
+		changes := "-"
+		if environment.Changes != nil {
+			changes = fmt.Sprintf("+%d ~%d -%d", environment.Changes.Add, environment.Changes.Change, environment.Changes.Destroy)
+		}
+		behind := "?"
+		if environment.Behind != nil {
+			behind = strconv.Itoa(*environment.Behind)
+		}
+		fmt.Fprintf(
+			writer, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			environment.EnvName, environment.Version, orDash(environment.Commit), orDash(environment.User),
+			deployedAt, changes, behind,
+		)
+	}
+	return writer.Flush()
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
@@ -0,0 +1,103 @@
+package status_test
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/manifest"
+	"github.com/mergermarket/cdflow2/status"
+	"github.com/mergermarket/cdflow2/test"
+)
+
+func TestParseArgs(t *testing.T) {
+	args, err := status.ParseArgs([]string{"live", "--json", "aslive"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !reflect.DeepEqual(args, &status.CommandArgs{EnvNames: []string{"live", "aslive"}, JSON: true}) {
+		t.Fatalf("unexpected args: %+v", args)
+	}
+	if _, err := status.ParseArgs([]string{"--unknown"}); err == nil {
+		t.Fatal("expected error for unknown option")
+	}
+}
+
+func TestRunCommand(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	var getDeploymentsRequest map[string]interface{}
+	test.HandleFakeConfig(dockerClient, "config-image", func(request map[string]interface{}) interface{} {
+		switch request["Action"] {
+		case config.ActionHello:
+			return map[string]interface{}{
+				"ProtocolVersion": config.ProtocolVersion,
+				"Actions":         []string{config.ActionGetDeployments, config.ActionListReleases},
+				"Success":         true,
+			}
+		case config.ActionGetDeployments:
+			getDeploymentsRequest = request
+			return map[string]interface{}{
+				"Deployments": []map[string]interface{}{
+					{"EnvName": "live", "Version": "1-abc", "Commit": "abc", "User": "alice", "Finished": "2020-01-31T15:04:05Z", "Changes": map[string]int{"Add": 1}},
+					{"EnvName": "aslive", "Version": "3-ghi", "Commit": "ghi", "User": "bob", "Finished": "2020-02-02T10:00:00Z"},
+					{"EnvName": "dev", "Version": "0-old", "Commit": "old"},
+				},
+				"Success": true,
+			}
+		case config.ActionListReleases:
+			if request["PageToken"] == nil {
+				return map[string]interface{}{
+					"Releases":      []map[string]string{{"Version": "3-ghi"}, {"Version": "2-def"}},
+					"NextPageToken": "page-2",
+					"Success":       true,
+				}
+			}
+			return map[string]interface{}{
+				"Releases": []map[string]string{{"Version": "1-abc"}},
+				"Success":  true,
+			}
+		}
+		return map[string]interface{}{"Success": false}
+	})
+	var outputBuffer bytes.Buffer
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &outputBuffer,
+		ErrorStream:  &bytes.Buffer{},
+		Component:    "test-component",
+		Manifest:     &manifest.Manifest{Version: 2, Config: manifest.ImageWithParams{Image: "config-image"}},
+		GlobalArgs:   &command.GlobalArgs{},
+	}
+	args, _ := status.ParseArgs([]string{})
+
+	// When
+	if err := status.RunCommand(context.Background(), state, args, map[string]string{}); err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+
+	// Then
+	if getDeploymentsRequest["Component"] != "test-component" {
+		t.Fatal("unexpected get_deployments request:", getDeploymentsRequest)
+	}
+	lines := strings.Split(strings.TrimSpace(outputBuffer.String()), "\n")
+	var rows []string
+	for _, line := range lines {
+		rows = append(rows, strings.Join(strings.Fields(line), " "))
+	}
+	if !reflect.DeepEqual(rows, []string{
+		"latest release: 3-ghi",
+		"",
+		"ENV VERSION COMMIT DEPLOYED BY DEPLOYED AT CHANGES BEHIND",
+		"aslive 3-ghi ghi bob 2020-02-02T10:00:00Z - 0",
+		"dev 0-old old - - - ?",
+		"live 1-abc abc alice 2020-01-31T15:04:05Z +1 ~0 -0 2",
+	}) {
+		t.Fatal("unexpected output:\n" + outputBuffer.String())
+	}
+}
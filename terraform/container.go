@@ -2,6 +2,7 @@ package terraform
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"os"
@@ -17,13 +18,17 @@ import (
 )
 
 // InitInitial runs terraform init as part of the release in order to download providers and modules.
-func InitInitial(dockerClient docker.Iface, image, codeDir string, buildVolume string, outputStream, errorStream io.Writer) error {
+func InitInitial(ctx context.Context, dockerClient docker.Iface, image string, limits docker.Limits, user, codeDir string, buildVolume string, outputStream, errorStream io.Writer) error {
 
-	cacheVolume, err := util.GetCacheVolume(dockerClient)
+	cacheVolume, err := util.GetCacheVolume(ctx, dockerClient)
 	if err != nil {
 		return err
 	}
 
+	if err := util.PrepareVolumes(ctx, dockerClient, image, user, buildVolume, cacheVolume); err != nil {
+		return err
+	}
+
 	fmt.Fprintf(
 		errorStream,
 		"\n%s\n%s\n\n",
@@ -31,7 +36,7 @@ func InitInitial(dockerClient docker.Iface, image, codeDir string, buildVolume s
 		util.FormatCommand("terraform init -backend=false"),
 	)
 
-	return dockerClient.Run(&docker.RunOptions{
+	return dockerClient.Run(ctx, &docker.RunOptions{
 		Image:      image,
 		WorkingDir: "/code/infra",
 		Cmd:        []string{"init", "-backend=false"},
@@ -49,6 +54,8 @@ func InitInitial(dockerClient docker.Iface, image, codeDir string, buildVolume s
 		NamePrefix:   "cdflow2-terraform-init",
 		OutputStream: outputStream,
 		ErrorStream:  errorStream,
+		Limits:       limits,
+		User:         user,
 	})
 }
 
@@ -58,20 +65,26 @@ type Container struct {
 	id           string
 	done         chan error
 	codeDir      string
+	user         string
 }
 
 // NewContainer creates and returns a terraformContainer for running terraform commands in.
-func NewContainer(dockerClient docker.Iface, image, codeDir string, releaseVolume string) (*Container, error) {
+func NewContainer(ctx context.Context, dockerClient docker.Iface, image string, limits docker.Limits, user, codeDir string, releaseVolume string) (*Container, error) {
 
+	if err := util.PrepareVolumes(ctx, dockerClient, image, user, releaseVolume); err != nil {
+		return nil, err
+	}
+
+	// not closed, since Run may still send to it after a cancellation (buffered so it never blocks)
 	started := make(chan string, 1)
-	defer close(started)
 
 	done := make(chan error, 1)
 
 	var outputBuffer bytes.Buffer
 
 	go func() {
-		done <- dockerClient.Run(&docker.RunOptions{
+		// not tied to ctx since the lifecycle of the container is managed by Done (which must run on cancellation)
+		done <- dockerClient.Run(context.Background(), &docker.RunOptions{
 			Image: image,
 			// output to user in case there's an error (e.g. terraform container doesn't have /bin/sleep)
 			OutputStream: &outputBuffer,
@@ -83,6 +96,8 @@ func NewContainer(dockerClient docker.Iface, image, codeDir string, releaseVolum
 			Started:      started,
 			Init:         true,
 			NamePrefix:   "cdflow2-terraform",
+			Limits:       limits,
+			User:         user,
 			Binds: []string{
 				codeDir + ":/code",
 				releaseVolume + ":/build",
@@ -92,12 +107,24 @@ func NewContainer(dockerClient docker.Iface, image, codeDir string, releaseVolum
 	}()
 
 	select {
+	case <-ctx.Done():
+		// the container may still start, so wait for it in order to clean up
+		go func() {
+			select {
+			case id := <-started:
+				dockerClient.Stop(context.Background(), id, 10*time.Second)
+				<-done
+			case <-done:
+			}
+		}()
+		return nil, ctx.Err()
 	case id := <-started:
 		return &Container{
 			dockerClient: dockerClient,
 			id:           id,
 			done:         done,
 			codeDir:      codeDir,
+			user:         user,
 		}, nil
 	case err := <-done:
 		return nil, fmt.Errorf("could not start terraform container: %w\nOutput: %v", err, outputBuffer.String())
@@ -189,7 +216,7 @@ func (terraformContainer *Container) createPartialBackendConfig(codeDir, backend
 }
 
 // ConfigureBackend runs terraform init as part of the release in order to download providers and modules.
-func (terraformContainer *Container) ConfigureBackend(outputStream, errorStream io.Writer, terraformResponse *config.PrepareTerraformResponse, download bool) error {
+func (terraformContainer *Container) ConfigureBackend(ctx context.Context, outputStream, errorStream io.Writer, terraformResponse *config.PrepareTerraformResponse, download bool) error {
 	if err := terraformContainer.createPartialBackendConfig(terraformContainer.codeDir, terraformResponse.TerraformBackendType); err != nil {
 		return err
 	}
@@ -227,7 +254,7 @@ func (terraformContainer *Container) ConfigureBackend(outputStream, errorStream
 		strings.Join(displayCommand, " "),
 	)
 
-	if err := terraformContainer.RunCommand(command, map[string]string{}, outputStream, errorStream); err != nil {
+	if err := terraformContainer.RunCommand(ctx, command, map[string]string{}, outputStream, errorStream); err != nil {
 		return err
 	}
 
@@ -235,8 +262,8 @@ func (terraformContainer *Container) ConfigureBackend(outputStream, errorStream
 }
 
 // SwitchWorkspace switched to a named workspace, creating it if necessary.
-func (terraformContainer *Container) SwitchWorkspace(name string, outputStream, errorStream io.Writer) error {
-	workspaces, err := terraformContainer.listWorkspaces(errorStream)
+func (terraformContainer *Container) SwitchWorkspace(ctx context.Context, name string, outputStream, errorStream io.Writer) error {
+	workspaces, err := terraformContainer.listWorkspaces(ctx, errorStream)
 	if err != nil {
 		return err
 	}
@@ -253,7 +280,7 @@ func (terraformContainer *Container) SwitchWorkspace(name string, outputStream,
 		util.FormatCommand("terraform workspace "+command+" "+name),
 	)
 
-	if err := terraformContainer.RunCommand([]string{"terraform", "workspace", command, name}, map[string]string{}, outputStream, errorStream); err != nil {
+	if err := terraformContainer.RunCommand(ctx, []string{"terraform", "workspace", command, name}, map[string]string{}, outputStream, errorStream); err != nil {
 		return err
 	}
 
@@ -261,7 +288,7 @@ func (terraformContainer *Container) SwitchWorkspace(name string, outputStream,
 }
 
 // listWorkspaces lists the terraform workspaces and returns them as a set
-func (terraformContainer *Container) listWorkspaces(errorStream io.Writer) (map[string]bool, error) {
+func (terraformContainer *Container) listWorkspaces(ctx context.Context, errorStream io.Writer) (map[string]bool, error) {
 	var outputBuffer bytes.Buffer
 
 	fmt.Fprintf(
@@ -271,7 +298,7 @@ func (terraformContainer *Container) listWorkspaces(errorStream io.Writer) (map[
 		util.FormatCommand("terraform workspace list"),
 	)
 
-	if err := terraformContainer.RunCommand([]string{"terraform", "workspace", "list"}, map[string]string{}, &outputBuffer, errorStream); err != nil {
+	if err := terraformContainer.RunCommand(ctx, []string{"terraform", "workspace", "list"}, map[string]string{}, &outputBuffer, errorStream); err != nil {
 		return nil, err
 	}
 
@@ -287,8 +314,8 @@ func (terraformContainer *Container) listWorkspaces(errorStream io.Writer) (map[
 	return result, nil
 }
 
-func (terraformContainer *Container) CopyTerraformLockIfExists(outputStream, errorStream io.Writer) error {
-	lockExists, err := terraformContainer.CheckFileExists("/build/.terraform.lock.hcl", errorStream)
+func (terraformContainer *Container) CopyTerraformLockIfExists(ctx context.Context, outputStream, errorStream io.Writer) error {
+	lockExists, err := terraformContainer.CheckFileExists(ctx, "/build/.terraform.lock.hcl", errorStream)
 	if err != nil {
 		return err
 	}
@@ -310,18 +337,47 @@ func (terraformContainer *Container) CopyTerraformLockIfExists(outputStream, err
 		util.FormatCommand("cp /build/.terraform.lock.hcl /code/infra/"),
 	)
 
-	if err := terraformContainer.RunCommand([]string{"cp", "/build/.terraform.lock.hcl", "/code/infra/"}, map[string]string{}, outputStream, errorStream); err != nil {
+	if err := terraformContainer.RunCommand(ctx, []string{"cp", "/build/.terraform.lock.hcl", "/code/infra/"}, map[string]string{}, outputStream, errorStream); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-func (terraformContainer *Container) CheckFileExists(path string, errorStream io.Writer) (bool, error) {
+// writeFileScript writes its input to a file in a directory (created if needed), replacing the file in one step so
+// commands running at the same time never read it half written.
+const writeFileScript = `umask 077 && mkdir -p "$1" && cat > "$1/.$2.tmp" && mv -f "$1/.$2.tmp" "$1/$2"`
+
+// WriteFiles writes files (keyed by name) to a directory in the terraform container, replacing any existing files
+// with the same names. They're written by the user the container runs as and only readable by it, since they may hold
+// credentials - and by exec'ing rather than copying, so they can go in a tmpfs (e.g. /tmp with read_only set).
+func (terraformContainer *Container) WriteFiles(ctx context.Context, dir string, files map[string]string) error {
+	for _, pair := range DictToSortedPairs(files) {
+		if pair.Key == "" || path.Base(pair.Key) != pair.Key {
+			return fmt.Errorf("invalid filename %q", pair.Key)
+		}
+	}
+	for _, pair := range DictToSortedPairs(files) {
+		var errorBuffer bytes.Buffer
+		if err := terraformContainer.RunInteractiveCommand(
+			ctx,
+			[]string{"sh", "-c", writeFileScript, "sh", dir, pair.Key},
+			map[string]string{},
+			strings.NewReader(pair.Value),
+			&errorBuffer, &errorBuffer,
+			false,
+		); err != nil {
+			return fmt.Errorf("error writing %s: %w\n%s", path.Join(dir, pair.Key), err, errorBuffer.String())
+		}
+	}
+	return nil
+}
+
+func (terraformContainer *Container) CheckFileExists(ctx context.Context, path string, errorStream io.Writer) (bool, error) {
 	var outputBuffer bytes.Buffer
 	command := fmt.Sprintf("test -f %s && echo exists || echo none", path)
 
-	if err := terraformContainer.RunCommand([]string{"sh", "-c", command}, map[string]string{}, &outputBuffer, errorStream); err != nil {
+	if err := terraformContainer.RunCommand(ctx, []string{"sh", "-c", command}, map[string]string{}, &outputBuffer, errorStream); err != nil {
 		return false, err
 	}
 
@@ -333,9 +389,10 @@ func (terraformContainer *Container) CheckFileExists(path string, errorStream io
 }
 
 // RunCommand execs a command inside the terraform container.
-func (terraformContainer *Container) RunCommand(cmd []string, env map[string]string, outputStream, errorStream io.Writer) error {
-	return terraformContainer.dockerClient.Exec(&docker.ExecOptions{
+func (terraformContainer *Container) RunCommand(ctx context.Context, cmd []string, env map[string]string, outputStream, errorStream io.Writer) error {
+	return terraformContainer.dockerClient.Exec(ctx, &docker.ExecOptions{
 		ID:           terraformContainer.id,
+		User:         terraformContainer.user,
 		Cmd:          cmd,
 		Env:          env,
 		OutputStream: outputStream,
@@ -346,14 +403,16 @@ func (terraformContainer *Container) RunCommand(cmd []string, env map[string]str
 
 // RunInteractiveCommand execs a command inside the terraform container.
 func (terraformContainer *Container) RunInteractiveCommand(
+	ctx context.Context,
 	cmd []string,
 	env map[string]string,
 	inputStream io.Reader,
 	outputStream,
 	errorStream io.Writer,
 	tty bool) error {
-	return terraformContainer.dockerClient.Exec(&docker.ExecOptions{
+	return terraformContainer.dockerClient.Exec(ctx, &docker.ExecOptions{
 		ID:           terraformContainer.id,
+		User:         terraformContainer.user,
 		Cmd:          cmd,
 		Env:          env,
 		InputStream:  inputStream,
@@ -363,9 +422,9 @@ func (terraformContainer *Container) RunInteractiveCommand(
 	})
 }
 
-// Done stops and removes the terraform container.
+// Done stops and removes the terraform container - it doesn't take a context since it must run even after cancellation.
 func (terraformContainer *Container) Done() error {
-	if err := terraformContainer.dockerClient.Stop(terraformContainer.id, 10*time.Second); err != nil {
+	if err := terraformContainer.dockerClient.Stop(context.Background(), terraformContainer.id, 10*time.Second); err != nil {
 		return err
 	}
 	return <-terraformContainer.done
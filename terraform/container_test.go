@@ -2,6 +2,7 @@ package terraform_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"log"
@@ -10,8 +11,11 @@ import (
 	"reflect"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/docker"
+	"github.com/mergermarket/cdflow2/docker/fake"
 	"github.com/mergermarket/cdflow2/terraform"
 	"github.com/mergermarket/cdflow2/test"
 )
@@ -29,8 +33,11 @@ func TestTerraformInitInitial(t *testing.T) {
 
 	// When
 	if err := terraform.InitInitial(
+		context.Background(),
 		dockerClient,
 		test.GetConfig("TEST_TERRAFORM_IMAGE"),
+		docker.Limits{},
+		"",
 		test.GetConfig("TEST_ROOT")+"/test/terraform/sample-code",
 		buildVolume,
 		&outputBuffer,
@@ -81,8 +88,11 @@ func TestTerraformConfigureBackend(t *testing.T) {
 	// When
 	func() {
 		terraformContainer, err := terraform.NewContainer(
+			context.Background(),
 			dockerClient,
 			test.GetConfig("TEST_TERRAFORM_IMAGE"),
+			docker.Limits{},
+			"",
 			codeDir,
 			releaseVolume,
 		)
@@ -96,6 +106,7 @@ func TestTerraformConfigureBackend(t *testing.T) {
 		}()
 
 		if err := terraformContainer.ConfigureBackend(
+			context.Background(),
 			&outputBuffer,
 			&errorBuffer,
 			&config.PrepareTerraformResponse{
@@ -162,8 +173,11 @@ func TestSwitchWorkspaceExisting(t *testing.T) {
 	// When
 	func() {
 		terraformContainer, err := terraform.NewContainer(
+			context.Background(),
 			dockerClient,
 			test.GetConfig("TEST_TERRAFORM_IMAGE"),
+			docker.Limits{},
+			"",
 			test.GetConfig("TEST_ROOT")+"/test/terraform/sample-code",
 			releaseVolume,
 		)
@@ -178,6 +192,7 @@ func TestSwitchWorkspaceExisting(t *testing.T) {
 		}()
 
 		if err := terraformContainer.SwitchWorkspace(
+			context.Background(),
 			workspaceName,
 			&outputBuffer,
 			&errorBuffer,
@@ -232,8 +247,11 @@ func TestSwitchWorkspaceNew(t *testing.T) {
 	// When
 	func() {
 		terraformContainer, err := terraform.NewContainer(
+			context.Background(),
 			dockerClient,
 			test.GetConfig("TEST_TERRAFORM_IMAGE"),
+			docker.Limits{},
+			"",
 			test.GetConfig("TEST_ROOT")+"/test/terraform/sample-code",
 			releaseVolume,
 		)
@@ -247,6 +265,7 @@ func TestSwitchWorkspaceNew(t *testing.T) {
 		}()
 
 		if err := terraformContainer.SwitchWorkspace(
+			context.Background(),
 			workspaceName,
 			&outputBuffer,
 			&errorBuffer,
@@ -270,3 +289,51 @@ func TestSwitchWorkspaceNew(t *testing.T) {
 
 	test.CheckTerraformWorkspaceNew(lines[1], workspaceName)
 }
+
+// slowStartClient delays running containers, so the context can be cancelled before they start.
+type slowStartClient struct {
+	*fake.Client
+}
+
+func (dockerClient *slowStartClient) Run(ctx context.Context, options *docker.RunOptions) error {
+	time.Sleep(50 * time.Millisecond)
+	return dockerClient.Client.Run(ctx, options)
+}
+
+func TestNewContainerCancelled(t *testing.T) {
+	// Given
+	dockerClient := fake.NewClient()
+	test.HandleFakeTerraform(dockerClient, "terraform-image", func(process *fake.Process) int {
+		return 0
+	})
+	ran := make(chan struct{})
+	dockerClient.HandleRun("terraform-image", func(process *fake.Process) int {
+		close(ran)
+		return fake.WaitForStop(128 + 15)(process)
+	})
+	if err := dockerClient.EnsureImage(context.Background(), "terraform-image", &bytes.Buffer{}); err != nil {
+		t.Fatal("error pulling terraform image:", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// When
+	_, err := terraform.NewContainer(ctx, &slowStartClient{dockerClient}, "terraform-image", docker.Limits{}, "", "/code", "")
+
+	// Then
+	if err != context.Canceled {
+		t.Fatal("expected context.Canceled, got:", err)
+	}
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the container to start")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(dockerClient.Containers()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the container to be stopped and removed, got:", dockerClient.Containers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
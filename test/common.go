@@ -3,6 +3,7 @@ package test
 import (
 	"archive/tar"
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"log"
@@ -33,7 +34,7 @@ func GetDockerClientWithDebugVolume() (docker.Iface, string) {
 
 // CreateVolume creates a volume (panics).
 func CreateVolume(dockerCient docker.Iface) string {
-	volume, err := dockerCient.CreateVolume("")
+	volume, err := dockerCient.CreateVolume(context.Background(), "")
 	if err != nil {
 		log.Panicln("could not create volume:", err)
 	}
@@ -42,7 +43,7 @@ func CreateVolume(dockerCient docker.Iface) string {
 
 // RemoveVolume removes a docker volume - outputs a warning if it fails to avoid masking another error.
 func RemoveVolume(dockerClient docker.Iface, volume string) {
-	if err := dockerClient.RemoveVolume(volume); err != nil {
+	if err := dockerClient.RemoveVolume(context.Background(), volume); err != nil {
 		log.Printf("error removing volume %v: %v\n", volume, err)
 	}
 }
@@ -50,11 +51,11 @@ func RemoveVolume(dockerClient docker.Iface, volume string) {
 // ReadVolume reads all the files in a volume as a map of path strings to byte slices of the file contents (panics).
 func ReadVolume(dockerClient docker.Iface, volume string) (map[string][]byte, error) {
 	image := "alpine:latest"
-	if err := dockerClient.EnsureImage(image, os.Stderr); err != nil {
+	if err := dockerClient.EnsureImage(context.Background(), image, os.Stderr); err != nil {
 		log.Panicln("error pulling:", err)
 	}
 
-	container, err := dockerClient.CreateContainer(&docker.CreateContainerOptions{
+	container, err := dockerClient.CreateContainer(context.Background(), &docker.CreateContainerOptions{
 		Image: image,
 		Binds: []string{volume + ":/root:ro"},
 	})
@@ -62,11 +63,11 @@ func ReadVolume(dockerClient docker.Iface, volume string) (map[string][]byte, er
 		return nil, err
 	}
 	defer func() {
-		if err := dockerClient.RemoveContainer(container); err != nil {
+		if err := dockerClient.RemoveContainer(context.Background(), container); err != nil {
 			log.Fatalln("could not remove container for reading volume:", err)
 		}
 	}()
-	reader, err := dockerClient.CopyFromContainer(container, "/root/")
+	reader, err := dockerClient.CopyFromContainer(context.Background(), container, "/root/")
 	if err != nil {
 		return nil, err
 	}
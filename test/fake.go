@@ -0,0 +1,34 @@
+package test
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/mergermarket/cdflow2/docker/fake"
+)
+
+// HandleFakeConfig simulates a config image in the fake docker client, with handle returning the response to each request
+// made via `/app forward` (decoded into a map).
+func HandleFakeConfig(dockerClient *fake.Client, image string, handle func(request map[string]interface{}) interface{}) {
+	dockerClient.AddImage(image)
+	dockerClient.HandleRun(image, fake.WaitForStop(0))
+	dockerClient.HandleExec(image, func(process *fake.Process) int {
+		var request map[string]interface{}
+		if err := json.NewDecoder(process.InputStream).Decode(&request); err != nil {
+			fmt.Fprintln(process.ErrorStream, "error decoding request:", err)
+			return 1
+		}
+		if err := json.NewEncoder(process.OutputStream).Encode(handle(request)); err != nil {
+			fmt.Fprintln(process.ErrorStream, "error encoding response:", err)
+			return 1
+		}
+		return 0
+	})
+}
+
+// HandleFakeTerraform simulates a terraform image in the fake docker client, with handle called for each exec'd command.
+func HandleFakeTerraform(dockerClient *fake.Client, image string, handle fake.Handler) {
+	dockerClient.AddImage(image, image+"@sha256:0000")
+	dockerClient.HandleRun(image, fake.WaitForStop(128+15))
+	dockerClient.HandleExec(image, handle)
+}
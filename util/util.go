@@ -1,8 +1,14 @@
 package util
 
 import (
+	"archive/tar"
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"os/user"
 	"strings"
 
 	"time"
@@ -12,6 +18,26 @@ import (
 	"github.com/rs/xid"
 )
 
+// CurrentUser returns the name of the user running cdflow2.
+func CurrentUser(env map[string]string) string {
+	if current, err := user.Current(); err == nil && current.Username != "" {
+		return current.Username
+	}
+	if name := env["USER"]; name != "" {
+		return name
+	}
+	return "unknown"
+}
+
+// Holder identifies who is running cdflow2 and where (e.g. for locks).
+func Holder(env map[string]string) string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return CurrentUser(env) + "@" + hostname
+}
+
 // GetEnv takes the environment as a slice of strings (as returned by os.Environ) and returns it as a map.
 func GetEnv(env []string) map[string]string {
 	result := make(map[string]string)
@@ -43,19 +69,95 @@ func FormatCommand(command string) string {
 	return au.Sprintf("%s %s", au.Bold("$"), au.BrightCyan(command))
 }
 
-const cacheVolumeName = "cdflow2-cache"
+// CacheVolumeName is the name of the volume shared between runs for caching (e.g. terraform providers).
+const CacheVolumeName = "cdflow2-cache"
 
 // GetCacheVolume returns the volume for cache at /cache (e.g. terraform providers).
-func GetCacheVolume(dockerClient docker.Iface) (string, error) {
-	exists, err := dockerClient.VolumeExists(cacheVolumeName)
+func GetCacheVolume(ctx context.Context, dockerClient docker.Iface) (string, error) {
+	exists, err := dockerClient.VolumeExists(ctx, CacheVolumeName)
 	if err != nil {
 		return "", err
 	}
 	if exists {
-		return cacheVolumeName, nil
+		return CacheVolumeName, nil
 	}
-	if _, err := dockerClient.CreateVolume(cacheVolumeName); err != nil {
+	if _, err := dockerClient.CreateVolume(ctx, CacheVolumeName); err != nil {
 		return "", err
 	}
-	return cacheVolumeName, nil
+	return CacheVolumeName, nil
+}
+
+// prepareVolumesScript changes the ownership of each path to the user in $1, skipping those it already owns (e.g. the
+// cache volume on every run after the first) since a recursive chown of a large volume is slow.
+const prepareVolumesScript = `user="$1"
+shift
+for path in "$@"; do
+	if [ "$(stat -c %u:%g "$path")" != "$user" ]; then
+		chown -R "$user" "$path" || exit 1
+	fi
+done`
+
+// PrepareVolumes makes the contents of each volume owned by user (a "uid:gid"), so that a container running as that
+// user can write to them. It runs chown as root in the passed image, which should be the terraform image - build
+// images may not include chown (e.g. distroless images), whereas the terraform image is pulled, pinned and archived
+// for every command that needs this. Does nothing if user is empty (i.e. containers run as the image's user).
+func PrepareVolumes(ctx context.Context, dockerClient docker.Iface, image, user string, volumes ...string) error {
+	if user == "" {
+		return nil
+	}
+	var binds, paths []string
+	for i, volume := range volumes {
+		path := fmt.Sprintf("/volume%d", i)
+		binds = append(binds, volume+":"+path)
+		paths = append(paths, path)
+	}
+	var outputBuffer bytes.Buffer
+	if err := dockerClient.Run(ctx, &docker.RunOptions{
+		Image:        image,
+		User:         "0:0",
+		Entrypoint:   []string{"sh"},
+		Cmd:          append([]string{"-c", prepareVolumesScript, "sh", user}, paths...),
+		Binds:        binds,
+		NamePrefix:   "cdflow2-prepare-volumes",
+		OutputStream: &outputBuffer,
+		ErrorStream:  &outputBuffer,
+	}); err != nil {
+		return fmt.Errorf(
+			"error setting ownership of volumes to %s using image %s (use the --no-host-user global option to run containers as the image's user): %w\nOutput: %v",
+			user, image, err, outputBuffer.String(),
+		)
+	}
+	return nil
+}
+
+// ReadVolumeFile reads a file from a volume, via a container created (but not started) from the passed image.
+func ReadVolumeFile(ctx context.Context, dockerClient docker.Iface, image, volume, filename string) (returnedContent []byte, returnedError error) {
+	id, err := dockerClient.CreateContainer(ctx, &docker.CreateContainerOptions{
+		Image: image,
+		Binds: []string{volume + ":/volume:ro"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := dockerClient.RemoveContainer(context.Background(), id); err != nil {
+			if returnedError != nil {
+				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+			} else {
+				returnedError = err
+			}
+		}
+	}()
+
+	reader, err := dockerClient.CopyFromContainer(ctx, id, "/volume/"+filename)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	tarReader := tar.NewReader(reader)
+	if _, err := tarReader.Next(); err != nil {
+		return nil, fmt.Errorf("error reading %s from volume: %w", filename, err)
+	}
+	return ioutil.ReadAll(tarReader)
 }
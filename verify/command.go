@@ -0,0 +1,129 @@
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/manifest"
+	release "github.com/mergermarket/cdflow2/release/command"
+	"github.com/mergermarket/cdflow2/util"
+)
+
+// CommandArgs contains specific arguments to the verify-release command.
+type CommandArgs struct {
+	EnvName string
+	Version string
+}
+
+// ParseArgs parses command line arguments to the verify-release subcommand.
+func ParseArgs(args []string) (*CommandArgs, error) {
+	var result CommandArgs
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "-e" || arg == "--env" {
+			i++
+			if i >= len(args) {
+				return nil, errors.New("missing value for " + arg)
+			}
+			result.EnvName = args[i]
+		} else if result.Version == "" {
+			result.Version = arg
+		} else {
+			return nil, fmt.Errorf("unexpected argument %q", arg)
+		}
+	}
+	if result.Version == "" {
+		return nil, errors.New("missing VERSION")
+	}
+	return &result, nil
+}
+
+// Difference is an image that is different in the current manifest (and lock) to the release.
+type Difference struct {
+	Key      string
+	Released string
+	Current  string
+}
+
+// Compare returns the differences between the image digests recorded in a release and the current ones, keyed as in
+// manifest.Images.
+func Compare(released, current map[string]string) []Difference {
+	var result []Difference
+	for key, digest := range current {
+		if released[key] != digest {
+			result = append(result, Difference{key, released[key], digest})
+		}
+	}
+	for key, digest := range released {
+		if _, ok := current[key]; !ok {
+			result = append(result, Difference{key, digest, ""})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result
+}
+
+// RunCommand runs the verify-release command, checking that the config and build images in the current cdflow.yaml
+// (and cdflow.lock) are the ones the release was built with.
+func RunCommand(ctx context.Context, state *command.GlobalState, args *CommandArgs, env map[string]string) (returnedError error) {
+	if err := release.PullImages(ctx, state, false); err != nil {
+		return err
+	}
+	current, err := release.ImageDigests(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	released, err := getReleasedImageDigests(ctx, state, args, env)
+	if err != nil {
+		return err
+	}
+
+	differences := Compare(released, current)
+	for _, difference := range differences {
+		if difference.Released == "" {
+			fmt.Fprintf(state.OutputStream, "%s: not in release (current %s)\n", difference.Key, difference.Current)
+		} else if difference.Current == "" {
+			fmt.Fprintf(state.OutputStream, "%s: not in cdflow.yaml (released %s)\n", difference.Key, difference.Released)
+		} else {
+			fmt.Fprintf(state.OutputStream, "%s: released %s, current %s\n", difference.Key, difference.Released, difference.Current)
+		}
+	}
+	if len(differences) != 0 {
+		return fmt.Errorf("release %s was built with different images to those in the current cdflow.yaml", args.Version)
+	}
+	fmt.Fprintf(state.ErrorStream, "\n%s\n", util.FormatInfo(fmt.Sprintf("release %s was built with the current images (%d checked)", args.Version, len(current))))
+	return nil
+}
+
+// getReleasedImageDigests fetches the release via the config container and reads the image digests recorded in it.
+func getReleasedImageDigests(ctx context.Context, state *command.GlobalState, args *CommandArgs, env map[string]string) (_ map[string]string, returnedError error) {
+	_, buildVolume, terraformImage, err := config.SetupTerraform(ctx, state, nil, args.EnvName, args.Version, env)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := state.DockerClient.RemoveVolume(context.Background(), buildVolume); err != nil {
+			if returnedError != nil {
+				returnedError = fmt.Errorf("%w, also %v", returnedError, err)
+			} else {
+				returnedError = err
+			}
+		}
+	}()
+
+	data, err := util.ReadVolumeFile(ctx, state.DockerClient, terraformImage, buildVolume, manifest.ImageDigestsFilename)
+	if err != nil {
+		return nil, fmt.Errorf("release %s has no image digests recorded (it may have been created by an older version of cdflow2): %w", args.Version, err)
+	}
+	var released map[string]string
+	if err := json.Unmarshal(data, &released); err != nil {
+		return nil, fmt.Errorf("error decoding image digests: %w", err)
+	}
+	return released, nil
+}
@@ -0,0 +1,129 @@
+package verify_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mergermarket/cdflow2/command"
+	"github.com/mergermarket/cdflow2/config"
+	"github.com/mergermarket/cdflow2/docker/fake"
+	"github.com/mergermarket/cdflow2/manifest"
+	"github.com/mergermarket/cdflow2/test"
+	"github.com/mergermarket/cdflow2/verify"
+)
+
+func TestParseArgs(t *testing.T) {
+	args, err := verify.ParseArgs([]string{"--env", "live", "34-a5dbc4a7"})
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if !reflect.DeepEqual(args, &verify.CommandArgs{EnvName: "live", Version: "34-a5dbc4a7"}) {
+		t.Fatal("unexpected args:", args)
+	}
+	if _, err := verify.ParseArgs([]string{}); err == nil {
+		t.Fatal("expected error for missing version")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	differences := verify.Compare(
+		map[string]string{"config": "config@sha256:1", "build/a": "a@sha256:1", "build/b": "b@sha256:1"},
+		map[string]string{"config": "config@sha256:1", "build/a": "a@sha256:2", "build/c": "c@sha256:1"},
+	)
+	if !reflect.DeepEqual(differences, []verify.Difference{
+		{Key: "build/a", Released: "a@sha256:1", Current: "a@sha256:2"},
+		{Key: "build/b", Released: "b@sha256:1", Current: ""},
+		{Key: "build/c", Released: "", Current: "c@sha256:1"},
+	}) {
+		t.Fatal("unexpected differences:", differences)
+	}
+}
+
+func runVerify(t *testing.T, releasedDigests map[string]string) (string, error) {
+	dockerClient := fake.NewClient()
+	test.HandleFakeConfig(dockerClient, "config-image", nil)
+	dockerClient.AddImage("config-image", "config-image@sha256:1111")
+	dockerClient.AddImage("build-image", "build-image@sha256:2222")
+	dockerClient.AddImage("terraform-image@sha256:3333", "terraform-image@sha256:3333")
+
+	encodedDigests, err := json.Marshal(releasedDigests)
+	if err != nil {
+		t.Fatal("error encoding image digests:", err)
+	}
+	dockerClient.HandleExec("config-image", func(process *fake.Process) int {
+		var request map[string]interface{}
+		if err := json.NewDecoder(process.InputStream).Decode(&request); err != nil {
+			fmt.Fprintln(process.ErrorStream, "error decoding request:", err)
+			return 1
+		}
+		if request["Action"] == config.ActionHello {
+			// answer hello as a config image that predates it does
+			json.NewEncoder(process.OutputStream).Encode(map[string]interface{}{"Success": false})
+			return 0
+		}
+		// simulate the config container downloading the release into the release volume
+		if err := process.Container.WriteFile("/release/"+manifest.ImageDigestsFilename, encodedDigests); err != nil {
+			fmt.Fprintln(process.ErrorStream, "error writing image digests:", err)
+			return 1
+		}
+		json.NewEncoder(process.OutputStream).Encode(map[string]interface{}{
+			"TerraformImage":       "terraform-image@sha256:3333",
+			"TerraformBackendType": "local",
+			"Success":              true,
+		})
+		return 0
+	})
+
+	var outputBuffer bytes.Buffer
+	state := &command.GlobalState{
+		DockerClient: dockerClient,
+		OutputStream: &outputBuffer,
+		ErrorStream:  &bytes.Buffer{},
+		Component:    "test-component",
+		Commit:       "test-commit",
+		Manifest: &manifest.Manifest{
+			Version:   2,
+			Config:    manifest.ImageWithParams{Image: "config-image"},
+			Builds:    map[string]manifest.ImageWithParams{"release": {Image: "build-image"}},
+			Terraform: manifest.Terraform{Image: "terraform-image"},
+		},
+		GlobalArgs: &command.GlobalArgs{},
+	}
+	args, _ := verify.ParseArgs([]string{"test-version"})
+	err = verify.RunCommand(context.Background(), state, args, map[string]string{})
+	return outputBuffer.String(), err
+}
+
+func TestRunCommandMatches(t *testing.T) {
+	// When
+	_, err := runVerify(t, map[string]string{
+		"config":        "config-image@sha256:1111",
+		"build/release": "build-image@sha256:2222",
+	})
+
+	// Then
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+}
+
+func TestRunCommandDiffers(t *testing.T) {
+	// When
+	output, err := runVerify(t, map[string]string{
+		"config":        "config-image@sha256:1111",
+		"build/release": "build-image@sha256:0000",
+	})
+
+	// Then
+	if err == nil {
+		t.Fatal("expected error for different build image")
+	}
+	if !strings.Contains(output, "build/release: released build-image@sha256:0000, current build-image@sha256:2222") {
+		t.Fatal("expected difference to be output, got:", output)
+	}
+}